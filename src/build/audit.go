@@ -0,0 +1,128 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// auditInputs compares the files that a target's build action read (as found by file tracing) with the inputs
+// it declared. Files outside the repo (e.g. system libraries) aren't considered.
+func auditInputs(state *core.BuildState, target *core.BuildTarget, files []string) *core.InputAudit {
+	tmpDir := filepath.Join(core.RepoRoot, target.TmpDir())
+	read := make([]string, len(files))
+	for i, f := range files {
+		if rel, ok := strings.CutPrefix(f, core.SandboxDir+"/"); ok && target.Sandbox {
+			f = filepath.Join(tmpDir, rel)
+		}
+		read[i] = f
+	}
+	audit := &core.InputAudit{}
+	var declared []string
+	for _, input := range declaredInputs(target) {
+		paths := inputPaths(state, target, tmpDir, input)
+		declared = append(declared, paths...)
+		if !slices.ContainsFunc(read, func(f string) bool { return core.IsWithin(f, paths) }) {
+			audit.Unused = append(audit.Unused, input)
+		}
+	}
+	for _, f := range read {
+		rel, ok := strings.CutPrefix(f, core.RepoRoot+"/")
+		if !ok || core.IsWithin(f, []string{tmpDir}) || core.IsWithin(f, declared) {
+			continue
+		} else if info, err := os.Stat(f); err != nil || !info.Mode().IsRegular() {
+			continue // Most likely it just listed a directory.
+		}
+		audit.Undeclared = append(audit.Undeclared, rel)
+	}
+	return audit
+}
+
+// declaredInputs returns the sources, dependencies and tools that a target declares.
+func declaredInputs(target *core.BuildTarget) []core.BuildInput {
+	inputs := append([]core.BuildInput{}, target.AllSources()...)
+	for _, dep := range target.DeclaredDependenciesStrict() {
+		inputs = append(inputs, dep)
+	}
+	return append(inputs, target.AllTools()...)
+}
+
+// inputPaths returns all the absolute paths that the given input could be read from by the target's build action,
+// which includes both its location in the temp dir and its original one (some tools resolve symlinks,
+// or the action might refer to it by absolute path). For a build target, this includes anything it
+// transitively provides to the action as well.
+func inputPaths(state *core.BuildState, target *core.BuildTarget, tmpDir string, input core.BuildInput) []string {
+	var paths []string
+	add := func(input core.BuildInput) {
+		for _, p := range input.Paths(state.Graph) {
+			paths = append(paths, filepath.Join(tmpDir, p))
+		}
+		for _, p := range input.FullPaths(state.Graph) {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(core.RepoRoot, p)
+			}
+			paths = append(paths, p)
+		}
+	}
+	add(input)
+	label, ok := input.Label()
+	if !ok {
+		return paths
+	}
+	done := map[core.BuildLabel]bool{label: true}
+	var addDeps func(t *core.BuildTarget)
+	addDeps = func(t *core.BuildTarget) {
+		var deps []core.BuildLabel
+		if target.NeedsTransitiveDependencies {
+			for _, dep := range t.Dependencies() {
+				deps = append(deps, dep.Label)
+			}
+		} else {
+			deps = t.ExportedDependencies()
+		}
+		for _, dep := range deps {
+			if !done[dep] {
+				done[dep] = true
+				add(dep)
+				addDeps(state.Graph.TargetOrDie(dep))
+			}
+		}
+	}
+	addDeps(state.Graph.TargetOrDie(label))
+	return paths
+}
+
+// PrintInputAudits prints the results of auditing the inputs of each target that was built with file tracing enabled.
+func PrintInputAudits(state *core.BuildState) {
+	audited := 0
+	tightenable := 0
+	for _, target := range state.Graph.AllTargets() {
+		audit := target.InputAudit()
+		if audit == nil {
+			continue
+		}
+		audited++
+		if len(audit.Undeclared) == 0 && len(audit.Unused) == 0 {
+			continue
+		}
+		tightenable++
+		fmt.Printf("%s:\n", target.Label)
+		if len(audit.Undeclared) > 0 {
+			fmt.Printf("  Read without declaring:\n")
+			for _, f := range audit.Undeclared {
+				fmt.Printf("    %s\n", f)
+			}
+		}
+		if len(audit.Unused) > 0 {
+			fmt.Printf("  Declared but not read:\n")
+			for _, input := range audit.Unused {
+				fmt.Printf("    %s\n", input)
+			}
+		}
+	}
+	fmt.Printf("Audited inputs of %d targets, %d of which have undeclared or unused inputs.\n", audited, tightenable)
+}
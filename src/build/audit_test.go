@@ -0,0 +1,54 @@
+package build
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestAuditInputs(t *testing.T) {
+	state, target := newState("//package1:audit")
+	target.AddSource(core.FileLabel{File: "src5", Package: "package1"})
+	target.AddSource(core.FileLabel{File: "unused.txt", Package: "package1"})
+	target.AddOutput("out.txt")
+	dep := core.NewBuildTarget(core.ParseBuildLabel("//package1:audit_dep", ""))
+	dep.AddOutput("file2")
+	exported := core.NewBuildTarget(core.ParseBuildLabel("//package1:audit_exported", ""))
+	exported.AddOutput("file3")
+	dep.AddMaybeExportedDependency(exported.Label, true, false, false)
+	unusedDep := core.NewBuildTarget(core.ParseBuildLabel("//package1:audit_unused", ""))
+	unusedDep.AddOutput("file4")
+	state.Graph.AddTarget(dep)
+	state.Graph.AddTarget(exported)
+	state.Graph.AddTarget(unusedDep)
+	target.AddDependency(dep.Label)
+	target.AddDependency(unusedDep.Label)
+
+	tmpDir := filepath.Join(core.RepoRoot, target.TmpDir())
+	audit := auditInputs(state, target, []string{
+		"/usr/lib/libc.so.6",
+		filepath.Join(tmpDir, "package1/src5"),
+		filepath.Join(tmpDir, "package1/out.txt"),
+		// The dependency is only used via something it exports, and via its absolute path.
+		filepath.Join(core.RepoRoot, "plz-out/gen/package1/file3"),
+		// These are in the repo but weren't declared.
+		filepath.Join(core.RepoRoot, "package1/package2/file1.py"),
+		filepath.Join(core.RepoRoot, "pypkg"),
+	})
+	assert.Equal(t, []string{"package1/package2/file1.py"}, audit.Undeclared)
+	assert.Equal(t, []core.BuildInput{core.FileLabel{File: "unused.txt", Package: "package1"}, unusedDep.Label}, audit.Unused)
+}
+
+func TestAuditInputsSandboxed(t *testing.T) {
+	state, target := newState("//package1:audit_sandboxed")
+	target.Sandbox = true
+	target.AddSource(core.FileLabel{File: "src5", Package: "package1"})
+	audit := auditInputs(state, target, []string{
+		filepath.Join(core.SandboxDir, "package1/src5"),
+	})
+	assert.Empty(t, audit.Undeclared)
+	assert.Empty(t, audit.Unused)
+}
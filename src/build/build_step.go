@@ -73,7 +73,7 @@ func Build(state *core.BuildState, target *core.BuildTarget, remote bool) {
 		target.FinishBuild()
 		return
 	}
-	if remote {
+	if remote && !target.RunsLocally() {
 		successfulRemoteTargetBuildDuration.Observe(float64(time.Since(start).Milliseconds()))
 	} else {
 		successfulLocalTargetBuildDuration.Observe(float64(time.Since(start).Milliseconds()))
@@ -203,10 +203,19 @@ func buildTarget(state *core.BuildState, target *core.BuildTarget, runRemotely b
 
 	if runRemotely {
 		metadata, err = state.RemoteClient.Build(target)
-		if err != nil {
+		if state.ShouldFallBackLocally(target, err) {
+			log.Warning("Can't build %s remotely, building locally instead: %s", target.Label, err)
+			target.RunLocally()
+			runRemotely = false
+			if state.LocalLimiter != nil {
+				state.LocalLimiter.Acquire(target)
+				defer state.LocalLimiter.Release(target)
+			}
+		} else if err != nil {
 			return err
 		}
-	} else {
+	}
+	if !runRemotely {
 		// Wait if another process is currently building this target
 		state.LogBuildResult(target, core.TargetBuilding, "Acquiring target lock...")
 		file := core.AcquireExclusiveFileLock(target.BuildLockFile())
@@ -277,6 +286,8 @@ func buildTarget(state *core.BuildState, target *core.BuildTarget, runRemotely b
 			return nil
 		}
 
+		// Load the old metadata before anything can overwrite it, so we can explain why we're rebuilding.
+		previousMetadata, _ := loadTargetMetadata(target)
 		if err := prepareDirectories(state.ProcessExecutor, target); err != nil {
 			return fmt.Errorf("Error preparing directories for %s: %s", target.Label, err)
 		}
@@ -323,6 +334,9 @@ func buildTarget(state *core.BuildState, target *core.BuildTarget, runRemotely b
 		if err != nil {
 			return err
 		}
+		metadata.Hashes = hashBreakdown(state, target)
+		metadata.RebuildReasons = rebuildReasons(state, target, previousMetadata, metadata.Hashes)
+		log.Debug("Rebuilt %s because: %s", target.Label, strings.Join(metadata.RebuildReasons, "; "))
 
 		// Add optional outputs to target metadata
 		metadata.OptionalOutputs = make([]string, 0)
@@ -491,9 +505,9 @@ func retrieveArtifacts(state *core.BuildState, target *core.BuildTarget, oldOutp
 		}
 		buildLinks(state, target)
 
-		// If we could've potentially pulled from the http cache, we need to write the xattrs back as they will be
-		// missing.
-		if state.Config.Cache.HTTPURL != "" {
+		// If we could've potentially pulled from the http or remote cache, we need to write the xattrs back as
+		// they will be missing.
+		if state.Config.Cache.HTTPURL != "" || state.Config.Remote.CacheOnly {
 			if err := writeRuleHash(state, target); err != nil {
 				log.Warningf("failed to write target hash: %w", err)
 				return false
@@ -516,11 +530,26 @@ func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command s
 		return nil, buildTextFile(state, target)
 	}
 	env := core.StampedBuildEnvironment(state, target, inputHash, filepath.Join(core.RepoRoot, target.TmpDir()), target.Stamp).ToSlice()
+	strict := target.Sandbox && state.Config.StrictSandbox()
+	if strict {
+		env = append(env, core.StrictSandboxEnv(state, target.AllTools())...)
+	}
 	log.Debug("Building target %s\nENVIRONMENT:\n%s\n%s", target.Label, env, command)
-	out, combined, err := state.ProcessExecutor.ExecWithTimeoutShell(target, target.TmpDir(), env, target.BuildTimeout, state.ShowAllOutput, false, process.NewSandboxConfig(target.Sandbox, target.Sandbox), command)
+	out, combined, usage, err := state.ProcessExecutor.ExecWithLimitsShell(target, target.TmpDir(), env, target.BuildTimeout, state.ShowAllOutput, false, process.NewSandboxConfig(target.Sandbox, target.Sandbox), target.Resources.Limits(), command, false)
+	target.SetResourceUsage(core.NewResourceUsage(usage))
 	if err != nil {
+		if strict {
+			var missing []string
+			if usage != nil {
+				missing = usage.Missing
+			}
+			combined = append(combined, core.StrictSandboxHint(combined, missing, core.StrictSandboxPaths(state, target.AllTools()))...)
+		}
 		return nil, fmt.Errorf("Error building target %s: %s\n%s", target.Label, err, combined)
 	}
+	if usage != nil && usage.Files != nil {
+		target.SetInputAudit(auditInputs(state, target, usage.Files))
+	}
 	return out, nil
 }
 
@@ -1215,6 +1244,7 @@ func build(state *core.BuildState, target *core.BuildTarget, inputHash []byte) (
 		return nil, err
 	} else if workerCmd == "" {
 		metadata.Stdout, err = runBuildCommand(state, target, localCmd, inputHash)
+		metadata.ResourceUsage = target.ResourceUsage()
 		return metadata, err
 	}
 	return nil, fmt.Errorf("Persistent workers are no longer supported, found worker command: %s", workerCmd)
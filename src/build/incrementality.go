@@ -217,6 +217,16 @@ func ruleHash(state *core.BuildState, target *core.BuildTarget, runtime bool) []
 			h.Write([]byte(l.String()))
 		}
 	}
+	providers := target.AllProviders()
+	providerKeys := make([]string, 0, len(providers))
+	for k := range providers {
+		providerKeys = append(providerKeys, k)
+	}
+	sort.Strings(providerKeys)
+	for _, name := range providerKeys {
+		h.Write([]byte(name))
+		h.Write([]byte(providers[name].String()))
+	}
 	// We don't need to hash the functions themselves because they get rerun every time -
 	// we just need to check whether one is added or removed, which is good since it's
 	// nigh impossible to really verify whether it's changed or not (since it may call
@@ -476,6 +486,82 @@ func PrintHashes(state *core.BuildState, target *core.BuildTarget) {
 	}
 }
 
+// hashBreakdown returns a breakdown of the individual inputs that make up a target's hash.
+// Unlike sourceHash it doesn't fail if some inputs can't be hashed; they're recorded without a hash instead.
+func hashBreakdown(state *core.BuildState, target *core.BuildTarget) *core.HashBreakdown {
+	hb := &core.HashBreakdown{
+		Config:  state.Hashes.Config,
+		Nonce:   state.Config.Build.Nonce,
+		Rule:    RuleHash(state, target, false, false),
+		Command: target.GetCommand(state),
+		Env:     make(map[string]string, len(target.Env)),
+		Sources: map[string][]byte{},
+		Tools:   map[string][]byte{},
+	}
+	for k, v := range target.Env {
+		hb.Env[k] = v
+	}
+	if target.PassEnv != nil {
+		for _, env := range *target.PassEnv {
+			h := sha1.Sum([]byte(os.Getenv(env)))
+			hb.Env[env] = b64(h[:])
+		}
+	}
+	for _, dep := range target.DeclaredDependencies() {
+		hb.Deps = append(hb.Deps, dep.String())
+	}
+	for source := range core.IterSources(state, state.Graph, target, false) {
+		result, _ := state.PathHasher.Hash(source.Src, false, true, false)
+		hb.Sources[source.Src] = result
+	}
+	for _, tool := range target.AllTools() {
+		for _, path := range tool.FullPaths(state.Graph) {
+			result, _ := state.PathHasher.Hash(path, false, true, false)
+			hb.Tools[path] = result
+		}
+	}
+	hb.Secret, _ = secretHash(state, target)
+	return hb
+}
+
+// rebuildReasons explains why a target is being rebuilt, given the metadata from its previous build (if any).
+func rebuildReasons(state *core.BuildState, target *core.BuildTarget, previous *core.BuildMetadata, current *core.HashBreakdown) []string {
+	if previous == nil {
+		return []string{"there was no previous build"}
+	} else if previous.Hashes == nil {
+		return []string{"the previous build did not record its inputs"}
+	} else if reasons := previous.Hashes.Diff(current); len(reasons) > 0 {
+		return reasons
+	} else if state.ShouldRebuild(target) {
+		return []string{"a rebuild was forced"}
+	}
+	return []string{"inputs are unchanged, but the outputs were missing or modified"}
+}
+
+// WhyRebuilt explains why a target was rebuilt the last time it was built, and what (if anything)
+// would cause it to be rebuilt now.
+func WhyRebuilt(state *core.BuildState, target *core.BuildTarget) (last, now []string) {
+	md, err := loadTargetMetadata(target)
+	if err != nil {
+		return nil, []string{"it has not been built yet"}
+	}
+	current := hashBreakdown(state, target)
+	if md.Hashes == nil {
+		return md.RebuildReasons, []string{"the previous build did not record its inputs"}
+	}
+	return md.RebuildReasons, md.Hashes.Diff(current)
+}
+
+// LastResourceUsage returns the resources used by the last build of a target, or nil if it hasn't been
+// built locally with cgroups enabled.
+func LastResourceUsage(target *core.BuildTarget) *core.ResourceUsage {
+	md, err := loadTargetMetadata(target)
+	if err != nil {
+		return nil
+	}
+	return md.ResourceUsage
+}
+
 // secretHash calculates a hash for any secrets of a target.
 func secretHash(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
 	if len(target.Secrets) == 0 {
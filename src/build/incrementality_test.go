@@ -35,6 +35,7 @@ var KnownFields = map[string]bool{
 	"Requires":                    true,
 	"PassEnv":                     true,
 	"Provides":                    true,
+	"Providers":                   true,
 	"PreBuildFunction":            true,
 	"PostBuildFunction":           true,
 	"PreBuildHash":                true,
@@ -93,6 +94,8 @@ var KnownFields = map[string]bool{
 	// hash because they don't affect the actual output of the target.
 	"Subrepo":                true,
 	"AddedPostBuild":         true,
+	"Kind":                   true,
+	"Resources":              true,
 	"BuildTimeout":           true,
 	"state":                  true,
 	"completedRuns":          true,
@@ -102,6 +105,10 @@ var KnownFields = map[string]bool{
 	"FileSize":               true,
 	"PassUnsafeEnv":          true,
 	"neededForSubinclude":    true,
+	"runLocally":             true,
+	"remoteRetries":          true,
+	"resourceUsage":          true,
+	"inputAudit":             true,
 	"mutex":                  true,
 	"dependenciesRegistered": true,
 	"finishedBuilding":       true,
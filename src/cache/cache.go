@@ -13,24 +13,36 @@ var log = logging.Log
 
 // NewCache is the factory function for creating a cache setup from the given config.
 func NewCache(state *core.BuildState) core.Cache {
-	c := newSyncCache(state, false)
+	stats := &Stats{}
+	c := newSyncCache(state, stats, false)
 	if state.Config.Cache.Workers > 0 {
-		return newAsyncCache(c, state.Config)
+		c = newAsyncCache(c, state.Config)
 	}
-	return c
+	return &statsWriter{Cache: c, stats: stats}
 }
 
 // newSyncCache creates a new cache, possibly multiplexing many underneath.
-func newSyncCache(state *core.BuildState, remoteOnly bool) core.Cache {
+// Each cache records its statistics into the given stats object.
+func newSyncCache(state *core.BuildState, stats *Stats, remoteOnly bool) core.Cache {
 	mplex := &cacheMultiplexer{}
+	add := func(name string, cache core.Cache) {
+		mplex.caches = append(mplex.caches, &statsCache{cache: cache, stats: stats.add(name)})
+	}
 	if state.Config.Cache.Dir != "" && !remoteOnly {
-		mplex.caches = append(mplex.caches, newDirCache(state.Config))
+		if state.Config.Cache.DirCAS {
+			add("dir", newCASDirCache(state.Config))
+		} else {
+			add("dir", newDirCache(state.Config))
+		}
 	}
 	if state.Config.Cache.HTTPURL != "" {
-		mplex.caches = append(mplex.caches, newHTTPCache(state.Config))
+		add("http", newHTTPCache(state.Config))
 	}
 	if state.Config.Cache.RetrieveCommand != "" {
-		mplex.caches = append(mplex.caches, newCmdCache(state.Config))
+		add("cmd", newCmdCache(state.Config))
+	}
+	if state.Config.Remote.URL != "" && state.Config.Remote.CacheOnly {
+		add("remote", newRemoteCache(state.Config))
 	}
 	if len(mplex.caches) == 0 {
 		return &noopCache{}
@@ -0,0 +1,387 @@
+// Content-addressed directory cache.
+//
+// This is an alternative layout for the dir cache where each file is stored once as a blob
+// named by its digest, and each target/key pair is a small manifest describing which blobs
+// make up its outputs. Targets that produce identical files (vendored jars, generated code,
+// copied configs etc) then share storage, and cleaning happens at the level of blobs rather
+// than whole entries.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/dustin/go-humanize"
+
+	"github.com/thought-machine/please/src/clean"
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// casBlobDir is the directory within the cache that blobs are stored in.
+// It's hidden so it can't collide with a package name.
+const casBlobDir = ".blobs"
+
+// casManifestSuffix is the suffix we apply to manifest files.
+const casManifestSuffix = ".manifest"
+
+// Types of entries in a manifest.
+const (
+	casEntryFile    = "file"
+	casEntryDir     = "dir"
+	casEntrySymlink = "symlink"
+)
+
+type casDirCache struct {
+	Dir   string
+	added map[string]uint64
+	mutex sync.Mutex
+}
+
+// A casManifest describes the outputs stored for a single target & key.
+type casManifest struct {
+	Entries []casManifestEntry `json:"entries"`
+}
+
+// A casManifestEntry is a single file, directory or symlink within a manifest.
+type casManifestEntry struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Digest string `json:"digest,omitempty"`
+	Size   uint64 `json:"size,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+func (cache *casDirCache) Store(target *core.BuildTarget, key []byte, files []string) {
+	manifest, err := cache.storeBlobs(target, files)
+	if err != nil {
+		log.Warning("Failed to store %s in dir cache: %s", target.Label, err)
+		return
+	}
+	filename := cache.manifestPath(target, key)
+	if err := cache.writeManifest(filename, manifest); err != nil {
+		log.Warning("Failed to write dir cache manifest %s: %s", filename, err)
+	}
+}
+
+// storeBlobs stores all the given outputs into the blob store and returns a manifest describing them.
+func (cache *casDirCache) storeBlobs(target *core.BuildTarget, files []string) (*casManifest, error) {
+	manifest := &casManifest{}
+	outDir := filepath.Join(core.RepoRoot, target.OutDir())
+	for _, out := range files {
+		if err := fs.WalkMode(filepath.Join(outDir, out), func(name string, mode fs.Mode) error {
+			rel := strings.TrimLeft(strings.TrimPrefix(name, outDir), "/")
+			if mode.IsDir() {
+				manifest.Entries = append(manifest.Entries, casManifestEntry{Path: rel, Type: casEntryDir})
+				return nil
+			} else if mode.IsSymlink() {
+				dest, err := os.Readlink(name)
+				if err != nil {
+					return err
+				}
+				manifest.Entries = append(manifest.Entries, casManifestEntry{Path: rel, Type: casEntrySymlink, Target: dest})
+				return nil
+			}
+			log.Debug("Storing %s: %s in dir cache...", target.Label, rel)
+			digest, size, err := cache.storeBlob(name)
+			if err != nil {
+				return err
+			}
+			manifest.Entries = append(manifest.Entries, casManifestEntry{Path: rel, Type: casEntryFile, Digest: digest, Size: size})
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// storeBlob stores a single file in the blob store, returning its digest & size.
+// If an identical blob already exists it is reused.
+func (cache *casDirCache) storeBlob(filename string) (string, uint64, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	digest, err := casDigest(filename, info.Mode())
+	if err != nil {
+		return "", 0, err
+	}
+	blob := cache.blobPath(digest)
+	size := uint64(info.Size())
+	cache.markBlob(blob, size)
+	if core.PathExists(blob) {
+		cache.touch(blob)
+		return digest, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), core.DirPermissions); err != nil {
+		return "", 0, err
+	}
+	// Write to a temporary name first so nobody can observe a partially written blob.
+	tmp := fmt.Sprintf("%s=%d", blob, time.Now().UnixNano())
+	if err := cloneOrLinkFile(filename, tmp, info.Mode()); err != nil {
+		return "", 0, err
+	} else if err := os.Rename(tmp, blob); err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	return digest, size, nil
+}
+
+// writeManifest atomically writes a manifest to the given location.
+func (cache *casDirCache) writeManifest(filename string, manifest *casManifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(strings.NewReader(string(b)), filename, 0644)
+}
+
+func (cache *casDirCache) Retrieve(target *core.BuildTarget, key []byte, outs []string) bool {
+	found, err := cache.retrieve(target, key, outs)
+	if err != nil {
+		log.Warning("Failed to retrieve %s from dir cache: %s", target.Label, err)
+		return false
+	} else if found {
+		log.Debug("Retrieved %s from dir cache", target.Label)
+	}
+	return found
+}
+
+func (cache *casDirCache) retrieve(target *core.BuildTarget, key []byte, outs []string) (bool, error) {
+	filename := cache.manifestPath(target, key)
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		log.Debug("%s: %s doesn't exist in dir cache", target.Label, filename)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	manifest := &casManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return false, fmt.Errorf("invalid manifest %s: %w", filename, err)
+	}
+	entries := manifest.Filter(outs)
+	// Check all the blobs exist before we start touching plz-out; they may have been cleaned independently.
+	for _, entry := range entries {
+		if entry.Type == casEntryFile {
+			if blob := cache.blobPath(entry.Digest); !core.PathExists(blob) {
+				log.Debug("%s: blob %s for %s is missing from dir cache", target.Label, entry.Digest, entry.Path)
+				if err := os.Remove(filename); err != nil {
+					log.Warning("Failed to remove stale manifest %s: %s", filename, err)
+				}
+				return false, nil
+			}
+		}
+	}
+	for _, out := range outs {
+		if _, err := ensureRetrieveReady(target, out); err != nil {
+			return false, err
+		}
+	}
+	outDir := filepath.Join(core.RepoRoot, target.OutDir())
+	for _, entry := range entries {
+		dest := filepath.Join(outDir, entry.Path)
+		switch entry.Type {
+		case casEntryDir:
+			if err := os.MkdirAll(dest, core.DirPermissions); err != nil {
+				return false, err
+			}
+		case casEntrySymlink:
+			if err := fs.EnsureDir(dest); err != nil {
+				return false, err
+			} else if err := os.Symlink(entry.Target, dest); err != nil {
+				return false, err
+			}
+		default:
+			blob := cache.blobPath(entry.Digest)
+			log.Debug("Retrieving %s: %s from dir cache...", target.Label, entry.Path)
+			if err := fs.EnsureDir(dest); err != nil {
+				return false, err
+			} else if err := cloneOrLinkFile(blob, dest, 0); err != nil {
+				return false, err
+			}
+			cache.markBlob(blob, entry.Size)
+			cache.touch(blob)
+		}
+	}
+	return true, nil
+}
+
+// Filter returns the entries in this manifest that belong to any of the given outputs.
+func (manifest *casManifest) Filter(outs []string) []casManifestEntry {
+	entries := make([]casManifestEntry, 0, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		for _, out := range outs {
+			if entry.Path == out || strings.HasPrefix(entry.Path, out+"/") {
+				entries = append(entries, entry)
+				break
+			}
+		}
+	}
+	return entries
+}
+
+func (cache *casDirCache) Clean(target *core.BuildTarget) {
+	// Only the manifests are removed; blobs may be shared with other targets and are left for the cleaner.
+	if err := os.RemoveAll(filepath.Join(cache.Dir, target.Label.PackageName, target.Label.Name)); err != nil {
+		log.Warning("Failed to remove artifacts for %s from dir cache: %s", target.Label, err)
+	}
+}
+
+func (cache *casDirCache) CleanAll() {
+	if err := clean.AsyncDeleteDir(cache.Dir); err != nil {
+		log.Error("Failed to clean cache: %s", err)
+	}
+}
+
+func (cache *casDirCache) Shutdown() {}
+
+// manifestPath returns the path to the manifest for the given target & key.
+func (cache *casDirCache) manifestPath(target *core.BuildTarget, key []byte) string {
+	return filepath.Join(cache.Dir, target.Label.PackageName, target.Label.Name, base64.URLEncoding.EncodeToString(key)) + casManifestSuffix
+}
+
+// blobPath returns the path to the blob with the given digest.
+func (cache *casDirCache) blobPath(digest string) string {
+	return filepath.Join(cache.Dir, casBlobDir, digest[:2], digest)
+}
+
+// markBlob marks a blob as used during this build, which saves it from later deletion.
+func (cache *casDirCache) markBlob(path string, size uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.added[path] = size
+}
+
+// isMarked returns true if a blob has previously been passed to markBlob.
+func (cache *casDirCache) isMarked(path string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	_, present := cache.added[path]
+	return present
+}
+
+// touch updates the access time of a blob. Linking doesn't count as an access so we have to do
+// this explicitly for the cleaner to see it as recently used.
+func (cache *casDirCache) touch(path string) {
+	if info, err := os.Stat(path); err == nil {
+		if err := os.Chtimes(path, time.Now(), info.ModTime()); err != nil {
+			log.Debug("Failed to update access time on %s: %s", path, err)
+		}
+	}
+}
+
+// casDigest returns the digest we use to identify a file in the blob store.
+// The executable bit is folded in since linked files share their permissions.
+func casDigest(filename string, mode os.FileMode) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if mode&0111 != 0 {
+		return digest + "x", nil
+	}
+	return digest, nil
+}
+
+// cloneOrLinkFile creates 'to' with the contents of 'from'. It prefers a copy-on-write clone where
+// the filesystem supports it, then falls back to a hardlink and finally a full copy.
+func cloneOrLinkFile(from, to string, mode os.FileMode) error {
+	if err := cloneFile(from, to); err == nil {
+		return nil
+	}
+	return fs.CopyOrLinkFile(from, to, mode, mode, true, true)
+}
+
+func newCASDirCache(config *core.Configuration) *casDirCache {
+	cache := &casDirCache{
+		Dir:   config.Cache.Dir,
+		added: map[string]uint64{},
+	}
+	// Absolute paths are allowed. Relative paths are interpreted relative to the repo root.
+	if !filepath.IsAbs(config.Cache.Dir) {
+		cache.Dir = filepath.Join(core.RepoRoot, config.Cache.Dir)
+	}
+	if err := os.MkdirAll(filepath.Join(cache.Dir, casBlobDir), core.DirPermissions); err != nil {
+		log.Fatalf("Failed to create root cache directory %s: %s", cache.Dir, err)
+	}
+	if config.Cache.DirClean {
+		go cache.clean(uint64(config.Cache.DirCacheHighWaterMark), uint64(config.Cache.DirCacheLowWaterMark))
+	}
+	return cache
+}
+
+// clean makes a single pass over the blob store, deleting the least recently used blobs if it's over
+// the high water mark until it's under the low water mark.
+// Returns the total size of the blobs after it's finished.
+// Manifests are tiny so aren't counted; any that refer to a cleaned blob are discarded on next retrieval.
+func (cache *casDirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
+	entries := []cacheEntry{}
+	var totalSize uint64
+	if err := filepath.Walk(filepath.Join(cache.Dir, casBlobDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || strings.ContainsRune(filepath.Base(path), '=') {
+			return nil // Directories aren't interesting, and temporary files are still being written.
+		}
+		size := uint64(info.Size())
+		totalSize += size
+		if !cache.isMarked(path) {
+			entries = append(entries, cacheEntry{
+				Path:  path,
+				Size:  size,
+				Atime: atime.Get(info).Unix(),
+			})
+		}
+		return nil
+	}); err != nil {
+		log.Error("error walking cache directory: %s\n", err)
+		return totalSize
+	}
+	log.Info("Total cache size: %s", humanize.Bytes(totalSize))
+	if totalSize < highWaterMark {
+		return totalSize
+	}
+	// Simple LRU, with the same tiebreaking on size as the regular dir cache.
+	sort.Slice(entries, func(i, j int) bool {
+		diff := entries[i].Atime - entries[j].Atime
+		if diff > -accessTimeGracePeriod && diff < accessTimeGracePeriod {
+			return entries[i].Size > entries[j].Size
+		}
+		return entries[i].Atime < entries[j].Atime
+	})
+	for _, entry := range entries {
+		if cache.isMarked(entry.Path) {
+			continue
+		}
+		log.Debug("Cleaning %s, accessed %s, saves %s", entry.Path, humanize.Time(time.Unix(entry.Atime, 0)), humanize.Bytes(entry.Size))
+		if err := os.Remove(entry.Path); err != nil {
+			log.Errorf("Couldn't remove %s: %s", entry.Path, err)
+			continue
+		}
+		totalSize -= entry.Size
+		if totalSize < lowWaterMark {
+			break
+		}
+	}
+	return totalSize
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestCASStoreAndRetrieve(t *testing.T) {
+	cache := makeCASCache(t.TempDir())
+	target := makeTarget2("//cas1:target1", 20)
+	cache.Store(target, hash, target.Outputs())
+	assert.True(t, core.PathExists(cache.manifestPath(target, hash)))
+	os.Remove("plz-out/gen/cas1/test.go")
+	assert.True(t, cache.Retrieve(target, hash, target.Outputs()))
+	assert.True(t, core.PathExists("plz-out/gen/cas1/test.go"))
+	// Should be able to store it again without problems
+	cache.Store(target, hash, target.Outputs())
+	assert.True(t, cache.Retrieve(target, hash, target.Outputs()))
+}
+
+func TestCASRetrieveMissing(t *testing.T) {
+	cache := makeCASCache(t.TempDir())
+	target := makeTarget2("//cas2:target1", 20)
+	assert.False(t, cache.Retrieve(target, hash, target.Outputs()))
+}
+
+func TestCASDeduplicates(t *testing.T) {
+	cache := makeCASCache(t.TempDir())
+	target1 := makeTarget2("//cas3:target1", 200)
+	target2 := makeTarget2("//cas3/sub:target2", 200)
+	cache.Store(target1, hash, target1.Outputs())
+	cache.Store(target2, hash, target2.Outputs())
+	// Both targets have identical contents so there should only be one blob.
+	assert.EqualValues(t, 600, cache.clean(100000, 1000))
+	assert.Equal(t, 1, countBlobs(cache))
+	assert.True(t, cache.Retrieve(target1, hash, target1.Outputs()))
+	assert.True(t, cache.Retrieve(target2, hash, target2.Outputs()))
+}
+
+func TestCASDirectoryOutput(t *testing.T) {
+	cache := makeCASCache(t.TempDir())
+	target := core.NewBuildTarget(core.ParseBuildLabel("//cas4:target1", ""))
+	target.AddOutput("dir")
+	// The output must be in plz-out, so clear out anything left behind by a previous run.
+	assert.NoError(t, os.RemoveAll("plz-out/gen/cas4"))
+	writeFile("plz-out/gen/cas4/dir/a.txt", 10)
+	writeFile("plz-out/gen/cas4/dir/sub/b.txt", 20)
+	assert.NoError(t, os.Symlink("a.txt", "plz-out/gen/cas4/dir/link"))
+	cache.Store(target, hash, target.Outputs())
+	assert.NoError(t, os.RemoveAll("plz-out/gen/cas4/dir"))
+	assert.True(t, cache.Retrieve(target, hash, target.Outputs()))
+	assert.True(t, core.PathExists("plz-out/gen/cas4/dir/a.txt"))
+	assert.True(t, core.PathExists("plz-out/gen/cas4/dir/sub/b.txt"))
+	dest, err := os.Readlink("plz-out/gen/cas4/dir/link")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", dest)
+}
+
+func TestCASClean(t *testing.T) {
+	dir := t.TempDir()
+	cache := makeCASCache(dir)
+	target1 := makeTarget2("//cas5:target1", 2000)
+	cache.Store(target1, hash, target1.Outputs())
+	target2 := makeTarget2("//cas5/sub:target2", 1000)
+	cache.Store(target2, hash, target2.Outputs())
+	// A fresh cache instance has not used either of these blobs, so it should be able to clean the larger one.
+	cache = makeCASCache(dir)
+	assert.EqualValues(t, 3000, cache.clean(8000, 4000))
+	assert.EqualValues(t, 3000, cache.clean(5000, 4000))
+	assert.Equal(t, 1, countBlobs(cache))
+	// The manifest for target1 now refers to a missing blob, so it is a miss.
+	assert.False(t, cache.Retrieve(target1, hash, target1.Outputs()))
+	assert.False(t, core.PathExists(cache.manifestPath(target1, hash)))
+	assert.True(t, cache.Retrieve(target2, hash, target2.Outputs()))
+}
+
+func TestCASExecutableBitIsPartOfDigest(t *testing.T) {
+	writeFile("plz-out/gen/cas6/a", 10)
+	a, err := casDigest("plz-out/gen/cas6/a", 0644)
+	assert.NoError(t, err)
+	b, err := casDigest("plz-out/gen/cas6/a", 0755)
+	assert.NoError(t, err)
+	assert.Equal(t, a+"x", b)
+}
+
+func makeCASCache(dir string) *casDirCache {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = dir
+	config.Cache.DirClean = false // We will do this explicitly
+	config.Cache.DirCAS = true
+	return newCASDirCache(config)
+}
+
+func countBlobs(cache *casDirCache) int {
+	count := 0
+	filepath.Walk(filepath.Join(cache.Dir, casBlobDir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package cache
+
+import (
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneUnsupported is set once we've discovered that the filesystem can't clone files,
+// so we don't keep paying for failed attempts.
+var cloneUnsupported atomic.Bool
+
+// cloneFile creates 'to' as a copy-on-write clone of 'from' (i.e. a reflink).
+// This only works on filesystems that support it, such as btrfs or XFS.
+func cloneFile(from, to string) error {
+	if cloneUnsupported.Load() {
+		return unix.EOPNOTSUPP
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dest, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(dest.Fd()), int(src.Fd()))
+	dest.Close()
+	if err != nil {
+		if err == unix.EOPNOTSUPP || err == unix.EXDEV || err == unix.EINVAL || err == unix.ENOTTY {
+			cloneUnsupported.Store(true)
+		}
+		os.Remove(to)
+	}
+	return err
+}
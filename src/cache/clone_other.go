@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package cache
+
+import "errors"
+
+// cloneFile is not supported on this platform; callers fall back to linking or copying.
+func cloneFile(from, to string) error {
+	return errors.New("file cloning is not supported on this platform")
+}
@@ -0,0 +1,147 @@
+// Compression codecs used for tarballs stored in the dir & HTTP caches.
+
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A codec is a compression format for stored tarballs.
+type codec string
+
+const (
+	gzipCodec codec = "gzip"
+	zstdCodec codec = "zstd"
+	noCodec   codec = "none"
+)
+
+// codecs are all the known codecs, in the order we check for them on retrieval.
+var codecs = []codec{gzipCodec, zstdCodec, noCodec}
+
+// acceptedContentTypes is the Accept header we send on retrieval from the HTTP cache.
+var acceptedContentTypes = strings.Join([]string{zstdCodec.ContentType(), gzipCodec.ContentType(), noCodec.ContentType()}, ", ")
+
+// zstdMagic is the magic number at the start of every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// gzipMagic is the magic number at the start of every gzip member.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// parseCodec returns the codec for a name from the config. The empty string is treated as gzip
+// to remain compatible with what we always used to store.
+func parseCodec(name string) (codec, error) {
+	if name == "" {
+		return gzipCodec, nil
+	}
+	for _, c := range codecs {
+		if string(c) == name {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown compression codec %s", name)
+}
+
+// Suffix returns the filename suffix used for tarballs compressed with this codec in the dir cache.
+func (c codec) Suffix() string {
+	switch c {
+	case zstdCodec:
+		return ".tar.zst"
+	case noCodec:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+// ContentType returns the MIME type used for tarballs compressed with this codec in the HTTP cache.
+func (c codec) ContentType() string {
+	switch c {
+	case zstdCodec:
+		return "application/zstd"
+	case noCodec:
+		return "application/x-tar"
+	}
+	return "application/gzip"
+}
+
+// NewWriter returns a writer that compresses into w. A level of zero uses the codec's default.
+// Closing the returned writer does not close w.
+func (c codec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case zstdCodec:
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case noCodec:
+		return nopWriteCloser{Writer: w}, nil
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// NewReader returns a reader that decompresses from r.
+func (c codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case zstdCodec:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case noCodec:
+		return io.NopCloser(r), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// codecForSuffix returns the codec that a dir cache filename was stored with.
+func codecForSuffix(filename string) (codec, bool) {
+	for _, c := range codecs {
+		if strings.HasSuffix(filename, c.Suffix()) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// codecForContentType returns the codec for a MIME type, or false if it's not one we recognise.
+func codecForContentType(contentType string) (codec, bool) {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	switch strings.TrimSpace(strings.ToLower(contentType)) {
+	case "application/gzip", "application/x-gzip":
+		return gzipCodec, true
+	case "application/zstd":
+		return zstdCodec, true
+	case "application/x-tar":
+		return noCodec, true
+	}
+	return "", false
+}
+
+// sniffCodec identifies the codec of a stream from its first few bytes. This handles servers that
+// don't preserve the content type we stored with; anything unrecognised is assumed to be an uncompressed tarball.
+func sniffCodec(r *bufio.Reader) codec {
+	if b, _ := r.Peek(len(zstdMagic)); bytes.Equal(b, zstdMagic) {
+		return zstdCodec
+	} else if b, _ := r.Peek(len(gzipMagic)); bytes.Equal(b, gzipMagic) {
+		return gzipCodec
+	}
+	return noCodec
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (w nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		t.Run(string(c), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := c.NewWriter(&buf, 0)
+			assert.NoError(t, err)
+			_, err = w.Write([]byte("wibble wibble wibble"))
+			assert.NoError(t, err)
+			assert.NoError(t, w.Close())
+
+			br := bufio.NewReader(&buf)
+			assert.Equal(t, c, sniffCodec(br))
+			r, err := c.NewReader(br)
+			assert.NoError(t, err)
+			b, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "wibble wibble wibble", string(b))
+		})
+	}
+}
+
+func TestCodecLevels(t *testing.T) {
+	for _, c := range []codec{gzipCodec, zstdCodec} {
+		for _, level := range []int{1, 9} {
+			w, err := c.NewWriter(io.Discard, level)
+			assert.NoError(t, err)
+			assert.NoError(t, w.Close())
+		}
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	c, err := parseCodec("")
+	assert.NoError(t, err)
+	assert.Equal(t, gzipCodec, c)
+	c, err = parseCodec("zstd")
+	assert.NoError(t, err)
+	assert.Equal(t, zstdCodec, c)
+	_, err = parseCodec("lz4")
+	assert.Error(t, err)
+}
+
+func TestCodecForContentType(t *testing.T) {
+	c, ok := codecForContentType("application/x-gzip")
+	assert.True(t, ok)
+	assert.Equal(t, gzipCodec, c)
+	c, ok = codecForContentType("application/zstd; charset=binary")
+	assert.True(t, ok)
+	assert.Equal(t, zstdCodec, c)
+	_, ok = codecForContentType("application/octet-stream")
+	assert.False(t, ok)
+}
+
+func TestStoreAndRetrieveZstd(t *testing.T) {
+	cache := makeCodecCache(".plz-cache-test-zstd", "zstd")
+	target := makeTarget2("//test_zstd:target", 20)
+	cache.Store(target, hash, target.Outputs())
+	assert.True(t, core.PathExists(filepath.Join(".plz-cache-test-zstd/test_zstd/target", b64Hash+".tar.zst")))
+	assert.True(t, cache.Retrieve(target, hash, target.Outputs()))
+}
+
+func TestRetrieveGzipWithZstdConfigured(t *testing.T) {
+	gzipCache := makeCodecCache(".plz-cache-test-codecs", "gzip")
+	target := makeTarget2("//test_codecs:target", 20)
+	gzipCache.Store(target, hash, target.Outputs())
+	os.Remove(filepath.Join("plz-out/gen/test_codecs/test.go"))
+
+	zstdCache := makeCodecCache(".plz-cache-test-codecs", "zstd")
+	assert.True(t, zstdCache.Retrieve(target, hash, target.Outputs()))
+	assert.True(t, core.PathExists("plz-out/gen/test_codecs/test.go"))
+	// The old entry is still eligible for cleaning.
+	assert.EqualValues(t, 0, zstdCache.clean(0, 0))
+}
+
+func TestHTTPCacheCodecs(t *testing.T) {
+	server := httptest.NewServer(&testServer{data: map[string][]byte{}})
+	defer server.Close()
+	target := makeTarget2("//test_http_codecs:target", 20)
+	for _, stored := range codecs {
+		for _, retrieved := range codecs {
+			config := core.DefaultConfiguration()
+			config.Cache.HTTPURL = cli.URL(server.URL)
+			config.Cache.Compression = string(stored)
+			newHTTPCache(config).Store(target, hash, target.Outputs())
+			assert.NoError(t, os.Remove("plz-out/gen/test_http_codecs/test.go"))
+
+			config.Cache.Compression = string(retrieved)
+			assert.True(t, newHTTPCache(config).Retrieve(target, hash, target.Outputs()), "stored with %s, retrieved with %s", stored, retrieved)
+			assert.True(t, core.PathExists("plz-out/gen/test_http_codecs/test.go"))
+		}
+	}
+}
+
+func makeCodecCache(dir, codec string) *dirCache {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = dir
+	config.Cache.DirClean = false
+	config.Cache.DirCompress = true
+	config.Cache.Compression = codec
+	return newDirCache(config)
+}
@@ -5,7 +5,6 @@ package cache
 import (
 	"archive/tar"
 	"bufio"
-	"compress/gzip"
 	"encoding/base64"
 	"io"
 	"os"
@@ -26,6 +25,8 @@ import (
 type dirCache struct {
 	Dir      string
 	Compress bool
+	Codec    codec
+	Level    int
 	Suffix   string
 	mtime    time.Time
 	added    map[string]uint64
@@ -88,9 +89,12 @@ func (cache *dirCache) storeCompressed2(target *core.BuildTarget, filename strin
 	defer f.Close()
 	bw := bufio.NewWriter(f)
 	defer bw.Flush()
-	gw := gzip.NewWriter(bw)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
+	cw, err := cache.Codec.NewWriter(bw, cache.Level)
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+	tw := tar.NewWriter(cw)
 	defer tw.Close()
 	outDir := target.OutDir()
 	for _, file := range files {
@@ -183,7 +187,7 @@ func (cache *dirCache) Retrieve(target *core.BuildTarget, key []byte, outs []str
 
 // retrieveFiles retrieves the given set of files from the cache.
 func (cache *dirCache) retrieve(target *core.BuildTarget, key []byte, suffix string, outs []string) bool {
-	found, err := cache.retrieveFiles(target, cache.getPath(target, key, suffix), outs)
+	found, err := cache.retrieveFiles(target, cache.findPath(target, key, suffix), outs)
 	if err != nil && !os.IsNotExist(err) {
 		log.Warning("Failed to retrieve %s from dir cache: %s", target.Label, err)
 		return false
@@ -207,7 +211,7 @@ func (cache *dirCache) retrieveFiles(target *core.BuildTarget, cacheDir string,
 		return true, cache.retrieveCompressed(target, cacheDir)
 	}
 	for _, out := range outs {
-		realOut, err := cache.ensureRetrieveReady(target, out)
+		realOut, err := ensureRetrieveReady(target, out)
 		if err != nil {
 			return false, err
 		}
@@ -230,12 +234,14 @@ func (cache *dirCache) retrieveCompressed(target *core.BuildTarget, filename str
 		return err
 	}
 	defer f.Close()
-	gr, err := gzip.NewReader(f)
+	// Each entry records the codec it was stored with in its suffix, which might not be the one we're currently using.
+	c, _ := codecForSuffix(filename)
+	cr, err := c.NewReader(bufio.NewReader(f))
 	if err != nil {
 		return err
 	}
-	defer gr.Close()
-	tr := tar.NewReader(gr)
+	defer cr.Close()
+	tr := tar.NewReader(cr)
 	for {
 		hdr, err := tr.Next()
 		if err != nil {
@@ -244,7 +250,7 @@ func (cache *dirCache) retrieveCompressed(target *core.BuildTarget, filename str
 			}
 			return err
 		}
-		out, err := cache.ensureRetrieveReady(target, hdr.Name)
+		out, err := ensureRetrieveReady(target, hdr.Name)
 		if err != nil {
 			return err
 		}
@@ -276,7 +282,7 @@ func (cache *dirCache) retrieveCompressed(target *core.BuildTarget, filename str
 }
 
 // ensureRetrieveReady makes sure that appropriate directories are created and old outputs are removed.
-func (cache *dirCache) ensureRetrieveReady(target *core.BuildTarget, out string) (string, error) {
+func ensureRetrieveReady(target *core.BuildTarget, out string) (string, error) {
 	fullOut := filepath.Join(core.RepoRoot, target.OutDir(), out)
 	if strings.ContainsRune(out, '/') { // The root directory will be there, only need to worry about outs in subdirectories.
 		if err := os.MkdirAll(filepath.Dir(fullOut), core.DirPermissions); err != nil {
@@ -321,6 +327,23 @@ func (cache *dirCache) getFullPath(target *core.BuildTarget, key []byte, extra,
 	return filepath.Join(cache.Dir, target.Label.PackageName, target.Label.Name, base64.URLEncoding.EncodeToString(key)) + extra + suffix + cache.Suffix
 }
 
+// findPath returns the path to an existing entry in the cache. For compressed caches, this might have been
+// stored with a different codec to the one we're now configured with; if no entry exists at all it returns
+// the path it would have been stored at.
+func (cache *dirCache) findPath(target *core.BuildTarget, key []byte, extra string) string {
+	path := cache.getPath(target, key, extra)
+	if !cache.Compress || core.PathExists(path) {
+		return path
+	}
+	base := strings.TrimSuffix(path, cache.Suffix)
+	for _, c := range codecs {
+		if c != cache.Codec && core.PathExists(base+c.Suffix()) {
+			return base + c.Suffix()
+		}
+	}
+	return path
+}
+
 // markDir marks a directory as added to the cache, which saves it from later deletion.
 func (cache *dirCache) markDir(path string, size uint64) {
 	cache.mutex.Lock()
@@ -338,14 +361,20 @@ func (cache *dirCache) isMarked(path string) (uint64, bool) {
 }
 
 func newDirCache(config *core.Configuration) *dirCache {
+	c, err := parseCodec(config.Cache.Compression)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 	cache := &dirCache{
 		Compress: config.Cache.DirCompress,
+		Codec:    c,
+		Level:    config.Cache.CompressionLevel,
 		Dir:      config.Cache.Dir,
 		added:    map[string]uint64{},
 		mtime:    time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
 	}
 	if cache.Compress {
-		cache.Suffix = ".tar.gz"
+		cache.Suffix = cache.Codec.Suffix()
 	}
 	// Absolute paths are allowed. Relative paths are interpreted relative to the repo root.
 	if !filepath.IsAbs(config.Cache.Dir) {
@@ -465,10 +494,14 @@ func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
 func (cache *dirCache) shouldClean(name string, isDir bool) bool {
 	if cache.Compress == isDir {
 		return false // If we're compressing, don't look for directories. If we're not, only look at directories.
-	} else if !strings.HasSuffix(name, cache.Suffix) {
-		return false // Suffix must match.
+	} else if cache.Compress {
+		// Entries stored with any codec are eligible, since we might have changed codec since they were written.
+		c, ok := codecForSuffix(name)
+		if !ok {
+			return false
+		}
+		name = strings.TrimSuffix(name, c.Suffix())
 	}
-	name = strings.TrimSuffix(name, cache.Suffix)
 	// 28 == length of 20-byte sha1 hash, encoded to base64, which always gets a trailing =
 	// as padding so we can check that to be "sure".
 	// Also 29 in case we appended an extra = (which we do for temporary files that are still being written to)
@@ -0,0 +1,157 @@
+// Introspection of the entries held in the dir cache.
+
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/dustin/go-humanize"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// An Entry is a single stored artifact in the dir cache.
+type Entry struct {
+	Label core.BuildLabel
+	// Key is the cache key for this entry, as it's encoded in the cache directory.
+	Key   string
+	Path  string
+	Size  uint64
+	Atime time.Time
+}
+
+// ListEntries returns all the entries in the dir cache belonging to any of the given labels.
+// This doesn't require parsing; labels are matched against the layout of the cache directory so
+// wildcards like //src/... work for anything that has been stored, even if it no longer exists.
+func ListEntries(config *core.Configuration, labels []core.BuildLabel) ([]Entry, error) {
+	dir := dirCacheRoot(config)
+	if dir == "" {
+		return nil, fmt.Errorf("the dir cache is not enabled")
+	}
+	entries := []Entry{}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir // Nothing has been stored yet
+			}
+			return err
+		} else if info.IsDir() && info.Name() == casBlobDir {
+			return filepath.SkipDir
+		}
+		key, ok := entryKey(info.Name())
+		if !ok {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, filepath.Dir(path))
+		pkg, name := filepath.Split(rel)
+		label := core.BuildLabel{PackageName: strings.TrimSuffix(pkg, "/"), Name: name}
+		if matchesAny(labels, label) {
+			size, err := findSize(path)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, Entry{
+				Label: label,
+				Key:   key,
+				Path:  path,
+				Size:  size,
+				Atime: atime.Get(info),
+			})
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Label != entries[j].Label {
+			return entries[i].Label.Less(entries[j].Label)
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+// PrintEntries prints a human-readable listing of the given entries.
+func PrintEntries(w io.Writer, entries []Entry) {
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s %s %10s  accessed %s\n", entry.Label, entry.Key, humanize.Bytes(entry.Size), humanize.Time(entry.Atime))
+	}
+}
+
+// Evict removes entries from the dir cache for the given labels.
+// If any keys are given, only entries with those keys are removed.
+// Returns the entries that were removed.
+func Evict(config *core.Configuration, labels []core.BuildLabel, keys []string) ([]Entry, error) {
+	entries, err := ListEntries(config, labels)
+	if err != nil {
+		return nil, err
+	}
+	evicted := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if len(keys) > 0 && !containsKey(keys, entry.Key) {
+			continue
+		}
+		if err := os.RemoveAll(entry.Path); err != nil {
+			return evicted, err
+		}
+		log.Debug("Evicted %s from dir cache", entry.Path)
+		evicted = append(evicted, entry)
+	}
+	return evicted, nil
+}
+
+// dirCacheRoot returns the root directory of the dir cache, or the empty string if it's not enabled.
+func dirCacheRoot(config *core.Configuration) string {
+	if config.Cache.Dir == "" || filepath.IsAbs(config.Cache.Dir) {
+		return config.Cache.Dir
+	}
+	return filepath.Join(core.RepoRoot, config.Cache.Dir)
+}
+
+// entryKey returns the cache key for a file or directory name in the dir cache, and
+// whether it's an entry at all. Any of the formats (plain, compressed or manifest) are accepted,
+// but temporary entries that are still being written are not.
+func entryKey(name string) (string, bool) {
+	name = strings.TrimSuffix(name, casManifestSuffix)
+	if c, ok := codecForSuffix(name); ok {
+		name = strings.TrimSuffix(name, c.Suffix())
+	}
+	// These lengths correspond to sha1 and sha256 respectively; see shouldClean for more detail.
+	for _, length := range []int{28, 44} {
+		if len(name) >= length && name[length-1] == '=' {
+			if len(name) > length && name[length] == '=' {
+				return "", false
+			}
+			return name[:length], true
+		}
+	}
+	return "", false
+}
+
+func matchesAny(labels []core.BuildLabel, label core.BuildLabel) bool {
+	for _, l := range labels {
+		if l.Includes(label) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestListAndEvictEntries(t *testing.T) {
+	dir := t.TempDir()
+	cache := makeCache(dir, false)
+	target1 := makeTarget2("//entries1:target1", 20)
+	target2 := makeTarget2("//entries1/sub:target2", 20)
+	cache.Store(target1, hash, target1.Outputs())
+	cache.Store(target2, hash, target2.Outputs())
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = dir
+
+	entries, err := ListEntries(config, []core.BuildLabel{core.ParseBuildLabel("//entries1/...", "")})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, target1.Label, entries[0].Label)
+	assert.Equal(t, b64Hash, entries[0].Key)
+	assert.Equal(t, target2.Label, entries[1].Label)
+
+	entries, err = ListEntries(config, []core.BuildLabel{core.ParseBuildLabel("//entries1:all", "")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	evicted, err := Evict(config, []core.BuildLabel{target1.Label}, []string{"wibble"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(evicted))
+	evicted, err = Evict(config, []core.BuildLabel{target1.Label}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(evicted))
+	assert.False(t, core.PathExists(filepath.Join(dir, "entries1", "target1", b64Hash)))
+	assert.False(t, cache.Retrieve(target1, hash, target1.Outputs()))
+	assert.True(t, cache.Retrieve(target2, hash, target2.Outputs()))
+}
+
+func TestListEntriesCAS(t *testing.T) {
+	dir := t.TempDir()
+	cache := makeCASCache(dir)
+	target := makeTarget2("//entries2:target1", 20)
+	cache.Store(target, hash, target.Outputs())
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = dir
+	entries, err := ListEntries(config, []core.BuildLabel{core.ParseBuildLabel("//...", "")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, b64Hash, entries[0].Key)
+}
+
+func TestEntryKey(t *testing.T) {
+	key, ok := entryKey(b64Hash)
+	assert.True(t, ok)
+	assert.Equal(t, b64Hash, key)
+	key, ok = entryKey(b64Hash + ".tar.gz")
+	assert.True(t, ok)
+	assert.Equal(t, b64Hash, key)
+	_, ok = entryKey(b64Hash + "=")
+	assert.False(t, ok)
+	_, ok = entryKey("test.go")
+	assert.False(t, ok)
+}
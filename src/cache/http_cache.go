@@ -4,13 +4,14 @@ package cache
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -24,7 +25,10 @@ import (
 type httpCache struct {
 	url      string
 	writable bool
+	codec    codec
+	level    int
 	client   *retryablehttp.Client
+	token    string
 
 	requestLimiter limiter
 }
@@ -52,11 +56,12 @@ func (cache *httpCache) Store(target *core.BuildTarget, key []byte, files []stri
 
 		r, w := io.Pipe()
 		go cache.write(w, target, files)
-		req, err := retryablehttp.NewRequest(http.MethodPut, cache.makeURL(key), r)
+		req, err := cache.newRequest(http.MethodPut, key, r)
 		if err != nil {
 			log.Warning("Invalid cache URL: %s", err)
 			return
 		}
+		req.Header.Set("Content-Type", cache.codec.ContentType())
 		if resp, err := cache.client.Do(req); err != nil {
 			log.Warning("Failed to store files in HTTP cache: %s", err)
 		} else {
@@ -65,17 +70,33 @@ func (cache *httpCache) Store(target *core.BuildTarget, key []byte, files []stri
 	}
 }
 
+// newRequest creates a new request for the given key, authenticated if we have a token.
+func (cache *httpCache) newRequest(method string, key []byte, body interface{}) (*retryablehttp.Request, error) {
+	req, err := retryablehttp.NewRequest(method, cache.makeURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if cache.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cache.token)
+	}
+	return req, nil
+}
+
 // makeURL returns the remote URL for a key.
 func (cache *httpCache) makeURL(key []byte) string {
 	return cache.url + "/" + hex.EncodeToString(key)
 }
 
 // write writes a series of files into the given Writer.
-func (cache *httpCache) write(w io.WriteCloser, target *core.BuildTarget, files []string) {
+func (cache *httpCache) write(w *io.PipeWriter, target *core.BuildTarget, files []string) {
 	defer w.Close()
-	gzw := gzip.NewWriter(w)
-	defer gzw.Close()
-	tw := tar.NewWriter(gzw)
+	cw, err := cache.codec.NewWriter(w, cache.level)
+	if err != nil {
+		w.CloseWithError(err)
+		return
+	}
+	defer cw.Close()
+	tw := tar.NewWriter(cw)
 	defer tw.Close()
 	outDir := target.OutDir()
 
@@ -138,10 +159,11 @@ func (cache *httpCache) Retrieve(target *core.BuildTarget, key []byte, _ []strin
 }
 
 func (cache *httpCache) retrieve(key []byte) (bool, error) {
-	req, err := retryablehttp.NewRequest(http.MethodGet, cache.makeURL(key), nil)
+	req, err := cache.newRequest(http.MethodGet, key, nil)
 	if err != nil {
 		return false, err
 	}
+	req.Header.Set("Accept", acceptedContentTypes)
 	resp, err := cache.client.Do(req)
 	if err != nil {
 		return false, err
@@ -153,12 +175,19 @@ func (cache *httpCache) retrieve(key []byte) (bool, error) {
 		b, _ := io.ReadAll(resp.Body)
 		return false, fmt.Errorf("%s", string(b))
 	}
-	gzr, err := gzip.NewReader(resp.Body)
+	// Entries may have been stored with a different codec to the one we're configured with (e.g. by an
+	// older client). The content type tells us which if the server preserves it, otherwise we sniff it.
+	br := bufio.NewReader(resp.Body)
+	c, ok := codecForContentType(resp.Header.Get("Content-Type"))
+	if !ok {
+		c = sniffCodec(br)
+	}
+	cr, err := c.NewReader(br)
 	if err != nil {
 		return false, err
 	}
-	defer gzr.Close()
-	return readTar(gzr)
+	defer cr.Close()
+	return readTar(cr)
 }
 
 func readTar(gzr io.Reader) (bool, error) {
@@ -225,9 +254,24 @@ func (cache *httpCache) CleanAll() {
 func (cache *httpCache) Shutdown() {}
 
 func newHTTPCache(config *core.Configuration) *httpCache {
+	c, err := parseCodec(config.Cache.Compression)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	var token string
+	if config.Cache.HTTPTokenFile != "" {
+		b, err := os.ReadFile(config.Cache.HTTPTokenFile)
+		if err != nil {
+			log.Fatalf("Failed to read HTTP cache token: %s", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
 	return &httpCache{
 		url:      config.Cache.HTTPURL.String(),
 		writable: config.Cache.HTTPWriteable,
+		codec:    c,
+		level:    config.Cache.CompressionLevel,
+		token:    token,
 		client: &retryablehttp.Client{
 			HTTPClient: &http.Client{
 				Timeout: time.Duration(config.Cache.HTTPTimeout),
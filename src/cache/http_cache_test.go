@@ -4,11 +4,14 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
 )
 
@@ -49,6 +52,25 @@ func TestStoreAndRetrieveHTTP(t *testing.T) {
 	assert.Equal(t, b, b2)
 }
 
+func TestHTTPCacheSendsToken(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600))
+	config := core.DefaultConfiguration()
+	config.Cache.HTTPURL = cli.URL(server.URL)
+	config.Cache.HTTPTokenFile = tokenFile
+	cache := newHTTPCache(config)
+	found, err := cache.retrieve([]byte("test_key"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "Bearer s3cr3t", auth)
+}
+
 type testServer struct {
 	data map[string][]byte
 }
@@ -0,0 +1,222 @@
+// Cache backed by the action cache & CAS of a remote execution server.
+//
+// This lets targets that are built locally share their outputs via a remote server without
+// needing any executors on it. Each target/key pair is represented by a synthetic action whose
+// result lists the files stored for it; the files themselves are uploaded to the CAS.
+
+package cache
+
+import (
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/command"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/uploadinfo"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/remote/dial"
+)
+
+type remoteCache struct {
+	config *core.Configuration
+	client *client.Client
+	once   sync.Once
+	err    error
+}
+
+func newRemoteCache(config *core.Configuration) *remoteCache {
+	return &remoteCache{config: config}
+}
+
+// init connects to the remote server. It's done lazily so we don't hold up startup when the
+// cache isn't needed.
+func (cache *remoteCache) init() error {
+	cache.once.Do(func() {
+		cache.client, cache.err = cache.dial()
+		if cache.err != nil {
+			log.Warning("Failed to connect to remote cache at %s: %s", cache.config.Remote.URL, cache.err)
+		}
+	})
+	return cache.err
+}
+
+func (cache *remoteCache) dial() (*client.Client, error) {
+	dialOpts, err := dial.Options(cache.config)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(cache.config.Remote.Timeout)
+	c, err := client.NewClient(context.Background(), cache.config.Remote.Instance, dial.Params(cache.config, dialOpts), client.UseBatchOps(true), &client.TreeSymlinkOpts{Preserved: true}, client.RetryTransient(), client.RPCTimeouts(map[string]time.Duration{
+		"default":         timeout,
+		"GetCapabilities": 5 * time.Second,
+	}))
+	if err != nil {
+		return nil, err
+	} else if c.MaxBatchSize == 0 {
+		// No limit was set by the server, assume we are implicitly limited by gRPC's default message size.
+		c.MaxBatchSize = client.DefaultMaxBatchSize
+	}
+	return c, nil
+}
+
+func (cache *remoteCache) Store(target *core.BuildTarget, key []byte, files []string) {
+	if err := cache.init(); err != nil {
+		return
+	}
+	log.Debug("Storing %s in remote cache...", target.Label)
+	if err := cache.store(target, key, files); err != nil {
+		log.Warning("Failed to store %s in remote cache: %s", target.Label, err)
+	}
+}
+
+func (cache *remoteCache) store(target *core.BuildTarget, key []byte, files []string) error {
+	ctx := context.Background()
+	outDir := filepath.Join(core.RepoRoot, target.OutDir())
+	entries, ar, err := cache.client.ComputeOutputsToUpload(outDir, ".", files, filemetadata.NewNoopCache(), command.PreserveSymlink)
+	if err != nil {
+		return err
+	}
+	action, actionEntries, err := cache.action(target, key)
+	if err != nil {
+		return err
+	}
+	uploads := make([]*uploadinfo.Entry, 0, len(entries)+len(actionEntries))
+	for _, entry := range entries {
+		uploads = append(uploads, entry)
+	}
+	uploads = append(uploads, actionEntries...)
+	if _, _, err := cache.client.UploadIfMissing(ctx, uploads...); err != nil {
+		return err
+	}
+	_, err = cache.client.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		InstanceName: cache.client.InstanceName,
+		ActionDigest: action.ToProto(),
+		ActionResult: ar,
+	})
+	return err
+}
+
+func (cache *remoteCache) Retrieve(target *core.BuildTarget, key []byte, files []string) bool {
+	if err := cache.init(); err != nil {
+		return false
+	}
+	found, err := cache.retrieve(target, key, files)
+	if err != nil {
+		log.Warning("Failed to retrieve %s from remote cache: %s", target.Label, err)
+		return false
+	} else if found {
+		log.Debug("Retrieved %s from remote cache", target.Label)
+	}
+	return found
+}
+
+func (cache *remoteCache) retrieve(target *core.BuildTarget, key []byte, files []string) (bool, error) {
+	ctx := context.Background()
+	action, _, err := cache.action(target, key)
+	if err != nil {
+		return false, err
+	}
+	ar, err := cache.client.CheckActionCache(ctx, action.ToProto())
+	if err != nil || ar == nil {
+		return false, err
+	}
+	ar, missing := filterActionResult(ar, files)
+	if len(missing) > 0 {
+		log.Debug("%s is in remote cache but missing outputs %s", target.Label, strings.Join(missing, ", "))
+		return false, nil
+	}
+	for _, out := range files {
+		if _, err := ensureRetrieveReady(target, out); err != nil {
+			return false, err
+		}
+	}
+	_, err = cache.client.DownloadActionOutputs(ctx, ar, filepath.Join(core.RepoRoot, target.OutDir()), filemetadata.NewNoopCache())
+	return err == nil, err
+}
+
+// action returns the digest of the synthetic action we use to identify a target & key in the
+// action cache, along with the entries needed to upload it.
+func (cache *remoteCache) action(target *core.BuildTarget, key []byte) (digest.Digest, []*uploadinfo.Entry, error) {
+	cmd, err := uploadinfo.EntryFromProto(&pb.Command{
+		Arguments: []string{"please", "cache", target.Label.String(), hex.EncodeToString(key)},
+	})
+	if err != nil {
+		return digest.Digest{}, nil, err
+	}
+	inputRoot, err := uploadinfo.EntryFromProto(&pb.Directory{})
+	if err != nil {
+		return digest.Digest{}, nil, err
+	}
+	action, err := uploadinfo.EntryFromProto(&pb.Action{
+		CommandDigest:   cmd.Digest.ToProto(),
+		InputRootDigest: inputRoot.Digest.ToProto(),
+	})
+	if err != nil {
+		return digest.Digest{}, nil, err
+	}
+	return action.Digest, []*uploadinfo.Entry{cmd, inputRoot, action}, nil
+}
+
+// filterActionResult returns a copy of the given action result containing only the given outputs,
+// and any of those that it didn't have.
+func filterActionResult(ar *pb.ActionResult, files []string) (*pb.ActionResult, []string) {
+	wanted := make(map[string]bool, len(files))
+	for _, file := range files {
+		wanted[file] = true
+	}
+	found := map[string]bool{}
+	keep := func(path string) bool {
+		if wanted[path] {
+			found[path] = true
+			return true
+		}
+		return false
+	}
+	ret := &pb.ActionResult{}
+	for _, f := range ar.OutputFiles {
+		if keep(f.Path) {
+			ret.OutputFiles = append(ret.OutputFiles, f)
+		}
+	}
+	for _, d := range ar.OutputDirectories {
+		if keep(d.Path) {
+			ret.OutputDirectories = append(ret.OutputDirectories, d)
+		}
+	}
+	for _, s := range ar.OutputSymlinks {
+		if keep(s.Path) {
+			ret.OutputSymlinks = append(ret.OutputSymlinks, s)
+		}
+	}
+	var missing []string
+	for _, file := range files {
+		if !found[file] {
+			missing = append(missing, file)
+		}
+	}
+	return ret, missing
+}
+
+func (cache *remoteCache) Clean(target *core.BuildTarget) {
+	// There's no way of removing things from the action cache; they'll expire on the server.
+}
+
+func (cache *remoteCache) CleanAll() {
+	// Similarly, we can't do anything here.
+}
+
+func (cache *remoteCache) Shutdown() {
+	if cache.client != nil {
+		if err := cache.client.Close(); err != nil {
+			log.Warning("Failed to close remote cache connection: %s", err)
+		}
+	}
+}
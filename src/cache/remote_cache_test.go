@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A fakeRemoteServer implements just enough of the action cache & CAS for the remote cache.
+type fakeRemoteServer struct {
+	pb.UnimplementedCapabilitiesServer
+	pb.UnimplementedActionCacheServer
+	pb.UnimplementedContentAddressableStorageServer
+	bs.UnimplementedByteStreamServer
+	mutex         sync.Mutex
+	actionResults map[string]*pb.ActionResult
+	blobs         map[string][]byte
+}
+
+func (s *fakeRemoteServer) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.ServerCapabilities, error) {
+	return &pb.ServerCapabilities{
+		CacheCapabilities: &pb.CacheCapabilities{
+			DigestFunctions:               []pb.DigestFunction_Value{pb.DigestFunction_SHA256},
+			ActionCacheUpdateCapabilities: &pb.ActionCacheUpdateCapabilities{UpdateEnabled: true},
+		},
+		LowApiVersion:  &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2, Minor: 1},
+	}, nil
+}
+
+func (s *fakeRemoteServer) GetActionResult(ctx context.Context, req *pb.GetActionResultRequest) (*pb.ActionResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ar, present := s.actionResults[req.ActionDigest.Hash]; present {
+		return ar, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "action result not found")
+}
+
+func (s *fakeRemoteServer) UpdateActionResult(ctx context.Context, req *pb.UpdateActionResultRequest) (*pb.ActionResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.actionResults[req.ActionDigest.Hash] = req.ActionResult
+	return req.ActionResult, nil
+}
+
+func (s *fakeRemoteServer) FindMissingBlobs(ctx context.Context, req *pb.FindMissingBlobsRequest) (*pb.FindMissingBlobsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resp := &pb.FindMissingBlobsResponse{}
+	for _, d := range req.BlobDigests {
+		if _, present := s.blobs[d.Hash]; !present {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, d)
+		}
+	}
+	return resp, nil
+}
+
+func (s *fakeRemoteServer) BatchUpdateBlobs(ctx context.Context, req *pb.BatchUpdateBlobsRequest) (*pb.BatchUpdateBlobsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resp := &pb.BatchUpdateBlobsResponse{}
+	for _, r := range req.Requests {
+		s.blobs[r.Digest.Hash] = r.Data
+		resp.Responses = append(resp.Responses, &pb.BatchUpdateBlobsResponse_Response{Digest: r.Digest, Status: &rpcstatus.Status{}})
+	}
+	return resp, nil
+}
+
+func (s *fakeRemoteServer) BatchReadBlobs(ctx context.Context, req *pb.BatchReadBlobsRequest) (*pb.BatchReadBlobsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resp := &pb.BatchReadBlobsResponse{}
+	for _, d := range req.Digests {
+		r := &pb.BatchReadBlobsResponse_Response{Digest: d, Status: &rpcstatus.Status{}}
+		if data, present := s.blobs[d.Hash]; present {
+			r.Data = data
+		} else {
+			r.Status.Code = int32(codes.NotFound)
+			r.Status.Message = fmt.Sprintf("blob %s not found", d.Hash)
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, nil
+}
+
+func (s *fakeRemoteServer) Read(req *bs.ReadRequest, srv bs.ByteStream_ReadServer) error {
+	// Resource names look like [{instance}/]blobs/{hash}/{size}
+	parts := strings.Split(req.ResourceName, "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %s", req.ResourceName)
+	}
+	s.mutex.Lock()
+	data, present := s.blobs[parts[len(parts)-2]]
+	s.mutex.Unlock()
+	if !present {
+		return status.Errorf(codes.NotFound, "blob %s not found", req.ResourceName)
+	}
+	return srv.Send(&bs.ReadResponse{Data: data[req.ReadOffset:]})
+}
+
+func newFakeRemoteServer(t *testing.T) (*fakeRemoteServer, string) {
+	server := &fakeRemoteServer{actionResults: map[string]*pb.ActionResult{}, blobs: map[string][]byte{}}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	pb.RegisterCapabilitiesServer(s, server)
+	pb.RegisterActionCacheServer(s, server)
+	pb.RegisterContentAddressableStorageServer(s, server)
+	bs.RegisterByteStreamServer(s, server)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return server, lis.Addr().String()
+}
+
+// newTestRemoteCache returns a new remote cache connected to the given URL, with the repo root in a temp dir.
+func newTestRemoteCache(t *testing.T, url string) *remoteCache {
+	repoRoot := core.RepoRoot
+	core.RepoRoot = t.TempDir()
+	t.Cleanup(func() { core.RepoRoot = repoRoot })
+	config := core.DefaultConfiguration()
+	config.Remote.URL = url
+	config.Remote.Secure = false
+	config.Remote.CacheOnly = true
+	cache := newRemoteCache(config)
+	t.Cleanup(cache.Shutdown)
+	return cache
+}
+
+func TestRemoteCacheStoreAndRetrieve(t *testing.T) {
+	server, url := newFakeRemoteServer(t)
+	cache := newTestRemoteCache(t, url)
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/remote", "target"))
+	outDir := filepath.Join(core.RepoRoot, target.OutDir())
+	require.NoError(t, os.MkdirAll(filepath.Join(outDir, "dir/sub"), core.DirPermissions))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "file.txt"), []byte("file"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "dir/sub/nested.txt"), []byte("nested"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "tool"), []byte("#!/bin/sh\n"), 0755))
+
+	key := []byte("12345678901234567890")
+	files := []string{"file.txt", "dir", "tool"}
+	assert.False(t, cache.Retrieve(target, key, files))
+	cache.Store(target, key, files)
+	assert.Equal(t, 1, len(server.actionResults))
+
+	require.NoError(t, os.RemoveAll(outDir))
+	require.NoError(t, os.MkdirAll(outDir, core.DirPermissions))
+	assert.True(t, cache.Retrieve(target, key, files))
+	b, err := os.ReadFile(filepath.Join(outDir, "file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "file", string(b))
+	b, err = os.ReadFile(filepath.Join(outDir, "dir/sub/nested.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "nested", string(b))
+	info, err := os.Stat(filepath.Join(outDir, "tool"))
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Mode()&0100)
+
+	// A subset of the stored files can be retrieved, but not anything that wasn't stored.
+	assert.True(t, cache.Retrieve(target, key, []string{"file.txt"}))
+	assert.False(t, cache.Retrieve(target, key, []string{"file.txt", "other.txt"}))
+	// Nor anything for a different key.
+	assert.False(t, cache.Retrieve(target, []byte("09876543210987654321"), files))
+}
+
+func TestRemoteCacheUnavailable(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	url := lis.Addr().String()
+	lis.Close()
+	cache := newTestRemoteCache(t, url)
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/remote", "target"))
+	// Neither of these should block or panic; the cache just becomes inert.
+	cache.Store(target, []byte("12345678901234567890"), []string{"file.txt"})
+	assert.False(t, cache.Retrieve(target, []byte("12345678901234567890"), []string{"file.txt"}))
+}
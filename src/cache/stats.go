@@ -0,0 +1,160 @@
+// Statistics about cache usage.
+//
+// Each backend is wrapped to count its hits, misses & stores, and the totals are written out
+// at the end of the build so `plz cache stats` can report them afterwards.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// StatsFile is the file we write statistics for the last build into.
+const StatsFile = "plz-out/log/cache_stats.json"
+
+// Stats contains statistics for all the caches active during a build.
+type Stats struct {
+	Backends []*BackendStats `json:"backends"`
+}
+
+// BackendStats contains statistics for a single cache backend.
+type BackendStats struct {
+	Name           string `json:"name"`
+	Hits           int64  `json:"hits"`
+	Misses         int64  `json:"misses"`
+	Stores         int64  `json:"stores"`
+	RetrievedBytes int64  `json:"retrieved_bytes"`
+	StoredBytes    int64  `json:"stored_bytes"`
+}
+
+// add registers a new backend with the given name.
+func (stats *Stats) add(name string) *BackendStats {
+	s := &BackendStats{Name: name}
+	stats.Backends = append(stats.Backends, s)
+	return s
+}
+
+// empty returns true if nothing was recorded in these stats.
+func (stats *Stats) empty() bool {
+	for _, s := range stats.Backends {
+		if s.Hits+s.Misses+s.Stores > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes these stats to the given file.
+func (stats *Stats) Write(filename string) error {
+	b, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
+
+// Print prints a human-readable summary of these stats.
+func (stats *Stats) Print(w io.Writer) {
+	if len(stats.Backends) == 0 {
+		fmt.Fprintln(w, "No caches were active during the last build.")
+		return
+	}
+	fmt.Fprintf(w, "%-10s %8s %8s %8s %9s %12s %12s\n", "Cache", "Hits", "Misses", "Stores", "Hit rate", "Retrieved", "Stored")
+	for _, s := range stats.Backends {
+		rate := "-"
+		if total := s.Hits + s.Misses; total > 0 {
+			rate = fmt.Sprintf("%.1f%%", 100.0*float64(s.Hits)/float64(total))
+		}
+		fmt.Fprintf(w, "%-10s %8d %8d %8d %9s %12s %12s\n", s.Name, s.Hits, s.Misses, s.Stores, rate,
+			humanize.Bytes(uint64(s.RetrievedBytes)), humanize.Bytes(uint64(s.StoredBytes)))
+	}
+}
+
+// ReadStats reads previously written stats from the given file.
+func ReadStats(filename string) (*Stats, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{}
+	return stats, json.Unmarshal(b, stats)
+}
+
+// A statsCache wraps another cache and records statistics about it.
+type statsCache struct {
+	cache core.Cache
+	stats *BackendStats
+}
+
+func (c *statsCache) Store(target *core.BuildTarget, key []byte, files []string) {
+	c.cache.Store(target, key, files)
+	atomic.AddInt64(&c.stats.Stores, 1)
+	atomic.AddInt64(&c.stats.StoredBytes, outputSize(target, files))
+}
+
+func (c *statsCache) Retrieve(target *core.BuildTarget, key []byte, files []string) bool {
+	if !c.cache.Retrieve(target, key, files) {
+		atomic.AddInt64(&c.stats.Misses, 1)
+		return false
+	}
+	atomic.AddInt64(&c.stats.Hits, 1)
+	atomic.AddInt64(&c.stats.RetrievedBytes, outputSize(target, files))
+	return true
+}
+
+func (c *statsCache) Clean(target *core.BuildTarget) {
+	c.cache.Clean(target)
+}
+
+func (c *statsCache) CleanAll() {
+	c.cache.CleanAll()
+}
+
+func (c *statsCache) Shutdown() {
+	c.cache.Shutdown()
+}
+
+// A statsWriter is the outermost cache, which writes out all the stats once it's shut down.
+type statsWriter struct {
+	core.Cache
+	stats *Stats
+}
+
+func (c *statsWriter) Shutdown() {
+	c.Cache.Shutdown()
+	if c.stats.empty() {
+		return // Don't overwrite stats from a previous build with nothing (e.g. for `plz clean`)
+	}
+	if err := c.stats.Write(StatsFile); err != nil {
+		log.Warning("Failed to write cache stats: %s", err)
+	}
+}
+
+// outputSize returns the total size of the given outputs of a target.
+func outputSize(target *core.BuildTarget, files []string) int64 {
+	var size int64
+	outDir := target.OutDir()
+	for _, file := range files {
+		fs.Walk(filepath.Join(outDir, file), func(name string, isDir bool) error {
+			if !isDir {
+				if info, err := os.Lstat(name); err == nil {
+					size += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+	return size
+}
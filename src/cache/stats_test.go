@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestStatsCacheRecordsHitsAndMisses(t *testing.T) {
+	stats := &Stats{}
+	c := &statsCache{cache: makeCache(t.TempDir(), false), stats: stats.add("dir")}
+	target := makeTarget2("//stats1:target1", 20)
+	assert.False(t, c.Retrieve(target, hash, target.Outputs()))
+	c.Store(target, hash, target.Outputs())
+	assert.True(t, c.Retrieve(target, hash, target.Outputs()))
+	s := stats.Backends[0]
+	assert.EqualValues(t, 1, s.Hits)
+	assert.EqualValues(t, 1, s.Misses)
+	assert.EqualValues(t, 1, s.Stores)
+	assert.EqualValues(t, 60, s.StoredBytes)
+	assert.EqualValues(t, 60, s.RetrievedBytes)
+}
+
+func TestStatsRoundTrip(t *testing.T) {
+	stats := &Stats{}
+	assert.True(t, stats.empty())
+	s := stats.add("http")
+	s.Hits = 3
+	s.Misses = 1
+	assert.False(t, stats.empty())
+	filename := filepath.Join(t.TempDir(), "stats.json")
+	assert.NoError(t, stats.Write(filename))
+	stats2, err := ReadStats(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, stats, stats2)
+	var buf bytes.Buffer
+	stats2.Print(&buf)
+	assert.Contains(t, buf.String(), "75.0%")
+}
+
+func TestStatsWriterSkipsEmptyStats(t *testing.T) {
+	stats := &Stats{}
+	stats.add("dir")
+	c := &statsWriter{Cache: &noopCache{}, stats: stats}
+	c.Shutdown()
+	assert.False(t, core.PathExists(StatsFile))
+}
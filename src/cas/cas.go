@@ -0,0 +1,147 @@
+// Package cas implements browsing and fetching the outputs of remotely built targets
+// directly from the remote CAS, without downloading all of them.
+package cas
+
+import (
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"github.com/thought-machine/please/src/core"
+	remotefs "github.com/thought-machine/please/src/remote/fs"
+)
+
+// List writes a listing of the given path within the filesystem to w, one entry per line along
+// with its digest. If the path is a directory its immediate contents are listed.
+func List(w io.Writer, fsys iofs.FS, name string) error {
+	name = clean(name)
+	info, err := iofs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	if !info.IsDir() {
+		return listEntry(tw, fsys, name, info)
+	}
+	entries, err := iofs.ReadDir(fsys, name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		} else if err := listEntry(tw, fsys, path.Join(name, entry.Name()), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listEntry(w io.Writer, fsys iofs.FS, name string, info iofs.FileInfo) error {
+	file, dir, link, err := remotefs.FindNode(fsys, name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case file != nil:
+		_, err = fmt.Fprintf(w, "%s\t%s\t%s\n", formatDigest(file.Digest), info.Mode(), info.Name())
+	case dir != nil:
+		_, err = fmt.Fprintf(w, "%s\t%s\t%s/\n", formatDigest(dir.Digest), info.Mode(), info.Name())
+	default:
+		_, err = fmt.Fprintf(w, "%s\t%s\t%s -> %s\n", "-", info.Mode(), info.Name(), link.Target)
+	}
+	return err
+}
+
+// formatDigest formats a digest in the usual hash/size form.
+func formatDigest(digest *pb.Digest) string {
+	return fmt.Sprintf("%s/%d", digest.Hash, digest.SizeBytes)
+}
+
+// Cat writes the contents of the given file to w.
+func Cat(w io.Writer, fsys iofs.FS, name string) error {
+	f, err := fsys.Open(clean(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Get downloads the given file or directory into the given output directory.
+func Get(fsys iofs.FS, name, out string) error {
+	name = clean(name)
+	base := path.Base(name)
+	if name == "." {
+		base = "."
+	}
+	return iofs.WalkDir(fsys, name, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(name, p)
+		dest := filepath.Join(out, base, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dest, core.DirPermissions)
+		case d.Type()&iofs.ModeSymlink != 0:
+			_, _, link, err := remotefs.FindNode(fsys, p)
+			if err != nil {
+				return err
+			} else if err := os.MkdirAll(filepath.Dir(dest), core.DirPermissions); err != nil {
+				return err
+			}
+			return os.Symlink(link.Target, dest)
+		default:
+			return writeFile(fsys, p, dest, info)
+		}
+	})
+}
+
+func writeFile(fsys iofs.FS, name, dest string, info iofs.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(dest), core.DirPermissions); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if file, _, _, err := remotefs.FindNode(fsys, name); err == nil && file.IsExecutable || info.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	src, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, src)
+	return err
+}
+
+// clean returns a cleaned version of the given path, with an empty path referring to the root.
+func clean(name string) string {
+	if name == "" {
+		return "."
+	}
+	return path.Clean(name)
+}
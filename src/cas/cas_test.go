@@ -0,0 +1,126 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	remotefs "github.com/thought-machine/please/src/remote/fs"
+)
+
+type fakeClient map[digest.Digest][]byte
+
+func (f fakeClient) ReadBlob(_ context.Context, d digest.Digest) ([]byte, *client.MovedBytesMetadata, error) {
+	return f[d], nil, nil
+}
+
+// newFS returns a filesystem with the following structure:
+// . (root)
+// |- out.txt
+// |- tool (executable)
+// |- dir
+//
+//	|- nested.txt
+//	|- link (a symlink to ../out.txt)
+func newFS(t *testing.T) *remotefs.CASFileSystem {
+	t.Helper()
+	c := fakeClient{}
+	blob := func(contents string) *pb.Digest {
+		d := digest.NewFromBlob([]byte(contents))
+		c[d] = []byte(contents)
+		return d.ToProto()
+	}
+	dir := &pb.Directory{
+		Files:    []*pb.FileNode{{Name: "nested.txt", Digest: blob("nested")}},
+		Symlinks: []*pb.SymlinkNode{{Name: "link", Target: "../out.txt"}},
+	}
+	dirDigest, err := digest.NewFromMessage(dir)
+	require.NoError(t, err)
+	tree := &pb.Tree{
+		Root: &pb.Directory{
+			Files: []*pb.FileNode{
+				{Name: "out.txt", Digest: blob("out")},
+				{Name: "tool", Digest: blob("#!/bin/sh"), IsExecutable: true},
+			},
+			Directories: []*pb.DirectoryNode{{Name: "dir", Digest: dirDigest.ToProto()}},
+		},
+		Children: []*pb.Directory{dir},
+	}
+	return remotefs.New(c, tree, ".")
+}
+
+func TestList(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, List(&buf, newFS(t), ""))
+	out := buf.String()
+	assert.Contains(t, out, digest.NewFromBlob([]byte("out")).String())
+	assert.Contains(t, out, "out.txt\n")
+	assert.Contains(t, out, "dir/\n")
+	assert.Contains(t, out, "tool\n")
+
+	buf.Reset()
+	require.NoError(t, List(&buf, newFS(t), "dir"))
+	out = buf.String()
+	assert.Contains(t, out, digest.NewFromBlob([]byte("nested")).String())
+	assert.Contains(t, out, "link -> ../out.txt\n")
+
+	buf.Reset()
+	require.NoError(t, List(&buf, newFS(t), "dir/nested.txt"))
+	assert.Contains(t, buf.String(), "nested.txt\n")
+
+	assert.Error(t, List(&buf, newFS(t), "missing.txt"))
+}
+
+func TestCat(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Cat(&buf, newFS(t), "dir/nested.txt"))
+	assert.Equal(t, "nested", buf.String())
+
+	buf.Reset()
+	require.NoError(t, Cat(&buf, newFS(t), "dir/link"))
+	assert.Equal(t, "out", buf.String())
+
+	assert.Error(t, Cat(&buf, newFS(t), "dir"))
+	assert.Error(t, Cat(&buf, newFS(t), "missing.txt"))
+}
+
+func TestGetFile(t *testing.T) {
+	out := t.TempDir()
+	require.NoError(t, Get(newFS(t), "tool", out))
+	b, err := os.ReadFile(filepath.Join(out, "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh", string(b))
+	info, err := os.Stat(filepath.Join(out, "tool"))
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&0100)
+}
+
+func TestGetDir(t *testing.T) {
+	out := t.TempDir()
+	require.NoError(t, Get(newFS(t), "dir", out))
+	b, err := os.ReadFile(filepath.Join(out, "dir/nested.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "nested", string(b))
+	link, err := os.Readlink(filepath.Join(out, "dir/link"))
+	require.NoError(t, err)
+	assert.Equal(t, "../out.txt", link)
+	_, err = os.Stat(filepath.Join(out, "out.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetAll(t *testing.T) {
+	out := t.TempDir()
+	require.NoError(t, Get(newFS(t), "", out))
+	for _, name := range []string{"out.txt", "tool", "dir/nested.txt"} {
+		_, err := os.Stat(filepath.Join(out, name))
+		assert.NoError(t, err, name)
+	}
+}
@@ -46,7 +46,7 @@ func TargetEnvironment(state *BuildState, target *BuildTarget) BuildEnv {
 	env["PKG"] = target.Label.PackageName
 	env["PKG_DIR"] = target.PackageDir()
 	env["NAME"] = target.Label.Name
-	if state.Config.Remote.URL == "" || target.Local {
+	if state.Config.Remote.URL == "" || state.Config.Remote.CacheOnly || target.Local {
 		// Expose the requested build config, but it is not available for remote execution.
 		// TODO(peterebden): Investigate removing these env vars completely.
 		env["BUILD_CONFIG"] = state.Config.Build.Config
@@ -275,6 +275,12 @@ func ParseBuildLabels(targets []string) []BuildLabel {
 	return ret
 }
 
+// ParseMaybeRelativeBuildLabel parses a single build label as given on the command line, which may be
+// relative to the current directory.
+func ParseMaybeRelativeBuildLabel(target string) (BuildLabel, error) {
+	return parseMaybeRelativeBuildLabel(target, "")
+}
+
 // IsAllSubpackages returns true if the label ends in ..., ie. it includes all subpackages.
 func (label BuildLabel) IsAllSubpackages() bool {
 	return label.Name == "..."
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -168,6 +169,10 @@ type BuildTarget struct {
 	Requires []string
 	// Dependent rules this rule provides for each language. Matches up to Requires as described above.
 	Provides map[string][]BuildLabel
+	// Structured values attached to this rule by name, which dependents can read while parsing or
+	// in pre/post-build functions. Other packages can read these while this one is still being
+	// parsed, so use AddProvider, Provider and AllProviders rather than accessing it directly.
+	Providers map[string]Provider
 	// Stores the hash of this build rule before any post-build function is run.
 	RuleHash []byte `name:"exported_deps"` // bit of a hack to call this exported_deps...
 	// Tools that this rule will use, ie. other rules that it may use at build time which are not
@@ -201,6 +206,14 @@ type BuildTarget struct {
 	// If true, the target is needed for a subinclude and therefore we will have to make sure its
 	// outputs are available locally when built.
 	neededForSubinclude atomic.Bool `print:"false"`
+	// If true, this target has been scheduled to be built locally even though it could be built remotely.
+	runLocally atomic.Bool `print:"false"`
+	// The number of times a remote action for this target has been retried after a transient failure.
+	remoteRetries atomic.Int32 `print:"false"`
+	// The resources used by the most recent local action for this target, if they were measured.
+	resourceUsage atomic.Pointer[ResourceUsage] `print:"false"`
+	// How the files read by the most recent local build action for this target compare to its declared inputs, if audited.
+	inputAudit atomic.Pointer[InputAudit] `print:"false"`
 	// The number of completed runs
 	completedRuns uint16 `print:"false"`
 	// True if this target is a binary (ie. runnable, will appear in plz-out/bin)
@@ -237,6 +250,10 @@ type BuildTarget struct {
 	IsTextFile bool `print:"false"`
 	// Marks that the target was added in a post-build function.
 	AddedPostBuild bool `print:"false"`
+	// The name of the function called in the BUILD file that created this target (e.g. go_library).
+	Kind string `print:"false"`
+	// The CPU and memory that the target's build action needs. Used to schedule it locally and remotely.
+	Resources ResourceRequests `print:"false"`
 	// If true, the interactive progress display will try to infer the target's progress
 	// via some heuristics on its output.
 	showProgress atomic.Bool `name:"progress"`
@@ -267,11 +284,25 @@ type BuildMetadata struct {
 	Test bool
 	// True if the results were retrieved from a cache, false if we ran the full build action.
 	Cached bool
+	// Breakdown of the inputs to the target's hash when it was built.
+	Hashes *HashBreakdown
+	// Reasons the target was rebuilt, compared to the previous time it was built.
+	RebuildReasons []string
+	// Resources used by the build action, if it ran locally in a cgroup.
+	ResourceUsage *ResourceUsage
 	// VersionTag is an integer representing the version of this cache object. If this doesn't match the
 	// expected version above, Please will not use this cached metadata.
 	VersionTag int
 }
 
+// An InputAudit compares the files that a target's build action actually read with the inputs it declared.
+type InputAudit struct {
+	// Files in the repo that the action read without having declared them, relative to the repo root.
+	Undeclared []string
+	// Declared sources, dependencies and tools that the action didn't read anything from.
+	Unused []BuildInput
+}
+
 // A PreBuildFunction is a type that allows hooking a pre-build callback.
 type PreBuildFunction interface {
 	fmt.Stringer
@@ -279,6 +310,13 @@ type PreBuildFunction interface {
 	Call(target *BuildTarget) error
 }
 
+// A Provider is a structured value that a build rule attaches to a target. Its contents are only
+// meaningful to the BUILD language.
+type Provider interface {
+	fmt.Stringer
+	json.Marshaler
+}
+
 // A PostBuildFunction is a type that allows hooking a post-build callback.
 type PostBuildFunction interface {
 	fmt.Stringer
@@ -438,6 +476,51 @@ func (target *BuildTarget) TestDirs() string {
 	return filepath.Join(TmpDir, target.Label.Subrepo, target.Label.PackageName, target.Label.Name+testDirSuffix)
 }
 
+// RunLocally marks this target to be built locally, even though it's capable of being built remotely.
+func (target *BuildTarget) RunLocally() {
+	target.runLocally.Store(true)
+}
+
+// RunsLocally returns true if this target is built locally, either because it has to be or because
+// it has been scheduled to be.
+func (target *BuildTarget) RunsLocally() bool {
+	return target.Local || target.runLocally.Load()
+}
+
+// AddRemoteRetry records that a remote action for this target was retried.
+func (target *BuildTarget) AddRemoteRetry() {
+	target.remoteRetries.Add(1)
+}
+
+// RemoteRetries returns the number of times remote actions for this target have been retried.
+func (target *BuildTarget) RemoteRetries() int {
+	return int(target.remoteRetries.Load())
+}
+
+// SetResourceUsage records the resources used by a local action for this target. Nil is ignored.
+func (target *BuildTarget) SetResourceUsage(usage *ResourceUsage) {
+	if usage != nil {
+		target.resourceUsage.Store(usage)
+	}
+}
+
+// ResourceUsage returns the resources used by the most recent local action for this target,
+// or nil if they weren't measured.
+func (target *BuildTarget) ResourceUsage() *ResourceUsage {
+	return target.resourceUsage.Load()
+}
+
+// SetInputAudit records the audit of the inputs of this target's build action.
+func (target *BuildTarget) SetInputAudit(audit *InputAudit) {
+	target.inputAudit.Store(audit)
+}
+
+// InputAudit returns the audit of the inputs of this target's most recent local build action,
+// or nil if it wasn't audited.
+func (target *BuildTarget) InputAudit() *InputAudit {
+	return target.inputAudit.Load()
+}
+
 // IsTest returns whether or not the target is a test target i.e. has its Test field populated
 func (target *BuildTarget) IsTest() bool {
 	return target.Test != nil
@@ -1193,6 +1276,36 @@ func (target *BuildTarget) AddProvide(language string, labels []BuildLabel) {
 	}
 }
 
+// AddProvider attaches a provider to this target under the given name, replacing any existing one.
+func (target *BuildTarget) AddProvider(name string, provider Provider) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	if target.Providers == nil {
+		target.Providers = map[string]Provider{name: provider}
+	} else {
+		target.Providers[name] = provider
+	}
+}
+
+// Provider returns the provider attached to this target under the given name, if there is one.
+func (target *BuildTarget) Provider(name string) (Provider, bool) {
+	target.mutex.RLock()
+	defer target.mutex.RUnlock()
+	provider, present := target.Providers[name]
+	return provider, present
+}
+
+// AllProviders returns a copy of all the providers attached to this target.
+func (target *BuildTarget) AllProviders() map[string]Provider {
+	target.mutex.RLock()
+	defer target.mutex.RUnlock()
+	ret := make(map[string]Provider, len(target.Providers))
+	for name, provider := range target.Providers {
+		ret[name] = provider
+	}
+	return ret
+}
+
 // ProvideFor returns the build label that we'd provide for the given target.
 func (target *BuildTarget) ProvideFor(other *BuildTarget) []BuildLabel {
 	if p, ok := target.provideFor(other); ok {
@@ -4,6 +4,7 @@ package core
 import (
 	"fmt"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -997,6 +998,34 @@ func makeFilegroup(label, visibility string, deps ...*BuildTarget) *BuildTarget
 	return target
 }
 
+type testProvider string
+
+func (p testProvider) String() string               { return string(p) }
+func (p testProvider) MarshalJSON() ([]byte, error) { return []byte(`"` + p + `"`), nil }
+
+func TestProvidersConcurrently(t *testing.T) {
+	target := makeTarget1("//src/core:target1", "PUBLIC")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		name := fmt.Sprintf("p%d", i)
+		go func() {
+			defer wg.Done()
+			target.AddProvider(name, testProvider(name))
+		}()
+		go func() {
+			defer wg.Done()
+			target.Provider(name)
+			target.AllProviders()
+		}()
+	}
+	wg.Wait()
+	p, present := target.Provider("p3")
+	assert.True(t, present)
+	assert.Equal(t, "p3", p.String())
+	assert.Equal(t, 10, len(target.AllProviders()))
+}
+
 func addFilegroupSource(target *BuildTarget, source string) {
 	target.AddSource(FileLabel{Package: target.Label.PackageName, File: source})
 }
@@ -297,6 +297,7 @@ func ReadConfigFiles(fs iofs.FS, filenames []string, profiles []string) (*Config
 	return config, config.ApplyOverrides(map[string]string{
 		"build.hashfunction": config.Build.HashFunction,
 		"build.hashcheckers": strings.Join(config.Build.HashCheckers, ","),
+		"cache.compression":  config.Cache.Compression,
 	})
 }
 
@@ -391,6 +392,7 @@ func DefaultConfiguration() *Configuration {
 	config.Cache.HTTPTimeout = cli.Duration(25 * time.Second)
 	config.Cache.HTTPConcurrentRequestLimit = 20
 	config.Cache.HTTPRetry = 4
+	config.Cache.Compression = "gzip"
 	if dir, err := os.UserCacheDir(); err == nil {
 		config.Cache.Dir = filepath.Join(dir, "please")
 	}
@@ -399,6 +401,7 @@ func DefaultConfiguration() *Configuration {
 	config.Cache.DirClean = true
 	config.Cache.Workers = runtime.NumCPU() + 2 // Mirrors the number of workers in please.go.
 	config.Test.Timeout = cli.Duration(10 * time.Minute)
+	config.Test.QuarantineRetries = 3
 	config.Display.SystemStats = true
 	config.Display.MaxWorkers = 40
 	config.Display.ColourScheme = "dark"
@@ -408,6 +411,10 @@ func DefaultConfiguration() *Configuration {
 	config.Remote.UploadDirs = true
 	config.Remote.CacheDuration = cli.Duration(10000 * 24 * time.Hour) // Effectively forever.
 	config.Remote.Shell = "bash"
+	config.Remote.MaxRetries = 3
+	config.Remote.RetryOn = []string{"UNAVAILABLE", "RESOURCE_EXHAUSTED", "ABORTED"}
+	config.Remote.RetryBackoff = cli.Duration(time.Second)
+	config.Remote.MaxRetryBackoff = cli.Duration(30 * time.Second)
 	config.Go.GoTool = "go"
 	config.Go.CgoCCTool = "gcc"
 	config.Go.DelveTool = "dlv"
@@ -455,6 +462,7 @@ func DefaultConfiguration() *Configuration {
 	config.Bazel.Compatibility = usingBazelWorkspace
 
 	config.Sandbox.Tool = "please_sandbox"
+	config.Sandbox.SystemPath = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc", "/dev"}
 	// Please tools
 	config.Go.FilterTool = "/////_please:please_go_filter"
 	config.Go.PleaseGoTool = "/////_please:please_go"
@@ -496,6 +504,7 @@ type Configuration struct {
 		BuildDefsDir       []string     `help:"Directory to look in when prompted for help topics that aren't known internally." example:"build_defs"`
 		NumThreads         int          `help:"Number of parallel parse operations to run.\nIs overridden by the --num_threads command line flag." example:"6"`
 		GitFunctions       bool         `help:"Activates built-in functions git_branch, git_commit, git_show and git_state. If disabled they will not be usable at parse time."`
+		Cache              bool         `help:"Persists the targets that result from parsing each package in plz-out/parse, so packages whose BUILD file, subincludes, globs and config haven't changed can be loaded without being interpreted again. Entries that haven't been used for a week are removed.\nPackages that call git functions, define subrepos or have pre- or post-build functions are never cached."`
 	} `help:"The [parse] section in the config contains settings specific to parsing files."`
 	Display struct {
 		UpdateTitle  bool   `help:"Updates the title bar of the shell window Please is running in as the build progresses. This isn't on by default because not everyone's shell is configured to reset it again after and we don't want to alter it forever."`
@@ -524,6 +533,8 @@ type Configuration struct {
 		UpdateGitignore      bool         `help:"Whether to automatically update the nearest gitignore with generated sources"`
 		ParallelDownloads    int          `help:"Max number of remote_file downloads to run in parallel."`
 		ArcatTool            string       `help:"Defines the tool used to concatenate files which we use in various build rules. Defaults to Arcat." var:"ARCAT_TOOL"`
+		LocalCPUs            int          `help:"Number of CPUs that build actions running locally can use between them. Targets that declare resources = {'cpu': n} only start once that many are free. Defaults to the number of CPUs on the machine."`
+		LocalMemory          cli.ByteSize `help:"Amount of memory that build actions running locally can use between them. Targets that declare resources = {'mem': '8G'} only start once that much is free. Defaults to the total memory of the machine."`
 	} `help:"A config section describing general settings related to building targets in Please.\nSince Please is by nature about building things, this only has the most generic properties; most of the more esoteric properties are configured in their own sections."`
 	BuildConfig map[string]string `help:"A section of arbitrary key-value properties that are made available in the BUILD language. These are often useful for writing custom rules that need some configurable property.\n\n[buildconfig]\nandroid-tools-version = 23.0.2\n\nFor example, the above can be accessed as CONFIG.ANDROID_TOOLS_VERSION."`
 	BuildEnv    map[string]string `help:"A set of extra environment variables to define for build rules. For example:\n\n[buildenv]\nsecret-passphrase = 12345\n\nThis would become SECRET_PASSPHRASE for any rules. These can be useful for passing secrets into custom rules; any variables containing SECRET or PASSWORD won't be logged.\n\nIt's also useful if you'd like internal tools to honour some external variable."`
@@ -534,11 +545,15 @@ type Configuration struct {
 		DirCacheLowWaterMark       cli.ByteSize `help:"When cleaning the directory cache, it's reduced to at most this size."`
 		DirClean                   bool         `help:"Controls whether entries in the dir cache are cleaned or not. If disabled the cache will only grow."`
 		DirCompress                bool         `help:"Compresses stored artifacts in the dir cache. They are slower to store & retrieve but more compact."`
+		Compression                string       `help:"The compression codec for artifacts stored in the HTTP cache, and in the dir cache when DirCompress is set. One of gzip (the default), zstd or none.\nEntries stored with any codec can always be retrieved, so this can be changed without invalidating existing caches." options:"gzip,zstd,none"`
+		CompressionLevel           int          `help:"The compression level to use. For gzip this is from 1 to 9, for zstd from 1 to 22 (higher levels are mapped onto the closest level the encoder supports). Zero uses the codec's default."`
+		DirCAS                     bool         `help:"Stores artifacts in the dir cache by content digest, so identical files produced by different targets are only stored once. Each entry becomes a small manifest referencing the stored blobs, which are linked back into plz-out on retrieval and cleaned individually. Takes precedence over DirCompress."`
 		HTTPURL                    cli.URL      `help:"Base URL of the HTTP cache.\nNot set to anything by default which means the cache will be disabled."`
 		HTTPWriteable              bool         `help:"If True this plz instance will write content back to the HTTP cache.\nBy default it runs in read-only mode."`
 		HTTPTimeout                cli.Duration `help:"Timeout for operations contacting the HTTP cache, in seconds."`
 		HTTPConcurrentRequestLimit int          `help:"The maximum amount of concurrent requests that can be open. Default 20."`
 		HTTPRetry                  int          `help:"The maximum number of retries before a request will give up, if a request is retryable"`
+		HTTPTokenFile              string       `help:"A file containing a token that is sent as a bearer token with every request to the HTTP cache, for servers that require authentication."`
 		StoreCommand               string       `help:"Use a custom command to store cache entries."`
 		RetrieveCommand            string       `help:"Use a custom command to retrieve cache entries."`
 	} `help:"Please has several built-in caches that can be configured in its config file.\n\nThe simplest one is the directory cache which by default is written into the .plz-cache directory. This allows for fast retrieval of code that has been built before (for example, when swapping Git branches).\n\nThere is also a remote RPC cache which allows using a centralised server to store artifacts. A typical pattern here is to have your CI system write artifacts into it and give developers read-only access so they can reuse its work.\n\nFinally there's a HTTP cache which is very similar, but a little obsolete now since the RPC cache outperforms it and has some extra features. Otherwise the two have similar semantics and share quite a bit of implementation.\n\nPlease has server implementations for both the RPC and HTTP caches."`
@@ -548,6 +563,8 @@ type Configuration struct {
 		Upload                   cli.URL      `help:"URL to upload test results to (in XML format)"`
 		UploadGzipped            bool         `help:"True to upload the test results gzipped."`
 		StoreTestOutputOnSuccess bool         `help:"True to store stdout and stderr in the test results for successful tests."`
+		Quarantine               []string     `help:"Tests that are known to be flaky. They are retried, and if they still fail they don't cause plz test to fail.\nEach entry is either a test target, or a test target followed by a colon and the name of one of its test cases.\nplz test flaky_report --quarantine prints a list of these based on the flakes that have been seen recently." example:"//src/core:core_test:TestSomething"`
+		QuarantineRetries        int          `help:"Number of times to run quarantined tests before giving up on them. Defaults to 3."`
 	} `help:"A config section describing settings related to testing in general."`
 	Sandbox struct {
 		Tool               string       `help:"The location of the tool to use for sandboxing. This can assume it is being run in a new network, user, and mount namespace on linux. If not set, Please will use 'plz sandbox'."`
@@ -556,24 +573,43 @@ type Configuration struct {
 		Build              bool         `help:"True to sandbox individual build actions, which isolates them from network access and some aspects of the filesystem. Currently only works on Linux." var:"BUILD_SANDBOX"`
 		Test               bool         `help:"True to sandbox individual tests, which isolates them from network access, IPC and some aspects of the filesystem. Currently only works on Linux." var:"TEST_SANDBOX"`
 		ExcludeableTargets []BuildLabel `help:"If set, only targets that match these wildcards will be allowed to opt out of the sandbox"`
+		Strict             bool         `help:"True to run sandboxed actions in a strict sandbox, where the only parts of the filesystem they can see are their own temporary directory, their tools and the paths in SystemPath. Only the built-in sandbox supports this, so Tool must also be set to an empty string; Please warns and runs actions in the normal sandbox otherwise."`
+		SystemPath         []string     `help:"Paths from the host that are made available (read-only) to actions in the strict sandbox. Defaults to the usual locations of system binaries, libraries and configuration."`
 	} `help:"A config section describing settings relating to sandboxing of build actions."`
+	Cgroup struct {
+		Enabled     bool         `help:"True to run each local build and test action in its own cgroup. This enforces the limits below and any memory that the target requests via its resources argument, gives actions that request more CPUs a proportionally larger share of CPU time, records the peak memory and CPU time used by each action, and ensures that every process an action starts is killed when it finishes. Requires Linux with cgroup v2; if they can't be used, Please warns and runs actions without them."`
+		Root        string       `help:"Path of the cgroup (relative to /sys/fs/cgroup) to create the cgroups for each action in. It must be delegated to the user running Please (e.g. by running it under systemd-run --user --scope -p Delegate=yes) and not contain any other processes. Defaults to the cgroup that Please is running in; in that case Please moves itself into a child cgroup named plz for the rest of its run (it can't move back once it has enabled controllers for its actions' cgroups) and leaves that behind for later invocations to reuse. That fails if anything else is running in the same cgroup (e.g. the shell that started Please), so it's usually best to set this to a dedicated cgroup."`
+		CPULimit    int          `help:"Maximum number of CPUs' worth of time that each action can use. Requesting CPUs via the resources argument doesn't raise this. Defaults to unlimited."`
+		MemoryLimit cli.ByteSize `help:"Memory limit for each action that doesn't request an amount itself. Defaults to unlimited."`
+		PidsLimit   int          `help:"Maximum number of processes that each action can have running at once. Defaults to unlimited."`
+	} `help:"A config section describing settings relating to confining individual build and test actions in cgroups."`
 	Remote struct {
-		URL           string       `help:"URL for the remote server."`
-		CASURL        string       `help:"URL for the CAS service, if it is different to the main one."`
-		AssetURL      string       `help:"URL for the remote asset server, if it is different to the main one."`
-		NumExecutors  int          `help:"Maximum number of remote executors to use simultaneously."`
-		Instance      string       `help:"Remote instance name to request; depending on the server this may be required."`
-		Name          string       `help:"A name for this worker instance. This is attached to artifacts uploaded to remote storage." example:"agent-001"`
-		DisplayURL    string       `help:"A URL to browse the remote server with (e.g. using buildbarn-browser). Only used when printing hashes."`
-		TokenFile     string       `help:"A file containing a token that is attached to outgoing RPCs to authenticate them. This is somewhat bespoke; we are still investigating further options for authentication."`
-		Timeout       cli.Duration `help:"Timeout for connections made to the remote server."`
-		Secure        bool         `help:"Whether to use TLS for communication or not."`
-		VerifyOutputs bool         `help:"Whether to verify all outputs are present after a cached remote execution action. Depending on your server implementation, you may require this to ensure files are really present."`
-		UploadDirs    bool         `help:"Uploads individual directory blobs after build actions. This might not be necessary with some servers, but if you aren't sure, you should leave it on."`
-		Shell         string       `help:"Path to the shell to use to execute actions in. Default is 'bash' which will be looked up by the server."`
-		Platform      []string     `help:"Platform properties to request from remote workers, in the format key=value."`
-		CacheDuration cli.Duration `help:"Length of time before we re-check locally cached build actions. Default is unlimited."`
-		BuildID       string       `help:"ID of the build action that's being run, to attach to remote requests. If not set then one is automatically generated."`
+		URL                    string       `help:"URL for the remote server."`
+		CASURL                 string       `help:"URL for the CAS service, if it is different to the main one."`
+		AssetURL               string       `help:"URL for the remote asset server, if it is different to the main one."`
+		NumExecutors           int          `help:"Maximum number of remote executors to use simultaneously."`
+		Instance               string       `help:"Remote instance name to request; depending on the server this may be required."`
+		Name                   string       `help:"A name for this worker instance. This is attached to artifacts uploaded to remote storage." example:"agent-001"`
+		DisplayURL             string       `help:"A URL to browse the remote server with (e.g. using buildbarn-browser). Only used when printing hashes."`
+		TokenFile              string       `help:"A file containing a token that is attached to outgoing RPCs to authenticate them. This is somewhat bespoke; we are still investigating further options for authentication."`
+		Timeout                cli.Duration `help:"Timeout for connections made to the remote server."`
+		Secure                 bool         `help:"Whether to use TLS for communication or not."`
+		VerifyOutputs          bool         `help:"Whether to verify all outputs are present after a cached remote execution action. Depending on your server implementation, you may require this to ensure files are really present."`
+		UploadDirs             bool         `help:"Uploads individual directory blobs after build actions. This might not be necessary with some servers, but if you aren't sure, you should leave it on."`
+		Shell                  string       `help:"Path to the shell to use to execute actions in. Default is 'bash' which will be looked up by the server."`
+		Platform               []string     `help:"Platform properties to request from remote workers, in the format key=value."`
+		CacheDuration          cli.Duration `help:"Length of time before we re-check locally cached build actions. Default is unlimited."`
+		BuildID                string       `help:"ID of the build action that's being run, to attach to remote requests. If not set then one is automatically generated."`
+		CacheOnly              bool         `help:"Only uses the remote server as a cache; targets are built locally but their outputs are looked up in and uploaded to its action cache & CAS. This is useful if you have access to a shared cache but not to any executors."`
+		LocalFallback          bool         `help:"Builds targets locally if the remote server is unavailable or doesn't have capacity to build them (i.e. it responds with UNAVAILABLE or RESOURCE_EXHAUSTED)."`
+		RaceMaxInputs          int          `help:"Actions with at most this many direct sources & dependencies are raced between local & remote execution, running on whichever has a free slot first. Defaults to 0, in which case only targets labelled remote:race are raced."`
+		MaxRetries             int          `help:"Maximum number of times to retry a remote action that fails due to a transient infrastructure error (see RetryOn). Defaults to 3; set to 0 to disable retries. Errors that make a target fall back to building locally (see LocalFallback) aren't retried."`
+		RetryOn                []string     `help:"gRPC status codes that are considered transient infrastructure failures and cause a remote action to be retried. Defaults to UNAVAILABLE, RESOURCE_EXHAUSTED and ABORTED." example:"UNAVAILABLE"`
+		RetryBackoff           cli.Duration `help:"Initial delay before retrying a remote action. This doubles on each subsequent attempt, with some random jitter applied."`
+		MaxRetryBackoff        cli.Duration `help:"Maximum delay between retries of a remote action."`
+		QueueTimeout           cli.Duration `help:"Maximum length of time to wait for a remote action beyond the target's own build or test timeout, for example while it is queued on the server. If this elapses the action fails as an infrastructure failure. Individual targets can override it with a label like remote-queue-timeout:10m. Defaults to unlimited."`
+		CPUPlatformProperty    string       `help:"Name of a platform property to set to the number of CPUs that a target requests via its resources argument, so the server can schedule it on a suitable worker. If unset, CPU requests aren't sent to the server."`
+		MemoryPlatformProperty string       `help:"Name of a platform property to set to the amount of memory, in bytes, that a target requests via its resources argument. If unset, memory requests aren't sent to the server."`
 	} `help:"Settings related to remote execution & caching using the Google remote execution APIs. This section is still experimental and subject to change."`
 	Size  map[string]*Size `help:"Named sizes of targets; these are the definitions of what can be passed to the 'size' argument."`
 	Cover struct {
@@ -1078,19 +1114,25 @@ func (config *Configuration) IsABuildFile(name string) bool {
 
 // NumRemoteExecutors returns the number of actual remote executors we'll have
 func (config *Configuration) NumRemoteExecutors() int {
-	if config.Remote.URL == "" {
+	if config.Remote.URL == "" || config.Remote.CacheOnly {
 		return 0
 	}
 	return config.Remote.NumExecutors
 }
 
 func (config *Configuration) IsRemoteExecution() bool {
-	if config.Remote.URL == "" {
+	if config.Remote.URL == "" || config.Remote.CacheOnly {
 		return false
 	}
 	return config.Remote.NumExecutors > 0
 }
 
+// StrictSandbox returns true if sandboxed actions run in the strict sandbox.
+// Only the built-in sandbox supports it, so it has no effect if a sandbox tool is set.
+func (config *Configuration) StrictSandbox() bool {
+	return config.Sandbox.Strict && config.Sandbox.Tool == ""
+}
+
 func (config *Configuration) ShouldLinkGeneratedSources() bool {
 	isTruthy, _ := gcfgtypes.ParseBool(config.Build.LinkGeneratedSources)
 	return config.Build.LinkGeneratedSources == "hard" || config.Build.LinkGeneratedSources == "soft" || isTruthy
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sort"
+)
+
+// A HashBreakdown records the individual inputs that make up the hash of a target.
+// It's stored in the build metadata so we can later explain exactly which of them changed
+// when a target gets rebuilt.
+type HashBreakdown struct {
+	// Hash of the general config.
+	Config []byte
+	// The build nonce from the config, which is one part of the config hash that's useful to call out.
+	Nonce string
+	// Hash of the rule definition as a whole.
+	Rule []byte
+	// The command that was run.
+	Command string
+	// Environment variables explicitly set on the rule, or passed through to it.
+	// Values of passed-through variables are hashed since they may be sensitive.
+	Env map[string]string
+	// Declared dependencies of the rule.
+	Deps []string
+	// Hashes of each of the rule's sources, keyed by path.
+	Sources map[string][]byte
+	// Hashes of each of the rule's tools, keyed by path.
+	Tools map[string][]byte
+	// Hash of any secrets. The secrets themselves are never recorded.
+	Secret []byte
+}
+
+// Diff returns a human-readable description of each difference between this breakdown and
+// a later one. It returns an empty slice if the two are identical.
+func (hb *HashBreakdown) Diff(next *HashBreakdown) []string {
+	var diffs []string
+	if !bytes.Equal(hb.Config, next.Config) {
+		if hb.Nonce != next.Nonce {
+			diffs = append(diffs, fmt.Sprintf("config nonce changed from %q to %q", hb.Nonce, next.Nonce))
+		} else {
+			diffs = append(diffs, "config changed")
+		}
+	}
+	if hb.Command != next.Command {
+		diffs = append(diffs, fmt.Sprintf("command changed from %q to %q", hb.Command, next.Command))
+	}
+	diffs = append(diffs, diffStrings("env var", hb.Env, next.Env)...)
+	diffs = append(diffs, diffStrings("dependency", setOf(hb.Deps), setOf(next.Deps))...)
+	diffs = append(diffs, diffHashes("source", hb.Sources, next.Sources)...)
+	diffs = append(diffs, diffHashes("tool", hb.Tools, next.Tools)...)
+	if !bytes.Equal(hb.Secret, next.Secret) {
+		diffs = append(diffs, "secrets changed")
+	}
+	if len(diffs) == 0 && !bytes.Equal(hb.Rule, next.Rule) {
+		// Something changed that we don't break down individually (e.g. labels, visibility, outputs)
+		diffs = append(diffs, "rule definition changed")
+	}
+	return diffs
+}
+
+func diffStrings(kind string, before, after map[string]string) []string {
+	var diffs []string
+	for _, k := range sortedKeys(before, after) {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		if !inAfter {
+			diffs = append(diffs, fmt.Sprintf("%s %s was removed", kind, k))
+		} else if !inBefore {
+			diffs = append(diffs, fmt.Sprintf("%s %s was added", kind, k))
+		} else if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s %s changed from %q to %q", kind, k, b, a))
+		}
+	}
+	return diffs
+}
+
+func diffHashes(kind string, before, after map[string][]byte) []string {
+	var diffs []string
+	for _, k := range sortedKeys(before, after) {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		if !inAfter {
+			diffs = append(diffs, fmt.Sprintf("%s %s was removed", kind, k))
+		} else if !inBefore {
+			diffs = append(diffs, fmt.Sprintf("%s %s was added", kind, k))
+		} else if a == nil {
+			diffs = append(diffs, fmt.Sprintf("%s %s is missing", kind, k))
+		} else if !bytes.Equal(a, b) {
+			diffs = append(diffs, fmt.Sprintf("%s %s changed (%s -> %s)", kind, k, base64.RawStdEncoding.EncodeToString(b), base64.RawStdEncoding.EncodeToString(a)))
+		}
+	}
+	return diffs
+}
+
+func sortedKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, present := a[k]; !present {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func setOf(s []string) map[string]string {
+	m := make(map[string]string, len(s))
+	for _, x := range s {
+		m[x] = ""
+	}
+	return m
+}
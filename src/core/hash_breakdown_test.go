@@ -0,0 +1,66 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashBreakdownDiffIdentical(t *testing.T) {
+	hb := testHashBreakdown()
+	assert.Equal(t, 0, len(hb.Diff(testHashBreakdown())))
+}
+
+func TestHashBreakdownDiff(t *testing.T) {
+	before := testHashBreakdown()
+	after := testHashBreakdown()
+	after.Command = "cat $SRCS > $OUT"
+	after.Env["FOO"] = "baz"
+	after.Sources["src/a.txt"] = []byte{9, 9}
+	delete(after.Sources, "src/b.txt")
+	after.Tools["plz-out/bin/tool"] = nil
+	after.Deps = append(after.Deps, "//src:dep2")
+	assert.Equal(t, []string{
+		`command changed from "cp $SRCS $OUT" to "cat $SRCS > $OUT"`,
+		`env var FOO changed from "bar" to "baz"`,
+		"dependency //src:dep2 was added",
+		"source src/a.txt changed (AQI -> CQk)",
+		"source src/b.txt was removed",
+		"tool plz-out/bin/tool is missing",
+	}, before.Diff(after))
+}
+
+func TestHashBreakdownDiffConfig(t *testing.T) {
+	before := testHashBreakdown()
+	after := testHashBreakdown()
+	after.Config = []byte{4, 5, 6}
+	assert.Equal(t, []string{"config changed"}, before.Diff(after))
+	after.Nonce = "1403"
+	assert.Equal(t, []string{`config nonce changed from "1402" to "1403"`}, before.Diff(after))
+}
+
+func TestHashBreakdownDiffRuleOnly(t *testing.T) {
+	before := testHashBreakdown()
+	after := testHashBreakdown()
+	after.Rule = []byte{7, 8, 9}
+	assert.Equal(t, []string{"rule definition changed"}, before.Diff(after))
+}
+
+func testHashBreakdown() *HashBreakdown {
+	return &HashBreakdown{
+		Config:  []byte{1, 2, 3},
+		Nonce:   "1402",
+		Rule:    []byte{4, 5, 6},
+		Command: "cp $SRCS $OUT",
+		Env:     map[string]string{"FOO": "bar"},
+		Deps:    []string{"//src:dep1"},
+		Sources: map[string][]byte{
+			"src/a.txt": {1, 2},
+			"src/b.txt": {3, 4},
+		},
+		Tools: map[string][]byte{
+			"plz-out/bin/tool": {5, 6},
+		},
+		Secret: []byte{0},
+	}
+}
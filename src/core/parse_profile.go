@@ -0,0 +1,76 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A ParseProfile records how long the parser spends in each package, subinclude and function call.
+// Samples are aggregated by call stack so it can be turned into a pprof profile or a flame graph.
+type ParseProfile struct {
+	mutex   sync.Mutex
+	samples map[string]*ParseProfileSample
+}
+
+// A ParseProfileFrame is a single frame of a call stack in a ParseProfile.
+type ParseProfileFrame struct {
+	// The name of the frame, e.g. the function being called or the package being parsed.
+	Name string
+	// The file the frame's code is defined in.
+	Filename string
+}
+
+// A ParseProfileSample is the aggregated time spent in a single call stack.
+type ParseProfileSample struct {
+	// The call stack, outermost frame first.
+	Stack []ParseProfileFrame
+	// The number of times this call stack was seen.
+	Calls int64
+	// The total time spent in the innermost frame, excluding anything it called.
+	Self time.Duration
+}
+
+// NewParseProfile creates a new, empty ParseProfile.
+func NewParseProfile() *ParseProfile {
+	return &ParseProfile{samples: map[string]*ParseProfileSample{}}
+}
+
+// Add records a call to the innermost frame of the given stack, which took the given time
+// excluding the time spent in any frames it called.
+func (p *ParseProfile) Add(stack []ParseProfileFrame, self time.Duration) {
+	var sb strings.Builder
+	for _, frame := range stack {
+		sb.WriteString(frame.Filename)
+		sb.WriteByte(0)
+		sb.WriteString(frame.Name)
+		sb.WriteByte(0)
+	}
+	key := sb.String()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sample, present := p.samples[key]
+	if !present {
+		sample = &ParseProfileSample{Stack: stack}
+		p.samples[key] = sample
+	}
+	sample.Calls++
+	sample.Self += self
+}
+
+// Samples returns a copy of all the samples recorded so far, sorted by call stack.
+func (p *ParseProfile) Samples() []ParseProfileSample {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ret := make([]ParseProfileSample, len(keys))
+	for i, key := range keys {
+		ret[i] = *p.samples[key]
+	}
+	return ret
+}
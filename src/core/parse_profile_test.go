@@ -0,0 +1,29 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProfileAggregatesStacks(t *testing.T) {
+	p := NewParseProfile()
+	pkg := ParseProfileFrame{Name: "package //src/core:all", Filename: "src/core/BUILD"}
+	fn := ParseProfileFrame{Name: "go_library", Filename: "build_defs/go.build_defs"}
+	p.Add([]ParseProfileFrame{pkg}, time.Millisecond)
+	p.Add([]ParseProfileFrame{pkg, fn}, 2*time.Millisecond)
+	p.Add([]ParseProfileFrame{pkg, fn}, 3*time.Millisecond)
+	samples := p.Samples()
+	assert.Equal(t, []ParseProfileSample{
+		{Stack: []ParseProfileFrame{pkg}, Calls: 1, Self: time.Millisecond},
+		{Stack: []ParseProfileFrame{pkg, fn}, Calls: 2, Self: 5 * time.Millisecond},
+	}, samples)
+}
+
+func TestParseProfileDistinguishesFilenames(t *testing.T) {
+	p := NewParseProfile()
+	p.Add([]ParseProfileFrame{{Name: "f", Filename: "a.build_defs"}}, time.Millisecond)
+	p.Add([]ParseProfileFrame{{Name: "f", Filename: "b.build_defs"}}, time.Millisecond)
+	assert.Equal(t, 2, len(p.Samples()))
+}
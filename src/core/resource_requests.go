@@ -0,0 +1,75 @@
+package core
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/mem"
+
+	"github.com/thought-machine/please/src/process"
+)
+
+// ResourceRequests describes the resources that a target's build action needs while it runs.
+// A zero value for either means the target hasn't requested that resource.
+type ResourceRequests struct {
+	// The number of CPUs the action needs.
+	CPU int
+	// The amount of memory the action needs, in bytes.
+	Memory uint64
+}
+
+// IsZero returns true if no resources have been requested.
+func (r ResourceRequests) IsZero() bool {
+	return r.CPU == 0 && r.Memory == 0
+}
+
+// Limits returns the limits to apply to an action that makes these requests when it runs in a cgroup.
+// The memory it requests is a hard limit, but the CPUs only weight its share of CPU time; it's
+// not throttled to them.
+func (r ResourceRequests) Limits() process.Limits {
+	return process.Limits{CPURequest: r.CPU, Memory: r.Memory}
+}
+
+// ResourceUsage describes the resources that a single build or test action used, as measured by its cgroup.
+type ResourceUsage struct {
+	// The most memory used at once by the action and all its subprocesses, in bytes.
+	PeakMemory uint64
+	// The total CPU time used by the action and all its subprocesses.
+	CPUTime time.Duration
+}
+
+// Add combines this usage with another (which may be nil), e.g. for several runs of a test.
+// The peak memory is the larger of the two and CPU time is the total.
+func (u *ResourceUsage) Add(other *ResourceUsage) *ResourceUsage {
+	if other == nil {
+		return u
+	}
+	return &ResourceUsage{PeakMemory: max(u.PeakMemory, other.PeakMemory), CPUTime: u.CPUTime + other.CPUTime}
+}
+
+// NewResourceUsage converts the usage reported by the process executor. It returns nil if that is nil or
+// didn't measure any resources (e.g. it only traced the files the command opened).
+func NewResourceUsage(usage *process.Usage) *ResourceUsage {
+	if usage == nil || (usage.PeakMemory == 0 && usage.CPUTime == 0) {
+		return nil
+	}
+	return &ResourceUsage{PeakMemory: usage.PeakMemory, CPUTime: usage.CPUTime}
+}
+
+// LocalResourceCapacity returns the resources available to build actions running on this machine.
+// These come from the config if set there, otherwise from the machine itself; the memory is left at zero
+// (i.e. not limited) if we can't determine how much there is.
+func (config *Configuration) LocalResourceCapacity() ResourceRequests {
+	capacity := ResourceRequests{CPU: config.Build.LocalCPUs, Memory: uint64(config.Build.LocalMemory)}
+	if capacity.CPU <= 0 {
+		capacity.CPU = runtime.NumCPU()
+	}
+	if capacity.Memory == 0 {
+		if vm, err := mem.VirtualMemory(); err != nil {
+			log.Warning("Can't determine available memory, local actions won't be limited by it: %s", err)
+		} else {
+			capacity.Memory = vm.Total
+		}
+	}
+	return capacity
+}
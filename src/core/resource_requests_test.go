@@ -0,0 +1,37 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/process"
+)
+
+func TestLocalResourceCapacity(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.LocalCPUs = 3
+	config.Build.LocalMemory = 1 << 30
+	assert.Equal(t, ResourceRequests{CPU: 3, Memory: 1 << 30}, config.LocalResourceCapacity())
+
+	config.Build.LocalCPUs = 0
+	assert.Greater(t, config.LocalResourceCapacity().CPU, 0)
+}
+
+func TestResourceUsageAdd(t *testing.T) {
+	u1 := &ResourceUsage{PeakMemory: 100, CPUTime: time.Second}
+	u2 := &ResourceUsage{PeakMemory: 50, CPUTime: 2 * time.Second}
+	assert.Equal(t, &ResourceUsage{PeakMemory: 100, CPUTime: 3 * time.Second}, u1.Add(u2))
+	assert.Equal(t, u1, u1.Add(nil))
+}
+
+func TestNewResourceUsage(t *testing.T) {
+	assert.Nil(t, NewResourceUsage(nil))
+	assert.Nil(t, NewResourceUsage(&process.Usage{Files: []string{"/usr/bin/bash"}}))
+	assert.Equal(t, &ResourceUsage{PeakMemory: 100, CPUTime: time.Second}, NewResourceUsage(&process.Usage{PeakMemory: 100, CPUTime: time.Second}))
+}
+
+func TestResourceRequestsLimits(t *testing.T) {
+	assert.Equal(t, process.Limits{CPURequest: 4, Memory: 8 << 30}, ResourceRequests{CPU: 4, Memory: 8 << 30}.Limits())
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// StrictSandboxPaths returns the paths on the host that an action with the given tools can see when it runs
+// in the strict sandbox, in addition to its own temporary directory.
+func StrictSandboxPaths(state *BuildState, tools []BuildInput) []string {
+	paths := make([]string, 0, len(state.Config.Sandbox.SystemPath)+len(tools))
+	for _, p := range state.Config.Sandbox.SystemPath {
+		paths = append(paths, filepath.Clean(p))
+	}
+	for _, tool := range tools {
+		var toolPaths []string
+		if label, ok := tool.Label(); ok {
+			// We expose all the outputs of the tool, since its entry point might be within one of them.
+			toolPaths = state.Graph.TargetOrDie(label).FullOutputs()
+		} else {
+			toolPaths = tool.FullPaths(state.Graph)
+		}
+		for _, p := range toolPaths {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(RepoRoot, p)
+			}
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// StrictSandboxEnv returns the environment variables that tell the built-in sandbox to run an action with the
+// given tools in the strict sandbox.
+// These are only for actions run locally; they contain absolute paths so mustn't be part of the environment
+// that's sent for remote execution.
+func StrictSandboxEnv(state *BuildState, tools []BuildInput) []string {
+	return []string{
+		"SANDBOX_STRICT=1",
+		"SANDBOX_PATHS=" + strings.Join(StrictSandboxPaths(state, tools), ","),
+	}
+}
+
+// missingFileRegex matches lines of output that are likely to be reporting that a file doesn't exist.
+var missingFileRegex = regexp.MustCompile(`(?i)no such file|not found|(cannot|can't|could not|couldn't|unable to|failed to) (find|open|stat|access|read|load)|does ?n[o']t exist`)
+
+// pathRegex matches things in those lines that look like paths.
+var pathRegex = regexp.MustCompile(`[A-Za-z0-9_./+@-]*/[A-Za-z0-9_./+@-]+`)
+
+// UndeclaredFiles returns the files that an action which failed in the strict sandbox tried to use, that exist on the
+// host but that it couldn't see. These are most likely files it needed but hadn't declared.
+// If the action was traced, missing is the files it tried to open that didn't exist, which tells us exactly.
+// Otherwise it's nil, and we can only guess from lines of its output that look like errors about missing files;
+// that misses any tool that doesn't print the path and can include files that aren't relevant.
+// Files in the repo are returned relative to the repo root, others as absolute paths.
+func UndeclaredFiles(output []byte, missing, visible []string) []string {
+	if missing == nil {
+		missing = mentionedFiles(output)
+	}
+	var ret []string
+	seen := map[string]bool{}
+	for _, p := range missing {
+		if p, ok := undeclaredFile(p, visible); ok && !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// mentionedFiles returns anything that looks like a path in lines of the given output that look like errors about
+// files that don't exist.
+func mentionedFiles(output []byte) []string {
+	var ret []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if missingFileRegex.MatchString(line) {
+			for _, p := range pathRegex.FindAllString(line, -1) {
+				ret = append(ret, strings.TrimRight(p, "."))
+			}
+		}
+	}
+	return ret
+}
+
+// undeclaredFile returns the given path that an action in the strict sandbox couldn't find, and true if it
+// exists on the host and wasn't visible to the action.
+func undeclaredFile(p string, visible []string) (string, bool) {
+	if rel, ok := strings.CutPrefix(p, SandboxDir+"/"); ok {
+		// This is within the sandbox, which mirrors the layout of the repo.
+		p = rel
+	} else if p = filepath.Clean(p); filepath.IsAbs(p) {
+		if IsWithin(p, visible) {
+			return "", false // It was visible already, so it's not the problem.
+		} else if rel, ok := strings.CutPrefix(p, RepoRoot+"/"); ok && RepoRoot != "" {
+			p = rel
+		} else if p == "/tmp" || strings.HasPrefix(p, "/tmp/") {
+			return "", false // This is the sandbox's own temp dir.
+		}
+	}
+	if p = filepath.Clean(p); p == "." || strings.HasPrefix(p, "../") {
+		return "", false
+	}
+	host := p
+	if !filepath.IsAbs(host) {
+		host = filepath.Join(RepoRoot, host)
+	}
+	return p, PathExists(host)
+}
+
+// StrictSandboxHint returns a message describing any undeclared files that an action that failed in the strict
+// sandbox seems to have needed, or the empty string if there don't seem to be any.
+// The arguments are as UndeclaredFiles.
+func StrictSandboxHint(output []byte, missing, visible []string) string {
+	files := UndeclaredFiles(output, missing, visible)
+	if len(files) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	if missing != nil {
+		sb.WriteString("\nThe action tried to open these files, which exist but aren't available in the strict sandbox.")
+	} else {
+		sb.WriteString("\nHint: the output above mentions these files, which exist but aren't available in the strict sandbox. This is only a guess from the output; build with --audit_inputs to find exactly which files were missing.")
+	}
+	sb.WriteString(" If the target needs them they must be declared as its sources, dependencies or tools, or added to sandbox.systempath in your config:\n")
+	for _, f := range files {
+		fmt.Fprintf(&sb, "  %s\n", f)
+	}
+	return sb.String()
+}
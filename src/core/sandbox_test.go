@@ -0,0 +1,102 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrictSandboxPaths(t *testing.T) {
+	state := NewDefaultBuildState()
+	state.Config.Sandbox.SystemPath = []string{"/usr", "/etc/"}
+	tool := NewBuildTarget(ParseBuildLabel("//tools:compiler", ""))
+	tool.AddOutput("compiler")
+	tool.AddOutput("lib")
+	state.Graph.AddTarget(tool)
+
+	paths := StrictSandboxPaths(state, []BuildInput{tool.Label, SystemFileLabel{Path: "/opt/bin/thing"}})
+	assert.Equal(t, []string{
+		"/usr",
+		"/etc",
+		filepath.Join(RepoRoot, "plz-out/gen/tools/compiler"),
+		filepath.Join(RepoRoot, "plz-out/gen/tools/lib"),
+		"/opt/bin/thing",
+	}, paths)
+}
+
+func TestUndeclaredFiles(t *testing.T) {
+	oldRoot := RepoRoot
+	RepoRoot = t.TempDir()
+	defer func() { RepoRoot = oldRoot }()
+	require.NoError(t, os.MkdirAll(filepath.Join(RepoRoot, "src/lib"), DirPermissions))
+	require.NoError(t, os.WriteFile(filepath.Join(RepoRoot, "src/lib/data.txt"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(RepoRoot, "src/lib/other.txt"), nil, 0644))
+
+	output := []byte(`cat: src/lib/data.txt: No such file or directory
+src/lib/other.txt: this file looks fine to me
+cp: cannot stat '/tmp/plz_sandbox/src/lib/other.txt': No such file or directory
+grep: /etc/passwd: No such file or directory
+cat: src/lib/nonexistent.txt: No such file or directory
+cat: /tmp/whatever/src/lib/data.txt: No such file or directory
+`)
+	assert.Equal(t, []string{"src/lib/data.txt", "src/lib/other.txt", "/etc/passwd"}, UndeclaredFiles(output, nil, nil))
+	// Anything that was visible isn't the problem.
+	assert.Equal(t, []string{"src/lib/data.txt", "src/lib/other.txt"}, UndeclaredFiles(output, nil, []string{"/etc"}))
+
+	// If the action was traced we know exactly what it couldn't find, regardless of the output.
+	missing := []string{
+		SandboxDir + "/src/lib/data.txt",
+		filepath.Join(RepoRoot, "src/lib/other.txt"),
+		"/etc/passwd",
+		"/etc/nonexistent",
+		"/tmp/whatever",
+	}
+	assert.Equal(t, []string{"src/lib/data.txt", "src/lib/other.txt", "/etc/passwd"}, UndeclaredFiles(nil, missing, nil))
+	assert.Equal(t, []string{"src/lib/data.txt", "src/lib/other.txt"}, UndeclaredFiles(output, missing, []string{"/etc"}))
+	assert.Empty(t, UndeclaredFiles(output, []string{}, nil))
+}
+
+func TestStrictSandboxHint(t *testing.T) {
+	assert.Equal(t, "", StrictSandboxHint([]byte("error: something went wrong\n"), nil, nil))
+	hint := StrictSandboxHint([]byte("cat: /etc/passwd: No such file or directory\n"), nil, nil)
+	assert.Contains(t, hint, "Hint: the output above mentions these files")
+	assert.Contains(t, hint, "  /etc/passwd\n")
+	hint = StrictSandboxHint([]byte("ImportError: No module named passwd\n"), []string{"/etc/passwd"}, nil)
+	assert.Contains(t, hint, "The action tried to open these files")
+	assert.Contains(t, hint, "  /etc/passwd\n")
+}
+
+func TestStrictSandboxEnv(t *testing.T) {
+	state := NewDefaultBuildState()
+	state.Config.Sandbox.SystemPath = []string{"/usr", "/etc"}
+	assert.Equal(t, []string{"SANDBOX_STRICT=1", "SANDBOX_PATHS=/usr,/etc"}, StrictSandboxEnv(state, nil))
+}
+
+func TestStrictSandboxNeedsBuiltInSandbox(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Sandbox.Strict = true
+	assert.False(t, config.StrictSandbox())
+	config.Sandbox.Tool = ""
+	assert.True(t, config.StrictSandbox())
+}
+
+func TestStrictSandboxNotInBuildEnv(t *testing.T) {
+	state := NewDefaultBuildState()
+	state.Config.Sandbox.Strict = true
+	state.Config.Sandbox.Tool = ""
+	target := NewBuildTarget(ParseBuildLabel("//pkg:test", ""))
+	target.Sandbox = true
+	target.Test = new(TestFields)
+	target.Test.Sandbox = true
+	// These are sent for remote execution, so mustn't contain anything that depends on the local machine.
+	for _, env := range []BuildEnv{
+		StampedBuildEnvironment(state, target, nil, "/tmp/pkg", false),
+		TestEnvironment(state, target, "/tmp/pkg", 1),
+	} {
+		assert.NotContains(t, env, "SANDBOX_STRICT")
+		assert.NotContains(t, env, "SANDBOX_PATHS")
+	}
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"crypto/sha1"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -24,6 +25,7 @@ import (
 	"github.com/thought-machine/please/src/cmap"
 	"github.com/thought-machine/please/src/fs"
 	"github.com/thought-machine/please/src/process"
+	"github.com/thought-machine/please/src/scm"
 )
 
 type ParseMode uint8
@@ -116,6 +118,53 @@ type RemoteClient interface {
 	Disconnect() error
 	// SubrepoFS returns a virtual filesystem for the subrepo target
 	SubrepoFS(target *BuildTarget, root string) iofs.FS
+	// OutputFS returns a virtual filesystem over the outputs of a target that has been built remotely.
+	OutputFS(target *BuildTarget) (iofs.FS, error)
+}
+
+// A RemoteUnavailableError is returned by a RemoteClient when it couldn't run an action because the
+// remote server was unavailable or didn't have capacity for it, as opposed to the action itself failing.
+type RemoteUnavailableError struct {
+	Err error
+}
+
+func (err *RemoteUnavailableError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *RemoteUnavailableError) Unwrap() error {
+	return err.Err
+}
+
+// A RemoteInfraError is returned by a RemoteClient when an action failed because of a transient problem
+// with the remote infrastructure (and any retries were exhausted), as opposed to the action itself failing.
+type RemoteInfraError struct {
+	Err error
+}
+
+func (err *RemoteInfraError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *RemoteInfraError) Unwrap() error {
+	return err.Err
+}
+
+// IsInfraFailure returns true if the given error indicates a failure of the remote infrastructure
+// rather than of the action being run.
+func IsInfraFailure(err error) bool {
+	var unavailable *RemoteUnavailableError
+	var infra *RemoteInfraError
+	return errors.As(err, &unavailable) || errors.As(err, &infra)
+}
+
+// A Limiter limits how many things can happen at once.
+type Limiter interface {
+	// Acquire blocks until there is capacity available to run the given target.
+	// Callers that currently hold a remote slot for the target give it up by calling this.
+	Acquire(target *BuildTarget)
+	// Release returns capacity acquired by Acquire for the same target.
+	Release(target *BuildTarget)
 }
 
 // A TargetHasher is a thing that knows how to create hashes for targets.
@@ -162,8 +211,12 @@ type BuildState struct {
 	Cache Cache
 	// Client to remote execution service, if configured.
 	RemoteClient RemoteClient
+	// Limits how many actions run locally at once when they fall back from remote execution. May be nil.
+	LocalLimiter Limiter
 	// Hasher for targets
 	TargetHasher TargetHasher
+	// Records time spent parsing, if we're profiling the parser. Nil if not.
+	ParseProfile *ParseProfile
 	// Arguments to tests.
 	TestArgs []string
 	// Labels of targets that we will include / exclude
@@ -193,6 +246,9 @@ type BuildState struct {
 	NeedRun bool
 	// True if we want to calculate target hashes (ie. 'plz hash').
 	NeedHashesOnly bool
+	// True if we shouldn't print the outputs of the original targets once they're built, because
+	// something else will be written to stdout afterwards (ie. 'plz cas').
+	NoPrintOutputs bool
 	// True if we only want to prepare build directories (ie. 'plz build --prepare')
 	PrepareOnly bool
 	// Whether and how to download outputs
@@ -223,6 +279,8 @@ type BuildState struct {
 	XattrsSupported bool
 	// Number of times to run each test target. 1 == once each, plus flakes if necessary.
 	NumTestRuns uint16
+	// The subset of test targets to run when splitting tests across machines. Nil if we aren't sharding.
+	TestShard *TestShard
 	// Experimental directories
 	experimentalLabels []BuildLabel
 	// Various items for tracking progress.
@@ -240,6 +298,15 @@ type BuildState struct {
 
 	// preloadDownloadOnce is used
 	preloadDownloadOnce *sync.Once
+
+	// repoSCM is the SCM for the repo. It's shared between all copies of this state.
+	repoSCM *lazySCM
+}
+
+// A lazySCM creates an SCM on first use.
+type lazySCM struct {
+	once sync.Once
+	scm  scm.SCM
 }
 
 // Copy creates a copy of this state object
@@ -252,6 +319,18 @@ func (state *BuildState) Copy() *BuildState {
 	return ret
 }
 
+// SCM returns the SCM for the repo.
+// It's created once per build, so anything it caches lasts for the lifetime of the state.
+func (state *BuildState) SCM() scm.SCM {
+	if state.repoSCM == nil {
+		return scm.New(RepoRoot)
+	}
+	state.repoSCM.once.Do(func() {
+		state.repoSCM.scm = scm.New(RepoRoot)
+	})
+	return state.repoSCM.scm
+}
+
 // Initialise will load the .plzconfig from the subrepo. We can only do this once the subrepo is built hence why
 // it's not done up front. Once we have done that, we can initialise the parser for the subrepo.
 func (state *BuildState) Initialise(subrepo *Subrepo) (err error) {
@@ -431,6 +510,9 @@ func (state *BuildState) isOriginalTarget(target *BuildTarget, exact bool) bool
 		return state.progress.originalTargets.MatchExact(target.Label)
 	}
 	matched, wasExact := state.progress.originalTargets.Match(target.Label)
+	if wasExact && !state.inTestShard(target) {
+		return false
+	}
 	return matched && (wasExact || state.ShouldInclude(target))
 }
 
@@ -469,7 +551,13 @@ func (state *BuildState) ShouldInclude(target *BuildTarget) bool {
 			return false
 		}
 	}
-	return target.ShouldInclude(state.Include, state.Exclude)
+	return target.ShouldInclude(state.Include, state.Exclude) && state.inTestShard(target)
+}
+
+// inTestShard returns true if the given target is in the shard of tests we're running.
+// Non-test targets are always included.
+func (state *BuildState) inTestShard(target *BuildTarget) bool {
+	return state.TestShard == nil || !state.NeedTests || !target.IsTest() || state.TestShard.Includes(target.Label)
 }
 
 // AddOriginalTarget adds one of the original targets and enqueues it for parsing / building.
@@ -600,6 +688,16 @@ func (state *BuildState) LogBuildError(label BuildLabel, status BuildResultStatu
 // logResult logs a build result directly to the state's queue.
 func (state *BuildState) logResult(result *BuildResult) {
 	result.Time = time.Now()
+	if target := result.target; target != nil {
+		result.Retries = target.RemoteRetries()
+		result.ResourceUsage = target.ResourceUsage()
+	} else if state.Graph != nil {
+		if target := state.Graph.Target(result.Label); target != nil {
+			result.Retries = target.RemoteRetries()
+			result.ResourceUsage = target.ResourceUsage()
+		}
+	}
+	result.InfraFailure = result.Status.IsFailure() && IsInfraFailure(result.Err)
 	state.progress.internalResults <- result
 	if result.Status.IsFailure() {
 		state.progress.failed.Store(true)
@@ -947,7 +1045,15 @@ func (state *BuildState) ShouldRebuild(target *BuildTarget) bool {
 
 // WillRunRemotely returns true if the given target will be run on a remote executor.
 func (state *BuildState) WillRunRemotely(target *BuildTarget) bool {
-	return state.RemoteClient != nil && state.Config.IsRemoteExecution() && !target.Local
+	return state.RemoteClient != nil && state.Config.IsRemoteExecution() && !target.RunsLocally()
+}
+
+// ShouldFallBackLocally returns true if the given error from running the target remotely means we should
+// run it locally instead.
+func (state *BuildState) ShouldFallBackLocally(target *BuildTarget, err error) bool {
+	var unavailable *RemoteUnavailableError
+	// Subrepos are set up differently depending on where their target is built, so we can't change our mind about them.
+	return err != nil && state.Config.Remote.LocalFallback && !target.IsSubrepo && errors.As(err, &unavailable)
 }
 
 // EnsureDownloaded ensures that a target has been downloaded when built remotely.
@@ -1387,11 +1493,21 @@ func executorFromConfig(config *Configuration) *process.Executor {
 		log.Warningf("Sandbox tool doesn't exist: %v", tool)
 	}
 
-	return process.NewSandboxingExecutor(
+	if config.Sandbox.Strict && !config.StrictSandbox() && (config.Sandbox.Build || config.Sandbox.Test) {
+		log.Warning("sandbox.strict has no effect with sandbox tool %s; set sandbox.tool to an empty string to use the built-in sandbox", config.Sandbox.Tool)
+	}
+
+	executor := process.NewSandboxingExecutor(
 		config.Sandbox.Tool == "" && (config.Sandbox.Build || config.Sandbox.Test),
 		process.NamespacingPolicy(config.Sandbox.Namespace),
 		tool,
 	)
+	if config.Cgroup.Enabled {
+		if err := executor.EnableCgroups(config.Cgroup.Root, process.Limits{CPU: config.Cgroup.CPULimit, Memory: uint64(config.Cgroup.MemoryLimit), Pids: config.Cgroup.PidsLimit}); err != nil {
+			log.Warning("Can't run actions in cgroups, they won't be limited: %s", err)
+		}
+	}
+	return executor
 }
 
 // NewBuildState constructs and returns a new BuildState.
@@ -1435,6 +1551,7 @@ func NewBuildState(config *Configuration) *BuildState {
 		},
 		initOnce:            new(sync.Once),
 		preloadDownloadOnce: new(sync.Once),
+		repoSCM:             &lazySCM{},
 	}
 
 	state.PathHasher = state.Hasher(config.Build.HashFunction)
@@ -1472,6 +1589,12 @@ type BuildResult struct {
 	Description string
 	// Test results
 	Tests TestSuite
+	// Number of times remote actions for this target have been retried after transient failures.
+	Retries int
+	// Resources used by the target's most recent local action, if they were measured.
+	ResourceUsage *ResourceUsage
+	// True if this is a failure caused by the remote infrastructure rather than the action itself.
+	InfraFailure bool
 }
 
 // A BuildResultStatus represents the status of a target when we log a build result.
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -167,3 +168,24 @@ func TestCopyPlugin(t *testing.T) {
 
 	assert.NotEqual(t, plugin.ExtraValues["foo"], newPlugin.ExtraValues["foo"])
 }
+
+func TestShouldFallBackLocally(t *testing.T) {
+	state := NewDefaultBuildState()
+	target := NewBuildTarget(ParseBuildLabel("//pkg:target", ""))
+	unavailable := fmt.Errorf("Failed to build: %w", &RemoteUnavailableError{Err: fmt.Errorf("connection refused")})
+
+	assert.False(t, state.ShouldFallBackLocally(target, unavailable), "fallback is off by default")
+	state.Config.Remote.LocalFallback = true
+	assert.True(t, state.ShouldFallBackLocally(target, unavailable))
+	assert.False(t, state.ShouldFallBackLocally(target, nil))
+	assert.False(t, state.ShouldFallBackLocally(target, fmt.Errorf("Remotely executed command exited with 1")))
+	target.IsSubrepo = true
+	assert.False(t, state.ShouldFallBackLocally(target, unavailable))
+}
+
+func TestIsInfraFailure(t *testing.T) {
+	assert.True(t, IsInfraFailure(fmt.Errorf("Failed to build: %w", &RemoteInfraError{Err: fmt.Errorf("aborted")})))
+	assert.True(t, IsInfraFailure(&RemoteUnavailableError{Err: fmt.Errorf("connection refused")}))
+	assert.False(t, IsInfraFailure(fmt.Errorf("Remotely executed command exited with 1")))
+	assert.False(t, IsInfraFailure(nil))
+}
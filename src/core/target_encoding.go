@@ -0,0 +1,508 @@
+// Serialisation of build targets, used to persist the results of parsing between invocations.
+// This is deliberately explicit about every field so adding a new one to BuildTarget doesn't
+// silently get lost; only the fields that are set at parse time are stored.
+
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// targetEncodingVersion is bumped whenever the encoding below changes incompatibly.
+const targetEncodingVersion = 3
+
+// An ErrUnencodableTarget is returned when a target can't be serialised, typically because
+// it has some attribute that only exists in the parser's memory (e.g. a pre-build function).
+type ErrUnencodableTarget struct {
+	Label  BuildLabel
+	Reason string
+}
+
+func (err *ErrUnencodableTarget) Error() string {
+	return fmt.Sprintf("%s can't be encoded: %s", err.Label, err.Reason)
+}
+
+// EncodeTargets serialises the given set of targets, as they are immediately after parsing.
+func EncodeTargets(targets []*BuildTarget) ([]byte, error) {
+	encoded := encodedTargets{Version: targetEncodingVersion, Targets: make([]encodedTarget, len(targets))}
+	for i, target := range targets {
+		t, err := encodeTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Targets[i] = t
+	}
+	sort.Slice(encoded.Targets, func(i, j int) bool { return encoded.Targets[i].Label.Name < encoded.Targets[j].Label.Name })
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&encoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeTargets deserialises a set of targets previously serialised by EncodeTargets.
+// The targets are created in the given package but not added to it.
+func DecodeTargets(data []byte, pkg *Package) ([]*BuildTarget, error) {
+	var encoded encodedTargets
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&encoded); err != nil {
+		return nil, err
+	} else if encoded.Version != targetEncodingVersion {
+		return nil, fmt.Errorf("unknown target encoding version %d", encoded.Version)
+	}
+	targets := make([]*BuildTarget, len(encoded.Targets))
+	for i, t := range encoded.Targets {
+		target, err := t.decode(pkg)
+		if err != nil {
+			return nil, err
+		}
+		targets[i] = target
+	}
+	return targets, nil
+}
+
+type encodedTargets struct {
+	Version int
+	Targets []encodedTarget
+}
+
+type encodedLabel struct {
+	Subrepo, PackageName, Name string
+}
+
+func encodeLabel(label BuildLabel) encodedLabel {
+	return encodedLabel{Subrepo: label.Subrepo, PackageName: label.PackageName, Name: label.Name}
+}
+
+func (label encodedLabel) decode() BuildLabel {
+	return BuildLabel{Subrepo: label.Subrepo, PackageName: label.PackageName, Name: label.Name}
+}
+
+func encodeLabels(labels []BuildLabel) []encodedLabel {
+	if labels == nil {
+		return nil
+	}
+	ret := make([]encodedLabel, len(labels))
+	for i, l := range labels {
+		ret[i] = encodeLabel(l)
+	}
+	return ret
+}
+
+func decodeLabels(labels []encodedLabel) []BuildLabel {
+	if labels == nil {
+		return nil
+	}
+	ret := make([]BuildLabel, len(labels))
+	for i, l := range labels {
+		ret[i] = l.decode()
+	}
+	return ret
+}
+
+// The kinds of BuildInput that we know how to encode.
+const (
+	buildLabelInput = iota
+	fileLabelInput
+	subrepoFileLabelInput
+	systemFileLabelInput
+	systemPathLabelInput
+	annotatedOutputLabelInput
+	urlLabelInput
+)
+
+type encodedInput struct {
+	Kind        int
+	Label       encodedLabel
+	Annotation  string
+	File        string
+	Package     string
+	FullPackage string
+	Name        string
+	Path        []string
+}
+
+func encodeInput(input BuildInput) (encodedInput, error) {
+	switch input := input.(type) {
+	case BuildLabel:
+		return encodedInput{Kind: buildLabelInput, Label: encodeLabel(input)}, nil
+	case FileLabel:
+		return encodedInput{Kind: fileLabelInput, File: input.File, Package: input.Package}, nil
+	case SubrepoFileLabel:
+		return encodedInput{Kind: subrepoFileLabelInput, File: input.File, Package: input.Package, FullPackage: input.FullPackage}, nil
+	case SystemFileLabel:
+		return encodedInput{Kind: systemFileLabelInput, File: input.Path}, nil
+	case SystemPathLabel:
+		return encodedInput{Kind: systemPathLabelInput, Name: input.Name, Path: input.Path}, nil
+	case AnnotatedOutputLabel:
+		return encodedInput{Kind: annotatedOutputLabelInput, Label: encodeLabel(input.BuildLabel), Annotation: input.Annotation}, nil
+	case URLLabel:
+		return encodedInput{Kind: urlLabelInput, Name: string(input)}, nil
+	}
+	return encodedInput{}, fmt.Errorf("unknown input type %T", input)
+}
+
+func (input encodedInput) decode() (BuildInput, error) {
+	switch input.Kind {
+	case buildLabelInput:
+		return input.Label.decode(), nil
+	case fileLabelInput:
+		return FileLabel{File: input.File, Package: input.Package}, nil
+	case subrepoFileLabelInput:
+		return SubrepoFileLabel{File: input.File, Package: input.Package, FullPackage: input.FullPackage}, nil
+	case systemFileLabelInput:
+		return SystemFileLabel{Path: input.File}, nil
+	case systemPathLabelInput:
+		return SystemPathLabel{Name: input.Name, Path: input.Path}, nil
+	case annotatedOutputLabelInput:
+		return AnnotatedOutputLabel{BuildLabel: input.Label.decode(), Annotation: input.Annotation}, nil
+	case urlLabelInput:
+		return URLLabel(input.Name), nil
+	}
+	return nil, fmt.Errorf("unknown input kind %d", input.Kind)
+}
+
+func encodeInputs(inputs []BuildInput) ([]encodedInput, error) {
+	if inputs == nil {
+		return nil, nil
+	}
+	ret := make([]encodedInput, len(inputs))
+	for i, input := range inputs {
+		e, err := encodeInput(input)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = e
+	}
+	return ret, nil
+}
+
+func decodeInputs(inputs []encodedInput) ([]BuildInput, error) {
+	if inputs == nil {
+		return nil, nil
+	}
+	ret := make([]BuildInput, len(inputs))
+	for i, input := range inputs {
+		d, err := input.decode()
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = d
+	}
+	return ret, nil
+}
+
+func encodeNamedInputs(inputs map[string][]BuildInput) (map[string][]encodedInput, error) {
+	if inputs == nil {
+		return nil, nil
+	}
+	ret := make(map[string][]encodedInput, len(inputs))
+	for name, l := range inputs {
+		e, err := encodeInputs(l)
+		if err != nil {
+			return nil, err
+		}
+		ret[name] = e
+	}
+	return ret, nil
+}
+
+func decodeNamedInputs(inputs map[string][]encodedInput) (map[string][]BuildInput, error) {
+	if inputs == nil {
+		return nil, nil
+	}
+	ret := make(map[string][]BuildInput, len(inputs))
+	for name, l := range inputs {
+		d, err := decodeInputs(l)
+		if err != nil {
+			return nil, err
+		}
+		ret[name] = d
+	}
+	return ret, nil
+}
+
+type encodedDependency struct {
+	Label                            encodedLabel
+	Exported, Internal, Source, Data bool
+}
+
+type encodedTestFields struct {
+	Command    string
+	Commands   map[string]string
+	Tools      []encodedInput
+	NamedTools map[string][]encodedInput
+	Timeout    time.Duration
+	Outputs    []string
+	Flakiness  uint8
+	Sandbox    bool
+	NoOutput   bool
+}
+
+type encodedDebugFields struct {
+	Command    string
+	Data       []encodedInput
+	NamedData  map[string][]encodedInput
+	Tools      []encodedInput
+	NamedTools map[string][]encodedInput
+}
+
+type encodedTarget struct {
+	Label                       encodedLabel
+	Dependencies                []encodedDependency
+	Visibility                  []encodedLabel
+	Sources                     []encodedInput
+	NamedSources                map[string][]encodedInput
+	Data                        []encodedInput
+	NamedData                   map[string][]encodedInput
+	Outputs                     []string
+	NamedOutputs                map[string][]string
+	OptionalOutputs             []string
+	Labels                      []string
+	Command                     string
+	Commands                    map[string]string
+	Test                        *encodedTestFields
+	Debug                       *encodedDebugFields
+	BuildingDescription         string
+	Hashes                      []string
+	Licences                    []string
+	Secrets                     []string
+	NamedSecrets                map[string][]string
+	Requires                    []string
+	Provides                    map[string][]encodedLabel
+	Tools                       []encodedInput
+	NamedTools                  map[string][]encodedInput
+	PassEnv                     *[]string
+	PassUnsafeEnv               *[]string
+	BuildTimeout                time.Duration
+	OutputDirectories           []OutputDirectory
+	EntryPoints                 map[string]string
+	Env                         map[string]string
+	FileContent                 string
+	IsBinary                    bool
+	IsSubrepo                   bool
+	TestOnly                    bool
+	Sandbox                     bool
+	NeedsTransitiveDependencies bool
+	OutputIsComplete            bool
+	Stamp                       bool
+	Local                       bool
+	ExitOnError                 bool
+	IsFilegroup                 bool
+	IsRemoteFile                bool
+	IsTextFile                  bool
+	ShowProgress                bool
+	Kind                        string
+	Resources                   ResourceRequests
+}
+
+func encodeTarget(target *BuildTarget) (t encodedTarget, err error) {
+	target.mutex.RLock()
+	defer target.mutex.RUnlock()
+	if target.PreBuildFunction != nil {
+		return t, &ErrUnencodableTarget{Label: target.Label, Reason: "it has a pre-build function"}
+	} else if target.PostBuildFunction != nil {
+		return t, &ErrUnencodableTarget{Label: target.Label, Reason: "it has a post-build function"}
+	} else if len(target.Providers) > 0 {
+		return t, &ErrUnencodableTarget{Label: target.Label, Reason: "it has providers"}
+	}
+	t = encodedTarget{
+		Label:                       encodeLabel(target.Label),
+		Visibility:                  encodeLabels(target.Visibility),
+		Outputs:                     target.outputs,
+		NamedOutputs:                target.namedOutputs,
+		OptionalOutputs:             target.OptionalOutputs,
+		Labels:                      target.Labels,
+		Command:                     target.Command,
+		Commands:                    target.Commands,
+		BuildingDescription:         target.BuildingDescription,
+		Hashes:                      target.Hashes,
+		Licences:                    target.Licences,
+		Secrets:                     target.Secrets,
+		NamedSecrets:                target.NamedSecrets,
+		Requires:                    target.Requires,
+		PassEnv:                     target.PassEnv,
+		PassUnsafeEnv:               target.PassUnsafeEnv,
+		BuildTimeout:                target.BuildTimeout,
+		OutputDirectories:           target.OutputDirectories,
+		EntryPoints:                 target.EntryPoints,
+		Env:                         target.Env,
+		FileContent:                 target.FileContent,
+		IsBinary:                    target.IsBinary,
+		IsSubrepo:                   target.IsSubrepo,
+		TestOnly:                    target.TestOnly,
+		Sandbox:                     target.Sandbox,
+		NeedsTransitiveDependencies: target.NeedsTransitiveDependencies,
+		OutputIsComplete:            target.OutputIsComplete,
+		Stamp:                       target.Stamp,
+		Local:                       target.Local,
+		ExitOnError:                 target.ExitOnError,
+		IsFilegroup:                 target.IsFilegroup,
+		IsRemoteFile:                target.IsRemoteFile,
+		IsTextFile:                  target.IsTextFile,
+		ShowProgress:                target.showProgress.Load(),
+		Kind:                        target.Kind,
+		Resources:                   target.Resources,
+	}
+	for _, dep := range target.dependencies {
+		t.Dependencies = append(t.Dependencies, encodedDependency{
+			Label:    encodeLabel(*dep.declared),
+			Exported: dep.exported,
+			Internal: dep.internal,
+			Source:   dep.source,
+			Data:     dep.data,
+		})
+	}
+	if target.Provides != nil {
+		t.Provides = make(map[string][]encodedLabel, len(target.Provides))
+		for k, v := range target.Provides {
+			t.Provides[k] = encodeLabels(v)
+		}
+	}
+	if t.Sources, err = encodeInputs(target.Sources); err != nil {
+		return t, err
+	} else if t.NamedSources, err = encodeNamedInputs(target.NamedSources); err != nil {
+		return t, err
+	} else if t.Data, err = encodeInputs(target.Data); err != nil {
+		return t, err
+	} else if t.NamedData, err = encodeNamedInputs(target.NamedData); err != nil {
+		return t, err
+	} else if t.Tools, err = encodeInputs(target.Tools); err != nil {
+		return t, err
+	} else if t.NamedTools, err = encodeNamedInputs(target.namedTools); err != nil {
+		return t, err
+	}
+	if test := target.Test; test != nil {
+		t.Test = &encodedTestFields{
+			Command:   test.Command,
+			Commands:  test.Commands,
+			Timeout:   test.Timeout,
+			Outputs:   test.Outputs,
+			Flakiness: test.Flakiness,
+			Sandbox:   test.Sandbox,
+			NoOutput:  test.NoOutput,
+		}
+		if t.Test.Tools, err = encodeInputs(test.tools); err != nil {
+			return t, err
+		} else if t.Test.NamedTools, err = encodeNamedInputs(test.namedTools); err != nil {
+			return t, err
+		}
+	}
+	if debug := target.Debug; debug != nil {
+		t.Debug = &encodedDebugFields{Command: debug.Command}
+		if t.Debug.Data, err = encodeInputs(debug.data); err != nil {
+			return t, err
+		} else if t.Debug.NamedData, err = encodeNamedInputs(debug.namedData); err != nil {
+			return t, err
+		} else if t.Debug.Tools, err = encodeInputs(debug.tools); err != nil {
+			return t, err
+		} else if t.Debug.NamedTools, err = encodeNamedInputs(debug.namedTools); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+func (t *encodedTarget) decode(pkg *Package) (target *BuildTarget, err error) {
+	target = NewBuildTarget(t.Label.decode())
+	target.Subrepo = pkg.Subrepo
+	target.Visibility = decodeLabels(t.Visibility)
+	target.outputs = t.Outputs
+	target.namedOutputs = t.NamedOutputs
+	target.OptionalOutputs = t.OptionalOutputs
+	target.Labels = t.Labels
+	target.Command = t.Command
+	target.Commands = t.Commands
+	target.BuildingDescription = t.BuildingDescription
+	target.Hashes = t.Hashes
+	target.Licences = t.Licences
+	target.Secrets = t.Secrets
+	target.NamedSecrets = t.NamedSecrets
+	target.Requires = t.Requires
+	target.PassEnv = t.PassEnv
+	target.PassUnsafeEnv = t.PassUnsafeEnv
+	target.BuildTimeout = t.BuildTimeout
+	target.OutputDirectories = t.OutputDirectories
+	target.EntryPoints = t.EntryPoints
+	target.Env = t.Env
+	target.FileContent = t.FileContent
+	target.IsBinary = t.IsBinary
+	target.IsSubrepo = t.IsSubrepo
+	target.TestOnly = t.TestOnly
+	target.Sandbox = t.Sandbox
+	target.NeedsTransitiveDependencies = t.NeedsTransitiveDependencies
+	target.OutputIsComplete = t.OutputIsComplete
+	target.Stamp = t.Stamp
+	target.Local = t.Local
+	target.ExitOnError = t.ExitOnError
+	target.IsFilegroup = t.IsFilegroup
+	target.IsRemoteFile = t.IsRemoteFile
+	target.IsTextFile = t.IsTextFile
+	target.showProgress.Store(t.ShowProgress)
+	target.Kind = t.Kind
+	target.Resources = t.Resources
+	if len(t.Dependencies) > 0 {
+		target.dependencies = make([]depInfo, len(t.Dependencies))
+		for i, dep := range t.Dependencies {
+			label := dep.Label.decode()
+			target.dependencies[i] = depInfo{
+				declared: &label,
+				exported: dep.Exported,
+				internal: dep.Internal,
+				source:   dep.Source,
+				data:     dep.Data,
+			}
+		}
+	}
+	if t.Provides != nil {
+		target.Provides = make(map[string][]BuildLabel, len(t.Provides))
+		for k, v := range t.Provides {
+			target.Provides[k] = decodeLabels(v)
+		}
+	}
+	if target.Sources, err = decodeInputs(t.Sources); err != nil {
+		return nil, err
+	} else if target.NamedSources, err = decodeNamedInputs(t.NamedSources); err != nil {
+		return nil, err
+	} else if target.Data, err = decodeInputs(t.Data); err != nil {
+		return nil, err
+	} else if target.NamedData, err = decodeNamedInputs(t.NamedData); err != nil {
+		return nil, err
+	} else if target.Tools, err = decodeInputs(t.Tools); err != nil {
+		return nil, err
+	} else if target.namedTools, err = decodeNamedInputs(t.NamedTools); err != nil {
+		return nil, err
+	}
+	if test := t.Test; test != nil {
+		target.Test = &TestFields{
+			Command:   test.Command,
+			Commands:  test.Commands,
+			Timeout:   test.Timeout,
+			Outputs:   test.Outputs,
+			Flakiness: test.Flakiness,
+			Sandbox:   test.Sandbox,
+			NoOutput:  test.NoOutput,
+		}
+		if target.Test.tools, err = decodeInputs(test.Tools); err != nil {
+			return nil, err
+		} else if target.Test.namedTools, err = decodeNamedInputs(test.NamedTools); err != nil {
+			return nil, err
+		}
+	}
+	if debug := t.Debug; debug != nil {
+		target.Debug = &DebugFields{Command: debug.Command}
+		if target.Debug.data, err = decodeInputs(debug.Data); err != nil {
+			return nil, err
+		} else if target.Debug.namedData, err = decodeNamedInputs(debug.NamedData); err != nil {
+			return nil, err
+		} else if target.Debug.tools, err = decodeInputs(debug.Tools); err != nil {
+			return nil, err
+		} else if target.Debug.namedTools, err = decodeNamedInputs(debug.NamedTools); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
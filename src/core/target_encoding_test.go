@@ -0,0 +1,117 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeTargetsRoundTrip(t *testing.T) {
+	pkg := NewPackage("src/core")
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.AddSource(FileLabel{File: "core.go", Package: "src/core"})
+	target.AddNamedSource("data", ParseBuildLabel("//src/data:data", ""))
+	target.AddDependency(ParseBuildLabel("//src/data:data", ""))
+	target.AddMaybeExportedDependency(ParseBuildLabel("//src/fs:fs", ""), true, false, false)
+	target.AddTool(SystemPathLabel{Name: "go", Path: []string{"/usr/bin"}})
+	target.AddOutput("core.a")
+	target.AddNamedOutput("srcs", "core.go")
+	target.AddLabel("go")
+	target.Command = "go build -o $OUT $SRCS"
+	target.Commands = map[string]string{"dbg": "go build -gcflags=all=-N $SRCS"}
+	target.Visibility = []BuildLabel{WholeGraph[0]}
+	target.BuildTimeout = 5 * time.Minute
+	target.Env = map[string]string{"CGO_ENABLED": "0"}
+	target.IsBinary = true
+	target.Kind = "go_library"
+	target.Resources = ResourceRequests{CPU: 4, Memory: 8 << 30}
+	target.Test = &TestFields{Command: "$TEST", Flakiness: 3}
+	target.AddTestTool(ParseBuildLabel("//tools:runner", ""))
+
+	data, err := EncodeTargets([]*BuildTarget{target})
+	require.NoError(t, err)
+	targets, err := DecodeTargets(data, pkg)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(targets))
+	decoded := targets[0]
+
+	assert.Equal(t, target.Label, decoded.Label)
+	assert.Equal(t, target.AllSources(), decoded.AllSources())
+	assert.Equal(t, target.NamedSources, decoded.NamedSources)
+	assert.Equal(t, target.DeclaredDependencies(), decoded.DeclaredDependencies())
+	assert.Equal(t, target.ExportedDependencies(), decoded.ExportedDependencies())
+	assert.Equal(t, target.AllTools(), decoded.AllTools())
+	assert.Equal(t, target.Outputs(), decoded.Outputs())
+	assert.Equal(t, []string{"core.go"}, decoded.NamedOutputs("srcs"))
+	assert.Equal(t, target.Labels, decoded.Labels)
+	assert.Equal(t, target.Command, decoded.Command)
+	assert.Equal(t, target.Commands, decoded.Commands)
+	assert.Equal(t, target.Visibility, decoded.Visibility)
+	assert.Equal(t, target.BuildTimeout, decoded.BuildTimeout)
+	assert.Equal(t, target.Env, decoded.Env)
+	assert.True(t, decoded.IsBinary)
+	assert.Equal(t, "go_library", decoded.Kind)
+	assert.Equal(t, target.Resources, decoded.Resources)
+	require.True(t, decoded.IsTest())
+	assert.Equal(t, uint8(3), decoded.Test.Flakiness)
+	assert.Equal(t, target.AllTestTools(), decoded.AllTestTools())
+}
+
+func TestEncodeTargetsPreBuildFunction(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.PreBuildFunction = preBuildFunction{}
+	_, err := EncodeTargets([]*BuildTarget{target})
+	assert.Error(t, err)
+	assert.IsType(t, &ErrUnencodableTarget{}, err)
+}
+
+type preBuildFunction struct{}
+
+func (f preBuildFunction) Call(*BuildTarget) error { return nil }
+func (f preBuildFunction) String() string          { return "" }
+
+// notEncodedFields are the fields of BuildTarget that deliberately aren't encoded. Most are state that's
+// only set after parsing; targets with functions or providers can't be encoded at all.
+var notEncodedFields = map[string]bool{
+	"Subrepo":             true, // Comes from the package
+	"Progress":            true,
+	"FileSize":            true,
+	"PreBuildFunction":    true,
+	"PostBuildFunction":   true,
+	"Providers":           true,
+	"RuleHash":            true,
+	"mutex":               true,
+	"finishedBuilding":    true,
+	"state":               true,
+	"neededForSubinclude": true,
+	"runLocally":          true,
+	"remoteRetries":       true,
+	"resourceUsage":       true,
+	"inputAudit":          true,
+	"completedRuns":       true,
+	"AddedPostBuild":      true,
+	"Test.Results":        true,
+}
+
+// TestEncodedTargetHasAllFields checks that adding a field to BuildTarget doesn't silently lose it
+// from the parse cache; it must either be encoded or listed above.
+func TestEncodedTargetHasAllFields(t *testing.T) {
+	checkEncodedFields(t, reflect.TypeOf(BuildTarget{}), reflect.TypeOf(encodedTarget{}), "")
+	checkEncodedFields(t, reflect.TypeOf(TestFields{}), reflect.TypeOf(encodedTestFields{}), "Test.")
+	checkEncodedFields(t, reflect.TypeOf(DebugFields{}), reflect.TypeOf(encodedDebugFields{}), "Debug.")
+}
+
+func checkEncodedFields(t *testing.T, typ, encoded reflect.Type, prefix string) {
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		if notEncodedFields[prefix+name] {
+			continue
+		} else if _, present := encoded.FieldByName(strings.ToUpper(name[:1]) + name[1:]); !present {
+			t.Errorf("Field %s%s is not encoded; add it to %s or notEncodedFields", prefix, name, encoded.Name())
+		}
+	}
+}
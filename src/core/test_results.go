@@ -24,6 +24,8 @@ type TestSuite struct {
 	TestCases  TestCases         // The test cases that ran during execution of this target.
 	Properties map[string]string // The system properties at the time of the test.
 	Timestamp  string            // ISO8601 formatted datetime when the test ran.
+	Hash       []byte            // The hash of the target's test inputs, if known.
+	Usage      *ResourceUsage    // The resources used by the test, if they were measured.
 }
 
 // JavaStyleName pretends we are using a language that has package names and classnames etc.
@@ -36,6 +38,12 @@ func (testSuite *TestSuite) Collapse(incoming TestSuite) {
 	testSuite.TestCases = append(testSuite.TestCases, incoming.TestCases...)
 	testSuite.Duration += incoming.Duration
 	testSuite.TimedOut = testSuite.TimedOut || incoming.TimedOut
+	if incoming.Hash != nil {
+		testSuite.Hash = incoming.Hash
+	}
+	if incoming.Usage != nil {
+		testSuite.Usage = incoming.Usage.Add(testSuite.Usage)
+	}
 	if testSuite.Properties == nil {
 		testSuite.Properties = make(map[string]string)
 	}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// A TestShard identifies a subset of test targets to run, which allows splitting a large set of tests
+// deterministically across several machines. Each machine is given the same set of targets and a different index.
+type TestShard struct {
+	Index, Count int
+	// assigned holds the shard for each target we have a duration for.
+	assigned map[BuildLabel]int
+}
+
+// NewTestShard creates a new TestShard for the given index & count.
+// If durations are given (typically from the results of a previous run) the targets in them are spread
+// across shards to balance their total duration; any others are assigned by a hash of their label.
+// Every shard must be given the same durations for the partitioning to be consistent.
+func NewTestShard(index, count int, durations map[BuildLabel]time.Duration) (*TestShard, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("shard count must be positive, was %d", count)
+	} else if index < 0 || index >= count {
+		return nil, fmt.Errorf("shard index must be between 0 and %d, was %d", count-1, index)
+	}
+	labels := make(BuildLabels, 0, len(durations))
+	for label := range durations {
+		labels = append(labels, label)
+	}
+	// Longest first, with ties broken by label so every shard arrives at the same ordering.
+	sort.SliceStable(labels, func(i, j int) bool {
+		if di, dj := durations[labels[i]], durations[labels[j]]; di != dj {
+			return di > dj
+		}
+		return labels[i].Less(labels[j])
+	})
+	shard := &TestShard{Index: index, Count: count, assigned: make(map[BuildLabel]int, len(labels))}
+	totals := make([]time.Duration, count)
+	for _, label := range labels {
+		smallest := 0
+		for i, total := range totals {
+			if total < totals[smallest] {
+				smallest = i
+			}
+		}
+		shard.assigned[label] = smallest
+		totals[smallest] += durations[label]
+	}
+	return shard, nil
+}
+
+// Includes returns true if the given target belongs in this shard.
+func (shard *TestShard) Includes(label BuildLabel) bool {
+	if i, present := shard.assigned[label]; present {
+		return i == shard.Index
+	}
+	h := fnv.New32a()
+	h.Write([]byte(label.String()))
+	return int(h.Sum32()%uint32(shard.Count)) == shard.Index
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestShardPartitions(t *testing.T) {
+	labels := make([]BuildLabel, 50)
+	for i := range labels {
+		labels[i] = NewBuildLabel("src/pkg", fmt.Sprintf("test%d", i))
+	}
+	const count = 4
+	shards := make([]*TestShard, count)
+	for i := range shards {
+		shard, err := NewTestShard(i, count, nil)
+		assert.NoError(t, err)
+		shards[i] = shard
+	}
+	for _, label := range labels {
+		n := 0
+		for _, shard := range shards {
+			if shard.Includes(label) {
+				n++
+			}
+		}
+		assert.Equal(t, 1, n, "%s should be in exactly one shard", label)
+	}
+}
+
+func TestTestShardBalancesDurations(t *testing.T) {
+	durations := map[BuildLabel]time.Duration{
+		NewBuildLabel("src/a", "slow"):   10 * time.Minute,
+		NewBuildLabel("src/b", "medium"): 6 * time.Minute,
+		NewBuildLabel("src/c", "quick"):  3 * time.Minute,
+		NewBuildLabel("src/d", "quick"):  3 * time.Minute,
+	}
+	shard0, err := NewTestShard(0, 2, durations)
+	assert.NoError(t, err)
+	shard1, err := NewTestShard(1, 2, durations)
+	assert.NoError(t, err)
+	assert.True(t, shard0.Includes(NewBuildLabel("src/a", "slow")))
+	assert.True(t, shard1.Includes(NewBuildLabel("src/b", "medium")))
+	assert.True(t, shard1.Includes(NewBuildLabel("src/c", "quick")))
+	assert.True(t, shard1.Includes(NewBuildLabel("src/d", "quick")))
+	assert.False(t, shard1.Includes(NewBuildLabel("src/a", "slow")))
+}
+
+func TestTestShardInvalid(t *testing.T) {
+	_, err := NewTestShard(2, 2, nil)
+	assert.Error(t, err)
+	_, err = NewTestShard(-1, 2, nil)
+	assert.Error(t, err)
+	_, err = NewTestShard(0, 0, nil)
+	assert.Error(t, err)
+}
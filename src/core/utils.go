@@ -436,6 +436,16 @@ func LookBuildPath(filename string, config *Configuration) (string, error) {
 	return LookPath(filename, config.Path())
 }
 
+// IsWithin returns true if the given path is any of the given paths or is within one of them.
+func IsWithin(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // PathExists is an alias to fs.PathExists.
 // TODO(peterebden): Remove and migrate everything over.
 func PathExists(filename string) bool {
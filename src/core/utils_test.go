@@ -138,6 +138,17 @@ func TestLookPathDoesntExist(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestIsWithin(t *testing.T) {
+	paths := []string{"/usr", "/etc/", "plz-out/gen/pkg"}
+	assert.True(t, IsWithin("/usr", paths))
+	assert.True(t, IsWithin("/usr/bin/bash", paths))
+	assert.True(t, IsWithin("/etc/passwd", paths))
+	assert.True(t, IsWithin("plz-out/gen/pkg/out.txt", paths))
+	assert.False(t, IsWithin("/usrlocal/bin", paths))
+	assert.False(t, IsWithin("plz-out/gen/pkg2/out.txt", paths))
+	assert.True(t, IsWithin("/anything", []string{"/"}))
+}
+
 // buildGraph builds a test graph which we use to test IterSources etc.
 func buildGraph() *BuildGraph {
 	graph := NewGraph()
@@ -15,6 +15,9 @@ There are several different .plzconfig files that can be loaded, which override
 const tracing = `
 Please can generate output compatible with Chrome's built-in tracing tool. It can be switched on with the ${BOLD_CYAN}--trace_file${RESET} flag and, once done, you can load the file by visiting ${BLUE}chrome://tracing${RESET}.
 This is a handy way to visualise where time is spent during a build and can be useful to diagnose slow builds.
+
+If parsing is the slow part, ${BOLD_CYAN}--parse_profile_file${RESET} records the time spent in each package, subinclude and function call while interpreting BUILD files.
+By default it is written as a pprof profile (try ${BOLD_CYAN}go tool pprof -http=: <file>${RESET}); pass ${BOLD_CYAN}--parse_profile_format=folded${RESET} for folded stacks that flame graph tools understand.
 `
 
 const toplevel = `
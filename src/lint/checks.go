@@ -0,0 +1,363 @@
+package lint
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// depArgs are the arguments to build rules that we check the visibility of.
+var depArgs = []string{"srcs", "deps", "exported_deps", "data", "tools", "test_tools"}
+
+// checkCalls checks the arguments of every call to a known function in the file.
+func (l *linter) checkCalls(f *file, env map[string]*asp.FuncDef) {
+	bound := boundNames(f)
+	check := func(name string, call *asp.Call, pos asp.Position) {
+		if def := env[name]; def != nil && !bound[name] {
+			l.checkCall(f, env, bound, name, def, call, pos)
+		}
+	}
+	asp.WalkAST(f.Stmts, func(stmt *asp.Statement) bool {
+		if name, call := topLevelCall(stmt); call != nil {
+			check(name, call, stmt.Pos)
+		}
+		return true
+	})
+	asp.WalkAST(f.Stmts, func(expr *asp.IdentExpr) bool {
+		if len(expr.Action) > 0 && expr.Action[0].Call != nil {
+			check(expr.Name, expr.Action[0].Call, expr.Pos)
+		}
+		return true
+	})
+}
+
+// checkCall checks a single call against the definition of the function it's calling.
+func (l *linter) checkCall(f *file, env map[string]*asp.FuncDef, bound map[string]bool, name string, def *asp.FuncDef, call *asp.Call, pos asp.Position) {
+	indices := make(map[string]int, len(def.Arguments))
+	for i, arg := range def.Arguments {
+		indices[arg.Name] = i
+		for _, alias := range arg.Aliases {
+			indices[alias] = i
+		}
+	}
+	passed := make([]bool, len(def.Arguments))
+	positional := 0
+	for _, arg := range call.Arguments {
+		if arg.Name != "" {
+			idx, present := indices[arg.Name]
+			if !present {
+				if !def.Kwargs {
+					l.report(f, arg.Pos, Error, "unknown-argument", "Unknown argument to %s: %s", name, arg.Name)
+				}
+				continue
+			}
+			passed[idx] = true
+			l.checkType(f, env, bound, name, def.Arguments[idx], &arg.Value)
+			continue
+		}
+		if def.KeywordsOnly && positional == 0 {
+			l.report(f, arg.Value.Pos, Error, "keyword-only", "Function %s can only be called with keyword arguments", name)
+		}
+		if positional < len(def.Arguments) {
+			passed[positional] = true
+			l.checkType(f, env, bound, name, def.Arguments[positional], &arg.Value)
+		} else if !def.Varargs && positional == len(def.Arguments) {
+			l.report(f, arg.Value.Pos, Error, "too-many-arguments", "Too many arguments to %s", name)
+		}
+		positional++
+	}
+	for i, arg := range def.Arguments {
+		if !passed[i] && arg.Value == nil {
+			l.report(f, pos, Error, "missing-argument", "Missing required argument to %s: %s", name, arg.Name)
+		}
+	}
+}
+
+// checkType checks the type of a single argument, if it's a literal whose type we know.
+func (l *linter) checkType(f *file, env map[string]*asp.FuncDef, bound map[string]bool, name string, arg asp.Argument, expr *asp.Expression) {
+	if len(arg.Type) == 0 {
+		return
+	}
+	typ := literalType(expr, env, bound)
+	if typ == "" || typ == "none" || slices.Contains(arg.Type, typ) {
+		return
+	} else if typ == "int" && slices.Contains(arg.Type, "bool") && l.config.Bazel.Compatibility {
+		return // Using integers in place of booleans is common in Bazel BUILD files.
+	}
+	l.report(f, expr.Pos, Error, "wrong-type", "Invalid type for argument %s to %s; expected %s, was %s", arg.Name, name, strings.Join(arg.Type, " or "), typ)
+}
+
+// literalType returns the type of an expression if it can be determined statically, or the empty string if not.
+func literalType(expr *asp.Expression, env map[string]*asp.FuncDef, bound map[string]bool) string {
+	v := expr.Val
+	if v == nil || len(expr.Op) != 0 || expr.If != nil || v.Slices != nil || v.Property != nil || v.Call != nil {
+		return ""
+	}
+	switch {
+	case v.String != "" || v.FString != nil:
+		return "str"
+	case v.True || v.False:
+		return "bool"
+	case v.None:
+		return "none"
+	case v.IsInt:
+		return "int"
+	case v.List != nil || v.Tuple != nil:
+		return "list"
+	case v.Dict != nil:
+		return "dict"
+	case v.Lambda != nil:
+		return "function"
+	case v.Ident != nil && len(v.Ident.Action) == 0 && env[v.Ident.Name] != nil && !bound[v.Ident.Name]:
+		return "function"
+	}
+	return ""
+}
+
+// boundNames returns the names of all variables assigned to anywhere in a file, other than top-level functions.
+func boundNames(f *file) map[string]bool {
+	bound := map[string]bool{}
+	asp.WalkAST(f.Stmts, func(stmt *asp.Statement) bool {
+		if stmt.Ident != nil {
+			if stmt.Ident.Action != nil && (stmt.Ident.Action.Assign != nil || stmt.Ident.Action.AugAssign != nil) {
+				bound[stmt.Ident.Name] = true
+			} else if stmt.Ident.Unpack != nil {
+				bound[stmt.Ident.Name] = true
+				for _, name := range stmt.Ident.Unpack.Names {
+					bound[name] = true
+				}
+			}
+		} else if stmt.For != nil {
+			for _, name := range stmt.For.Names {
+				bound[name] = true
+			}
+		} else if stmt.FuncDef != nil {
+			for _, arg := range stmt.FuncDef.Arguments {
+				bound[arg.Name] = true
+			}
+			for _, s := range stmt.FuncDef.Statements {
+				if s.FuncDef != nil {
+					bound[s.FuncDef.Name] = true
+				}
+			}
+		}
+		return true
+	})
+	asp.WalkAST(f.Stmts, func(c *asp.Comprehension) bool {
+		for _, name := range c.Names {
+			bound[name] = true
+		}
+		if c.Second != nil {
+			for _, name := range c.Second.Names {
+				bound[name] = true
+			}
+		}
+		return true
+	})
+	asp.WalkAST(f.Stmts, func(lambda *asp.Lambda) bool {
+		for _, arg := range lambda.Arguments {
+			bound[arg.Name] = true
+		}
+		return true
+	})
+	return bound
+}
+
+// usedNames returns the names of all variables and functions that are read anywhere in a file.
+func usedNames(f *file) map[string]bool {
+	used := map[string]bool{}
+	asp.WalkAST(f.Stmts, func(stmt *asp.IdentStatement) bool {
+		if stmt.Action == nil || stmt.Action.Assign == nil {
+			used[stmt.Name] = true
+		}
+		return true
+	})
+	asp.WalkAST(f.Stmts, func(expr *asp.IdentExpr) bool {
+		used[expr.Name] = true
+		return true
+	})
+	asp.WalkAST(f.Stmts, func(v *asp.FStringVar) bool {
+		if len(v.Var) > 0 {
+			used[v.Var[0]] = true
+		}
+		return false
+	})
+	return used
+}
+
+// checkShadowedBuiltins checks for any assignments or function definitions that hide a builtin function.
+func (l *linter) checkShadowedBuiltins(f *file) {
+	check := func(name string, pos asp.Position) {
+		if l.builtins[name] != nil {
+			l.report(f, pos, Warning, "shadowed-builtin", "%s shadows a builtin function of the same name", name)
+		}
+	}
+	asp.WalkAST(f.Stmts, func(stmt *asp.Statement) bool {
+		if stmt.Ident != nil {
+			if stmt.Ident.Action != nil && stmt.Ident.Action.Assign != nil {
+				check(stmt.Ident.Name, stmt.Pos)
+			} else if stmt.Ident.Unpack != nil {
+				check(stmt.Ident.Name, stmt.Pos)
+				for _, name := range stmt.Ident.Unpack.Names {
+					check(name, stmt.Pos)
+				}
+			}
+		} else if stmt.For != nil {
+			for _, name := range stmt.For.Names {
+				check(name, stmt.Pos)
+			}
+		} else if stmt.FuncDef != nil {
+			check(stmt.FuncDef.Name, stmt.Pos)
+		}
+		return true
+	})
+}
+
+// checkUnusedSubincludes checks for subincludes that define nothing used in the file.
+func (l *linter) checkUnusedSubincludes(f *file) {
+	used := usedNames(f)
+	for _, label := range subincludes(f) {
+		symbols := l.resolveSubinclude(f, label.Value)
+		if symbols == nil {
+			continue // Can't tell what it defines.
+		}
+		if !anyUsed(symbols, used) {
+			l.report(f, label.Pos, Warning, "unused-subinclude", "Nothing defined by subinclude %s is used", label.Value)
+		}
+	}
+}
+
+func anyUsed(symbols map[string]*asp.FuncDef, used map[string]bool) bool {
+	for name := range symbols {
+		if used[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUnusedLoads checks for symbols imported by load() that aren't used in the file.
+func (l *linter) checkUnusedLoads(f *file) {
+	used := usedNames(f)
+	for _, stmt := range f.Stmts {
+		name, call := topLevelCall(stmt)
+		if name != "load" || len(call.Arguments) == 0 {
+			continue
+		}
+		from, _ := stringLiterals(&call.Arguments[0].Value)
+		if len(from) != 1 {
+			continue
+		}
+		for _, arg := range call.Arguments[1:] {
+			if arg.Name != "" {
+				if !used[arg.Name] {
+					l.report(f, arg.Pos, Warning, "unused-load", "%s is loaded from %s but never used", arg.Name, from[0].Value)
+				}
+				continue
+			}
+			for _, sym := range mustStringLiterals(&arg.Value) {
+				if !used[sym.Value] {
+					l.report(f, sym.Pos, Warning, "unused-load", "%s is loaded from %s but never used", sym.Value, from[0].Value)
+				}
+			}
+		}
+	}
+}
+
+// A declaredTarget is a target declared in a BUILD file, as far as we can tell statically.
+type declaredTarget struct {
+	Label core.BuildLabel
+	// The visibility argument, or nil if it isn't given.
+	Visibility *asp.Expression
+	// True if the package sets a default visibility.
+	DefaultVisibility bool
+}
+
+// A dependency is a dependency of one declared target on another.
+type dependency struct {
+	From, To core.BuildLabel
+	File     *file
+	Pos      asp.Position
+}
+
+// collectTargets records all the targets declared at the top level of a BUILD file, and their dependencies.
+func (l *linter) collectTargets(f *file) {
+	defaultVisibility := false
+	for _, stmt := range f.Stmts {
+		if name, call := topLevelCall(stmt); name == "package" && callArgument(call, "default_visibility") != nil {
+			defaultVisibility = true
+		}
+	}
+	for _, stmt := range f.Stmts {
+		_, call := topLevelCall(stmt)
+		if call == nil {
+			continue
+		}
+		nameArg := callArgument(call, "name")
+		if nameArg == nil {
+			continue
+		}
+		names, ok := stringLiterals(nameArg)
+		if !ok || len(names) != 1 {
+			continue
+		}
+		label := core.BuildLabel{PackageName: f.Package, Name: names[0].Value}
+		l.targets[label] = &declaredTarget{
+			Label:             label,
+			Visibility:        callArgument(call, "visibility"),
+			DefaultVisibility: defaultVisibility,
+		}
+		for _, argName := range depArgs {
+			if arg := callArgument(call, argName); arg != nil {
+				for _, dep := range mustStringLiterals(arg) {
+					if !strings.HasPrefix(dep.Value, "//") {
+						continue
+					}
+					if to, err := core.TryParseBuildLabel(dep.Value, f.Package, ""); err == nil && to.Subrepo == "" {
+						l.deps = append(l.deps, dependency{From: label, To: to, File: f, Pos: dep.Pos})
+					}
+				}
+			}
+		}
+	}
+}
+
+// checkVisibility checks that the dependencies between the declared targets are all visible.
+func (l *linter) checkVisibility() {
+	for _, dep := range l.deps {
+		to := l.targets[dep.To]
+		if to == nil || dep.To.PackageName == dep.From.PackageName || to.DefaultVisibility {
+			continue
+		} else if to.Visibility == nil {
+			l.report(dep.File, dep.Pos, Error, "missing-visibility", "%s isn't visible to %s; it doesn't declare any visibility", dep.To, dep.From)
+			continue
+		}
+		if vis, ok := stringLiterals(to.Visibility); ok && !isVisible(vis, dep.To, dep.From) {
+			l.report(dep.File, dep.Pos, Error, "missing-visibility", "%s isn't visible to %s", dep.To, dep.From)
+		}
+	}
+}
+
+// isVisible returns true if any of the given visibility specifications allow from to see to.
+func isVisible(visibility []stringArg, to, from core.BuildLabel) bool {
+	for _, vis := range visibility {
+		if vis.Value == "PUBLIC" {
+			return true
+		} else if label, err := core.TryParseBuildLabel(vis.Value, to.PackageName, ""); err == nil && label.Includes(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// callArgument returns the value of the named argument to a call, or nil if it isn't passed.
+func callArgument(call *asp.Call, name string) *asp.Expression {
+	for i, arg := range call.Arguments {
+		if arg.Name == name {
+			return &call.Arguments[i].Value
+		}
+	}
+	return nil
+}
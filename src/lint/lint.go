@@ -0,0 +1,426 @@
+// Package lint implements static checks of BUILD files and build_defs.
+//
+// Unlike parsing, nothing here is evaluated; we only look at the AST, so the checks
+// are necessarily conservative. Anything that can't be determined statically (e.g.
+// the type of an argument that's a variable, or a subinclude of a remote plugin) is
+// simply not checked.
+package lint
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/cli/logging"
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+	"github.com/thought-machine/please/src/parse/asp"
+	"github.com/thought-machine/please/src/plz"
+)
+
+var log = logging.Log
+
+// A Severity describes how serious an issue is.
+type Severity string
+
+// Error is the severity of issues that will fail (or are very likely to fail) at parse or build time.
+const Error Severity = "error"
+
+// Warning is the severity of issues that work but are probably not what was intended.
+const Warning Severity = "warning"
+
+// An Issue is a single problem found in a file.
+type Issue struct {
+	Filename string   `json:"file"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Severity Severity `json:"severity"`
+	Rule     string   `json:"rule"`
+	Message  string   `json:"message"`
+}
+
+// String implements the fmt.Stringer interface.
+func (issue Issue) String() string {
+	if issue.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s [%s]", issue.Filename, issue.Severity, issue.Message, issue.Rule)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s [%s]", issue.Filename, issue.Line, issue.Column, issue.Severity, issue.Message, issue.Rule)
+}
+
+// A Rule describes one of the checks we run.
+type Rule struct {
+	ID          string
+	Description string
+}
+
+// Rules are all the checks that can produce issues.
+var Rules = []Rule{
+	{ID: "parse-error", Description: "The file could not be parsed."},
+	{ID: "unknown-argument", Description: "A function is called with a keyword argument it doesn't declare."},
+	{ID: "too-many-arguments", Description: "A function is called with more positional arguments than it declares."},
+	{ID: "missing-argument", Description: "A function is called without one of its required arguments."},
+	{ID: "keyword-only", Description: "A build rule is called with positional arguments."},
+	{ID: "wrong-type", Description: "An argument doesn't match the type declared for it."},
+	{ID: "unused-subinclude", Description: "Nothing defined by a subinclude is used."},
+	{ID: "unused-load", Description: "A symbol imported by load() is not used."},
+	{ID: "shadowed-builtin", Description: "A builtin function is redefined or assigned to."},
+	{ID: "missing-visibility", Description: "A target depends on one in another package that isn't visible to it."},
+}
+
+// Lint runs all the checks on the given files, which can be either BUILD files or build_defs.
+// If none are given, all of them in the repo are checked.
+// The returned issues are sorted by file and position.
+func Lint(config *core.Configuration, filenames []string) ([]Issue, error) {
+	l, err := newLinter(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		filenames = findAllFiles(config)
+	}
+	for _, filename := range filenames {
+		l.lint(filename)
+	}
+	l.checkVisibility()
+	sort.SliceStable(l.issues, func(i, j int) bool {
+		a, b := l.issues[i], l.issues[j]
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		} else if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return l.issues, nil
+}
+
+// findAllFiles returns all the BUILD files and build_defs in the repo.
+func findAllFiles(config *core.Configuration) []string {
+	var filenames []string
+	for filename := range plz.FindAllBuildFiles(config, core.RepoRoot, "") {
+		filenames = append(filenames, filename)
+	}
+	if err := fs.Walk(core.RepoRoot, func(name string, isDir bool) error {
+		basename := filepath.Base(name)
+		if isDir && (basename == core.OutDir || (strings.HasPrefix(basename, ".") && name != core.RepoRoot)) {
+			return filepath.SkipDir
+		} else if !isDir && strings.HasSuffix(basename, ".build_defs") {
+			filenames = append(filenames, name)
+		}
+		return nil
+	}); err != nil {
+		log.Warning("Failed to find build_defs files: %s", err)
+	}
+	for i, filename := range filenames {
+		if rel, err := filepath.Rel(core.RepoRoot, filename); err == nil {
+			filenames[i] = rel
+		}
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// A linter holds the state needed while linting a set of files.
+type linter struct {
+	config   *core.Configuration
+	parser   *asp.Parser
+	builtins map[string]*asp.FuncDef
+	files    map[string]*file
+	// Symbols defined by each subinclude we've resolved, or nil if it couldn't be resolved.
+	subincludes map[string]map[string]*asp.FuncDef
+	// Targets declared in BUILD files we've linted, for checking visibility.
+	targets map[core.BuildLabel]*declaredTarget
+	// Dependencies between those targets.
+	deps   []dependency
+	issues []Issue
+}
+
+// A file is a single parsed BUILD file or build_defs.
+type file struct {
+	Name    string
+	Package string
+	Stmts   []*asp.Statement
+	pos     *asp.File
+	err     error
+}
+
+// Pos converts the given position within this file to a FilePosition.
+func (f *file) Pos(pos asp.Position) asp.FilePosition {
+	return f.pos.Pos(pos)
+}
+
+func newLinter(config *core.Configuration) (*linter, error) {
+	p := asp.NewParser(core.NewBuildState(config))
+	dir, _ := rules.AllAssets()
+	sort.Strings(dir)
+	for _, filename := range dir {
+		src, _ := rules.ReadAsset(filename)
+		if err := p.LoadBuiltins(filename, src); err != nil {
+			return nil, fmt.Errorf("Failed to load builtin rules: %w", err)
+		}
+	}
+	for _, preload := range config.Parse.PreloadBuildDefs {
+		if err := p.LoadBuiltins(preload, nil); err != nil {
+			return nil, fmt.Errorf("Failed to load preloaded build defs: %w", err)
+		}
+	}
+	builtins := map[string]*asp.FuncDef{}
+	for name, def := range p.BuiltinFunctions() {
+		// Methods (e.g. str.format) are declared alongside the global functions, but aren't global.
+		if len(def.Arguments) == 0 || def.Arguments[0].Name != "self" {
+			builtins[name] = def
+		}
+	}
+	return &linter{
+		config:      config,
+		parser:      p,
+		builtins:    builtins,
+		files:       map[string]*file{},
+		subincludes: map[string]map[string]*asp.FuncDef{},
+		targets:     map[core.BuildLabel]*declaredTarget{},
+	}, nil
+}
+
+// parse parses the given file, or returns it if it's already been parsed.
+func (l *linter) parse(filename string) *file {
+	if f, present := l.files[filename]; present {
+		return f
+	}
+	f := &file{Name: filename, Package: filepath.Dir(filename)}
+	if f.Package == "." {
+		f.Package = ""
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		f.err = err
+	} else {
+		f.pos = asp.NewFile(filename, b)
+		f.Stmts, f.err = l.parser.ParseData(b, filename)
+	}
+	l.files[filename] = f
+	return f
+}
+
+// lint runs all the checks on a single file.
+func (l *linter) lint(filename string) {
+	if l.isBuiltin(filename) {
+		log.Debug("Not linting %s, it defines builtins", filename)
+		return
+	}
+	f := l.parse(filename)
+	if f.err != nil {
+		pos, msg := asp.ErrorPosition(f.err)
+		l.issues = append(l.issues, Issue{
+			Filename: filename,
+			Line:     pos.Line,
+			Column:   pos.Column,
+			Severity: Error,
+			Rule:     "parse-error",
+			Message:  msg,
+		})
+		return
+	}
+	env := l.environment(f)
+	l.checkCalls(f, env)
+	l.checkShadowedBuiltins(f)
+	l.checkUnusedSubincludes(f)
+	l.checkUnusedLoads(f)
+	if l.config.IsABuildFile(filepath.Base(filename)) {
+		l.collectTargets(f)
+	}
+}
+
+// isBuiltin returns true if the given file is one that defines builtin functions.
+// This is either one of our own builtin rules or one that's preloaded.
+func (l *linter) isBuiltin(filename string) bool {
+	if slices.Contains(l.config.Parse.PreloadBuildDefs, filename) {
+		return true
+	}
+	asset, err := rules.ReadAsset(filepath.Base(filename))
+	if err != nil {
+		return false
+	}
+	b, err := os.ReadFile(filename)
+	return err == nil && bytes.Equal(b, asset)
+}
+
+// report records an issue at the given position in a file.
+func (l *linter) report(f *file, pos asp.Position, severity Severity, rule, msg string, args ...interface{}) {
+	p := f.Pos(pos)
+	l.issues = append(l.issues, Issue{
+		Filename: f.Name,
+		Line:     p.Line,
+		Column:   p.Column,
+		Severity: severity,
+		Rule:     rule,
+		Message:  fmt.Sprintf(msg, args...),
+	})
+}
+
+// environment returns the functions that are available to call in the given file.
+func (l *linter) environment(f *file) map[string]*asp.FuncDef {
+	env := make(map[string]*asp.FuncDef, len(l.builtins))
+	for name, def := range l.builtins {
+		env[name] = def
+	}
+	for _, label := range subincludes(f) {
+		for name, def := range l.resolveSubinclude(f, label.Value) {
+			if def != nil {
+				env[name] = def
+			}
+		}
+	}
+	for _, stmt := range f.Stmts {
+		if stmt.FuncDef != nil {
+			env[stmt.FuncDef.Name] = stmt.FuncDef
+		}
+	}
+	return env
+}
+
+// A stringArg is a string literal passed to a function, e.g. the labels in a subinclude.
+type stringArg struct {
+	Value string
+	Pos   asp.Position
+}
+
+// subincludes returns the labels of all the subincludes at the top level of a file.
+func subincludes(f *file) []stringArg {
+	var ret []stringArg
+	for _, stmt := range f.Stmts {
+		if name, call := topLevelCall(stmt); name == "subinclude" {
+			for _, arg := range call.Arguments {
+				ret = append(ret, mustStringLiterals(&arg.Value)...)
+			}
+		}
+	}
+	return ret
+}
+
+// resolveSubinclude returns all the symbols defined by a subinclude.
+// Functions map to their definitions; anything else maps to nil.
+// It returns nil if the subinclude can't be resolved to files in this repo (e.g. it's a plugin,
+// or the files are generated by a build rule).
+func (l *linter) resolveSubinclude(f *file, target string) map[string]*asp.FuncDef {
+	label, err := core.TryParseBuildLabel(target, f.Package, "")
+	if err != nil || label.Subrepo != "" {
+		return nil
+	}
+	key := label.String()
+	if symbols, present := l.subincludes[key]; present {
+		return symbols
+	}
+	l.subincludes[key] = nil // Guards against cycles
+	filenames := l.subincludeSources(label)
+	if len(filenames) == 0 {
+		return nil
+	}
+	symbols := map[string]*asp.FuncDef{}
+	for _, filename := range filenames {
+		sf := l.parse(filename)
+		if sf.err != nil {
+			return nil
+		}
+		for _, label := range subincludes(sf) {
+			nested := l.resolveSubinclude(sf, label.Value)
+			if nested == nil {
+				return nil // If we can't tell everything it defines, we can't say much about it.
+			}
+			for name, def := range nested {
+				symbols[name] = def
+			}
+		}
+		for _, stmt := range sf.Stmts {
+			if stmt.FuncDef != nil {
+				symbols[stmt.FuncDef.Name] = stmt.FuncDef
+			} else if stmt.Ident != nil && stmt.Ident.Action != nil && stmt.Ident.Action.Assign != nil {
+				symbols[stmt.Ident.Name] = nil
+			}
+		}
+	}
+	l.subincludes[key] = symbols
+	return symbols
+}
+
+// subincludeSources returns the source files for the given subinclude target, if they're
+// literal files in its BUILD file (as for a filegroup or export_file).
+func (l *linter) subincludeSources(label core.BuildLabel) []string {
+	for _, buildFileName := range l.config.Parse.BuildFileName {
+		f := l.parse(filepath.Join(label.PackageName, buildFileName))
+		if f.err != nil {
+			continue
+		}
+		stmt := asp.FindTarget(f.Stmts, label.Name)
+		if stmt == nil {
+			return nil
+		}
+		var filenames []string
+		if arg := asp.FindArgument(stmt, "srcs", "src"); arg != nil {
+			srcs, ok := stringLiterals(&arg.Value)
+			if !ok {
+				return nil
+			}
+			for _, src := range srcs {
+				if strings.HasPrefix(src.Value, ":") || strings.HasPrefix(src.Value, "/") {
+					return nil // It's generated by another rule, we won't try to go further.
+				}
+				filenames = append(filenames, filepath.Join(label.PackageName, src.Value))
+			}
+		}
+		for _, filename := range filenames {
+			if !fs.FileExists(filename) {
+				return nil
+			}
+		}
+		return filenames
+	}
+	return nil
+}
+
+// topLevelCall returns the name of the function called by a statement, and the call itself,
+// if the statement is a simple function call (e.g. `go_library(...)`).
+func topLevelCall(stmt *asp.Statement) (string, *asp.Call) {
+	if stmt.Ident != nil && stmt.Ident.Action != nil && stmt.Ident.Action.Call != nil {
+		return stmt.Ident.Name, stmt.Ident.Action.Call
+	}
+	return "", nil
+}
+
+// stringLiterals returns all the string literals in an expression that is either a string
+// or a list of strings. The returned bool is false if the expression contains anything else.
+func stringLiterals(expr *asp.Expression) ([]stringArg, bool) {
+	if expr.Val == nil || len(expr.Op) != 0 || expr.If != nil {
+		return nil, false
+	} else if s := expr.Val.String; s != "" && expr.Val.Property == nil && expr.Val.Slices == nil {
+		return []stringArg{{Value: strings.Trim(s, `"'`), Pos: expr.Pos}}, true
+	} else if expr.Val.List != nil && expr.Val.List.Comprehension == nil {
+		ret := make([]stringArg, 0, len(expr.Val.List.Values))
+		for _, v := range expr.Val.List.Values {
+			strs, ok := stringLiterals(v)
+			if !ok {
+				return nil, false
+			}
+			ret = append(ret, strs...)
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// mustStringLiterals is like stringLiterals but returns any literals it finds, ignoring anything else.
+func mustStringLiterals(expr *asp.Expression) []stringArg {
+	if expr.Val != nil && expr.Val.List != nil && expr.Val.List.Comprehension == nil && len(expr.Op) == 0 && expr.If == nil {
+		var ret []stringArg
+		for _, v := range expr.Val.List.Values {
+			ret = append(ret, mustStringLiterals(v)...)
+		}
+		return ret
+	}
+	strs, _ := stringLiterals(expr)
+	return strs
+}
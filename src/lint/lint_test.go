@@ -0,0 +1,93 @@
+package lint
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestMain(m *testing.M) {
+	// This works both under plz (which runs from the repo root) and go test (which runs in this directory).
+	if err := os.Chdir("src/lint/test_data"); err != nil {
+		if err := os.Chdir("test_data"); err != nil {
+			panic(err)
+		}
+	}
+	core.RepoRoot, _ = os.Getwd()
+	os.Exit(m.Run())
+}
+
+func testConfig() *core.Configuration {
+	config := core.DefaultConfiguration()
+	config.Parse.BuildFileName = []string{"BUILD_FILE"}
+	return config
+}
+
+// summarise returns a short summary of each issue for comparison.
+func summarise(issues []Issue) []string {
+	ret := make([]string, len(issues))
+	for i, issue := range issues {
+		ret[i] = fmt.Sprintf("%s:%d %s", issue.Filename, issue.Line, issue.Rule)
+	}
+	return ret
+}
+
+func TestLintAll(t *testing.T) {
+	issues, err := Lint(testConfig(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"broken/BUILD_FILE:2 parse-error",
+		"pkg/BUILD_FILE:1 unused-subinclude",
+		"pkg/BUILD_FILE:3 unused-load",
+		"pkg/BUILD_FILE:9 wrong-type",
+		"pkg/BUILD_FILE:15 unknown-argument",
+		"pkg/BUILD_FILE:18 missing-argument",
+		"pkg/BUILD_FILE:20 keyword-only",
+		"pkg/BUILD_FILE:25 missing-visibility",
+		"pkg/BUILD_FILE:27 missing-visibility",
+		"pkg/BUILD_FILE:32 too-many-arguments",
+		"pkg/BUILD_FILE:34 shadowed-builtin",
+	}, summarise(issues))
+}
+
+func TestLintMessages(t *testing.T) {
+	issues, err := Lint(testConfig(), []string{"pkg/BUILD_FILE"})
+	require.NoError(t, err)
+	require.True(t, len(issues) > 3)
+	assert.Equal(t, Issue{
+		Filename: "pkg/BUILD_FILE",
+		Line:     9,
+		Column:   12,
+		Severity: Error,
+		Rule:     "wrong-type",
+		Message:  "Invalid type for argument srcs to my_rule; expected list, was str",
+	}, issues[2])
+	assert.Equal(t, "pkg/BUILD_FILE:9:12: error: Invalid type for argument srcs to my_rule; expected list, was str [wrong-type]", issues[2].String())
+}
+
+func TestLintVisibilityNeedsBothPackages(t *testing.T) {
+	// Without lib's BUILD file we don't know anything about its targets' visibility.
+	issues, err := Lint(testConfig(), []string{"pkg/BUILD_FILE"})
+	require.NoError(t, err)
+	assert.NotContains(t, summarise(issues), "pkg/BUILD_FILE:25 missing-visibility")
+
+	issues, err = Lint(testConfig(), []string{"lib/BUILD_FILE", "pkg/BUILD_FILE"})
+	require.NoError(t, err)
+	assert.Contains(t, summarise(issues), "pkg/BUILD_FILE:25 missing-visibility")
+}
+
+func TestLintClean(t *testing.T) {
+	issues, err := Lint(testConfig(), []string{"clean/BUILD_FILE", "lib/BUILD_FILE", "build_defs/defs.build_defs"})
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+}
+
+func TestParseErrorHasNoLineInString(t *testing.T) {
+	issue := Issue{Filename: "BUILD", Severity: Error, Rule: "parse-error", Message: "oh no"}
+	assert.Equal(t, "BUILD: error: oh no [parse-error]", issue.String())
+}
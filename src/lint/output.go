@@ -0,0 +1,131 @@
+package lint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// Formats are the output formats that Write supports.
+var Formats = []string{"text", "json", "sarif"}
+
+// Write writes the given issues to w in the given format.
+func Write(w io.Writer, issues []Issue, format string) error {
+	switch format {
+	case "text", "":
+		for _, issue := range issues {
+			if _, err := fmt.Fprintln(w, issue); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		if issues == nil {
+			issues = []Issue{}
+		}
+		return writeJSON(w, issues)
+	case "sarif":
+		return writeJSON(w, toSARIF(issues))
+	}
+	return fmt.Errorf("Unknown output format %s", format)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// The following types implement the subset of SARIF 2.1.0 that we need.
+// See https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html for the full thing.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// toSARIF converts a set of issues to a SARIF log.
+func toSARIF(issues []Issue) *sarifLog {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "plz lint",
+			Version:        core.PleaseVersion,
+			InformationURI: "https://please.build",
+			Rules:          make([]sarifRule, len(Rules)),
+		}},
+		Results: make([]sarifResult, len(issues)),
+	}
+	for i, rule := range Rules {
+		run.Tool.Driver.Rules[i] = sarifRule{ID: rule.ID, ShortDescription: sarifMessage{Text: rule.Description}}
+	}
+	for i, issue := range issues {
+		loc := sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: issue.Filename}}
+		if issue.Line != 0 {
+			loc.Region = &sarifRegion{StartLine: issue.Line, StartColumn: issue.Column}
+		}
+		run.Results[i] = sarifResult{
+			RuleID:    issue.Rule,
+			Level:     string(issue.Severity),
+			Message:   sarifMessage{Text: issue.Message},
+			Locations: []sarifLocation{{PhysicalLocation: loc}},
+		}
+	}
+	return &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+}
@@ -0,0 +1,55 @@
+package lint
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testIssues = []Issue{
+	{Filename: "pkg/BUILD", Line: 3, Column: 5, Severity: Error, Rule: "unknown-argument", Message: "Unknown argument to my_rule: srcz"},
+	{Filename: "broken/BUILD", Severity: Error, Rule: "parse-error", Message: "oh no"},
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testIssues, "text"))
+	assert.Equal(t, "pkg/BUILD:3:5: error: Unknown argument to my_rule: srcz [unknown-argument]\nbroken/BUILD: error: oh no [parse-error]\n", buf.String())
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testIssues, "json"))
+	var issues []Issue
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &issues))
+	assert.Equal(t, testIssues, issues)
+
+	buf.Reset()
+	require.NoError(t, Write(&buf, nil, "json"))
+	assert.Equal(t, "[]\n", buf.String())
+}
+
+func TestWriteSARIF(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testIssues, "sarif"))
+	var log sarifLog
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	require.Len(t, log.Runs, 1)
+	run := log.Runs[0]
+	assert.Len(t, run.Tool.Driver.Rules, len(Rules))
+	require.Len(t, run.Results, 2)
+	assert.Equal(t, "unknown-argument", run.Results[0].RuleID)
+	assert.Equal(t, "error", run.Results[0].Level)
+	loc := run.Results[0].Locations[0].PhysicalLocation
+	assert.Equal(t, "pkg/BUILD", loc.ArtifactLocation.URI)
+	assert.Equal(t, &sarifRegion{StartLine: 3, StartColumn: 5}, loc.Region)
+	assert.Nil(t, run.Results[1].Locations[0].PhysicalLocation.Region)
+}
+
+func TestWriteUnknownFormat(t *testing.T) {
+	assert.Error(t, Write(&bytes.Buffer{}, testIssues, "xml"))
+}
@@ -0,0 +1,394 @@
+// Streams build events in a similar style to Bazel's Build Event Protocol, either to a file
+// or to a gRPC Build Event Service.
+// See https://bazel.build/remote/bep for the general idea; the events themselves are our own.
+
+package output
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	bes "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// The types of event that we emit.
+const (
+	buildStartedEvent     = "started"
+	targetConfiguredEvent = "targetConfigured"
+	actionCompletedEvent  = "actionCompleted"
+	testResultEvent       = "testResult"
+	buildFinishedEvent    = "buildFinished"
+)
+
+// besTimeout is how long we wait for the build event service to acknowledge everything at the end of the build.
+const besTimeout = 30 * time.Second
+
+// A buildEvent is a single event in the stream. Only one of the event-specific fields is populated,
+// corresponding to its type.
+type buildEvent struct {
+	Sequence         int64             `json:"sequence"`
+	Type             string            `json:"type"`
+	Time             time.Time         `json:"time"`
+	Label            string            `json:"label,omitempty"`
+	Started          *buildStarted     `json:"started,omitempty"`
+	TargetConfigured *targetConfigured `json:"targetConfigured,omitempty"`
+	ActionCompleted  *actionCompleted  `json:"actionCompleted,omitempty"`
+	TestResult       *testResult       `json:"testResult,omitempty"`
+	Finished         *buildFinished    `json:"buildFinished,omitempty"`
+}
+
+type buildStarted struct {
+	BuildID      string   `json:"buildId"`
+	InvocationID string   `json:"invocationId"`
+	Command      []string `json:"command"`
+	WorkingDir   string   `json:"workingDirectory"`
+}
+
+type targetConfigured struct {
+	Labels []string `json:"labels,omitempty"`
+	Test   bool     `json:"test,omitempty"`
+}
+
+type actionCompleted struct {
+	Success     bool           `json:"success"`
+	Cached      bool           `json:"cached,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Retries     int            `json:"retries,omitempty"`
+	Infra       bool           `json:"infrastructureFailure,omitempty"`
+	Usage       *resourceUsage `json:"resourceUsage,omitempty"`
+}
+
+type testResult struct {
+	Run      int            `json:"run,omitempty"`
+	Success  bool           `json:"success"`
+	Passed   int            `json:"passed"`
+	Failed   int            `json:"failed"`
+	Errored  int            `json:"errored"`
+	Skipped  int            `json:"skipped"`
+	Flaky    int            `json:"flaky"`
+	Cached   bool           `json:"cached,omitempty"`
+	Duration string         `json:"duration"`
+	Error    string         `json:"error,omitempty"`
+	Usage    *resourceUsage `json:"resourceUsage,omitempty"`
+}
+
+// resourceUsage describes the resources used by an action that ran locally in a cgroup.
+type resourceUsage struct {
+	PeakMemory uint64 `json:"peakMemoryBytes"`
+	CPUTime    string `json:"cpuTime"`
+}
+
+func newResourceUsage(usage *core.ResourceUsage) *resourceUsage {
+	if usage == nil {
+		return nil
+	}
+	return &resourceUsage{PeakMemory: usage.PeakMemory, CPUTime: usage.CPUTime.String()}
+}
+
+type buildFinished struct {
+	Success  bool   `json:"success"`
+	Duration string `json:"duration"`
+}
+
+// A buildEventSink is something that accepts build events.
+type buildEventSink interface {
+	Send(event *buildEvent) error
+	Close() error
+}
+
+// A buildEventStream converts build results into events and sends them to a set of sinks.
+type buildEventStream struct {
+	state      *core.BuildState
+	sinks      []buildEventSink
+	sequence   int64
+	configured map[core.BuildLabel]struct{}
+}
+
+// newBuildEventStream returns a new buildEventStream writing to the given file and/or gRPC endpoint.
+// It returns nil if neither are given.
+func newBuildEventStream(state *core.BuildState, filename, url string) *buildEventStream {
+	buildID := state.Config.Remote.BuildID
+	if buildID == "" {
+		buildID = uuid.New().String()
+	}
+	invocationID := uuid.New().String()
+	var sinks []buildEventSink
+	if filename != "" {
+		if sink, err := newFileEventSink(filename); err != nil {
+			log.Errorf("Couldn't create build event file: %s", err)
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if url != "" {
+		if sink, err := newBESEventSink(url, buildID, invocationID); err != nil {
+			log.Errorf("Couldn't connect to build event service at %s: %s", url, err)
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	s := &buildEventStream{
+		state:      state,
+		sinks:      sinks,
+		configured: map[core.BuildLabel]struct{}{},
+	}
+	wd, _ := os.Getwd()
+	s.send(&buildEvent{
+		Type: buildStartedEvent,
+		Time: state.StartTime,
+		Started: &buildStarted{
+			BuildID:      buildID,
+			InvocationID: invocationID,
+			Command:      os.Args,
+			WorkingDir:   wd,
+		},
+	})
+	return s
+}
+
+// AddResult converts a single build result to events, if it's relevant.
+func (s *buildEventStream) AddResult(result *core.BuildResult) {
+	if result.Status.IsParse() {
+		return
+	}
+	if _, present := s.configured[result.Label]; !present {
+		s.configured[result.Label] = struct{}{}
+		tc := &targetConfigured{}
+		if target := s.state.Graph.Target(result.Label); target != nil {
+			tc.Labels = target.Labels
+			tc.Test = target.IsTest()
+		}
+		s.send(&buildEvent{Type: targetConfiguredEvent, Time: result.Time, Label: result.Label.String(), TargetConfigured: tc})
+	}
+	switch result.Status {
+	case core.TargetBuilt, core.TargetCached, core.TargetBuildFailed:
+		s.send(&buildEvent{
+			Type:  actionCompletedEvent,
+			Time:  result.Time,
+			Label: result.Label.String(),
+			ActionCompleted: &actionCompleted{
+				Success:     result.Status != core.TargetBuildFailed,
+				Cached:      result.Status == core.TargetCached,
+				Description: result.Description,
+				Error:       errorString(result.Err),
+				Retries:     result.Retries,
+				Infra:       result.InfraFailure,
+				Usage:       newResourceUsage(result.ResourceUsage),
+			},
+		})
+	case core.TargetTested, core.TargetTestFailed:
+		s.send(&buildEvent{
+			Type:  testResultEvent,
+			Time:  result.Time,
+			Label: result.Label.String(),
+			TestResult: &testResult{
+				Run:      result.Run,
+				Success:  result.Status == core.TargetTested,
+				Passed:   result.Tests.Passes(),
+				Failed:   result.Tests.Failures(),
+				Errored:  result.Tests.Errors(),
+				Skipped:  result.Tests.Skips(),
+				Flaky:    result.Tests.FlakyPasses(),
+				Cached:   result.Tests.Cached,
+				Duration: result.Tests.Duration.String(),
+				Error:    errorString(result.Err),
+				Usage:    newResourceUsage(result.Tests.Usage),
+			},
+		})
+	}
+}
+
+// Finish sends the final event and closes all the sinks.
+func (s *buildEventStream) Finish(success bool) {
+	s.send(&buildEvent{
+		Type: buildFinishedEvent,
+		Time: time.Now(),
+		Finished: &buildFinished{
+			Success:  success,
+			Duration: time.Since(s.state.StartTime).String(),
+		},
+	})
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			log.Warning("Failed to close build event stream: %s", err)
+		}
+	}
+}
+
+func (s *buildEventStream) send(event *buildEvent) {
+	s.sequence++
+	event.Sequence = s.sequence
+	for _, sink := range s.sinks {
+		if err := sink.Send(event); err != nil {
+			log.Warning("Failed to send build event: %s", err)
+		}
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// A fileEventSink writes events to a file as JSON, one per line.
+type fileEventSink struct {
+	f   *os.File
+	b   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newFileEventSink(filename string) (*fileEventSink, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	b := bufio.NewWriter(f)
+	return &fileEventSink{f: f, b: b, enc: json.NewEncoder(b)}, nil
+}
+
+func (sink *fileEventSink) Send(event *buildEvent) error {
+	return sink.enc.Encode(event)
+}
+
+func (sink *fileEventSink) Close() error {
+	if err := sink.b.Flush(); err != nil {
+		return err
+	}
+	return sink.f.Close()
+}
+
+// A besEventSink streams events to a gRPC Build Event Service.
+// Each event is sent as a google.protobuf.Struct in the bazel_event field of the stream.
+type besEventSink struct {
+	conn         *grpc.ClientConn
+	stream       bes.PublishBuildEvent_PublishBuildToolEventStreamClient
+	cancel       context.CancelFunc
+	streamID     *bes.StreamId
+	lastSequence int64
+	acks         chan error
+}
+
+// newBESEventSink connects to the build event service at the given URL.
+// URLs beginning with grpcs:// use TLS; anything else is treated as insecure.
+func newBESEventSink(url, buildID, invocationID string) (*besEventSink, error) {
+	creds := insecure.NewCredentials()
+	if strings.HasPrefix(url, "grpcs://") {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	url = strings.TrimPrefix(strings.TrimPrefix(url, "grpcs://"), "grpc://")
+	conn, err := grpc.Dial(url, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := bes.NewPublishBuildEventClient(conn).PublishBuildToolEventStream(ctx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	sink := &besEventSink{
+		conn:   conn,
+		stream: stream,
+		cancel: cancel,
+		streamID: &bes.StreamId{
+			BuildId:      buildID,
+			InvocationId: invocationID,
+			Component:    bes.StreamId_TOOL,
+		},
+		acks: make(chan error, 1),
+	}
+	go sink.receive()
+	return sink, nil
+}
+
+// receive consumes acknowledgements from the server until the stream ends.
+func (sink *besEventSink) receive() {
+	for {
+		if _, err := sink.stream.Recv(); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			sink.acks <- err
+			return
+		}
+	}
+}
+
+func (sink *besEventSink) Send(event *buildEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s := &structpb.Struct{}
+	if err := protojson.Unmarshal(b, s); err != nil {
+		return err
+	}
+	a, err := anypb.New(s)
+	if err != nil {
+		return err
+	}
+	return sink.send(event.Sequence, &bes.BuildEvent{
+		EventTime: timestamppb.New(event.Time),
+		Event:     &bes.BuildEvent_BazelEvent{BazelEvent: a},
+	})
+}
+
+func (sink *besEventSink) send(sequence int64, event *bes.BuildEvent) error {
+	sink.lastSequence = sequence
+	return sink.stream.Send(&bes.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &bes.OrderedBuildEvent{
+			StreamId:       sink.streamID,
+			SequenceNumber: sequence,
+			Event:          event,
+		},
+	})
+}
+
+// Close marks the end of the stream and waits for the server to acknowledge everything.
+func (sink *besEventSink) Close() error {
+	defer sink.conn.Close()
+	defer sink.cancel()
+	if err := sink.send(sink.lastSequence+1, &bes.BuildEvent{
+		EventTime: timestamppb.Now(),
+		Event: &bes.BuildEvent_ComponentStreamFinished{
+			ComponentStreamFinished: &bes.BuildEvent_BuildComponentStreamFinished{
+				Type: bes.BuildEvent_BuildComponentStreamFinished_FINISHED,
+			},
+		},
+	}); err != nil {
+		return err
+	} else if err := sink.stream.CloseSend(); err != nil {
+		return err
+	}
+	select {
+	case err := <-sink.acks:
+		return err
+	case <-time.After(besTimeout):
+		return fmt.Errorf("timed out waiting for the build event service to acknowledge events")
+	}
+}
@@ -0,0 +1,164 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bes "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestBuildEventFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events.json")
+	state := core.NewDefaultBuildState()
+	events := newBuildEventStream(state, filename, "")
+	require.NotNil(t, events)
+	sendTestResults(state, events)
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	var all []buildEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event buildEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		all = append(all, event)
+	}
+	assertTestEvents(t, all)
+}
+
+func TestNoBuildEventStream(t *testing.T) {
+	assert.Nil(t, newBuildEventStream(core.NewDefaultBuildState(), "", ""))
+}
+
+func TestBuildEventService(t *testing.T) {
+	server := &fakeBES{}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	bes.RegisterPublishBuildEventServer(s, server)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	state := core.NewDefaultBuildState()
+	state.Config.Remote.BuildID = "build-1234"
+	events := newBuildEventStream(state, "", "grpc://"+lis.Addr().String())
+	require.NotNil(t, events)
+	sendTestResults(state, events)
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	require.Equal(t, 6, len(server.requests))
+	var all []buildEvent
+	for i, req := range server.requests {
+		obe := req.OrderedBuildEvent
+		assert.EqualValues(t, i+1, obe.SequenceNumber)
+		assert.Equal(t, "build-1234", obe.StreamId.BuildId)
+		assert.Equal(t, bes.StreamId_TOOL, obe.StreamId.Component)
+		if i == len(server.requests)-1 {
+			assert.Equal(t, bes.BuildEvent_BuildComponentStreamFinished_FINISHED, obe.Event.GetComponentStreamFinished().Type)
+			continue
+		}
+		s := &structpb.Struct{}
+		require.NoError(t, obe.Event.GetBazelEvent().UnmarshalTo(s))
+		b, err := s.MarshalJSON()
+		require.NoError(t, err)
+		var event buildEvent
+		require.NoError(t, json.Unmarshal(b, &event))
+		all = append(all, event)
+	}
+	assertTestEvents(t, all)
+}
+
+func sendTestResults(state *core.BuildState, events *buildEventStream) {
+	target := core.NewBuildTarget(core.NewBuildLabel("src/output", "test"))
+	target.Test = new(core.TestFields)
+	target.Labels = []string{"go"}
+	state.Graph.AddTarget(target)
+	now := time.Now()
+	events.AddResult(&core.BuildResult{Time: now, Label: core.BuildLabel{PackageName: "src/output", Name: "all"}, Status: core.PackageParsed})
+	events.AddResult(&core.BuildResult{Time: now, Label: target.Label, Status: core.TargetBuilding})
+	events.AddResult(&core.BuildResult{Time: now, Label: target.Label, Status: core.TargetBuilt, Description: "Built", ResourceUsage: &core.ResourceUsage{PeakMemory: 1024, CPUTime: 2 * time.Second}})
+	events.AddResult(&core.BuildResult{Time: now, Label: target.Label, Status: core.TargetTesting})
+	events.AddResult(&core.BuildResult{
+		Time:   now,
+		Label:  target.Label,
+		Status: core.TargetTestFailed,
+		Err:    fmt.Errorf("1 test failed"),
+		Tests: core.TestSuite{
+			TestCases: core.TestCases{
+				{Name: "TestPasses", Executions: []core.TestExecution{{}}},
+				{Name: "TestFails", Executions: []core.TestExecution{{Failure: &core.TestResultFailure{}}}},
+			},
+		},
+	})
+	events.Finish(false)
+}
+
+func assertTestEvents(t *testing.T, events []buildEvent) {
+	t.Helper()
+	require.Equal(t, 5, len(events))
+	for i, event := range events {
+		assert.EqualValues(t, i+1, event.Sequence)
+	}
+	assert.Equal(t, buildStartedEvent, events[0].Type)
+	assert.NotEmpty(t, events[0].Started.InvocationID)
+
+	assert.Equal(t, targetConfiguredEvent, events[1].Type)
+	assert.Equal(t, "//src/output:test", events[1].Label)
+	assert.Equal(t, &targetConfigured{Labels: []string{"go"}, Test: true}, events[1].TargetConfigured)
+
+	assert.Equal(t, actionCompletedEvent, events[2].Type)
+	assert.True(t, events[2].ActionCompleted.Success)
+	assert.Equal(t, &resourceUsage{PeakMemory: 1024, CPUTime: "2s"}, events[2].ActionCompleted.Usage)
+
+	assert.Equal(t, testResultEvent, events[3].Type)
+	assert.False(t, events[3].TestResult.Success)
+	assert.Equal(t, 1, events[3].TestResult.Passed)
+	assert.Equal(t, 1, events[3].TestResult.Failed)
+	assert.Equal(t, "1 test failed", events[3].TestResult.Error)
+
+	assert.Equal(t, buildFinishedEvent, events[4].Type)
+	assert.False(t, events[4].Finished.Success)
+}
+
+// A fakeBES records all the events streamed to it.
+type fakeBES struct {
+	bes.UnimplementedPublishBuildEventServer
+	mutex    sync.Mutex
+	requests []*bes.PublishBuildToolEventStreamRequest
+}
+
+func (f *fakeBES) PublishBuildToolEventStream(stream bes.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f.mutex.Lock()
+		f.requests = append(f.requests, req)
+		f.mutex.Unlock()
+		if err := stream.Send(&bes.PublishBuildToolEventStreamResponse{
+			StreamId:       req.OrderedBuildEvent.StreamId,
+			SequenceNumber: req.OrderedBuildEvent.SequenceNumber,
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// For writing out profiles of how long we spend parsing BUILD files.
+// These can either be written in pprof's format (see https://github.com/google/pprof/blob/main/proto/profile.proto)
+// or in the "folded" format that flame graph tools like https://github.com/brendangregg/FlameGraph and
+// https://www.speedscope.app understand.
+
+package output
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// ParseProfileFormats are the formats that WriteParseProfile supports.
+var ParseProfileFormats = []string{"pprof", "folded"}
+
+// WriteParseProfile writes the given parse profile to a file in the given format.
+func WriteParseProfile(profile *core.ParseProfile, filename, format string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := bufio.NewWriter(f)
+	switch format {
+	case "pprof", "":
+		err = writePprof(b, profile.Samples())
+	case "folded":
+		err = writeFolded(b, profile.Samples())
+	default:
+		return fmt.Errorf("Unknown parse profile format %s", format)
+	}
+	if err != nil {
+		return err
+	} else if err := b.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeFolded writes samples in the folded stack format, one line per stack with frames separated by semicolons
+// followed by the time spent in that stack in microseconds.
+func writeFolded(w io.Writer, samples []core.ParseProfileSample) error {
+	for _, sample := range samples {
+		names := make([]string, len(sample.Stack))
+		for i, frame := range sample.Stack {
+			names[i] = strings.ReplaceAll(frame.Name, ";", ":")
+		}
+		if _, err := fmt.Fprintf(w, "%s %d\n", strings.Join(names, ";"), sample.Self.Microseconds()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePprof writes samples as a gzipped pprof profile. Each sample has two values; the number of calls and the
+// wall time spent in it.
+func writePprof(w io.Writer, samples []core.ParseProfileSample) error {
+	p := pprofBuilder{
+		strings:   map[string]int64{"": 0},
+		table:     []string{""},
+		functions: map[core.ParseProfileFrame]uint64{},
+	}
+	var b []byte
+	for _, valueType := range [][2]string{{"calls", "count"}, {"wall", "nanoseconds"}} {
+		b = protowire.AppendTag(b, 1, protowire.BytesType) // sample_type
+		b = protowire.AppendBytes(b, p.valueType(valueType[0], valueType[1]))
+	}
+	for _, sample := range samples {
+		b = protowire.AppendTag(b, 2, protowire.BytesType) // sample
+		b = protowire.AppendBytes(b, p.sample(sample))
+	}
+	for _, fn := range p.functionList {
+		b = protowire.AppendTag(b, 4, protowire.BytesType) // location
+		b = protowire.AppendBytes(b, p.location(fn))
+	}
+	for _, fn := range p.functionList {
+		b = protowire.AppendTag(b, 5, protowire.BytesType) // function
+		b = protowire.AppendBytes(b, p.function(fn))
+	}
+	// The string table has to be written after everything else, since they add to it.
+	var strs []byte
+	for _, s := range p.table {
+		strs = protowire.AppendTag(strs, 6, protowire.BytesType) // string_table
+		strs = protowire.AppendString(strs, s)
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b); err != nil {
+		return err
+	} else if _, err := gz.Write(strs); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// A pprofBuilder helps with building the various tables in a pprof profile.
+type pprofBuilder struct {
+	strings      map[string]int64
+	table        []string
+	functions    map[core.ParseProfileFrame]uint64
+	functionList []core.ParseProfileFrame
+}
+
+// str returns the index of a string in the string table, adding it if needed.
+func (p *pprofBuilder) str(s string) int64 {
+	if idx, present := p.strings[s]; present {
+		return idx
+	}
+	idx := int64(len(p.table))
+	p.strings[s] = idx
+	p.table = append(p.table, s)
+	return idx
+}
+
+// functionID returns the ID of the given frame's function. We use the same ID for its location.
+func (p *pprofBuilder) functionID(frame core.ParseProfileFrame) uint64 {
+	if id, present := p.functions[frame]; present {
+		return id
+	}
+	p.functionList = append(p.functionList, frame)
+	id := uint64(len(p.functionList)) // IDs must be nonzero
+	p.functions[frame] = id
+	return id
+}
+
+func (p *pprofBuilder) valueType(typ, unit string) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(p.str(typ)))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(p.str(unit)))
+}
+
+func (p *pprofBuilder) sample(sample core.ParseProfileSample) []byte {
+	// Locations are listed innermost first, which is the opposite way round to how we store them.
+	var locations []byte
+	for i := len(sample.Stack) - 1; i >= 0; i-- {
+		locations = protowire.AppendVarint(locations, p.functionID(sample.Stack[i]))
+	}
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, locations)
+	var values []byte
+	values = protowire.AppendVarint(values, uint64(sample.Calls))
+	values = protowire.AppendVarint(values, uint64(sample.Self.Nanoseconds()))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, values)
+}
+
+func (p *pprofBuilder) location(frame core.ParseProfileFrame) []byte {
+	id := p.functions[frame]
+	var line []byte
+	line = protowire.AppendTag(line, 1, protowire.VarintType)
+	line = protowire.AppendVarint(line, id)
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, id)
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	return protowire.AppendBytes(b, line)
+}
+
+func (p *pprofBuilder) function(frame core.ParseProfileFrame) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.functions[frame])
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(p.str(frame.Name)))
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(p.str(frame.Filename)))
+}
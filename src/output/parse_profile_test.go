@@ -0,0 +1,76 @@
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+var testSamples = []core.ParseProfileSample{
+	{
+		Stack: []core.ParseProfileFrame{{Name: "package //src/core:all", Filename: "src/core/BUILD"}},
+		Calls: 1,
+		Self:  1500 * time.Microsecond,
+	},
+	{
+		Stack: []core.ParseProfileFrame{
+			{Name: "package //src/core:all", Filename: "src/core/BUILD"},
+			{Name: "go_library", Filename: "build_defs/go.build_defs"},
+			{Name: "glob", Filename: "<builtin>"},
+		},
+		Calls: 2,
+		Self:  3 * time.Millisecond,
+	},
+}
+
+func TestWriteFolded(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeFolded(&buf, testSamples))
+	assert.Equal(t, "package //src/core:all 1500\npackage //src/core:all;go_library;glob 3000\n", buf.String())
+}
+
+func TestWritePprof(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writePprof(&buf, testSamples))
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	b, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	// Count up the top-level fields of the profile, and check the strings we expect are in the string table.
+	fields := map[protowire.Number]int{}
+	var strs []string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.True(t, n > 0)
+		require.Equal(t, protowire.BytesType, typ)
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		fields[num]++
+		if num == 6 {
+			strs = append(strs, string(v))
+		}
+	}
+	assert.Equal(t, map[protowire.Number]int{
+		1: 2,  // sample types
+		2: 2,  // samples
+		4: 3,  // locations
+		5: 3,  // functions
+		6: 11, // strings
+	}, fields)
+	assert.Equal(t, "", strs[0])
+	assert.Contains(t, strs, "wall")
+	assert.Contains(t, strs, "nanoseconds")
+	assert.Contains(t, strs, "go_library")
+	assert.Contains(t, strs, "build_defs/go.build_defs")
+}
@@ -27,7 +27,7 @@ const testDurationGranularity = time.Millisecond
 
 // MonitorState monitors the build while it's running and prints output until the results
 // channel of state has completed.
-func MonitorState(state *core.BuildState, plainOutput, detailedTests, streamTestResults, shell, shellRun bool, traceFile string) {
+func MonitorState(state *core.BuildState, plainOutput, detailedTests, streamTestResults, shell, shellRun bool, traceFile, buildEventFile, buildEventURL string) {
 	initPrintf(state.Config)
 
 	if len(state.Config.Please.Motd) != 0 {
@@ -46,6 +46,10 @@ func MonitorState(state *core.BuildState, plainOutput, detailedTests, streamTest
 	defer t.Stop()
 	results := state.Results()
 	bt := newBuildingTargets(state, plainOutput)
+	events := newBuildEventStream(state, buildEventFile, buildEventURL)
+	if events != nil {
+		defer func() { events.Finish(len(bt.FailedTargets) == 0) }()
+	}
 	displayer.Update(bt.Targets())
 loop:
 	for {
@@ -57,6 +61,9 @@ loop:
 			if threadID := bt.ProcessResult(result); tw != nil && !result.Status.IsParse() {
 				tw.AddTrace(threadID, result, result.Status.IsActive())
 			}
+			if events != nil {
+				events.AddResult(result)
+			}
 			if streamTestResults && (result.Status == core.TargetTested || result.Status == core.TargetTestFailed) {
 				os.Stdout.Write(test.SerialiseResultsToXML(state.Graph.TargetOrDie(result.Label), false, state.Config.Test.StoreTestOutputOnSuccess))
 				os.Stdout.Write([]byte{'\n'})
@@ -69,7 +76,7 @@ loop:
 
 	duration := time.Since(state.StartTime).Round(durationGranularity)
 	if len(bt.FailedNonTests) > 0 { // Something failed in the build step.
-		printFailedBuildResults(bt.FailedNonTests, bt.FailedTargets, duration)
+		printFailedBuildResults(bt.FailedNonTests, bt.FailedTargets, duration, remoteRetries(state.Graph))
 		return
 	}
 	if state.NeedBuild {
@@ -92,7 +99,7 @@ loop:
 		} else if state.NeedHashesOnly {
 			printHashes(state, duration)
 		} else if !state.NeedRun { // Must be plz build or similar, report build outputs.
-			if !cli.IsATerminal(os.Stdout) {
+			if !cli.IsATerminal(os.Stdout) && !state.NoPrintOutputs {
 				printUnformattedBuildResults(state)
 			} else {
 				printBuildResults(state, duration)
@@ -165,7 +172,11 @@ func printTestResults(state *core.BuildState, failedTargets map[core.BuildLabel]
 				if target.Test.Results.TimedOut {
 				} else {
 					err := failedTargets[failed]
-					printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Failed to run test${RESET}: %v\n", target.Label, err)
+					if core.IsInfraFailure(err) {
+						printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Failed to run test (infrastructure failure)${RESET}: %v\n", target.Label, err)
+					} else {
+						printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Failed to run test${RESET}: %v\n", target.Label, err)
+					}
 					target.Test.Results.TestCases = append(target.Test.Results.TestCases, core.TestCase{
 						Executions: []core.TestExecution{
 							{
@@ -264,7 +275,7 @@ func printTestResults(state *core.BuildState, failedTargets map[core.BuildLabel]
 	}
 	printf(fmt.Sprintf("${BOLD_WHITE}%s and %s${BOLD_WHITE}.${RESET}\n",
 		pluralise(len(targets), "test target", "test targets"), testResultMessage(aggregate, false)))
-	printf("${BOLD_WHITE}Total time: %s real, %s compute.${RESET}\n", duration, aggregate.Duration.Round(durationGranularity))
+	printf("${BOLD_WHITE}Total time: %s real, %s compute%s.${RESET}\n", duration, aggregate.Duration.Round(durationGranularity), retrySummary(remoteRetries(state.Graph)))
 }
 
 func showExecutionOutput(execution core.TestExecution) {
@@ -390,7 +401,7 @@ func printBuildResults(state *core.BuildState, duration time.Duration) {
 		incrementality = 100 // avoid NaN
 	}
 	// Print this stuff so we always see it.
-	printf("Build finished; total time %s, incrementality %.1f%%.", duration, incrementality)
+	printf("Build finished; total time %s, incrementality %.1f%%%s.", duration, incrementality, retrySummary(remoteRetries(state.Graph)))
 	if state.RemoteClient != nil && state.OutputDownload == core.NoOutputDownload {
 		fmt.Printf("\n") // Outputs are not downloaded so do not print them out.
 		return
@@ -476,15 +487,19 @@ func buildResult(target *core.BuildTarget) []string {
 	return results
 }
 
-func printFailedBuildResults(failedTargets []core.BuildLabel, failedTargetMap map[core.BuildLabel]error, duration time.Duration) {
-	printf("${WHITE_ON_RED}Build stopped after %s. %s failed:${RESET}\n", duration, pluralise(len(failedTargetMap), "target", "targets"))
+func printFailedBuildResults(failedTargets []core.BuildLabel, failedTargetMap map[core.BuildLabel]error, duration time.Duration, retries int) {
+	printf("${WHITE_ON_RED}Build stopped after %s%s. %s failed:${RESET}\n", duration, retrySummary(retries), pluralise(len(failedTargetMap), "target", "targets"))
 	for _, label := range failedTargets {
 		err := failedTargetMap[label]
 		if err != nil {
+			infra := ""
+			if core.IsInfraFailure(err) {
+				infra = " (infrastructure failure)"
+			}
 			if cli.ShowColouredOutput {
-				printf("    ${BOLD_RED}%s\n${RESET}%s${RESET}\n", label, colouriseError(err))
+				printf("    ${BOLD_RED}%s%s\n${RESET}%s${RESET}\n", label, infra, colouriseError(err))
 			} else {
-				printf("    %s\n%s\n", label, err)
+				printf("    %s%s\n%s\n", label, infra, err)
 			}
 		} else {
 			printf("    ${BOLD_RED}%s${RESET}\n", label)
@@ -492,6 +507,23 @@ func printFailedBuildResults(failedTargets []core.BuildLabel, failedTargetMap ma
 	}
 }
 
+// remoteRetries returns the total number of times remote actions were retried during the build.
+func remoteRetries(graph *core.BuildGraph) int {
+	total := 0
+	for _, target := range graph.AllTargets() {
+		total += target.RemoteRetries()
+	}
+	return total
+}
+
+// retrySummary returns a description of the number of remote retries to append to a summary line.
+func retrySummary(retries int) string {
+	if retries == 0 {
+		return ""
+	}
+	return ", " + pluralise(retries, "remote retry", "remote retries")
+}
+
 // Since this is a gentleman's build tool, we'll make an effort to get plurals correct
 // in at least this one place.
 func pluralise(num int, singular, plural string) string {
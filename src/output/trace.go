@@ -82,6 +82,12 @@ func (tw *traceWriter) writeEvent(threadID int, result *core.BuildResult, phase
 	}
 	entry.Tid = fmt.Sprintf("Builder %d", threadID)
 	entry.Args.Description = result.Description
+	entry.Args.Retries = result.Retries
+	entry.Args.InfraFailure = result.InfraFailure
+	if usage := result.ResourceUsage; usage != nil && phase == "E" {
+		entry.Args.PeakMemory = usage.PeakMemory
+		entry.Args.CPUTime = usage.CPUTime.String()
+	}
 	if result.Err != nil {
 		entry.Args.Err = result.Err.Error()
 		entry.Cname = "terrible"
@@ -101,7 +107,11 @@ type traceEntry struct {
 	Ts    int64  `json:"ts"`
 	Cname string `json:"cname,omitempty"`
 	Args  struct {
-		Description string `json:"description"`
-		Err         string `json:"err,omitempty"`
+		Description  string `json:"description"`
+		Err          string `json:"err,omitempty"`
+		Retries      int    `json:"retries,omitempty"`
+		InfraFailure bool   `json:"infra_failure,omitempty"`
+		PeakMemory   uint64 `json:"peak_memory_bytes,omitempty"`
+		CPUTime      string `json:"cpu_time,omitempty"`
 	} `json:"args"`
 }
@@ -74,6 +74,9 @@ func registerBuiltins(s *scope) {
 	setNativeCode(s, "get_command", getCommand)
 	setNativeCode(s, "set_command", setCommand)
 	setNativeCode(s, "json", valueAsJSON)
+	setNativeCode(s, "struct", structFunc, false, kwargs)
+	setNativeCode(s, "add_provider", addProvider)
+	setNativeCode(s, "get_provider", getProvider)
 	setNativeCode(s, "breakpoint", breakpoint)
 	setNativeCode(s, "is_semver", isSemver)
 	setNativeCode(s, "semver_check", semverCheck)
@@ -197,6 +200,10 @@ func buildRule(s *scope, args []pyObject) pyObject {
 	}
 
 	target := createTarget(s, args)
+	target.Kind = s.ruleKind
+	if target.Kind == "" {
+		target.Kind = "build_rule" // Called directly from the BUILD file
+	}
 	s.Assert(s.pkg.Target(target.Label.Name) == nil, "Duplicate build target in %s: %s", s.pkg.Name, target.Label.Name)
 	populateTarget(s, target, args)
 	s.state.AddTarget(s.pkg, target)
@@ -280,6 +287,7 @@ func tagName(name, tag string) string {
 // bazelLoad implements the load() builtin, which is only available for Bazel compatibility.
 func bazelLoad(s *scope, args []pyObject) pyObject {
 	s.Assert(s.state.Config.Bazel.Compatibility, "load() is only available in Bazel compatibility mode. See `plz help bazel` for more information.")
+	s.noCache("it calls load()")
 	// The argument always looks like a build label, but it is not really one (i.e. there is no BUILD file that defines it).
 	// We do not support their legacy syntax here (i.e. "/tools/build_rules/build_test" etc).
 	l := s.parseLabelInContextPkg(string(args[0].(pyString)))
@@ -350,6 +358,7 @@ func subinclude(s *scope, args []pyObject) pyObject {
 		} else {
 			outs = t.Outputs()
 		}
+		s.recordSubinclude(t, annotation)
 		for _, out := range outs {
 			s.SetAll(s.interpreter.Subinclude(s, filepath.Join(t.OutDir(), out), t.Label, false), false)
 		}
@@ -360,6 +369,17 @@ func subinclude(s *scope, args []pyObject) pyObject {
 // subincludeTarget returns the target for a subinclude() call to a label.
 // It blocks until the target exists and is built.
 func subincludeTarget(s *scope, l core.BuildLabel) *core.BuildTarget {
+	t := s.buildSubincludeTarget(l)
+	// TODO(jpoole): when pkg is nil, that means this subinclude was made by another subinclude. We're currently loosing
+	// this information here. We probably need a way to transitively record the subincludes.
+	if s.pkg != nil {
+		s.pkg.RegisterSubinclude(l)
+	}
+	return t
+}
+
+// buildSubincludeTarget is like subincludeTarget but doesn't register the subinclude on the package.
+func (s *scope) buildSubincludeTarget(l core.BuildLabel) *core.BuildTarget {
 	s.NAssert(l.IsPseudoTarget(), "Can't pass :all or /... to subinclude()")
 
 	pkg := s.contextPackage()
@@ -400,14 +420,7 @@ func subincludeTarget(s *scope, l core.BuildLabel) *core.BuildTarget {
 		}
 	}
 
-	t := s.WaitForSubincludedTarget(l, pkgLabel)
-
-	// TODO(jpoole): when pkg is nil, that means this subinclude was made by another subinclude. We're currently loosing
-	// this information here. We probably need a way to transitively record the subincludes.
-	if s.pkg != nil {
-		s.pkg.RegisterSubinclude(l)
-	}
-	return t
+	return s.WaitForSubincludedTarget(l, pkgLabel)
 }
 
 func lenFunc(s *scope, args []pyObject) pyObject {
@@ -488,6 +501,8 @@ func isType(obj pyObject, name string) bool {
 		return name == "dict"
 	case *pyConfig:
 		return name == "config"
+	case *pyStruct:
+		return name == "struct"
 	case *pyFunc:
 		return name == "callable"
 	}
@@ -669,15 +684,8 @@ func glob(s *scope, args []pyObject) pyObject {
 	includeSymlinks := args[3].IsTruthy()
 	allowEmpty := args[4].IsTruthy()
 	exclude = append(exclude, s.state.Config.Parse.BuildFileName...)
-	if s.globber == nil {
-		if s.pkg.Subrepo != nil {
-			s.globber = fs.NewGlobber(s.pkg.Subrepo.FS(), s.state.Config.Parse.BuildFileName)
-		} else {
-			s.globber = fs.NewGlobber(fs.HostFS, s.state.Config.Parse.BuildFileName)
-		}
-	}
-
-	glob := s.globber.Glob(s.pkg.Name, include, exclude, hidden, includeSymlinks)
+	glob := s.globberForPackage().Glob(s.pkg.Name, include, exclude, hidden, includeSymlinks)
+	s.recordGlob(include, exclude, hidden, includeSymlinks, glob)
 	if !allowEmpty && len(glob) == 0 {
 		// Strip build file name from exclude list for error message
 		exclude = exclude[:len(exclude)-len(s.state.Config.Parse.BuildFileName)]
@@ -687,6 +695,18 @@ func glob(s *scope, args []pyObject) pyObject {
 	return fromStringList(glob)
 }
 
+// globberForPackage returns the globber for this scope's package, creating it if needed.
+func (s *scope) globberForPackage() *fs.Globber {
+	if s.globber == nil {
+		if s.pkg.Subrepo != nil {
+			s.globber = fs.NewGlobber(s.pkg.Subrepo.FS(), s.state.Config.Parse.BuildFileName)
+		} else {
+			s.globber = fs.NewGlobber(fs.HostFS, s.state.Config.Parse.BuildFileName)
+		}
+	}
+	return s.globber
+}
+
 func pyStrOrListAsList(s *scope, arg pyObject, name string) []string {
 	if str, ok := arg.(pyString); ok {
 		return []string{str.String()}
@@ -1043,6 +1063,7 @@ func getLabels(s *scope, args []pyObject) pyObject {
 	all := args[2].IsTruthy()
 	transitive := args[3].IsTruthy()
 	if core.LooksLikeABuildLabel(name) {
+		s.noCache("it calls get_labels() on " + name)
 		label := core.ParseBuildLabel(name, s.pkg.Name)
 		return getLabelsInternal(s.state.Graph.TargetOrDie(label), prefix, core.Built, all, transitive)
 	}
@@ -1056,6 +1077,7 @@ func addLabel(s *scope, args []pyObject) pyObject {
 
 	var target *core.BuildTarget
 	if core.LooksLikeABuildLabel(name) {
+		s.noCache("it calls add_label() on " + name)
 		label := core.ParseBuildLabel(name, s.pkg.Name)
 		target = s.state.Graph.TargetOrDie(label)
 	} else {
@@ -1209,6 +1231,7 @@ func addOut(s *scope, args []pyObject) pyObject {
 func getOuts(s *scope, args []pyObject) pyObject {
 	var target *core.BuildTarget
 	if name := args[0].String(); core.LooksLikeABuildLabel(name) {
+		s.noCache("it calls get_outs() on " + name)
 		label := core.ParseBuildLabel(name, s.pkg.Name)
 		target = s.state.Graph.TargetOrDie(label)
 	} else {
@@ -1227,6 +1250,7 @@ func getOuts(s *scope, args []pyObject) pyObject {
 func getNamedOuts(s *scope, args []pyObject) pyObject {
 	var target *core.BuildTarget
 	if name := args[0].String(); core.LooksLikeABuildLabel(name) {
+		s.noCache("it calls get_named_outs() on " + name)
 		label := core.ParseBuildLabel(name, s.pkg.Name)
 		target = s.state.Graph.TargetOrDie(label)
 	} else {
@@ -1316,6 +1340,53 @@ func valueAsJSON(s *scope, args []pyObject) pyObject {
 	return pyString(js)
 }
 
+// structFunc implements struct(), which creates an immutable struct from its keyword arguments.
+func structFunc(s *scope, args []pyObject) pyObject {
+	return newPyStruct(s.locals)
+}
+
+// addProvider attaches a provider to a target in the current package.
+func addProvider(s *scope, args []pyObject) pyObject {
+	target := getTargetPost(s, string(args[0].(pyString)))
+	provider, ok := args[2].(*pyStruct)
+	s.Assert(ok, "Providers must be structs, not %s", args[2].Type())
+	target.AddProvider(string(args[1].(pyString)), provider)
+	return None
+}
+
+// getProvider returns a provider attached to a target, or the given default if it doesn't have one by that name.
+// The target can be in another package, in which case we wait for that package to be parsed.
+func getProvider(s *scope, args []pyObject) pyObject {
+	name := string(args[0].(pyString))
+	var target *core.BuildTarget
+	if !core.LooksLikeABuildLabel(name) {
+		target = s.pkg.Target(name)
+		s.Assert(target != nil, "Unknown build target %s in %s", name, s.pkg.Name)
+	} else if label := s.parseLabelInContextPkg(name); s.pkg != nil && label.Subrepo == s.pkg.SubrepoName && label.PackageName == s.pkg.Name {
+		target = s.pkg.Target(label.Name)
+		s.Assert(target != nil, "Target %s is not defined in this package; it has to be defined before get_provider() is called on it", label)
+	} else {
+		s.noCache("it calls get_provider() on " + name)
+		target = s.WaitForTarget(label)
+	}
+	if provider, present := target.Provider(string(args[1].(pyString))); present {
+		return provider.(pyObject)
+	}
+	return args[2]
+}
+
+// WaitForTarget drops the interpreter lock and waits for the package containing the given target to be parsed,
+// then returns the target.
+func (s *scope) WaitForTarget(label core.BuildLabel) *core.BuildTarget {
+	s.interpreter.limiter.Release()
+	pkg := s.state.WaitForPackage(label, s.contextPackage().Label(), s.mode)
+	s.interpreter.limiter.Acquire()
+	s.Assert(pkg != nil, "Failed to parse package %s", label.PackageName)
+	target := pkg.Target(label.Name)
+	s.Assert(target != nil, "Unknown build target %s", label)
+	return target
+}
+
 // setCommand sets the command of a target, optionally for a configuration.
 func setCommand(s *scope, args []pyObject) pyObject {
 	target := getTargetPost(s, string(args[0].(pyString)))
@@ -1361,6 +1432,7 @@ func selectTarget(s *scope, l core.BuildLabel) *core.BuildTarget {
 
 // subrepo implements the subrepo() builtin that adds a new repository.
 func subrepo(s *scope, args []pyObject) pyObject {
+	s.noCache("it defines a subrepo")
 	const (
 		NameArgIdx = iota
 		DepArgIdx
@@ -1450,6 +1522,7 @@ func breakpoint(s *scope, args []pyObject) pyObject {
 		log.Warningf("Skipping breakpoint. Use --debug to enable breakpoints.")
 		return None
 	}
+	s.noCache("it contains a breakpoint")
 	// Take this mutex to ensure only one debugger runs at a time
 	s.interpreter.breakpointMutex.Lock()
 	defer s.interpreter.breakpointMutex.Unlock()
@@ -0,0 +1,394 @@
+package asp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/please-build/gcfg"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// parseCacheDir is the directory that we persist parsed packages in.
+var parseCacheDir = filepath.Join(core.OutDir, "parse")
+
+// Entries that haven't been used for this long are removed from the parse cache.
+// Every change to a BUILD file or the config creates new entries, so they'd build up forever otherwise.
+const parseCacheMaxAge = 7 * 24 * time.Hour
+
+// parseCachePruneInterval is how often we check the parse cache for old entries.
+const parseCachePruneInterval = 24 * time.Hour
+
+// A parseCache persists the targets that result from interpreting BUILD files, so that packages
+// that haven't changed can be loaded in later invocations without interpreting them again.
+//
+// Entries are keyed on the contents of the BUILD file and on everything global that can affect
+// it (config, preloaded build defs etc). Each one also records the other inputs that were
+// discovered during interpretation (subincludes and globs) which are checked before it's used.
+type parseCache struct {
+	dir string
+	// The global part of the key for each state, since subrepos and architectures have different config.
+	stateKeys sync.Map
+	// Hashes of the files we've read. They are all outputs of subincluded targets, so don't change during a build.
+	fileHashes sync.Map
+	// The inputs recorded while interpreting each subinclude.
+	subincludeInputs sync.Map
+}
+
+// A cacheEntry is what we store in the parse cache for each package.
+type cacheEntry struct {
+	Inputs  cacheInputs
+	Targets []byte
+}
+
+// cacheInputs are the inputs to interpreting a package (or subinclude) that we find out about as we go.
+type cacheInputs struct {
+	Subincludes []cachedSubinclude
+	Globs       []cachedGlob
+	// Set to a description of why the package can't be cached, if it can't be.
+	Uncacheable string
+}
+
+type cachedSubinclude struct {
+	Subrepo, PackageName, Name string
+	Annotation                 string
+	// True if this was subincluded from another subinclude, rather than directly from the package.
+	Nested bool
+	// Hash of the subincluded files.
+	Hash []byte
+}
+
+func (inc *cachedSubinclude) label() core.BuildLabel {
+	return core.BuildLabel{Subrepo: inc.Subrepo, PackageName: inc.PackageName, Name: inc.Name}
+}
+
+type cachedGlob struct {
+	Include, Exclude        []string
+	Hidden, IncludeSymlinks bool
+	Files                   []string
+}
+
+// merge adds the inputs recorded for a subinclude to this set.
+func (inputs *cacheInputs) merge(sub *cacheInputs) {
+	for _, inc := range sub.Subincludes {
+		inc.Nested = true
+		inputs.Subincludes = append(inputs.Subincludes, inc)
+	}
+	inputs.Globs = append(inputs.Globs, sub.Globs...)
+	if inputs.Uncacheable == "" {
+		inputs.Uncacheable = sub.Uncacheable
+	}
+}
+
+func newParseCache() *parseCache {
+	c := &parseCache{dir: parseCacheDir}
+	if now := time.Now(); c.shouldPrune(now) {
+		go c.prune(now.Add(-parseCacheMaxAge))
+	}
+	return c
+}
+
+// shouldPrune returns true if it's time to check the cache for old entries. It records when it last
+// returned true in a marker file, so only one invocation a day does it.
+func (c *parseCache) shouldPrune(now time.Time) bool {
+	marker := filepath.Join(c.dir, "last_pruned")
+	info, err := os.Stat(marker)
+	if os.IsNotExist(err) {
+		// A new cache has nothing to prune yet.
+		if err := fs.WriteFile(bytes.NewReader(nil), marker, 0); err != nil {
+			log.Debug("Failed to create %s: %s", marker, err)
+		}
+		return false
+	} else if err != nil || now.Sub(info.ModTime()) < parseCachePruneInterval {
+		return false
+	} else if err := os.Chtimes(marker, now, now); err != nil {
+		log.Debug("Failed to update %s: %s", marker, err)
+		return false
+	}
+	return true
+}
+
+// prune removes all cache entries that were last used before the given time.
+func (c *parseCache) prune(before time.Time) {
+	removed := 0
+	if err := filepath.WalkDir(c.dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		} else if info, err := d.Info(); err == nil && info.ModTime().Before(before) {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Debug("Failed to prune parse cache: %s", err)
+	}
+	log.Debug("Removed %d old entries from the parse cache", removed)
+}
+
+// noCache marks the package currently being interpreted as one that can't be cached.
+func (s *scope) noCache(reason string) {
+	if s.record != nil && !s.Callback && s.record.Uncacheable == "" {
+		s.record.Uncacheable = reason
+	}
+}
+
+// recordGlob records a call to glob() in the package currently being interpreted.
+func (s *scope) recordGlob(include, exclude []string, hidden, includeSymlinks bool, files []string) {
+	if s.record != nil && !s.Callback {
+		s.record.Globs = append(s.record.Globs, cachedGlob{
+			Include:         include,
+			Exclude:         exclude,
+			Hidden:          hidden,
+			IncludeSymlinks: includeSymlinks,
+			Files:           files,
+		})
+	}
+}
+
+// recordSubinclude records a call to subinclude() in the package currently being interpreted.
+func (s *scope) recordSubinclude(t *core.BuildTarget, annotation string) {
+	if s.record == nil || s.Callback {
+		return
+	}
+	if pkg := s.contextPackage(); t.Label.Subrepo == pkg.SubrepoName && t.Label.PackageName == pkg.Name {
+		s.noCache("it subincludes a target in the same package")
+		return
+	}
+	hash, err := s.interpreter.cache.hashSubinclude(s.state, t, annotation)
+	if err != nil {
+		s.noCache(err.Error())
+		return
+	}
+	s.record.Subincludes = append(s.record.Subincludes, cachedSubinclude{
+		Subrepo:     t.Label.Subrepo,
+		PackageName: t.Label.PackageName,
+		Name:        t.Label.Name,
+		Annotation:  annotation,
+		Hash:        hash,
+	})
+}
+
+// hashSubinclude returns a hash of the files that subincluding the given target would load.
+func (c *parseCache) hashSubinclude(state *core.BuildState, t *core.BuildTarget, annotation string) ([]byte, error) {
+	h := sha256.New()
+	outs := t.Outputs()
+	if annotation != "" {
+		outs = t.NamedOutputs(annotation)
+	}
+	for _, out := range outs {
+		path := filepath.Join(t.OutDir(), out)
+		hash, err := c.hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(path))
+		h.Write(hash)
+	}
+	// Plugins can also have config of their own that affects what their build defs do.
+	if t.Label.Subrepo != "" {
+		if subrepo := state.Graph.Subrepo(t.Label.Subrepo); subrepo != nil && subrepo.State != nil && subrepo.State.RepoConfig != nil {
+			config, err := canonicalConfig(subrepo.State.RepoConfig)
+			if err != nil {
+				return nil, err
+			}
+			h.Write(config)
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// hashFile returns the hash of a single file.
+func (c *parseCache) hashFile(path string) ([]byte, error) {
+	if hash, present := c.fileHashes.Load(path); present {
+		return hash.([]byte), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(b)
+	c.fileHashes.Store(path, hash[:])
+	return hash[:], nil
+}
+
+// stateKey returns the part of the cache key that's common to all packages parsed for a state.
+func (c *parseCache) stateKey(state *core.BuildState) ([]byte, error) {
+	if key, present := c.stateKeys.Load(state); present {
+		return key.([]byte), nil
+	}
+	h := sha256.New()
+	h.Write([]byte(core.PleaseVersion))
+	h.Write([]byte(state.Arch.String()))
+	h.Write([]byte(state.CurrentSubrepo))
+	config, err := canonicalConfig(state.Config)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(config)
+	for _, filename := range state.Config.Parse.PreloadBuildDefs {
+		hash, err := c.hashFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(hash)
+	}
+	for _, label := range state.GetPreloadedSubincludes() {
+		t := state.Graph.Target(label)
+		if t == nil || !t.State().IsBuilt() {
+			return nil, fmt.Errorf("preloaded subinclude %s isn't built yet", label)
+		}
+		hash, err := c.hashSubinclude(state, t, "")
+		if err != nil {
+			return nil, err
+		}
+		h.Write(hash)
+	}
+	key := h.Sum(nil)
+	c.stateKeys.Store(state, key)
+	return key, nil
+}
+
+// canonicalConfig returns a serialised form of the given config that is consistent between runs.
+func canonicalConfig(config *core.Configuration) ([]byte, error) {
+	b, err := gcfg.RawJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	// RawJSON doesn't sort map keys, but the standard library does.
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Path returns the path to the cache entry for the given BUILD file.
+func (c *parseCache) Path(state *core.BuildState, pkg *core.Package, fileSystem iofs.FS, filename string) (string, error) {
+	key, err := c.stateKey(state)
+	if err != nil {
+		return "", err
+	}
+	var contents []byte
+	if fileSystem == nil {
+		contents, err = os.ReadFile(filename)
+	} else {
+		contents, err = iofs.ReadFile(fileSystem, filename)
+	}
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte(pkg.SubrepoName))
+	h.Write([]byte{0})
+	h.Write([]byte(pkg.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(filename))
+	h.Write([]byte{0})
+	h.Write(contents)
+	hash := hex.EncodeToString(h.Sum(nil))
+	return filepath.Join(c.dir, hash[:2], hash), nil
+}
+
+// Load loads the cache entry at the given path. It returns nil if there isn't one.
+func (c *parseCache) Load(path string) *cacheEntry {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(entry); err != nil {
+		log.Warning("Failed to read parse cache entry %s: %s", path, err)
+		return nil
+	}
+	// Mark it as used so it doesn't get pruned.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Debug("Failed to update modification time on %s: %s", path, err)
+	}
+	return entry
+}
+
+// Store stores a cache entry for a package that has just been interpreted.
+func (c *parseCache) Store(path string, pkg *core.Package, inputs *cacheInputs) {
+	if inputs.Uncacheable != "" {
+		log.Debug("Not caching parse results for %s: %s", pkg.Label(), inputs.Uncacheable)
+		return
+	}
+	targets, err := core.EncodeTargets(pkg.AllTargets())
+	if err != nil {
+		log.Debug("Not caching parse results for %s: %s", pkg.Label(), err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cacheEntry{Inputs: *inputs, Targets: targets}); err != nil {
+		log.Warning("Failed to encode parse cache entry for %s: %s", pkg.Label(), err)
+	} else if err := fs.WriteFile(&buf, path, 0); err != nil {
+		log.Warning("Failed to write parse cache entry for %s: %s", pkg.Label(), err)
+	}
+}
+
+// restore attempts to restore a package from the given cache entry.
+// It returns false if any of the inputs recorded in the entry have changed, in which case the package
+// needs to be interpreted as normal.
+func (i *interpreter) restore(pkg *core.Package, mode core.ParseMode, entry *cacheEntry) (ok bool) {
+	s := i.scope.NewPackagedScope(pkg, mode, 0)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debug("Not restoring %s from the parse cache: %s", pkg.Label(), handleErrors(r))
+			ok = false
+		}
+	}()
+	// Subincludes aren't registered on the package until we know the entry is valid, since it
+	// gets interpreted as normal otherwise and that registers whatever it subincludes now.
+	for _, inc := range entry.Inputs.Subincludes {
+		t := s.buildSubincludeTarget(inc.label())
+		if !inc.Nested && !pkg.Label().CanSee(s.state, t) {
+			return false
+		}
+		if hash, err := i.cache.hashSubinclude(s.state, t, inc.Annotation); err != nil || !bytes.Equal(hash, inc.Hash) {
+			log.Debug("Not restoring %s from the parse cache: subinclude %s has changed", pkg.Label(), t.Label)
+			return false
+		}
+	}
+	for _, g := range entry.Inputs.Globs {
+		if files := s.globberForPackage().Glob(pkg.Name, g.Include, g.Exclude, g.Hidden, g.IncludeSymlinks); !slices.Equal(files, g.Files) {
+			log.Debug("Not restoring %s from the parse cache: glob results have changed", pkg.Label())
+			return false
+		}
+	}
+	targets, err := core.DecodeTargets(entry.Targets, pkg)
+	if err != nil {
+		log.Warning("Failed to decode parse cache entry for %s: %s", pkg.Label(), err)
+		return false
+	}
+	for _, inc := range entry.Inputs.Subincludes {
+		if !inc.Nested {
+			pkg.RegisterSubinclude(inc.label())
+		}
+	}
+	for _, target := range targets {
+		s.state.AddTarget(pkg, target)
+	}
+	return true
+}
+
+// stateFor returns the state that the given package is parsed with.
+func (i *interpreter) stateFor(pkg *core.Package) *core.BuildState {
+	if pkg.Subrepo != nil && pkg.Subrepo.State != nil {
+		return pkg.Subrepo.State
+	}
+	return i.scope.state
+}
@@ -0,0 +1,161 @@
+package asp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+const cacheTestBuildFile = `
+build_rule(
+    name = "lib",
+    srcs = glob(["*.txt"]),
+    outs = ["lib.out"],
+    cmd = "cat $SRCS > $OUT",
+    labels = ["cached"],
+)
+
+build_rule(
+    name = "bin",
+    srcs = {"lib": [":lib"]},
+    outs = ["bin.out"],
+    cmd = "cp $SRCS_LIB $OUT",
+    binary = True,
+    visibility = ["PUBLIC"],
+)
+`
+
+// inTempRepo runs the given function in a temporary directory containing a package with the test BUILD file.
+func inTempRepo(t *testing.T, f func()) {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "pkg"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pkg/BUILD"), []byte(cacheTestBuildFile), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pkg/a.txt"), nil, 0644))
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	f()
+}
+
+// parseWithCache parses the test package with a fresh parser, as a new invocation of plz would.
+// It returns the package and true if it was restored from the cache rather than interpreted.
+func parseWithCache(t *testing.T) (*core.Package, bool) {
+	t.Helper()
+	state := core.NewDefaultBuildState()
+	state.Config.Parse.Cache = true
+	state.ParseProfile = core.NewParseProfile()
+	parser := NewParser(state)
+	src, err := rules.ReadAsset("builtins.build_defs")
+	require.NoError(t, err)
+	parser.MustLoadBuiltins("builtins.build_defs", src)
+	pkg := core.NewPackage("pkg")
+	pkg.Filename = "pkg/BUILD"
+	require.NoError(t, parser.ParseFile(pkg, nil, nil, core.ParseModeNormal, nil, pkg.Filename))
+	return pkg, len(state.ParseProfile.Samples()) == 0
+}
+
+func TestParseCacheRestoresPackage(t *testing.T) {
+	inTempRepo(t, func() {
+		pkg, restored := parseWithCache(t)
+		assert.False(t, restored)
+		assert.Equal(t, 2, pkg.NumTargets())
+
+		pkg2, restored := parseWithCache(t)
+		assert.True(t, restored)
+		require.Equal(t, 2, pkg2.NumTargets())
+		lib := pkg2.Target("lib")
+		assert.Equal(t, []core.BuildInput{core.FileLabel{File: "a.txt", Package: "pkg"}}, lib.Sources)
+		assert.Equal(t, []string{"lib.out"}, lib.Outputs())
+		assert.Equal(t, []string{"cached"}, lib.Labels)
+		bin := pkg2.Target("bin")
+		assert.True(t, bin.IsBinary)
+		assert.Equal(t, []core.BuildLabel{core.WholeGraph[0]}, bin.Visibility)
+		assert.Equal(t, []core.BuildLabel{{PackageName: "pkg", Name: "lib"}}, bin.DeclaredDependencies())
+		assert.Equal(t, pkg.Target("bin").AllSources(), bin.AllSources())
+		assert.True(t, pkg2.HasOutput("lib.out"))
+	})
+}
+
+func TestParseCacheInvalidatedByGlob(t *testing.T) {
+	inTempRepo(t, func() {
+		_, restored := parseWithCache(t)
+		assert.False(t, restored)
+		require.NoError(t, os.WriteFile("pkg/b.txt", nil, 0644))
+		pkg, restored := parseWithCache(t)
+		assert.False(t, restored)
+		assert.Equal(t, 2, len(pkg.Target("lib").Sources))
+		_, restored = parseWithCache(t)
+		assert.True(t, restored)
+	})
+}
+
+func TestParseCacheInvalidatedByBuildFile(t *testing.T) {
+	inTempRepo(t, func() {
+		_, restored := parseWithCache(t)
+		assert.False(t, restored)
+		require.NoError(t, os.WriteFile("pkg/BUILD", []byte(cacheTestBuildFile+"\n# a comment\n"), 0644))
+		_, restored = parseWithCache(t)
+		assert.False(t, restored)
+	})
+}
+
+func TestParseCacheSkipsUncacheablePackages(t *testing.T) {
+	inTempRepo(t, func() {
+		cache := newParseCache()
+		pkg := core.NewPackage("pkg")
+		cache.Store("plz-out/parse/entry", pkg, &cacheInputs{Uncacheable: "it calls git_branch()"})
+		assert.NoFileExists(t, "plz-out/parse/entry")
+		cache.Store("plz-out/parse/entry", pkg, &cacheInputs{})
+		assert.FileExists(t, "plz-out/parse/entry")
+	})
+}
+
+func TestCacheInputsMerge(t *testing.T) {
+	inputs := &cacheInputs{
+		Subincludes: []cachedSubinclude{{PackageName: "build_defs", Name: "go"}},
+	}
+	inputs.merge(&cacheInputs{
+		Subincludes: []cachedSubinclude{{PackageName: "build_defs", Name: "proto"}},
+		Uncacheable: "it calls git_commit()",
+	})
+	assert.Equal(t, []cachedSubinclude{
+		{PackageName: "build_defs", Name: "go"},
+		{PackageName: "build_defs", Name: "proto", Nested: true},
+	}, inputs.Subincludes)
+	assert.Equal(t, "it calls git_commit()", inputs.Uncacheable)
+}
+
+func TestParseCachePrune(t *testing.T) {
+	cache := &parseCache{dir: t.TempDir()}
+	now := time.Now()
+	assert.False(t, cache.shouldPrune(now))
+	assert.False(t, cache.shouldPrune(now.Add(time.Hour)))
+	assert.True(t, cache.shouldPrune(now.Add(parseCachePruneInterval)))
+	assert.False(t, cache.shouldPrune(now.Add(parseCachePruneInterval+time.Hour)))
+
+	old := filepath.Join(cache.dir, "ab", "abcd")
+	recent := filepath.Join(cache.dir, "cd", "cdef")
+	used := filepath.Join(cache.dir, "ef", "ef01")
+	for _, path := range []string{old, recent, used} {
+		cache.Store(path, core.NewPackage("pkg"), &cacheInputs{})
+	}
+	then := now.Add(-2 * parseCacheMaxAge)
+	require.NoError(t, os.Chtimes(old, then, then))
+	require.NoError(t, os.Chtimes(used, then, then))
+	// Loading an entry marks it as recently used.
+	assert.NotNil(t, cache.Load(used))
+	cache.prune(now.Add(-parseCacheMaxAge))
+	assert.NoFileExists(t, old)
+	assert.FileExists(t, recent)
+	assert.FileExists(t, used)
+	assert.FileExists(t, filepath.Join(cache.dir, "last_pruned"))
+}
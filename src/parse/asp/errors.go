@@ -94,6 +94,15 @@ func (stack *errorStack) ShortError() string {
 	return stack.err.Error()
 }
 
+// ErrorPosition returns the position that an error from parsing or interpreting occurred at, and a
+// short message describing it. The position is zero if the error doesn't have one.
+func ErrorPosition(err error) (FilePosition, string) {
+	if stack, ok := err.(*errorStack); ok && len(stack.Stack) > 0 {
+		return stack.Stack[0], stack.ShortError()
+	}
+	return FilePosition{}, err.Error()
+}
+
 // stackTrace returns the lines of stacktrace from the error.
 func (stack *errorStack) stackTrace() string {
 	ret := make([]string, len(stack.Stack))
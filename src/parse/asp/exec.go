@@ -9,6 +9,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/thought-machine/please/src/scm"
 )
 
 type execKey struct {
@@ -178,6 +180,14 @@ func execGetCachedOutput(key execKey, args []string) (output *execOut, found boo
 //
 // git_branch() returns the output of `git symbolic-ref -q --short HEAD`
 func execGitBranch(s *scope, args []pyObject) pyObject {
+	s.noCache("it calls git_branch()")
+	if g := gitSCM(s); g != nil {
+		branch, err := g.Branch(args[0].IsTruthy())
+		if err != nil {
+			return s.Error("git_branch() failed: %v", err)
+		}
+		return pyString(branch)
+	}
 	cmdIn := make([]pyObject, 3, 5)
 	cmdIn[0] = pyString("git")
 	cmdIn[1] = pyString("symbolic-ref")
@@ -227,6 +237,14 @@ func execGitBranch(s *scope, args []pyObject) pyObject {
 //
 // git_commit() returns the output of `git rev-parse HEAD`
 func execGitCommit(s *scope, args []pyObject) pyObject {
+	s.noCache("it calls git_commit()")
+	if g := gitSCM(s); g != nil {
+		commit, err := g.Show("%H")
+		if err != nil {
+			return s.Error("git_commit() failed: %v", err)
+		}
+		return pyString(commit)
+	}
 	cmdIn := []pyObject{
 		pyString("git"),
 		pyString("rev-parse"),
@@ -252,6 +270,7 @@ func execGitCommit(s *scope, args []pyObject) pyObject {
 //
 //	`git show -s --format=%ci` = 2018-12-10 00:53:35 -0800
 func execGitShow(s *scope, args []pyObject) pyObject {
+	s.noCache("it calls git_show()")
 	formatVerb := args[0].(pyString)
 	switch formatVerb {
 	case "%H": // commit hash
@@ -284,6 +303,14 @@ func execGitShow(s *scope, args []pyObject) pyObject {
 		return s.Error("git_show() unsupported format code: %q", formatVerb)
 	}
 
+	if g := gitSCM(s); g != nil {
+		out, err := g.Show(string(formatVerb))
+		if err != nil {
+			return s.Error("git_show() failed: %v", err)
+		}
+		return pyString(out)
+	}
+
 	cmdIn := []pyObject{
 		pyString("git"),
 		pyString("show"),
@@ -304,9 +331,20 @@ func execGitShow(s *scope, args []pyObject) pyObject {
 //
 // git_state() returns the output of `git status --porcelain`.
 func execGitState(s *scope, args []pyObject) pyObject {
+	s.noCache("it calls git_state()")
 	cleanLabel := args[0].(pyString)
 	dirtyLabel := args[1].(pyString)
 
+	if g := gitSCM(s); g != nil {
+		clean, err := g.IsClean()
+		if err != nil {
+			return s.Error("git_state() failed: %v", err)
+		} else if clean {
+			return cleanLabel
+		}
+		return dirtyLabel
+	}
+
 	cmdIn := []pyObject{
 		pyString("git"),
 		pyString("status"),
@@ -356,3 +394,13 @@ func execSetCachedOutput(key execKey, args []string, output *execOut) string {
 	out := outputRaw.(*execOut).out
 	return out
 }
+
+// gitSCM returns the git SCM for the repo, or nil if it's not a git repo (in which case the git_* builtins
+// fall back to invoking git directly, which will find any repo above this one).
+func gitSCM(s *scope) scm.Git {
+	if s.state == nil {
+		return nil
+	}
+	g, _ := s.state.SCM().(scm.Git)
+	return g
+}
@@ -57,6 +57,9 @@ type FuncDef struct {
 	IsPrivate bool
 	// True if the function is builtin to Please.
 	IsBuiltin bool
+	// True if the function accepts arbitrary positional or keyword arguments.
+	// Only natively implemented builtins can do this.
+	Varargs, Kwargs bool
 }
 
 // A ForStatement implements the 'for' statement.
@@ -268,7 +268,7 @@ func (p *parser) parseArgument() Argument {
 	if tok.Type == ':' {
 		// Type annotations
 		for {
-			tok = p.oneofval("bool", "str", "int", "list", "dict", "function", "config")
+			tok = p.oneofval("bool", "str", "int", "list", "dict", "function", "config", "struct")
 			a.Type = append(a.Type, tok.Value)
 			if !p.optional('|') {
 				break
@@ -27,6 +27,9 @@ type interpreter struct {
 	breakpointMutex sync.Mutex
 	limiter         semaphore
 
+	// Persists the results of parsing packages between runs. Nil if it isn't enabled.
+	cache *parseCache
+
 	stringMethods, dictMethods, configMethods map[string]*pyFunc
 }
 
@@ -47,9 +50,13 @@ func newInterpreter(state *core.BuildState, p *Parser) *interpreter {
 	if p.interpreter != nil {
 		i.subincludes = p.interpreter.subincludes
 		i.asts = p.interpreter.asts
+		i.cache = p.interpreter.cache
 	} else {
 		i.subincludes = cmap.NewErrMap[string, pyDict](cmap.SmallShardCount, cmap.XXHash, i.limiter)
 		i.asts = cmap.NewErrMap[string, []*Statement](cmap.SmallShardCount, cmap.XXHash, i.limiter)
+		if state.Config.Parse.Cache {
+			i.cache = newParseCache()
+		}
 	}
 	s.interpreter = i
 	s.LoadSingletons(state)
@@ -152,10 +159,16 @@ func (i *interpreter) preloadSubinclude(s *scope, label core.BuildLabel) (err er
 }
 
 // interpretAll runs a series of statements in the scope of the given package.
-// The first return value is for testing only.
+// The returned scope is used to find the inputs to cache the package with, or for testing.
 func (i *interpreter) interpretAll(pkg *core.Package, forLabel, dependent *core.BuildLabel, mode core.ParseMode, statements []*Statement) (*scope, error) {
 	s := i.scope.NewPackagedScope(pkg, mode, 1)
 	s.config = i.getConfig(s.state).Copy()
+	if i.cache != nil {
+		s.record = &cacheInputs{}
+	}
+	if s.profile = s.startProfile("package "+pkg.Label().String(), pkg.Filename); s.profile != nil {
+		defer s.endProfile(s.profile)
+	}
 
 	// Config needs a little separate tweaking.
 	// Annoyingly we'd like to not have to do this at all, but it's very hard to handle
@@ -221,6 +234,13 @@ func (i *interpreter) Subinclude(pkgScope *scope, path string, label core.BuildL
 		s.config = i.scope.config.Copy()
 		s.Set("CONFIG", s.config)
 		s.subincludeLabel = &label
+		s.profile = pkgScope.profile
+		if s.profile = s.startProfile("subinclude "+label.String(), path); s.profile != nil {
+			defer s.endProfile(s.profile)
+		}
+		if i.cache != nil {
+			s.record = &cacheInputs{}
+		}
 
 		if !mode.IsPreload() {
 			if err := i.preloadSubincludes(s); err != nil {
@@ -232,9 +252,17 @@ func (i *interpreter) Subinclude(pkgScope *scope, path string, label core.BuildL
 		if s.config.overlay == nil {
 			delete(locals, "CONFIG") // Config doesn't have any local modifications
 		}
+		if s.record != nil {
+			i.cache.subincludeInputs.Store(key, s.record)
+		}
 		return locals, nil
 	})
 	pkgScope.Assert(err == nil, "failed to subinclude %s: %s", label, err)
+	if pkgScope.record != nil && !pkgScope.Callback {
+		if inputs, present := i.cache.subincludeInputs.Load(key); present {
+			pkgScope.record.merge(inputs.(*cacheInputs))
+		}
+	}
 	return globals
 }
 
@@ -294,6 +322,12 @@ type scope struct {
 	// True if this scope is for a pre- or post-build callback.
 	Callback bool
 	mode     core.ParseMode
+	// The current frame of the call stack, if we're profiling.
+	profile *profileFrame
+	// The inputs to the package being interpreted, if we're going to cache it.
+	record *cacheInputs
+	// The name of the function called from the BUILD file that we're currently within.
+	ruleKind string
 }
 
 // parseAnnotatedLabelInPackage similarly to parseLabelInPackage, parses the label contextualising it to the provided
@@ -409,6 +443,9 @@ func (s *scope) newScope(pkg *core.Package, mode core.ParseMode, filename string
 		config:      s.config,
 		Callback:    s.Callback,
 		mode:        mode,
+		profile:     s.profile,
+		record:      s.record,
+		ruleKind:    s.ruleKind,
 	}
 	if pkg != nil && pkg.Subrepo != nil && pkg.Subrepo.State != nil {
 		s2.state = pkg.Subrepo.State
@@ -700,3 +700,58 @@ func TestListConcatenation(t *testing.T) {
 		pyString("haribo"),
 	}, s.Lookup("fruit_veg_canned_food_and_sweets"))
 }
+
+func TestStruct(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/struct.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, "wibble", s.Lookup("name"))
+	assert.EqualValues(t, 3, s.Lookup("count"))
+	assert.Equal(t, pyList{pyString("a.go"), pyString("b.go")}, s.Lookup("srcs").(pyFrozenList).pyList)
+	assert.Equal(t, True, s.Lookup("has_name"))
+	assert.Equal(t, False, s.Lookup("has_wobble"))
+	assert.Equal(t, True, s.Lookup("same"))
+	assert.Equal(t, False, s.Lookup("different"))
+	assert.EqualValues(t, `{"count":3,"name":"wibble","srcs":["a.go","b.go"]}`, s.Lookup("encoded"))
+	assert.EqualValues(t, `struct(count=3, name="wibble", srcs=["a.go", "b.go"])`, s.Lookup("text"))
+	assert.EqualValues(t, `struct(deps={"a": [], "b": ["x", "y z"]}, info=struct(name="wibble"))`, s.Lookup("nested"))
+	assert.EqualValues(t, "struct()", s.Lookup("empty").String())
+	assert.Equal(t, True, s.Lookup("is_struct"))
+}
+
+func TestStructIsImmutable(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/struct_immutable.build")
+	assert.Error(t, err)
+}
+
+func TestProviders(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/providers.build")
+	require.NoError(t, err)
+	lib := s.pkg.Target("lib")
+	require.Contains(t, lib.Providers, "go")
+	assert.Equal(t, `struct(cgo=False, import_path="github.com/example/lib")`, lib.Providers["go"].String())
+	assert.Equal(t, []string{"import:github.com/example/lib"}, s.pkg.Target("bin").Labels)
+	assert.EqualValues(t, "binary", s.Lookup("kind"))
+	assert.Equal(t, None, s.Lookup("missing"))
+	assert.EqualValues(t, "nope", s.Lookup("fallback"))
+}
+
+func TestRuleKind(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/rule_kind.build")
+	require.NoError(t, err)
+	assert.Equal(t, "my_rule", s.pkg.Target("a").Kind)
+	assert.Equal(t, "my_macro", s.pkg.Target("b").Kind)
+	assert.Equal(t, "build_rule", s.pkg.Target("c").Kind)
+}
+
+func TestResources(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/resources.build")
+	require.NoError(t, err)
+	assert.Equal(t, core.ResourceRequests{CPU: 4, Memory: 8000000000}, s.pkg.Target("a").Resources)
+	assert.Equal(t, core.ResourceRequests{Memory: 1024}, s.pkg.Target("b").Resources)
+	assert.True(t, s.pkg.Target("c").Resources.IsZero())
+}
+
+func TestResourcesInvalid(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/resources_invalid.build")
+	assert.ErrorContains(t, err, "Unknown resource gpu")
+}
@@ -682,7 +682,23 @@ func (f *pyFunc) String() string {
 	return fmt.Sprintf("<function %s>", f.name)
 }
 
+// profileFilename returns the filename we attribute calls to this function to when profiling.
+func (f *pyFunc) profileFilename() string {
+	if f.nativeCode != nil {
+		return "<builtin>"
+	}
+	return f.scope.filename
+}
+
 func (f *pyFunc) Call(s *scope, c *Call) pyObject {
+	if frame := s.startProfile(f.name, f.profileFilename()); frame != nil {
+		prev := s.profile
+		s.profile = frame
+		defer func() {
+			s.profile = prev
+			s.endProfile(frame)
+		}()
+	}
 	if f.nativeCode != nil {
 		if f.kwargs {
 			return f.callNative(s.NewScope("<builtin code>", 0), c)
@@ -694,6 +710,12 @@ func (f *pyFunc) Call(s *scope, c *Call) pyObject {
 	s2.Set("CONFIG", s.config) // This needs to be copied across too :(
 	s2.Callback = s.Callback
 	s2.parsingFor = s.parsingFor
+	s2.profile = s.profile
+	s2.record = s.record
+	s2.ruleKind = s.ruleKind
+	if s2.ruleKind == "" {
+		s2.ruleKind = f.name
+	}
 	// Handle implicit 'self' parameter for bound functions.
 	args := c.Arguments
 	if f.self != nil {
@@ -823,6 +845,47 @@ func (f *pyFunc) Member(obj pyObject) pyObject {
 	}
 }
 
+// FuncDef reconstructs a definition of this function, without any of its code.
+// We do this rather than keeping the original since some native functions don't match their declarations
+// (e.g. filegroup takes the same arguments as build_rule).
+func (f *pyFunc) FuncDef() *FuncDef {
+	def := &FuncDef{
+		Name:         f.name,
+		Docstring:    f.docstring,
+		Arguments:    make([]Argument, len(f.args)),
+		Return:       f.returnType,
+		KeywordsOnly: f.kwargsonly,
+		IsPrivate:    strings.HasPrefix(f.name, "_"),
+		IsBuiltin:    true,
+		Varargs:      f.varargs,
+		Kwargs:       f.kwargs,
+	}
+	for i, name := range f.args {
+		arg := &def.Arguments[i]
+		arg.Name = name
+		arg.IsPrivate = strings.HasPrefix(name, "_")
+		for _, t := range knownTypeNames {
+			if f.types[i]&knownTypeNameToTag[t] != 0 {
+				arg.Type = append(arg.Type, t)
+			}
+		}
+		if f.constants[i] != nil {
+			arg.Value = &Expression{optimised: &optimisedExpression{Constant: f.constants[i]}}
+		} else if f.defaults != nil && f.defaults[i] != nil {
+			arg.Value = f.defaults[i]
+		}
+	}
+	for alias, i := range f.argIndices {
+		if alias != f.args[i] {
+			def.Arguments[i].Aliases = append(def.Arguments[i].Aliases, alias)
+		}
+	}
+	for _, arg := range def.Arguments {
+		sort.Strings(arg.Aliases)
+	}
+	return def
+}
+
 // validateType validates that this argument matches the given type
 func (f *pyFunc) validateType(s *scope, i int, expr *Expression) pyObject {
 	val := s.interpretExpression(expr)
@@ -1055,10 +1118,105 @@ func (r *pyRange) toList(extraCapacity int) pyList {
 	return ret
 }
 
+// A pyStruct is an immutable collection of named fields, as created by struct().
+// It's used for providers, which attach structured information to build targets.
+type pyStruct struct {
+	fields pyDict
+}
+
+// newPyStruct creates a new struct from the given fields, freezing any of them that are mutable.
+func newPyStruct(fields pyDict) *pyStruct {
+	return &pyStruct{fields: fields.Freeze().(pyFrozenDict).pyDict}
+}
+
+func (s *pyStruct) Type() string {
+	return "struct"
+}
+
+func (s *pyStruct) TypeTag() int32 {
+	return pyStructTag
+}
+
+func (s *pyStruct) IsTruthy() bool {
+	return true
+}
+
+func (s *pyStruct) Property(scope *scope, name string) pyObject {
+	if obj, present := s.fields[name]; present {
+		return obj
+	}
+	panic("struct object has no field " + name)
+}
+
+func (s *pyStruct) Operator(operator Operator, operand pyObject) pyObject {
+	if operator == In || operator == NotIn {
+		if str, ok := operand.(pyString); ok {
+			_, present := s.fields[string(str)]
+			return newPyBool(present == (operator == In))
+		}
+		return newPyBool(operator == NotIn)
+	}
+	panic(fmt.Sprintf("operator %s not implemented on type struct", operator))
+}
+
+func (s *pyStruct) String() string {
+	var b strings.Builder
+	b.WriteString("struct(")
+	for i, k := range s.fields.Keys() {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		writeRepr(&b, s.fields[k])
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// writeRepr writes a representation of an object in BUILD language syntax, quoting strings at every level.
+// Structs use it so their string form is unambiguous, since it's used to detect when a provider changes.
+func writeRepr(b *strings.Builder, obj pyObject) {
+	switch o := obj.(type) {
+	case pyString:
+		b.WriteString(strconv.Quote(string(o)))
+	case pyFrozenList:
+		writeRepr(b, o.pyList)
+	case pyList:
+		b.WriteByte('[')
+		for i, v := range o {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeRepr(b, v)
+		}
+		b.WriteByte(']')
+	case pyFrozenDict:
+		writeRepr(b, o.pyDict)
+	case pyDict:
+		b.WriteByte('{')
+		for i, k := range o.Keys() {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(strconv.Quote(k))
+			b.WriteString(": ")
+			writeRepr(b, o[k])
+		}
+		b.WriteByte('}')
+	default:
+		b.WriteString(obj.String())
+	}
+}
+
+func (s *pyStruct) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.fields)
+}
+
 // Known types, used for type signatures on function arguments
 // This doesn't have to be totally exhaustive, it's only the ones that can be declared in syntax.
 var (
-	knownTypes         = []pyObject{False, pyString(""), pyInt(0), pyList{}, pyDict{}, &pyFunc{}, &pyConfig{}, None}
+	knownTypes         = []pyObject{False, pyString(""), pyInt(0), pyList{}, pyDict{}, &pyFunc{}, &pyConfig{}, &pyStruct{}, None}
 	knownTypeNames     = make([]string, len(knownTypes))
 	knownTypeTagToName = make(map[int]string, len(knownTypes))
 	knownTypeNameToTag = make(map[string]int32, len(knownTypes))
@@ -1073,6 +1231,7 @@ const (
 	pyDictTag
 	pyFuncTag
 	pyConfigTag
+	pyStructTag
 )
 
 func init() {
@@ -77,16 +77,33 @@ func (p *Parser) ParseFile(pkg *core.Package, label, dependent *core.BuildLabel,
 	p.limiter.Acquire()
 	defer p.limiter.Release()
 
+	var cachePath string
+	// Packages needed for preloading are parsed before the preloads are built, so can't be cached.
+	if cache := p.interpreter.cache; cache != nil && !mode.IsPreload() {
+		path, err := cache.Path(p.interpreter.stateFor(pkg), pkg, fs, filename)
+		if err != nil {
+			log.Debug("Can't use the parse cache for %s: %s", pkg.Label(), err)
+		} else if entry := cache.Load(path); entry != nil && p.interpreter.restore(pkg, mode, entry) {
+			log.Debug("Restored %s from the parse cache", pkg.Label())
+			return nil
+		}
+		cachePath = path
+	}
+
 	statements, err := p.parse(fs, filename)
 	if err != nil {
 		return err
 	}
-	_, err = p.interpreter.interpretAll(pkg, label, dependent, mode, statements)
+	s, err := p.interpreter.interpretAll(pkg, label, dependent, mode, statements)
 	if err != nil {
 		f, _ := p.open(fs, filename)
 		p.annotate(err, f)
+		return err
 	}
-	return err
+	if cachePath != "" {
+		p.interpreter.cache.Store(cachePath, pkg, s.record)
+	}
+	return nil
 }
 
 // RegisterPreload pre-registers a preload, forcing us to build any transitive preloads before we move on
@@ -101,6 +118,18 @@ func (p *Parser) RegisterPreload(label core.BuildLabel) error {
 	return p.interpreter.preloadSubinclude(s, label)
 }
 
+// BuiltinFunctions returns the definitions of all the builtin functions that have been loaded, keyed by name.
+// They aren't needed for parsing, but are useful for static analysis of BUILD files.
+func (p *Parser) BuiltinFunctions() map[string]*FuncDef {
+	m := map[string]*FuncDef{}
+	for name, obj := range p.interpreter.scope.locals {
+		if f, ok := obj.(*pyFunc); ok {
+			m[name] = f.FuncDef()
+		}
+	}
+	return m
+}
+
 // ParseReader parses the contents of the given ReadSeeker as a BUILD file.
 // The first return value is true if parsing succeeds - if the error is still non-nil
 // that indicates that interpretation failed.
@@ -1,11 +1,16 @@
 package asp
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
 )
 
 // TODO(peterebden): Might get rid of this, we may want to expose a similar thing on Parser.
@@ -831,3 +836,40 @@ func TestFStringIncompleteError(t *testing.T) {
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "Unterminated brace in fstring")
 }
+
+func TestErrorPosition(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "BUILD")
+	require.NoError(t, os.WriteFile(filename, []byte("x = 1\ny = (\n"), 0644))
+	_, err := newParser().ParseFileOnly(filename)
+	require.Error(t, err)
+	pos, msg := ErrorPosition(err)
+	assert.Equal(t, 3, pos.Line)
+	assert.Equal(t, "Unexpected token end of file", strings.TrimSpace(msg))
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	p := NewParser(core.NewDefaultBuildState())
+	for _, filename := range []string{"builtins.build_defs", "misc_rules.build_defs"} {
+		src, err := rules.ReadAsset(filename)
+		require.NoError(t, err)
+		p.MustLoadBuiltins(filename, src)
+	}
+	funcs := p.BuiltinFunctions()
+
+	subinclude := funcs["subinclude"]
+	require.NotNil(t, subinclude)
+	assert.True(t, subinclude.Varargs)
+	assert.False(t, subinclude.KeywordsOnly)
+	assert.Equal(t, []string{"str", "list"}, subinclude.Arguments[0].Type)
+	assert.Nil(t, subinclude.Arguments[0].Value)
+
+	// filegroup is declared with its own arguments but natively takes the same ones as build_rule.
+	filegroup := funcs["filegroup"]
+	require.NotNil(t, filegroup)
+	assert.True(t, filegroup.KeywordsOnly)
+	assert.Equal(t, funcs["build_rule"].Arguments, filegroup.Arguments)
+
+	pkg := funcs["package"]
+	require.NotNil(t, pkg)
+	assert.True(t, pkg.Kwargs)
+}
@@ -0,0 +1,54 @@
+package asp
+
+import (
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A profileFrame is a single frame of the BUILD language's call stack, which we track when profiling the parser.
+type profileFrame struct {
+	parent   *profileFrame
+	frame    core.ParseProfileFrame
+	start    time.Time
+	children time.Duration // Time spent in frames called by this one.
+}
+
+// startProfile begins a new profiling frame as a child of this scope's current one.
+// It returns nil if we aren't profiling; post-build callbacks aren't profiled since they happen during the build.
+func (s *scope) startProfile(name, filename string) *profileFrame {
+	if s.state == nil || s.state.ParseProfile == nil || s.Callback {
+		return nil
+	}
+	return &profileFrame{
+		parent: s.profile,
+		frame:  core.ParseProfileFrame{Name: name, Filename: filename},
+		start:  time.Now(),
+	}
+}
+
+// endProfile finishes a profiling frame started by startProfile and records it.
+func (s *scope) endProfile(f *profileFrame) {
+	if f == nil {
+		return
+	}
+	d := time.Since(f.start)
+	if f.parent != nil {
+		f.parent.children += d
+	}
+	s.state.ParseProfile.Add(f.stack(), d-f.children)
+}
+
+// stack returns the call stack ending at this frame, outermost frame first.
+func (f *profileFrame) stack() []core.ParseProfileFrame {
+	n := 0
+	for f2 := f; f2 != nil; f2 = f2.parent {
+		n++
+	}
+	ret := make([]core.ParseProfileFrame, n)
+	for f2 := f; f2 != nil; f2 = f2.parent {
+		n--
+		ret[n] = f2.frame
+	}
+	return ret
+}
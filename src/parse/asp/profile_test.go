@@ -0,0 +1,88 @@
+package asp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+func parseFileWithProfile(t *testing.T, filename string) (*interpreter, *scope) {
+	t.Helper()
+	state := core.NewDefaultBuildState()
+	state.ParseProfile = core.NewParseProfile()
+	parser := NewParser(state)
+	src, err := rules.ReadAsset("builtins.build_defs")
+	require.NoError(t, err)
+	parser.MustLoadBuiltins("builtins.build_defs", src)
+	statements, err := parser.parse(nil, filename)
+	require.NoError(t, err)
+	pkg := core.NewPackage("test/package")
+	pkg.Filename = filename
+	s, err := parser.interpreter.interpretAll(pkg, nil, nil, 0, statements)
+	require.NoError(t, err)
+	return parser.interpreter, s
+}
+
+// findSample returns the sample with the given stack of names, or nil if there isn't one.
+func findSample(profile *core.ParseProfile, names ...string) *core.ParseProfileSample {
+	for _, sample := range profile.Samples() {
+		if len(sample.Stack) != len(names) {
+			continue
+		}
+		match := true
+		for i, frame := range sample.Stack {
+			match = match && frame.Name == names[i]
+		}
+		if match {
+			return &sample
+		}
+	}
+	return nil
+}
+
+func TestProfileFunctionCalls(t *testing.T) {
+	_, s := parseFileWithProfile(t, "src/parse/asp/test_data/interpreter/profile.build")
+	profile := s.state.ParseProfile
+
+	pkg := findSample(profile, "package //test/package:all")
+	require.NotNil(t, pkg)
+	assert.EqualValues(t, 1, pkg.Calls)
+	assert.Equal(t, "src/parse/asp/test_data/interpreter/profile.build", pkg.Stack[0].Filename)
+
+	outer := findSample(profile, "package //test/package:all", "outer")
+	require.NotNil(t, outer)
+	assert.EqualValues(t, 1, outer.Calls)
+	assert.Equal(t, "src/parse/asp/test_data/interpreter/profile.build", outer.Stack[1].Filename)
+
+	inner := findSample(profile, "package //test/package:all", "outer", "inner")
+	require.NotNil(t, inner)
+	assert.EqualValues(t, 3, inner.Calls)
+
+	builtin := findSample(profile, "package //test/package:all", "outer", "inner", "len")
+	require.NotNil(t, builtin)
+	assert.EqualValues(t, 3, builtin.Calls)
+	assert.Equal(t, "<builtin>", builtin.Stack[3].Filename)
+}
+
+func TestProfileSubinclude(t *testing.T) {
+	i, s := parseFileWithProfile(t, "src/parse/asp/test_data/interpreter/profile.build")
+	label := core.ParseBuildLabel("//test:profile", "")
+	i.Subinclude(s, "src/parse/asp/test_data/interpreter/profile.build", label, false)
+
+	sub := findSample(s.state.ParseProfile, "package //test/package:all", "subinclude //test:profile")
+	require.NotNil(t, sub)
+	assert.EqualValues(t, 1, sub.Calls)
+	assert.NotNil(t, findSample(s.state.ParseProfile, "package //test/package:all", "subinclude //test:profile", "outer", "inner", "len"))
+}
+
+func TestNoProfileInCallbacks(t *testing.T) {
+	_, s := parseFileWithProfile(t, "src/parse/asp/test_data/interpreter/profile.build")
+	before := len(s.state.ParseProfile.Samples())
+	s.Callback = true
+	s.Lookup("outer").(*pyFunc).Call(s, &Call{})
+	assert.Equal(t, before, len(s.state.ParseProfile.Samples()))
+}
@@ -71,6 +71,8 @@ const (
 	envArgIdx
 	fileContentArgIdx
 	subrepoArgIdx
+	providersArgIdx
+	resourcesArgIdx
 )
 
 // createTarget creates a new build target as part of build_rule().
@@ -286,6 +288,8 @@ func populateTarget(s *scope, t *core.BuildTarget, args []pyObject) {
 	addEnv(s, args[envArgIdx], t)
 	addMaybeNamedSecret(s, "secrets", args[secretsBuildRuleArgIdx], t.AddSecret, t.AddNamedSecret, t, true)
 	addProvides(s, "provides", args[providesBuildRuleArgIdx], t)
+	addProviders(s, args[providersArgIdx], t)
+	addResources(s, args[resourcesArgIdx], t)
 	if f := callbackFunction(s, "pre_build", args[preBuildBuildRuleArgIdx], 1, "argument"); f != nil {
 		t.PreBuildFunction = &preBuildFunction{f: f, s: s}
 	}
@@ -523,6 +527,51 @@ func addProvides(s *scope, name string, obj pyObject, t *core.BuildTarget) {
 	}
 }
 
+// addProviders attaches a set of providers to the target, which is a dict of string -> struct
+func addProviders(s *scope, obj pyObject, t *core.BuildTarget) {
+	if obj != nil && obj != None {
+		d, ok := asDict(obj)
+		s.Assert(ok, "Argument providers must be a dict, not %s, %v", obj.Type(), obj)
+		for k, v := range d {
+			provider, ok := v.(*pyStruct)
+			s.Assert(ok, "providers values must be structs, not %s", v.Type())
+			t.AddProvider(k, provider)
+		}
+	}
+}
+
+// addResources sets the resources requested by the target, which is a dict with keys 'cpu' and 'mem'.
+// Memory can be given either as a number of bytes or as a string like '8G'.
+func addResources(s *scope, obj pyObject, t *core.BuildTarget) {
+	if obj == nil || obj == None {
+		return
+	}
+	d, ok := asDict(obj)
+	s.Assert(ok, "Argument resources must be a dict, not %s, %v", obj.Type(), obj)
+	for k, v := range d {
+		switch k {
+		case "cpu":
+			cpu, ok := v.(pyInt)
+			s.Assert(ok && cpu >= 0, "resources['cpu'] must be a non-negative integer, not %s", v)
+			t.Resources.CPU = int(cpu)
+		case "mem", "memory":
+			switch mem := v.(type) {
+			case pyInt:
+				s.Assert(mem >= 0, "resources['%s'] must not be negative", k)
+				t.Resources.Memory = uint64(mem)
+			case pyString:
+				var size cli.ByteSize
+				s.Assert(size.UnmarshalFlag(string(mem)) == nil, "Invalid value for resources['%s']: %s", k, mem)
+				t.Resources.Memory = uint64(size)
+			default:
+				s.Error("resources['%s'] must be an integer or a string like '8G', not %s", k, v.Type())
+			}
+		default:
+			s.Error("Unknown resource %s; valid resources are 'cpu' and 'mem'", k)
+		}
+	}
+}
+
 // parseVisibility converts a visibility string to a build label.
 // Mostly they are just build labels but other things are allowed too (e.g. "PUBLIC").
 func parseVisibility(s *scope, vis string) core.BuildLabel {
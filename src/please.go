@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	iofs "io/fs"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -21,6 +23,7 @@ import (
 	"github.com/thought-machine/please/src/assets"
 	"github.com/thought-machine/please/src/build"
 	"github.com/thought-machine/please/src/cache"
+	"github.com/thought-machine/please/src/cas"
 	"github.com/thought-machine/please/src/clean"
 	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/cli/logging"
@@ -34,6 +37,7 @@ import (
 	"github.com/thought-machine/please/src/generate"
 	"github.com/thought-machine/please/src/hashes"
 	"github.com/thought-machine/please/src/help"
+	"github.com/thought-machine/please/src/lint"
 	"github.com/thought-machine/please/src/output"
 	"github.com/thought-machine/please/src/plz"
 	"github.com/thought-machine/please/src/plzinit"
@@ -67,17 +71,21 @@ var opts struct {
 	} `group:"Options controlling what to build & how to build it"`
 
 	OutputFlags struct {
-		Verbosity         cli.Verbosity `short:"v" long:"verbosity" description:"Verbosity of output (error, warning, notice, info, debug)" default:"warning"`
-		LogFile           cli.Filepath  `long:"log_file" description:"File to echo full logging output to" default:"plz-out/log/build.log"`
-		LogFileLevel      cli.Verbosity `long:"log_file_level" description:"Log level for file output" default:"debug"`
-		LogAppend         bool          `long:"log_append" description:"Append log to existing file instead of overwriting its content"`
-		InteractiveOutput bool          `long:"interactive_output" description:"Show interactive output in a terminal"`
-		PlainOutput       bool          `short:"p" long:"plain_output" description:"Don't show interactive output."`
-		Colour            bool          `long:"colour" description:"Forces coloured output from logging & other shell output."`
-		NoColour          bool          `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
-		TraceFile         cli.Filepath  `long:"trace_file" description:"File to write Chrome tracing output into"`
-		ShowAllOutput     bool          `long:"show_all_output" description:"Show all output live from all commands. Implies --plain_output."`
-		CompletionScript  bool          `long:"completion_script" description:"Prints the bash / zsh completion script to stdout"`
+		Verbosity          cli.Verbosity `short:"v" long:"verbosity" description:"Verbosity of output (error, warning, notice, info, debug)" default:"warning"`
+		LogFile            cli.Filepath  `long:"log_file" description:"File to echo full logging output to" default:"plz-out/log/build.log"`
+		LogFileLevel       cli.Verbosity `long:"log_file_level" description:"Log level for file output" default:"debug"`
+		LogAppend          bool          `long:"log_append" description:"Append log to existing file instead of overwriting its content"`
+		InteractiveOutput  bool          `long:"interactive_output" description:"Show interactive output in a terminal"`
+		PlainOutput        bool          `short:"p" long:"plain_output" description:"Don't show interactive output."`
+		Colour             bool          `long:"colour" description:"Forces coloured output from logging & other shell output."`
+		NoColour           bool          `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
+		TraceFile          cli.Filepath  `long:"trace_file" description:"File to write Chrome tracing output into"`
+		ParseProfileFile   cli.Filepath  `long:"parse_profile_file" description:"File to write a profile of time spent parsing BUILD files into"`
+		ParseProfileFormat string        `long:"parse_profile_format" choice:"pprof" choice:"folded" default:"pprof" description:"Format to write the parse profile in; pprof, or folded stacks for flame graph tools"`
+		BuildEventFile     cli.Filepath  `long:"build_event_file" description:"File to write a stream of build events into, as JSON lines"`
+		BuildEventURL      string        `long:"build_event_url" description:"Build Event Service endpoint to stream build events to. Prefix with grpcs:// to use TLS."`
+		ShowAllOutput      bool          `long:"show_all_output" description:"Show all output live from all commands. Implies --plain_output."`
+		CompletionScript   bool          `long:"completion_script" description:"Prints the bash / zsh completion script to stdout"`
 	} `group:"Options controlling output & logging"`
 
 	BehaviorFlags struct {
@@ -104,12 +112,13 @@ var opts struct {
 	Complete         string `long:"complete" hidden:"true" env:"PLZ_COMPLETE" description:"Provide completion options for this build target."`
 
 	Build struct {
-		Shell      string `long:"shell" choice:"shell" choice:"run" optional:"true" optional-value:"shell" description:"Like --prepare, but opens a shell in the build directory with the appropriate environment variables."`
-		Rebuild    bool   `long:"rebuild" description:"To force the optimisation and rebuild one or more targets."`
-		NoDownload bool   `long:"nodownload" hidden:"true" description:"Don't download outputs after building. Only applies when using remote build execution."`
-		Download   bool   `long:"download" hidden:"true" description:"Force download of all outputs regardless of original target spec. Only applies when using remote build execution."`
-		OutDir     string `long:"out_dir" optional:"true" description:"Copies build output to given directory"`
-		Args       struct {
+		Shell       string `long:"shell" choice:"shell" choice:"run" optional:"true" optional-value:"shell" description:"Like --prepare, but opens a shell in the build directory with the appropriate environment variables."`
+		Rebuild     bool   `long:"rebuild" description:"To force the optimisation and rebuild one or more targets."`
+		NoDownload  bool   `long:"nodownload" hidden:"true" description:"Don't download outputs after building. Only applies when using remote build execution."`
+		Download    bool   `long:"download" hidden:"true" description:"Force download of all outputs regardless of original target spec. Only applies when using remote build execution."`
+		OutDir      string `long:"out_dir" optional:"true" description:"Copies build output to given directory"`
+		AuditInputs bool   `long:"audit_inputs" description:"Traces the files each build action reads, and reports any it read without declaring and any declared inputs it didn't read. Only actions that run locally are audited, so this is usually combined with --rebuild. Linux only."`
+		Args        struct {
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to build"`
 		} `positional-args:"true" required:"true"`
 	} `command:"build" description:"Builds one or more targets"`
@@ -128,6 +137,7 @@ var opts struct {
 		Rerun            bool         `long:"rerun" description:"Rerun the test even if the hash hasn't changed."`
 		Sequentially     bool         `long:"sequentially" description:"Whether to run multiple runs of the same test sequentially"`
 		TestResultsFile  cli.Filepath `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
+		ResultsFormat    []string     `long:"results_format" choice:"jsonl" choice:"tap" description:"Additional formats to write test results in, next to the test results file. Can be passed multiple times."`
 		SurefireDir      cli.Filepath `long:"surefire_dir" default:"plz-out/surefire-reports" description:"Directory to copy XML test results to."`
 		ShowOutput       bool         `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
 		DebugFailingTest bool         `short:"d" long:"debug" description:"Allows starting an interactive debugger on test failure. Does not work with all test types (currently only python/pytest). Implies -c dbg unless otherwise set."`
@@ -135,13 +145,26 @@ var opts struct {
 		Detailed         bool         `long:"detailed" description:"Prints more detailed output after tests."`
 		Shell            string       `long:"shell" choice:"shell" choice:"run" optional:"true" optional-value:"shell" description:"Opens a shell in the test directory with the appropriate environment variables."`
 		StreamResults    bool         `long:"stream_results" description:"Prints test results on stdout as they are run."`
+		ShardIndex       int          `long:"shard_index" description:"Index of the shard of test targets to run, from 0 to --shard_count - 1."`
+		ShardCount       int          `long:"shard_count" description:"Number of shards to split the selected test targets into, e.g. to run them across several machines."`
+		ShardDurations   cli.Filepath `long:"shard_durations" description:"Results file from a previous run, used to balance shards by test duration."`
 		// Slightly awkward since we can specify a single test with arguments or multiple test targets.
 		Args struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test"`
 			Args   TargetsOrArgs   `positional-arg-name:"arguments" description:"Arguments or test selectors"`
 		} `positional-args:"true"`
-		StateArgs []string `no-flag:"true"`
-	} `command:"test" description:"Builds and tests one or more targets"`
+		StateArgs    []string `no-flag:"true"`
+		MergeResults struct {
+			Output cli.Filepath `short:"o" long:"output" default:"plz-out/log/test_results.xml" description:"File to write the merged results to."`
+			Args   struct {
+				Files cli.Filepaths `positional-arg-name:"files" required:"true" description:"Results files to merge"`
+			} `positional-args:"true" required:"true"`
+		} `command:"merge_results" description:"Merges the results files written by separate test shards into one."`
+		FlakyReport struct {
+			JSON       bool `long:"json" description:"Prints the report as JSON"`
+			Quarantine bool `long:"quarantine" description:"Prints config that quarantines the flaky tests instead of the report"`
+		} `command:"flaky_report" description:"Reports test cases that have both passed and failed without anything changing"`
+	} `command:"test" subcommands-optional:"true" description:"Builds and tests one or more targets"`
 
 	Cover struct {
 		active              bool          `no-flag:"true"`
@@ -154,6 +177,7 @@ var opts struct {
 		IncludeAllFiles     bool          `short:"a" long:"include_all_files" description:"Include all dependent files in coverage (default is just those from relevant packages)"`
 		IncludeFile         cli.Filepaths `long:"include_file" description:"Filenames to filter coverage display to. Supports shell pattern matching e.g. file/path/*."`
 		TestResultsFile     cli.Filepath  `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
+		ResultsFormat       []string      `long:"results_format" choice:"jsonl" choice:"tap" description:"Additional formats to write test results in, next to the test results file. Can be passed multiple times."`
 		SurefireDir         cli.Filepath  `long:"surefire_dir" default:"plz-out/surefire-reports" description:"Directory to copy XML test results to."`
 		CoverageResultsFile cli.Filepath  `long:"coverage_results_file" env:"COVERAGE_RESULTS_FILE" default:"plz-out/log/coverage.json" description:"File to write combined coverage results to."`
 		CoverageXMLReport   cli.Filepath  `long:"coverage_xml_report" env:"COVERAGE_XML_REPORT" default:"plz-out/log/coverage.xml" description:"XML File to write combined coverage results to."`
@@ -164,6 +188,9 @@ var opts struct {
 		Detailed            bool          `long:"detailed" description:"Prints more detailed output after tests."`
 		Shell               string        `long:"shell" choice:"shell" choice:"run" optional:"true" optional-value:"shell" description:"Opens a shell in the test directory with the appropriate environment variables."`
 		StreamResults       bool          `long:"stream_results" description:"Prints test results on stdout as they are run."`
+		ShardIndex          int           `long:"shard_index" description:"Index of the shard of test targets to run, from 0 to --shard_count - 1."`
+		ShardCount          int           `long:"shard_count" description:"Number of shards to split the selected test targets into, e.g. to run them across several machines."`
+		ShardDurations      cli.Filepath  `long:"shard_durations" description:"Results file from a previous run, used to balance shards by test duration."`
 		Args                struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test"`
 			Args   TargetsOrArgs   `positional-arg-name:"arguments" description:"Arguments or test selectors"`
@@ -248,6 +275,23 @@ var opts struct {
 		} `positional-args:"true"`
 	} `command:"clean" description:"Cleans build artifacts" subcommands-optional:"true"`
 
+	Cache struct {
+		Stats struct {
+			JSON bool `long:"json" description:"Output as JSON."`
+		} `command:"stats" description:"Prints hit, miss & store counts for each cache during the last build"`
+		Ls struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" required:"true" description:"Targets to list entries for"`
+			} `positional-args:"true" required:"true"`
+		} `command:"ls" description:"Lists entries stored in the dir cache for the given targets"`
+		Evict struct {
+			Key  []string `short:"k" long:"key" description:"Only evict entries with this key (as printed by plz cache ls). Can be repeated."`
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" required:"true" description:"Targets to evict entries for"`
+			} `positional-args:"true" required:"true"`
+		} `command:"evict" description:"Removes entries for the given targets from the dir cache"`
+	} `command:"cache" description:"Inspects and manages the contents of the build caches"`
+
 	Watch struct {
 		Run    bool `short:"r" long:"run" description:"Runs the specified targets when they change (default is to build or test as appropriate)."`
 		NoTest bool `long:"notest" description:"If set, no tests will be ran. The targets will only be re-built."`
@@ -319,6 +363,28 @@ var opts struct {
 		} `command:"outputs" description:"Exports outputs of a set of targets"`
 	} `command:"export" subcommands-optional:"true" description:"Exports a set of targets and files from the repo."`
 
+	Cas struct {
+		Ls struct {
+			Args struct {
+				Target core.BuildLabel `positional-arg-name:"target" required:"true" description:"Target to list outputs of"`
+				Path   string          `positional-arg-name:"path" description:"Path within the target's outputs to list"`
+			} `positional-args:"true"`
+		} `command:"ls" description:"Lists outputs of a remotely built target along with their digests"`
+		Cat struct {
+			Args struct {
+				Target core.BuildLabel `positional-arg-name:"target" required:"true" description:"Target to print an output of"`
+				Path   string          `positional-arg-name:"path" description:"Path of the file within the target's outputs. Can be omitted if the target has a single output."`
+			} `positional-args:"true"`
+		} `command:"cat" description:"Prints an output file of a remotely built target"`
+		Get struct {
+			Output string `short:"o" long:"output" default:"." description:"Directory to write outputs into"`
+			Args   struct {
+				Target core.BuildLabel `positional-arg-name:"target" required:"true" description:"Target to fetch outputs of"`
+				Path   string          `positional-arg-name:"path" description:"Path within the target's outputs to fetch. Fetches all of them if not given."`
+			} `positional-args:"true"`
+		} `command:"get" description:"Fetches outputs of a remotely built target"`
+	} `command:"cas" description:"Browses and fetches outputs of remotely built targets without downloading all of them"`
+
 	Format struct {
 		Quiet bool `long:"quiet" short:"q" description:"Don't print corrections to stdout, simply exit with a code indicating success / failure (for linting etc)."`
 		Write bool `long:"write" short:"w" description:"Rewrite files after update"`
@@ -327,6 +393,13 @@ var opts struct {
 		} `positional-args:"true"`
 	} `command:"format" alias:"fmt" description:"Autoformats BUILD files"`
 
+	Lint struct {
+		Format string `long:"format" short:"f" choice:"text" choice:"json" choice:"sarif" default:"text" description:"Format to print issues in"`
+		Args   struct {
+			Files cli.Filepaths `positional-arg-name:"files" description:"BUILD files and build_defs to check. Checks all of them in the repo if none are given."`
+		} `positional-args:"true"`
+	} `command:"lint" description:"Statically checks BUILD files and build_defs for problems"`
+
 	Help struct {
 		Args struct {
 			Topic help.Topic `positional-arg-name:"topic" description:"Topic to display help on"`
@@ -397,6 +470,16 @@ var opts struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to display outputs for" required:"true"`
 			} `positional-args:"true" required:"true"`
 		} `command:"output" alias:"outputs" description:"Prints all outputs of a target."`
+		WhyRebuilt struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to explain" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"why_rebuilt" description:"Explains which inputs changed to cause a target to be rebuilt."`
+		ResourceUsage struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to report on" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"resource_usage" description:"Prints the peak memory and CPU time used the last time targets were built."`
 		Graph struct {
 			Args struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to render graph for"`
@@ -438,6 +521,13 @@ var opts struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to filter"`
 			} `positional-args:"true"`
 		} `command:"filter" description:"Filter the given set of targets according to some rules"`
+		Expr struct {
+			Format string `long:"format" short:"f" choice:"text" choice:"json" choice:"dot" default:"text" description:"Format to print the resulting targets in"`
+			Hidden bool   `long:"hidden" description:"Show hidden targets as well"`
+			Args   struct {
+				Expression []string `positional-arg-name:"expression" description:"Query expression to evaluate, e.g. 'deps(//src/core) except //third_party/...'" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"expr" alias:"expression" description:"Evaluates an expression combining other queries"`
 		RepoRoot struct {
 		} `command:"reporoot" alias:"repo_root" description:"Output the root of the current Please repo"`
 		Config struct {
@@ -460,6 +550,9 @@ var opts struct {
 var buildFunctions = map[string]func() int{
 	"build": func() int {
 		success, state := runBuild(opts.Build.Args.Targets, true, false, false)
+		if opts.Build.AuditInputs {
+			build.PrintInputAudits(state)
+		}
 		if !success || opts.Build.OutDir == "" {
 			return toExitCode(success, state)
 		}
@@ -497,10 +590,32 @@ var buildFunctions = map[string]func() int{
 		return toExitCode(success, state)
 	},
 	"test": func() int {
-		targets, args := testTargets(opts.Test.Args.Target, opts.Test.Args.Args, opts.Test.Failed, opts.Test.TestResultsFile)
-		success, state := doTest(targets, args, opts.Test.SurefireDir, opts.Test.TestResultsFile)
+		resultsFile := shardResultsFile(opts.Test.TestResultsFile, opts.Test.ShardIndex, opts.Test.ShardCount)
+		targets, args := testTargets(opts.Test.Args.Target, opts.Test.Args.Args, opts.Test.Failed, resultsFile)
+		success, state := doTest(targets, args, opts.Test.SurefireDir, resultsFile, opts.Test.ResultsFormat)
 		return toExitCode(success, state)
 	},
+	"test.flaky_report": func() int {
+		history, err := test.ReadHistory(test.HistoryFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to read test history: %s", err)
+		}
+		flaky := history.Flaky()
+		if opts.Test.FlakyReport.JSON {
+			if err := json.NewEncoder(os.Stdout).Encode(flaky); err != nil {
+				log.Fatalf("Failed to encode flaky tests: %s", err)
+			}
+		} else {
+			test.PrintFlakyReport(os.Stdout, flaky, opts.Test.FlakyReport.Quarantine)
+		}
+		return 0
+	},
+	"test.merge_results": func() int {
+		if err := test.MergeResultsFiles(opts.Test.MergeResults.Args.Files.AsStrings(), string(opts.Test.MergeResults.Output)); err != nil {
+			log.Fatalf("Failed to merge test results: %s", err)
+		}
+		return 0
+	},
 	"cover": func() int {
 		opts.Cover.active = true
 		if opts.BuildFlags.Config != "" {
@@ -508,9 +623,10 @@ var buildFunctions = map[string]func() int{
 		} else {
 			opts.BuildFlags.Config = "cover"
 		}
-		targets, args := testTargets(opts.Cover.Args.Target, opts.Cover.Args.Args, opts.Cover.Failed, opts.Cover.TestResultsFile)
+		resultsFile := shardResultsFile(opts.Cover.TestResultsFile, opts.Cover.ShardIndex, opts.Cover.ShardCount)
+		targets, args := testTargets(opts.Cover.Args.Target, opts.Cover.Args.Args, opts.Cover.Failed, resultsFile)
 		os.RemoveAll(string(opts.Cover.CoverageResultsFile))
-		success, state := doTest(targets, args, opts.Cover.SurefireDir, opts.Cover.TestResultsFile)
+		success, state := doTest(targets, args, opts.Cover.SurefireDir, resultsFile, opts.Cover.ResultsFormat)
 		test.AddOriginalTargetsToCoverage(state, opts.Cover.IncludeAllFiles)
 		test.RemoveFilesFromCoverage(state.Coverage, state.Config.Cover.ExcludeExtension, state.Config.Cover.ExcludeGlob)
 
@@ -676,6 +792,38 @@ var buildFunctions = map[string]func() int{
 		}
 		return 1
 	},
+	"cache.stats": func() int {
+		stats, err := cache.ReadStats(cache.StatsFile)
+		if os.IsNotExist(err) {
+			log.Fatalf("No cache stats found; they are written at the end of each build")
+		} else if err != nil {
+			log.Fatalf("Failed to read cache stats: %s", err)
+		}
+		if opts.Cache.Stats.JSON {
+			if err := json.NewEncoder(os.Stdout).Encode(stats); err != nil {
+				log.Fatalf("Failed to encode cache stats: %s", err)
+			}
+		} else {
+			stats.Print(os.Stdout)
+		}
+		return 0
+	},
+	"cache.ls": func() int {
+		entries, err := cache.ListEntries(config, opts.Cache.Ls.Args.Targets)
+		if err != nil {
+			log.Fatalf("Failed to list cache entries: %s", err)
+		}
+		cache.PrintEntries(os.Stdout, entries)
+		return 0
+	},
+	"cache.evict": func() int {
+		entries, err := cache.Evict(config, opts.Cache.Evict.Args.Targets, opts.Cache.Evict.Key)
+		if err != nil {
+			log.Fatalf("Failed to evict cache entries: %s", err)
+		}
+		cache.PrintEntries(os.Stdout, entries)
+		return 0
+	},
 	"update": func() int {
 		fmt.Printf("Up to date (version %s).\n", core.PleaseVersion)
 		return 0 // We'd have died already if something was wrong.
@@ -710,6 +858,17 @@ var buildFunctions = map[string]func() int{
 		}
 		return 0
 	},
+	"lint": func() int {
+		issues, err := lint.Lint(config, opts.Lint.Args.Files.AsStrings())
+		if err != nil {
+			log.Fatalf("Failed to lint files: %s", err)
+		} else if err := lint.Write(os.Stdout, issues, opts.Lint.Format); err != nil {
+			log.Fatalf("Failed to write output: %s", err)
+		} else if len(issues) > 0 {
+			return 1
+		}
+		return 0
+	},
 	"init": func() int {
 		plzinit.InitConfig(string(opts.Init.Dir), opts.Init.BazelCompatibility, opts.Init.NoPrompt)
 
@@ -764,6 +923,29 @@ var buildFunctions = map[string]func() int{
 		}
 		return toExitCode(success, state)
 	},
+	"cas.ls": func() int {
+		return runCas(opts.Cas.Ls.Args.Target, func(target *core.BuildTarget, fsys iofs.FS) error {
+			return cas.List(os.Stdout, fsys, opts.Cas.Ls.Args.Path)
+		})
+	},
+	"cas.cat": func() int {
+		return runCas(opts.Cas.Cat.Args.Target, func(target *core.BuildTarget, fsys iofs.FS) error {
+			path := opts.Cas.Cat.Args.Path
+			if path == "" {
+				if outs := target.Outputs(); len(outs) == 1 {
+					path = outs[0]
+				} else {
+					return fmt.Errorf("%s has %d outputs, you must specify which one to print", target, len(outs))
+				}
+			}
+			return cas.Cat(os.Stdout, fsys, path)
+		})
+	},
+	"cas.get": func() int {
+		return runCas(opts.Cas.Get.Args.Target, func(target *core.BuildTarget, fsys iofs.FS) error {
+			return cas.Get(fsys, opts.Cas.Get.Args.Path, opts.Cas.Get.Output)
+		})
+	},
 	"help": func() int {
 		return toExitCode(help.Help(string(opts.Help.Args.Topic)), nil)
 	},
@@ -811,6 +993,16 @@ var buildFunctions = map[string]func() int{
 			query.TargetOutputs(state.Graph, state.ExpandOriginalLabels(), opts.Query.Output.JSON)
 		})
 	},
+	"query.why_rebuilt": func() int {
+		return runQuery(true, opts.Query.WhyRebuilt.Args.Targets, func(state *core.BuildState) {
+			query.WhyRebuilt(state, state.ExpandOriginalLabels())
+		})
+	},
+	"query.resource_usage": func() int {
+		return runQuery(true, opts.Query.ResourceUsage.Args.Targets, func(state *core.BuildState) {
+			query.ResourceUsage(state, state.ExpandOriginalLabels())
+		})
+	},
 	"query.completions": func() int {
 		// Somewhat fiddly because the inputs are not necessarily well-formed at this point.
 		opts.ParsePackageOnly = true
@@ -928,7 +1120,7 @@ var buildFunctions = map[string]func() int{
 		if len(opts.Query.Changes.Args.Files) > 0 {
 			return runInexact(opts.Query.Changes.Args.Files.Get())
 		}
-		scm := scm.MustNew(core.RepoRoot)
+		scm := scm.New(core.RepoRoot)
 		if opts.Query.Changes.In != "" {
 			return runInexact(scm.ChangesIn(opts.Query.Changes.In, ""))
 		} else if opts.Query.Changes.Inexact {
@@ -962,6 +1154,17 @@ var buildFunctions = map[string]func() int{
 			query.Filter(state, state.ExpandOriginalLabels(), opts.Query.Filter.Hidden)
 		})
 	},
+	"query.expr": func() int {
+		expr, err := query.ParseExpression(strings.Join(opts.Query.Expr.Args.Expression, " "))
+		if err != nil {
+			log.Fatalf("Invalid query expression: %s", err)
+		}
+		return runQuery(true, expr.Labels(), func(state *core.BuildState) {
+			if err := query.Expr(state, expr, opts.Query.Expr.Hidden, opts.Query.Expr.Format); err != nil {
+				log.Fatalf("Failed to evaluate query expression: %s", err)
+			}
+		})
+	},
 	"query.reporoot": func() int {
 		fmt.Println(core.RepoRoot)
 		return 0
@@ -1028,6 +1231,13 @@ var buildFunctions = map[string]func() int{
 		}
 		return 0
 	},
+	"trace_files": func() int {
+		code, err := process.TraceFiles(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return code
+	},
 }
 
 // Check if tool is given as label or path and then run
@@ -1086,7 +1296,7 @@ func runQuery(needFullParse bool, labels []core.BuildLabel, onSuccess func(state
 	return 1
 }
 
-func doTest(targets []core.BuildLabel, args []string, surefireDir cli.Filepath, resultsFile cli.Filepath) (bool, *core.BuildState) {
+func doTest(targets []core.BuildLabel, args []string, surefireDir cli.Filepath, resultsFile cli.Filepath, resultsFormats []string) (bool, *core.BuildState) {
 	os.RemoveAll(string(surefireDir))
 	os.RemoveAll(string(resultsFile))
 	os.MkdirAll(string(surefireDir), core.DirPermissions)
@@ -1094,6 +1304,8 @@ func doTest(targets []core.BuildLabel, args []string, surefireDir cli.Filepath,
 	success, state := runBuild(targets, true, true, false)
 	test.CopySurefireXMLFilesToDir(state, string(surefireDir))
 	test.WriteResultsToFileOrDie(state.Graph, string(resultsFile), state.Config.Test.StoreTestOutputOnSuccess)
+	test.WriteResultsInFormatsOrDie(state.Graph, string(resultsFile), resultsFormats)
+	test.WriteHistory()
 	return success, state
 }
 
@@ -1127,12 +1339,14 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 		state.NumTestRuns = uint16(opts.Cover.NumRuns)
 	}
 	state.TestSequentially = opts.Test.Sequentially || opts.Cover.Sequentially // Similarly here.
+	state.TestShard = testShard()
 	state.TestArgs = opts.Test.StateArgs
 	state.NeedCoverage = opts.Cover.active
 	state.NeedBuild = shouldBuild
 	state.NeedTests = shouldTest
 	state.NeedRun = !opts.Run.Args.Target.IsEmpty() || len(opts.Run.Parallel.PositionalArgs.Targets) > 0 || len(opts.Run.Sequential.PositionalArgs.Targets) > 0 || !opts.Exec.Args.Target.IsEmpty() || len(opts.Exec.Sequential.Args.Targets) > 0 || len(opts.Exec.Parallel.Args.Targets) > 0 || opts.Tool.Args.Tool != "" || debug
 	state.NeedHashesOnly = len(opts.Hash.Args.Targets) > 0
+	state.NoPrintOutputs = !opts.Cas.Ls.Args.Target.IsEmpty() || !opts.Cas.Cat.Args.Target.IsEmpty() || !opts.Cas.Get.Args.Target.IsEmpty()
 	state.PrepareOnly = opts.Build.Shell != "" || opts.Test.Shell != "" || opts.Cover.Shell != ""
 	state.Watch = !opts.Watch.Args.Target.IsEmpty()
 	state.CleanWorkdirs = !opts.BehaviorFlags.KeepWorkdirs
@@ -1144,6 +1358,14 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 	state.ShowAllOutput = opts.OutputFlags.ShowAllOutput
 	state.ParsePackageOnly = opts.ParsePackageOnly
 	state.EnableBreakpoints = opts.BehaviorFlags.Debug
+	if opts.OutputFlags.ParseProfileFile != "" {
+		state.ParseProfile = core.NewParseProfile()
+	}
+	if opts.Build.AuditInputs {
+		if err := state.ProcessExecutor.EnableFileTracing(); err != nil {
+			log.Fatalf("Can't audit build inputs: %s", err)
+		}
+	}
 
 	// What outputs get downloaded in remote execution.
 	if debug {
@@ -1167,6 +1389,11 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 	}
 
 	runPlease(state, targets)
+	if state.ParseProfile != nil {
+		if err := output.WriteParseProfile(state.ParseProfile, string(opts.OutputFlags.ParseProfileFile), opts.OutputFlags.ParseProfileFormat); err != nil {
+			log.Error("Failed to write parse profile: %s", err)
+		}
+	}
 	if state.RemoteClient != nil && !opts.Run.Remote {
 		defer state.RemoteClient.Disconnect()
 	}
@@ -1199,7 +1426,7 @@ func runPlease(state *core.BuildState, targets []core.BuildLabel) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		output.MonitorState(state, !pretty, detailedTests, streamTests, shell, shellRun, string(opts.OutputFlags.TraceFile))
+		output.MonitorState(state, !pretty, detailedTests, streamTests, shell, shellRun, string(opts.OutputFlags.TraceFile), string(opts.OutputFlags.BuildEventFile), opts.OutputFlags.BuildEventURL)
 		wg.Done()
 	}()
 	plz.Run(targets, opts.BuildFlags.PreTargets, state, config, state.TargetArch)
@@ -1220,6 +1447,43 @@ func testTargets(target core.BuildLabel, inputs TargetsOrArgs, failed bool, resu
 	return append([]core.BuildLabel{target}, labels...), args
 }
 
+// testShard returns the shard of tests to run, or nil if we aren't sharding.
+func testShard() *core.TestShard {
+	index, count, durationsFile := opts.Test.ShardIndex, opts.Test.ShardCount, opts.Test.ShardDurations
+	if opts.Cover.active {
+		index, count, durationsFile = opts.Cover.ShardIndex, opts.Cover.ShardCount, opts.Cover.ShardDurations
+	}
+	if count == 0 {
+		if index != 0 {
+			log.Fatalf("--shard_index requires --shard_count to be passed as well")
+		}
+		return nil
+	}
+	var durations map[core.BuildLabel]time.Duration
+	if durationsFile != "" {
+		d, err := test.LoadTestDurations(string(durationsFile))
+		if err != nil {
+			log.Warningf("Failed to load test durations, shards will not be balanced: %s", err)
+		}
+		durations = d
+	}
+	shard, err := core.NewTestShard(index, count, durations)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return shard
+}
+
+// shardResultsFile returns the results file to use for the given shard, which is distinguished
+// from the others so they can be collected together and merged afterwards.
+func shardResultsFile(filename cli.Filepath, index, count int) cli.Filepath {
+	if count == 0 {
+		return filename
+	}
+	ext := filepath.Ext(string(filename))
+	return cli.Filepath(fmt.Sprintf("%s_shard_%d_of_%d%s", strings.TrimSuffix(string(filename), ext), index, count, ext))
+}
+
 type TargetOrArg struct {
 	arg   string
 	label core.AnnotatedOutputLabel
@@ -1313,6 +1577,26 @@ func runBuild(targets []core.BuildLabel, shouldBuild, shouldTest, isQuery bool)
 	return Please(targets, config, shouldBuild, shouldTest)
 }
 
+// runCas builds a single target remotely without downloading it, then calls the given function with a
+// filesystem over its outputs.
+func runCas(label core.BuildLabel, f func(*core.BuildTarget, iofs.FS) error) int {
+	opts.Build.NoDownload = true
+	success, state := runBuild([]core.BuildLabel{label}, true, false, false)
+	if !success {
+		return toExitCode(success, state)
+	} else if state.RemoteClient == nil {
+		log.Fatalf("plz cas requires remote execution to be configured")
+	}
+	target := state.Graph.TargetOrDie(state.ExpandOriginalLabels()[0])
+	fsys, err := state.RemoteClient.OutputFS(target)
+	if err != nil {
+		log.Fatalf("%s", err)
+	} else if err := f(target, fsys); err != nil {
+		log.Fatalf("%s", err)
+	}
+	return 0
+}
+
 var originalWorkingDirectory string
 
 // readConfigAndSetRoot returns an error if we can't find a repo root
@@ -1410,8 +1694,8 @@ func getCompletions(qry string) (*query.CompletionPackages, []string) {
 }
 
 func initBuild(args []string) string {
-	if len(args) > 1 && (args[1] == "sandbox") {
-		// Shortcut these as they're special commands used for please sandboxing
+	if len(args) > 1 && (args[1] == "sandbox" || args[1] == "trace_files") {
+		// Shortcut these as they're special commands used for please sandboxing & tracing
 		// going through the normal init path would be too slow
 		return args[1]
 	}
@@ -27,7 +27,7 @@ var log = logging.Log
 // starting this (otherwise a sufficiently fast build may bypass you completely).
 func Run(targets, preTargets []core.BuildLabel, state *core.BuildState, config *core.Configuration, arch cli.Arch) {
 	build.Init(state)
-	if state.Config.Remote.URL != "" {
+	if state.Config.Remote.URL != "" && !state.Config.Remote.CacheOnly {
 		state.RemoteClient = remote.New(state)
 	}
 	if config.Display.SystemStats {
@@ -41,9 +41,8 @@ func Run(targets, preTargets []core.BuildLabel, state *core.BuildState, config *
 
 	parses, actions := state.TaskQueues()
 
-	localLimiter := make(limiter, config.Please.NumThreads)
-	remoteLimiter := make(limiter, config.NumRemoteExecutors())
-	anyRemote := config.NumRemoteExecutors() > 0
+	scheduler := newScheduler(config)
+	state.LocalLimiter = scheduler.LocalLimiter()
 
 	// Start up all the build workers
 	var wg sync.WaitGroup
@@ -60,14 +59,8 @@ func Run(targets, preTargets []core.BuildLabel, state *core.BuildState, config *
 	go func() {
 		for task := range actions {
 			go func(task core.Task) {
-				remote := anyRemote && !task.Target.Local
-				if remote {
-					remoteLimiter.Acquire()
-					defer remoteLimiter.Release()
-				} else {
-					localLimiter.Acquire()
-					defer localLimiter.Release()
-				}
+				remote, release := scheduler.Acquire(task)
+				defer release()
 				switch task.Type {
 				case core.TestTask:
 					test.Test(state, task.Target, remote, int(task.Run))
@@ -268,3 +261,13 @@ func (l limiter) Acquire() {
 func (l limiter) Release() {
 	<-l
 }
+
+// TryAcquire acquires the limiter if it can do so without blocking, and returns true if it did.
+func (l limiter) TryAcquire() bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
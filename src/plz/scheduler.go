@@ -0,0 +1,237 @@
+package plz
+
+import (
+	"sync"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// Labels that targets can use to state where they would rather be built when remote execution is enabled.
+const (
+	// preferLocalLabel builds the target locally if there's a free local slot, and remotely otherwise.
+	preferLocalLabel = "remote:prefer_local"
+	// preferRemoteLabel always builds the target remotely, even if it'd otherwise be raced.
+	preferRemoteLabel = "remote:prefer_remote"
+	// raceLabel builds the target on whichever of local or remote has a free slot first.
+	raceLabel = "remote:race"
+)
+
+// A scheduler decides whether each task runs locally or remotely, and limits how many run at once in each.
+// Tasks that run locally also have to fit within the machine's resources, according to what they request.
+type scheduler struct {
+	local, remote limiter
+	resources     *resourcePool
+	anyRemote     bool
+	raceMaxInputs int
+
+	mutex sync.Mutex
+	// fallenBack counts, per target, the remote slots that tasks gave up early to run locally instead.
+	fallenBack map[*core.BuildTarget]int
+}
+
+func newScheduler(config *core.Configuration) *scheduler {
+	return &scheduler{
+		local:         make(limiter, config.Please.NumThreads),
+		remote:        make(limiter, config.NumRemoteExecutors()),
+		resources:     newResourcePool(config.LocalResourceCapacity()),
+		anyRemote:     config.NumRemoteExecutors() > 0,
+		raceMaxInputs: config.Remote.RaceMaxInputs,
+		fallenBack:    map[*core.BuildTarget]int{},
+	}
+}
+
+// Acquire waits until there is a slot free to run the given task in. It returns true if the slot
+// is a remote one, and a function to release the slot once the task is done.
+func (s *scheduler) Acquire(task core.Task) (bool, func()) {
+	if s.runRemotely(task) {
+		return true, func() { s.releaseRemote(task.Target) }
+	}
+	return false, func() { s.releaseLocal(task.Target) }
+}
+
+func (s *scheduler) runRemotely(task core.Task) bool {
+	target := task.Target
+	if !s.anyRemote || target.Local {
+		s.acquireLocal(target)
+		return false
+	} else if task.Type != core.BuildTask || target.IsSubrepo || target.HasLabel(preferRemoteLabel) {
+		// Tests and subrepos always run where the target says they should.
+		s.remote.Acquire()
+		return true
+	} else if target.HasLabel(preferLocalLabel) {
+		if s.tryAcquireLocal(target) {
+			target.RunLocally()
+			return false
+		}
+		s.remote.Acquire()
+		return true
+	} else if s.shouldRace(target) {
+		select {
+		case s.local <- struct{}{}:
+			// We only race for the slot; if the machine is too busy to run it now, it goes remote instead.
+			if s.resources.TryAcquire(target.Resources) {
+				target.RunLocally()
+				return false
+			}
+			s.local.Release()
+			s.remote.Acquire()
+			return true
+		case s.remote <- struct{}{}:
+			return true
+		}
+	}
+	s.remote.Acquire()
+	return true
+}
+
+// acquireLocal waits for a local slot and for the resources the target needs.
+func (s *scheduler) acquireLocal(target *core.BuildTarget) {
+	s.local.Acquire()
+	s.resources.Acquire(target.Resources)
+}
+
+// tryAcquireLocal acquires a local slot and the target's resources if they are all available now.
+func (s *scheduler) tryAcquireLocal(target *core.BuildTarget) bool {
+	if !s.local.TryAcquire() {
+		return false
+	} else if !s.resources.TryAcquire(target.Resources) {
+		s.local.Release()
+		return false
+	}
+	return true
+}
+
+// releaseLocal releases a local slot acquired by acquireLocal or tryAcquireLocal.
+func (s *scheduler) releaseLocal(target *core.BuildTarget) {
+	s.resources.Release(target.Resources)
+	s.local.Release()
+}
+
+// releaseRemote releases a remote slot acquired by Acquire, unless the task already gave it up to fall back to
+// running locally. Slots are interchangeable, so it doesn't matter which task of the target gave one up.
+func (s *scheduler) releaseRemote(target *core.BuildTarget) {
+	s.mutex.Lock()
+	if n := s.fallenBack[target]; n > 0 {
+		if n == 1 {
+			delete(s.fallenBack, target)
+		} else {
+			s.fallenBack[target] = n - 1
+		}
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Unlock()
+	s.remote.Release()
+}
+
+// fallBack gives up the remote slot held by a task for the given target, which has decided to run locally instead.
+func (s *scheduler) fallBack(target *core.BuildTarget) {
+	s.mutex.Lock()
+	s.fallenBack[target]++
+	s.mutex.Unlock()
+	s.remote.Release()
+}
+
+// LocalLimiter returns a core.Limiter that limits local tasks in the same way as this scheduler does.
+// It's used for targets that fall back to building locally after failing remotely.
+func (s *scheduler) LocalLimiter() core.Limiter {
+	return localLimiter{s: s}
+}
+
+type localLimiter struct {
+	s *scheduler
+}
+
+// Acquire releases the remote slot the caller holds before waiting for a local one, so a target that's
+// falling back doesn't hold up remote work while it waits (or deadlock with other targets doing the same).
+func (l localLimiter) Acquire(target *core.BuildTarget) {
+	l.s.fallBack(target)
+	l.s.acquireLocal(target)
+}
+
+func (l localLimiter) Release(target *core.BuildTarget) {
+	l.s.releaseLocal(target)
+}
+
+// shouldRace returns true if the given target should be raced between local & remote execution.
+func (s *scheduler) shouldRace(target *core.BuildTarget) bool {
+	if target.HasLabel(raceLabel) {
+		return true
+	}
+	return s.raceMaxInputs > 0 && len(target.AllSources())+len(target.Dependencies()) <= s.raceMaxInputs
+}
+
+// A resourcePool tracks the CPU and memory used by local tasks, and admits new ones when they fit.
+// Requests are admitted in the order they arrive, so a large one can't be starved by a stream of small ones.
+// Requests larger than the pool are reduced to its size so they can still run (on their own), and any
+// resource for which the capacity is zero isn't limited.
+type resourcePool struct {
+	mutex          sync.Mutex
+	cond           *sync.Cond
+	capacity, used core.ResourceRequests
+	next, serving  uint64 // Tickets for the queue of waiting requests
+}
+
+func newResourcePool(capacity core.ResourceRequests) *resourcePool {
+	p := &resourcePool{capacity: capacity}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// Acquire blocks until the given resources are available.
+func (p *resourcePool) Acquire(req core.ResourceRequests) {
+	if req = p.clamp(req); req.IsZero() {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ticket := p.next
+	p.next++
+	for ticket != p.serving || !p.fits(req) {
+		p.cond.Wait()
+	}
+	p.serving++
+	p.add(req)
+	p.cond.Broadcast() // Let the next in the queue have a go.
+}
+
+// TryAcquire acquires the given resources if they are available now, and returns true if it did.
+func (p *resourcePool) TryAcquire(req core.ResourceRequests) bool {
+	if req = p.clamp(req); req.IsZero() {
+		return true
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.next != p.serving || !p.fits(req) {
+		return false
+	}
+	p.add(req)
+	return true
+}
+
+// Release returns resources acquired by Acquire or TryAcquire.
+func (p *resourcePool) Release(req core.ResourceRequests) {
+	if req = p.clamp(req); req.IsZero() {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.used.CPU -= req.CPU
+	p.used.Memory -= req.Memory
+	p.cond.Broadcast()
+}
+
+func (p *resourcePool) clamp(req core.ResourceRequests) core.ResourceRequests {
+	req.CPU = min(req.CPU, p.capacity.CPU)
+	req.Memory = min(req.Memory, p.capacity.Memory)
+	return req
+}
+
+func (p *resourcePool) fits(req core.ResourceRequests) bool {
+	return p.used.CPU+req.CPU <= p.capacity.CPU && p.used.Memory+req.Memory <= p.capacity.Memory
+}
+
+func (p *resourcePool) add(req core.ResourceRequests) {
+	p.used.CPU += req.CPU
+	p.used.Memory += req.Memory
+}
@@ -0,0 +1,213 @@
+package plz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func newTestScheduler(numLocal, numRemote int) *scheduler {
+	config := core.DefaultConfiguration()
+	config.Please.NumThreads = numLocal
+	config.Remote.URL = "127.0.0.1:8980"
+	config.Remote.NumExecutors = numRemote
+	return newScheduler(config)
+}
+
+func buildTask(name string, labels ...string) core.Task {
+	target := core.NewBuildTarget(core.ParseBuildLabel(name, ""))
+	target.Labels = labels
+	return core.Task{Target: target, Type: core.BuildTask}
+}
+
+func TestSchedulerNoRemote(t *testing.T) {
+	s := newScheduler(core.DefaultConfiguration())
+	task := buildTask("//pkg:target")
+	remote, release := s.Acquire(task)
+	defer release()
+	assert.False(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+}
+
+func TestSchedulerDefaultsToRemote(t *testing.T) {
+	s := newTestScheduler(2, 2)
+	task := buildTask("//pkg:target")
+	remote, release := s.Acquire(task)
+	defer release()
+	assert.True(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+}
+
+func TestSchedulerLocalTarget(t *testing.T) {
+	s := newTestScheduler(2, 2)
+	task := buildTask("//pkg:target")
+	task.Target.Local = true
+	remote, release := s.Acquire(task)
+	defer release()
+	assert.False(t, remote)
+}
+
+func TestSchedulerPreferLocal(t *testing.T) {
+	s := newTestScheduler(1, 1)
+	task := buildTask("//pkg:target1", preferLocalLabel)
+	remote, release := s.Acquire(task)
+	defer release()
+	assert.False(t, remote)
+	assert.True(t, task.Target.RunsLocally())
+
+	// There are no local slots left now so the next one goes remote.
+	task = buildTask("//pkg:target2", preferLocalLabel)
+	remote, release = s.Acquire(task)
+	defer release()
+	assert.True(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+}
+
+func TestSchedulerTestsDontMove(t *testing.T) {
+	s := newTestScheduler(1, 1)
+	task := buildTask("//pkg:target", preferLocalLabel)
+	task.Type = core.TestTask
+	remote, release := s.Acquire(task)
+	defer release()
+	assert.True(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+}
+
+func TestSchedulerRace(t *testing.T) {
+	s := newTestScheduler(1, 1)
+	// Fill up the remote slot; the raced target should go local.
+	remote, release := s.Acquire(buildTask("//pkg:remote"))
+	assert.True(t, remote)
+	task := buildTask("//pkg:raced", raceLabel)
+	remote, releaseRaced := s.Acquire(task)
+	assert.False(t, remote)
+	assert.True(t, task.Target.RunsLocally())
+	release()
+	releaseRaced()
+
+	// Now fill up the local one; it should go remote.
+	remote, release = s.Acquire(buildTask("//pkg:local", preferLocalLabel))
+	assert.False(t, remote)
+	defer release()
+	task = buildTask("//pkg:raced2", raceLabel)
+	remote, releaseRaced = s.Acquire(task)
+	defer releaseRaced()
+	assert.True(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+}
+
+func TestSchedulerRaceSmallActions(t *testing.T) {
+	s := newTestScheduler(1, 1)
+	s.raceMaxInputs = 1
+	small := buildTask("//pkg:small")
+	small.Target.AddSource(core.FileLabel{File: "a.txt", Package: "pkg"})
+	large := buildTask("//pkg:large")
+	large.Target.AddSource(core.FileLabel{File: "a.txt", Package: "pkg"})
+	large.Target.AddSource(core.FileLabel{File: "b.txt", Package: "pkg"})
+	assert.True(t, s.shouldRace(small.Target))
+	assert.False(t, s.shouldRace(large.Target))
+}
+
+func TestSchedulerPreferRemoteIsNotRaced(t *testing.T) {
+	s := newTestScheduler(1, 1)
+	s.raceMaxInputs = 10
+	task := buildTask("//pkg:target", preferRemoteLabel)
+	remote, release := s.Acquire(task)
+	defer release()
+	assert.True(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+}
+
+func TestSchedulerResourcesPreferLocal(t *testing.T) {
+	s := newTestScheduler(4, 1)
+	s.resources = newResourcePool(core.ResourceRequests{CPU: 4, Memory: 8 << 30})
+	task := buildTask("//pkg:target1", preferLocalLabel)
+	task.Target.Resources = core.ResourceRequests{CPU: 3}
+	remote, release := s.Acquire(task)
+	defer release()
+	assert.False(t, remote)
+
+	// There are local slots left but not enough CPU, so this one goes remote.
+	task = buildTask("//pkg:target2", preferLocalLabel)
+	task.Target.Resources = core.ResourceRequests{CPU: 2}
+	remote, release = s.Acquire(task)
+	defer release()
+	assert.True(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+
+	// Targets without any requests aren't affected.
+	task = buildTask("//pkg:target3", preferLocalLabel)
+	remote, release = s.Acquire(task)
+	defer release()
+	assert.False(t, remote)
+}
+
+func TestSchedulerResourcesRace(t *testing.T) {
+	s := newTestScheduler(2, 1)
+	s.resources = newResourcePool(core.ResourceRequests{CPU: 4, Memory: 8 << 30})
+	local, releaseLocal := s.Acquire(buildTask("//pkg:local", preferLocalLabel))
+	assert.False(t, local)
+	s.resources.Acquire(core.ResourceRequests{Memory: 6 << 30})
+	task := buildTask("//pkg:raced", raceLabel)
+	task.Target.Resources = core.ResourceRequests{Memory: 4 << 30}
+	// The local slot is free but there isn't enough memory, so it must go remote.
+	remote, release := s.Acquire(task)
+	assert.True(t, remote)
+	assert.False(t, task.Target.RunsLocally())
+	release()
+	releaseLocal()
+}
+
+func TestResourcePoolBlocks(t *testing.T) {
+	p := newResourcePool(core.ResourceRequests{CPU: 4, Memory: 8 << 30})
+	big := core.ResourceRequests{CPU: 3}
+	p.Acquire(big)
+	acquired := make(chan struct{})
+	go func() {
+		p.Acquire(core.ResourceRequests{CPU: 2})
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired resources that shouldn't have been available")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// While that one is waiting, nothing else can jump the queue.
+	assert.False(t, p.TryAcquire(core.ResourceRequests{CPU: 1}))
+	p.Release(big)
+	<-acquired
+	assert.Equal(t, core.ResourceRequests{CPU: 2}, p.used)
+}
+
+func TestResourcePoolClamps(t *testing.T) {
+	p := newResourcePool(core.ResourceRequests{CPU: 4})
+	// More than the machine has is reduced to all of it, and memory isn't limited since we don't know how much there is.
+	req := core.ResourceRequests{CPU: 16, Memory: 64 << 30}
+	assert.True(t, p.TryAcquire(req))
+	assert.Equal(t, core.ResourceRequests{CPU: 4}, p.used)
+	assert.False(t, p.TryAcquire(core.ResourceRequests{CPU: 1}))
+	p.Release(req)
+	assert.True(t, p.used.IsZero())
+}
+
+func TestSchedulerFallBackReleasesRemoteSlot(t *testing.T) {
+	s := newTestScheduler(1, 1)
+	task := buildTask("//pkg:target1")
+	remote, release := s.Acquire(task)
+	assert.True(t, remote)
+	limiter := s.LocalLimiter()
+	limiter.Acquire(task.Target)
+	// The remote slot is free again while the first task runs locally.
+	task2 := buildTask("//pkg:target2", preferRemoteLabel)
+	remote, release2 := s.Acquire(task2)
+	assert.True(t, remote)
+	limiter.Release(task.Target)
+	release()
+	// The first task's release mustn't have freed the second task's slot.
+	assert.False(t, s.remote.TryAcquire())
+	release2()
+	assert.True(t, s.remote.TryAcquire())
+}
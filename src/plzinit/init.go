@@ -75,7 +75,7 @@ func InitConfig(dir string, bazelCompatibility bool, noPrompt bool) {
 	InitWrapperScript()
 	fmt.Printf("\nAlso wrote wrapper script to %s; users can invoke that directly to run Please, even without it installed.\n", wrapperScriptName)
 	// If we're in a known repository type, ignore the plz-out directory.
-	if s := scm.New(dir); s != nil {
+	if s := scm.New(dir); scm.Versioned(s) {
 		fmt.Printf("Also marking plz-out to be ignored by your SCM.\n")
 		if err := s.IgnoreFiles(".gitignore", nil); err != nil {
 			log.Error("Failed to ignore plz-out: %s", err)
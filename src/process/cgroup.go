@@ -0,0 +1,66 @@
+package process
+
+import (
+	"time"
+)
+
+// Limits are resource limits applied to a command when it runs in its own cgroup.
+// Zero values mean that resource is not limited.
+type Limits struct {
+	// The number of CPUs' worth of time the command can use.
+	CPU int
+	// The number of CPUs the command has requested. This doesn't limit it; it gives it a proportionally
+	// larger share of CPU time than other commands when they're contending for it.
+	CPURequest int
+	// The amount of memory the command can use, in bytes.
+	Memory uint64
+	// The number of processes the command can have running at once.
+	Pids int
+}
+
+// merge returns these limits with any that are unset taken from the given defaults.
+func (l Limits) merge(defaults Limits) Limits {
+	if l.CPU == 0 {
+		l.CPU = defaults.CPU
+	}
+	if l.Memory == 0 {
+		l.Memory = defaults.Memory
+	}
+	if l.Pids == 0 {
+		l.Pids = defaults.Pids
+	}
+	return l
+}
+
+// Usage describes the resources used by a command that ran in its own cgroup, and/or the files it used
+// if file tracing is enabled.
+type Usage struct {
+	// The most memory used at once by the command and all its subprocesses, in bytes.
+	// Zero if the kernel doesn't report it.
+	PeakMemory uint64
+	// The total CPU time (user and system) used by the command and all its subprocesses.
+	CPUTime time.Duration
+	// True if any of its processes were killed for exceeding the memory limit.
+	OOMKilled bool
+	// The absolute paths of the files that the command and its subprocesses opened for reading or executed.
+	// Nil if file tracing isn't enabled.
+	Files []string
+	// The absolute paths of the files that they tried to open for reading or execute, but that didn't exist.
+	// Nil if file tracing isn't enabled.
+	Missing []string
+}
+
+// EnableCgroups makes this executor run each command in its own cgroup, created underneath the given one,
+// which allows limits to be applied to them, their resource usage to be measured and all their
+// subprocesses to be reliably killed once they finish. If root is empty then the cgroup that we are
+// running in is used. The given limits apply to any command that doesn't specify its own.
+// It returns an error if cgroups can't be used, in which case the executor is unchanged.
+func (e *Executor) EnableCgroups(root string, defaults Limits) error {
+	m, err := newCgroupManager(root)
+	if err != nil {
+		return err
+	}
+	e.cgroups = m
+	e.cgroupDefaults = defaults
+	return nil
+}
@@ -0,0 +1,271 @@
+package process
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupMount is where we expect the cgroup v2 hierarchy to be mounted.
+const cgroupMount = "/sys/fs/cgroup"
+
+// cgroupControllers are the controllers we try to enable for the cgroups we create.
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+// cpuPeriod is the period (in microseconds) we use when limiting CPU time.
+const cpuPeriod = 100000
+
+// cpuWeight is the default cpu.weight of a cgroup, which we give to commands for each CPU they request.
+// maxCPUWeight is the largest weight the kernel accepts.
+const (
+	cpuWeight    = 100
+	maxCPUWeight = 10000
+)
+
+// A cgroupManager creates cgroups for individual commands underneath a root cgroup.
+type cgroupManager struct {
+	root    string
+	counter atomic.Int64
+}
+
+// newCgroupManager returns a cgroupManager that creates cgroups under the given root, which is the
+// cgroup we're running in if it's empty.
+// In that case we move ourselves into a child of it named plz and stay there until we exit; we can't
+// move back once we've enabled controllers for the root's children. The plz cgroup is left behind for
+// later invocations to reuse. If anything fails before then, we move back and remove it again.
+func newCgroupManager(root string) (*cgroupManager, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupMount)
+	}
+	own := root == ""
+	if own {
+		contents, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return nil, err
+		} else if root, err = parseProcCgroup(contents); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasPrefix(root, cgroupMount+"/") {
+		root = filepath.Join(cgroupMount, root)
+	}
+	if err := checkDelegated(root); err != nil {
+		return nil, fmt.Errorf("cgroup %s isn't delegated to us: %w", root, err)
+	}
+	if !own {
+		if err := enableControllers(root); err != nil {
+			return nil, fmt.Errorf("can't enable controllers in %s (it must not contain any processes): %w", root, err)
+		}
+		return &cgroupManager{root: root}, nil
+	}
+	// Controllers can only be enabled for a cgroup's children if it doesn't have any processes
+	// in it itself, so we move ourselves into a leaf cgroup first. That's no use if we're not alone.
+	pid := strconv.Itoa(os.Getpid())
+	if procs, err := os.ReadFile(filepath.Join(root, "cgroup.procs")); err != nil {
+		return nil, err
+	} else if fields := strings.Fields(string(procs)); len(fields) != 1 || fields[0] != pid {
+		return nil, fmt.Errorf("cgroup %s contains other processes; set cgroup.root to a dedicated cgroup", root)
+	}
+	leaf := filepath.Join(root, "plz")
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("can't create cgroup: %w", err)
+	} else if err := writeCgroupFile(leaf, "cgroup.procs", pid); err != nil {
+		os.Remove(leaf)
+		return nil, fmt.Errorf("can't move into cgroup %s: %w", leaf, err)
+	} else if err := enableControllers(root); err != nil {
+		if err := writeCgroupFile(root, "cgroup.procs", pid); err != nil {
+			log.Warning("Failed to move back out of cgroup %s: %s", leaf, err)
+		} else if err := os.Remove(leaf); err != nil && !errors.Is(err, syscall.EBUSY) {
+			// It's busy if another invocation is using it, which is fine.
+			log.Warning("Failed to remove cgroup %s: %s", leaf, err)
+		}
+		return nil, fmt.Errorf("can't enable controllers in %s: %w", root, err)
+	}
+	return &cgroupManager{root: root}, nil
+}
+
+// checkDelegated returns an error if we can't create cgroups under the given one and enable any of the
+// controllers we want for them.
+func checkDelegated(dir string) error {
+	for _, name := range []string{"cgroup.subtree_control", "cgroup.procs"} {
+		if err := unix.Access(filepath.Join(dir, name), unix.W_OK); err != nil {
+			return fmt.Errorf("can't write %s: %w", name, err)
+		}
+	}
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	} else if !slices.ContainsFunc(strings.Fields(string(available)), func(c string) bool { return slices.Contains(cgroupControllers, c) }) {
+		return fmt.Errorf("none of the %s controllers are available", strings.Join(cgroupControllers, ", "))
+	}
+	return nil
+}
+
+// parseProcCgroup returns the cgroup v2 path from the contents of /proc/<pid>/cgroup.
+func parseProcCgroup(contents []byte) (string, error) {
+	for _, line := range strings.Split(string(contents), "\n") {
+		if path, found := strings.CutPrefix(line, "0::"); found {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("not running in a cgroup v2 hierarchy")
+}
+
+// enableControllers enables any of the controllers we want that are available for the children of the given cgroup.
+func enableControllers(dir string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	enabled, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	var changes []string
+	for _, controller := range cgroupControllers {
+		if slices.Contains(strings.Fields(string(available)), controller) && !slices.Contains(strings.Fields(string(enabled)), controller) {
+			changes = append(changes, "+"+controller)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(changes, " "))
+}
+
+// New creates a new cgroup with the given limits applied.
+func (m *cgroupManager) New(limits Limits) (*cgroup, error) {
+	dir := filepath.Join(m.root, fmt.Sprintf("plz-%d-%d", os.Getpid(), m.counter.Add(1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{dir: dir}
+	if err := cg.setLimits(limits); err != nil {
+		cg.Remove()
+		return nil, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		cg.Remove()
+		return nil, err
+	}
+	cg.f = f
+	return cg, nil
+}
+
+// A cgroup is a single cgroup that one command runs in.
+type cgroup struct {
+	dir string
+	f   *os.File
+}
+
+func (cg *cgroup) setLimits(limits Limits) error {
+	if limits.Memory > 0 {
+		if err := writeCgroupFile(cg.dir, "memory.max", strconv.FormatUint(limits.Memory, 10)); err != nil {
+			return fmt.Errorf("can't limit memory: %w", err)
+		}
+		// Without this the limit can be sidestepped by swapping. Not all kernels account for swap so
+		// we don't mind if it's not possible.
+		writeCgroupFile(cg.dir, "memory.swap.max", "0")
+	}
+	if limits.CPU > 0 {
+		if err := writeCgroupFile(cg.dir, "cpu.max", fmt.Sprintf("%d %d", limits.CPU*cpuPeriod, cpuPeriod)); err != nil {
+			return fmt.Errorf("can't limit CPU: %w", err)
+		}
+	}
+	if limits.CPURequest > 0 {
+		if err := writeCgroupFile(cg.dir, "cpu.weight", strconv.Itoa(min(limits.CPURequest*cpuWeight, maxCPUWeight))); err != nil {
+			return fmt.Errorf("can't set CPU weight: %w", err)
+		}
+	}
+	if limits.Pids > 0 {
+		if err := writeCgroupFile(cg.dir, "pids.max", strconv.Itoa(limits.Pids)); err != nil {
+			return fmt.Errorf("can't limit processes: %w", err)
+		}
+	}
+	return nil
+}
+
+// Attach arranges for the given command to be started inside this cgroup.
+func (cg *cgroup) Attach(cmd *exec.Cmd) {
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.f.Fd())
+}
+
+// Kill kills every process in this cgroup.
+func (cg *cgroup) Kill() {
+	if err := writeCgroupFile(cg.dir, "cgroup.kill", "1"); err == nil {
+		return
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warning("Failed to kill processes in cgroup %s: %s", cg.dir, err)
+		return
+	}
+	// cgroup.kill only exists from Linux 5.14; before that we have to do it one process at a time.
+	if contents, err := os.ReadFile(filepath.Join(cg.dir, "cgroup.procs")); err == nil {
+		for _, pid := range strings.Fields(string(contents)) {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+}
+
+// Usage returns the resources used by the processes in this cgroup.
+func (cg *cgroup) Usage() *Usage {
+	usage := &Usage{}
+	if contents, err := os.ReadFile(filepath.Join(cg.dir, "memory.peak")); err == nil {
+		usage.PeakMemory, _ = strconv.ParseUint(string(bytes.TrimSpace(contents)), 10, 64)
+	}
+	if contents, err := os.ReadFile(filepath.Join(cg.dir, "cpu.stat")); err == nil {
+		usage.CPUTime = time.Duration(cgroupStat(contents, "usage_usec")) * time.Microsecond
+	}
+	if contents, err := os.ReadFile(filepath.Join(cg.dir, "memory.events")); err == nil {
+		usage.OOMKilled = cgroupStat(contents, "oom_kill") > 0
+	}
+	return usage
+}
+
+// Remove kills anything left in this cgroup and removes it.
+func (cg *cgroup) Remove() {
+	if cg.f != nil {
+		cg.f.Close()
+	}
+	cg.Kill()
+	// The cgroup can't be removed until all its processes have exited, which takes a moment after killing them.
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = os.Remove(cg.dir); err == nil || !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		log.Warning("Failed to remove cgroup %s: %s", cg.dir, err)
+	}
+}
+
+// cgroupStat returns the value of the given key from a cgroup file that's made up of "key value" lines.
+func cgroupStat(contents []byte, key string) uint64 {
+	for _, line := range strings.Split(string(contents), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == key {
+			v, _ := strconv.ParseUint(fields[1], 10, 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func writeCgroupFile(dir, name, contents string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+}
@@ -0,0 +1,122 @@
+package process
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcCgroup(t *testing.T) {
+	path, err := parseProcCgroup([]byte("0::/user.slice/user-1000.slice/session-2.scope\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/user.slice/user-1000.slice/session-2.scope", path)
+
+	_, err = parseProcCgroup([]byte("4:memory:/user.slice\n1:cpu:/\n"))
+	assert.Error(t, err)
+}
+
+func TestCheckDelegated(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, writeCgroupFile(dir, "cgroup.procs", ""))
+	require.NoError(t, writeCgroupFile(dir, "cgroup.subtree_control", ""))
+	require.NoError(t, writeCgroupFile(dir, "cgroup.controllers", "cpuset io hugetlb\n"))
+	assert.Error(t, checkDelegated(dir))
+	require.NoError(t, writeCgroupFile(dir, "cgroup.controllers", "cpuset cpu io memory\n"))
+	assert.NoError(t, checkDelegated(dir))
+	if os.Getuid() != 0 {
+		require.NoError(t, os.Chmod(filepath.Join(dir, "cgroup.subtree_control"), 0444))
+		assert.Error(t, checkDelegated(dir))
+	}
+}
+
+func TestCgroupStat(t *testing.T) {
+	contents := []byte("usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n")
+	assert.Equal(t, uint64(1500000), cgroupStat(contents, "usage_usec"))
+	assert.Equal(t, uint64(500000), cgroupStat(contents, "system_usec"))
+	assert.Equal(t, uint64(0), cgroupStat(contents, "nr_throttled"))
+}
+
+func TestLimitsMerge(t *testing.T) {
+	defaults := Limits{Memory: 1 << 30, Pids: 100}
+	assert.Equal(t, Limits{CPU: 2, Memory: 1 << 30, Pids: 100}, Limits{CPU: 2}.merge(defaults))
+	assert.Equal(t, Limits{CPU: 4, CPURequest: 2, Memory: 1 << 30, Pids: 100}, Limits{CPURequest: 2}.merge(Limits{CPU: 4, Memory: 1 << 30, Pids: 100}))
+	assert.Equal(t, Limits{Memory: 4 << 30, Pids: 100}, Limits{Memory: 4 << 30}.merge(defaults))
+}
+
+// These use a plain directory in place of a real cgroup, so only exercise reading & writing its files.
+func TestCgroupSetLimits(t *testing.T) {
+	cg := &cgroup{dir: t.TempDir()}
+	require.NoError(t, cg.setLimits(Limits{CPU: 2, CPURequest: 3, Memory: 1024, Pids: 50}))
+	assertCgroupFile(t, cg.dir, "cpu.max", "200000 100000")
+	assertCgroupFile(t, cg.dir, "cpu.weight", "300")
+	assertCgroupFile(t, cg.dir, "memory.max", "1024")
+	assertCgroupFile(t, cg.dir, "memory.swap.max", "0")
+	assertCgroupFile(t, cg.dir, "pids.max", "50")
+
+	cg = &cgroup{dir: t.TempDir()}
+	require.NoError(t, cg.setLimits(Limits{}))
+	entries, err := os.ReadDir(cg.dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	cg = &cgroup{dir: t.TempDir()}
+	require.NoError(t, cg.setLimits(Limits{CPURequest: 500}))
+	assertCgroupFile(t, cg.dir, "cpu.weight", "10000")
+	assert.NoFileExists(t, filepath.Join(cg.dir, "cpu.max"))
+}
+
+func TestCgroupUsage(t *testing.T) {
+	cg := &cgroup{dir: t.TempDir()}
+	assert.Equal(t, &Usage{}, cg.Usage())
+
+	require.NoError(t, writeCgroupFile(cg.dir, "memory.peak", "2097152\n"))
+	require.NoError(t, writeCgroupFile(cg.dir, "cpu.stat", "usage_usec 1500000\nuser_usec 1000000\n"))
+	require.NoError(t, writeCgroupFile(cg.dir, "memory.events", "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"))
+	assert.Equal(t, &Usage{
+		PeakMemory: 2097152,
+		CPUTime:    1500 * time.Millisecond,
+		OOMKilled:  true,
+	}, cg.Usage())
+}
+
+func TestExecWithLimitsNoCgroups(t *testing.T) {
+	_, _, usage, err := New().ExecWithLimits(context.Background(), nil, "", nil, 10*time.Second, false, false, false, false, NoSandbox, Limits{Memory: 1024}, []string{"true"})
+	assert.NoError(t, err)
+	assert.Nil(t, usage)
+}
+
+// This needs a real cgroup that's delegated to the current user, so only runs if one is given in the environment,
+// e.g. systemd-run --user --scope -p Delegate=yes bash -c 'PLZ_TEST_CGROUP_ROOT=$(cut -d: -f3 /proc/self/cgroup)/test go test'
+func TestExecWithLimitsCgroup(t *testing.T) {
+	root := os.Getenv("PLZ_TEST_CGROUP_ROOT")
+	if root == "" {
+		t.Skip("PLZ_TEST_CGROUP_ROOT is not set")
+	}
+	e := New()
+	require.NoError(t, e.EnableCgroups(root, Limits{Pids: 20}))
+	_, _, usage, err := e.ExecWithLimits(context.Background(), nil, "", nil, 10*time.Second, false, false, false, false, NoSandbox, Limits{Memory: 64 << 20}, []string{"bash", "-c", "x=$(head -c 16000000 /dev/zero | tr '\\0' a); echo ${#x}"})
+	require.NoError(t, err)
+	assert.Greater(t, usage.PeakMemory, uint64(16000000))
+	assert.False(t, usage.OOMKilled)
+
+	// Now it'll exceed the limit.
+	_, _, usage, err = e.ExecWithLimits(context.Background(), nil, "", nil, 10*time.Second, false, false, false, false, NoSandbox, Limits{Memory: 8 << 20}, []string{"bash", "-c", "x=$(head -c 64000000 /dev/zero | tr '\\0' a); echo ${#x}"})
+	assert.ErrorContains(t, err, "memory limit")
+	assert.True(t, usage.OOMKilled)
+
+	// Nothing should be left behind once it's done.
+	matches, _ := filepath.Glob(filepath.Join(e.cgroups.root, "plz-*"))
+	assert.Empty(t, matches)
+}
+
+func assertCgroupFile(t *testing.T, dir, name, expected string) {
+	t.Helper()
+	contents, err := os.ReadFile(filepath.Join(dir, name))
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(contents))
+}
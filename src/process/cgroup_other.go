@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+type cgroupManager struct{}
+
+func newCgroupManager(root string) (*cgroupManager, error) {
+	return nil, fmt.Errorf("cgroups are only supported on Linux")
+}
+
+func (m *cgroupManager) New(limits Limits) (*cgroup, error) {
+	return &cgroup{}, nil
+}
+
+type cgroup struct{}
+
+func (cg *cgroup) Attach(cmd *exec.Cmd) {}
+
+func (cg *cgroup) Kill() {}
+
+func (cg *cgroup) Usage() *Usage {
+	return &Usage{}
+}
+
+func (cg *cgroup) Remove() {}
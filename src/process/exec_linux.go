@@ -56,20 +56,26 @@ func (e *Executor) ExecCommand(sandbox SandboxConfig, foreground bool, command s
 			cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
 		}
 
-		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{
-			// Map the host user ID to 0 which is a privileged user as is treated specially by the kernel.
-			// This essentially gives us fakeroot(1) style elevation for build rules
-			{HostID: os.Getuid(), Size: 1, ContainerID: 0},
-		}
-		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{
-			// Map the host group ID to 0. This is usually wheel or root though it doesn't have any special meaning
-			// to the kernel unlike user 0
-			{HostID: os.Getgid(), Size: 1, ContainerID: 0},
-		}
+		cmd.SysProcAttr.UidMappings, cmd.SysProcAttr.GidMappings = namespaceIDMappings()
 	}
 	return cmd
 }
 
+// namespaceIDMappings returns the user and group ID mappings for commands we run in a new user namespace.
+func namespaceIDMappings() (uids, gids []syscall.SysProcIDMap) {
+	uids = []syscall.SysProcIDMap{
+		// Map the host user ID to 0 which is a privileged user as is treated specially by the kernel.
+		// This essentially gives us fakeroot(1) style elevation for build rules
+		{HostID: os.Getuid(), Size: 1, ContainerID: 0},
+	}
+	gids = []syscall.SysProcIDMap{
+		// Map the host group ID to 0. This is usually wheel or root though it doesn't have any special meaning
+		// to the kernel unlike user 0
+		{HostID: os.Getgid(), Size: 1, ContainerID: 0},
+	}
+	return uids, gids
+}
+
 // Say nothing...
 func boolToString(value bool) string {
 	if value {
@@ -0,0 +1,61 @@
+package process
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// traceFilesCommand is the plz subcommand that runs a command under the file tracer (see TraceFiles).
+const traceFilesCommand = "trace_files"
+
+// missingFilePrefix marks the lines of the tracer's output that are files that didn't exist. Everything else is an absolute path.
+const missingFilePrefix = "!"
+
+// EnableFileTracing makes this executor record every file opened for reading by the commands it runs
+// (and any subprocesses they start), which are then returned in their Usage.
+// This is relatively expensive so is only intended for auditing what actions actually use.
+// It returns an error if it isn't supported on this platform, in which case the executor is unchanged.
+func (e *Executor) EnableFileTracing() error {
+	if !fileTracingSupported {
+		return fmt.Errorf("file tracing is only supported on Linux (amd64 and arm64)")
+	}
+	plz, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	e.tracer = plz
+	return nil
+}
+
+// traceCommand rewrites the given command to run under the file tracer, which writes the files it opens to the given file.
+func (e *Executor) traceCommand(cmd *exec.Cmd, output *os.File) {
+	cmd.Args = append([]string{e.tracer, traceFilesCommand, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = e.tracer
+	// This becomes fd 3 in the tracer.
+	cmd.ExtraFiles = []*os.File{output}
+	moveNamespacesToTracee(cmd)
+}
+
+// readTraceOutput reads the lists of files that were opened and that were missing written by the file tracer.
+func readTraceOutput(f *os.File) (files, missing []string, err error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	files = []string{}
+	missing = []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if path, found := strings.CutPrefix(line, missingFilePrefix); found {
+			missing = append(missing, path)
+		} else if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, missing, nil
+}
@@ -0,0 +1,281 @@
+package process
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxTracedPath is the longest path we'll read out of a traced process.
+const maxTracedPath = unix.PathMax
+
+// traceCloneflagsVar is the environment variable that passes the namespaces to run the traced command in to the tracer.
+const traceCloneflagsVar = "TRACE_CLONEFLAGS"
+
+// TraceFiles runs the given command using ptrace to record every file that it or any of its subprocesses
+// successfully open for reading (or execute), and writes them to fd 3 once it's done, followed by any
+// that they tried to open or execute that didn't exist.
+// This is the implementation of `plz trace_files`, which the executor runs commands under when file
+// tracing is enabled. It returns the exit code of the command.
+// Anything the command leaves running in the background is killed when it exits.
+func TraceFiles(args []string) (int, error) {
+	if len(args) < 1 {
+		return 1, fmt.Errorf("incorrect number of args to call plz trace_files")
+	}
+	output := os.NewFile(3, "trace output")
+	syscall.CloseOnExec(3)
+
+	// All ptrace requests have to come from the thread that started the tracee.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	cmd, err := tracedCommand(args)
+	if err != nil {
+		return 1, err
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+	t := newFileTracer()
+	code, err := t.Run(cmd.Process.Pid)
+	if err != nil {
+		return 1, err
+	}
+	files := make([]string, 0, len(t.files)+len(t.missing))
+	for f := range t.files {
+		files = append(files, f)
+	}
+	for f := range t.missing {
+		files = append(files, missingFilePrefix+f)
+	}
+	slices.Sort(files)
+	if _, err := output.WriteString(strings.Join(files, "\n") + "\n"); err != nil {
+		return 1, err
+	}
+	return code, output.Close()
+}
+
+// tracedCommand returns the command to run under the tracer, in any namespaces that were passed to us by
+// moveNamespacesToTracee.
+func tracedCommand(args []string) (*exec.Cmd, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Ptrace:    true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if flags := os.Getenv(traceCloneflagsVar); flags != "" {
+		os.Unsetenv(traceCloneflagsVar)
+		cloneflags, err := strconv.ParseUint(flags, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", traceCloneflagsVar, err)
+		}
+		cmd.SysProcAttr.Cloneflags = uintptr(cloneflags)
+		if cloneflags&syscall.CLONE_NEWUSER != 0 {
+			cmd.SysProcAttr.UidMappings, cmd.SysProcAttr.GidMappings = namespaceIDMappings()
+		}
+	}
+	return cmd, nil
+}
+
+// moveNamespacesToTracee arranges for the tracer to create the namespaces that the given command would have
+// run in for the command it traces, rather than running in them itself. It resolves relative paths via
+// /proc, which only works if it's in the same PID namespace as the procfs is for.
+func moveNamespacesToTracee(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Cloneflags == 0 {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, traceCloneflagsVar+"="+strconv.FormatUint(uint64(cmd.SysProcAttr.Cloneflags), 10))
+	cmd.SysProcAttr.Cloneflags = 0
+	cmd.SysProcAttr.UidMappings = nil
+	cmd.SysProcAttr.GidMappings = nil
+}
+
+// A fileTracer traces a process tree, recording the files they open.
+type fileTracer struct {
+	files map[string]struct{}
+	// Files they tried to open that didn't exist.
+	missing map[string]struct{}
+	// The open that each process is in the middle of, by pid. An entry exists (possibly nil) while
+	// the process is inside any syscall.
+	pending map[int]*tracedOpen
+	// Processes we've seen stop before.
+	attached map[int]bool
+}
+
+func newFileTracer() *fileTracer {
+	return &fileTracer{
+		files:    map[string]struct{}{},
+		missing:  map[string]struct{}{},
+		pending:  map[int]*tracedOpen{},
+		attached: map[int]bool{},
+	}
+}
+
+// A tracedOpen is a syscall that opens a file that we're waiting to see the result of.
+type tracedOpen struct {
+	path string
+}
+
+// Run traces the given process, which must have just started with PTRACE_TRACEME, until it exits.
+// It returns its exit code.
+func (t *fileTracer) Run(pid int) (int, error) {
+	var ws unix.WaitStatus
+	if _, err := unix.Wait4(pid, &ws, 0, nil); err != nil {
+		return 1, err
+	} else if !ws.Stopped() {
+		return 1, fmt.Errorf("traced process failed to start")
+	}
+	t.attached[pid] = true
+	const options = unix.PTRACE_O_TRACESYSGOOD | unix.PTRACE_O_TRACECLONE | unix.PTRACE_O_TRACEFORK | unix.PTRACE_O_TRACEVFORK | unix.PTRACE_O_TRACEEXEC | unix.PTRACE_O_EXITKILL
+	if err := unix.PtraceSetOptions(pid, options); err != nil {
+		return 1, fmt.Errorf("failed to set ptrace options: %w", err)
+	} else if err := unix.PtraceSyscall(pid, 0); err != nil {
+		return 1, err
+	}
+	for {
+		wpid, err := unix.Wait4(-1, &ws, unix.WALL, nil)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return 1, err
+		}
+		if ws.Exited() || ws.Signaled() {
+			delete(t.pending, wpid)
+			delete(t.attached, wpid)
+			if wpid != pid {
+				continue
+			} else if ws.Signaled() {
+				return 128 + int(ws.Signal()), nil
+			}
+			return ws.ExitStatus(), nil
+		} else if !ws.Stopped() {
+			continue
+		}
+		signal := 0
+		switch sig := ws.StopSignal(); {
+		case sig == syscall.SIGTRAP|0x80:
+			t.syscallStop(wpid)
+		case sig == syscall.SIGTRAP && ws.TrapCause() != 0:
+			// A fork / clone / exec event; any new process is attached to us automatically.
+		case sig == syscall.SIGSTOP && !t.attached[wpid]:
+			// This is the initial stop of a newly attached process.
+		default:
+			signal = int(sig)
+		}
+		t.attached[wpid] = true
+		// This can fail if the process has been killed in the meantime, which is fine.
+		unix.PtraceSyscall(wpid, signal)
+	}
+}
+
+// syscallStop handles a process stopping on entry to or exit from a syscall.
+func (t *fileTracer) syscallStop(pid int) {
+	var regs tracedRegs
+	if err := getTracedRegs(pid, &regs); err != nil {
+		return
+	}
+	if open, present := t.pending[pid]; present {
+		delete(t.pending, pid)
+		if open == nil {
+			return
+		} else if ret := syscallReturn(&regs); ret >= 0 {
+			t.files[open.path] = struct{}{}
+		} else if ret == -int64(unix.ENOENT) {
+			t.missing[open.path] = struct{}{}
+		}
+		return
+	}
+	t.pending[pid] = t.syscallEntry(pid, &regs)
+}
+
+// syscallEntry returns the file that the given process is opening, or nil if it isn't opening one
+// (or not one we're interested in).
+func (t *fileTracer) syscallEntry(pid int, regs *tracedRegs) *tracedOpen {
+	nr, args := syscallArgs(regs)
+	atFdcwd := int64(unix.AT_FDCWD)
+	var dirfd, pathAddr, flags uint64
+	switch nr {
+	case sysOpen:
+		dirfd, pathAddr, flags = uint64(atFdcwd), args[0], args[1]
+	case unix.SYS_OPENAT:
+		dirfd, pathAddr, flags = args[0], args[1], args[2]
+	case unix.SYS_OPENAT2:
+		// The flags are the first field of the struct open_how that this points to.
+		var how [8]byte
+		if n, _ := unix.PtracePeekData(pid, uintptr(args[2]), how[:]); n != len(how) {
+			return nil
+		}
+		dirfd, pathAddr, flags = args[0], args[1], binary.NativeEndian.Uint64(how[:])
+	case unix.SYS_EXECVE:
+		dirfd, pathAddr = uint64(atFdcwd), args[0]
+	case unix.SYS_EXECVEAT:
+		dirfd, pathAddr = args[0], args[1]
+	default:
+		return nil
+	}
+	if flags&unix.O_ACCMODE == unix.O_WRONLY || flags&unix.O_TRUNC != 0 {
+		return nil // It's not reading this file.
+	}
+	path := readTracedString(pid, uintptr(pathAddr))
+	if path == "" {
+		return nil
+	} else if path = resolveTracedPath(pid, int32(dirfd), path); path == "" {
+		return nil
+	}
+	return &tracedOpen{path: path}
+}
+
+// readTracedString reads a null-terminated string from the memory of a traced process.
+func readTracedString(pid int, addr uintptr) string {
+	var buf []byte
+	chunk := make([]byte, 256)
+	for len(buf) < maxTracedPath {
+		n, _ := unix.PtracePeekData(pid, addr+uintptr(len(buf)), chunk)
+		if idx := bytes.IndexByte(chunk[:n], 0); idx != -1 {
+			return string(append(buf, chunk[:idx]...))
+		} else if n < len(chunk) {
+			return "" // Presumably we've run off the end of its memory.
+		}
+		buf = append(buf, chunk...)
+	}
+	return ""
+}
+
+// resolveTracedPath resolves a path opened by a traced process (relative to the given directory fd) into an absolute path.
+// It returns the empty string if it can't be resolved.
+func resolveTracedPath(pid int, dirfd int32, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	// We find the directory via /proc, which needs to be for the same PID namespace as we're in. That's
+	// normally the case since we create any namespaces for the traced command ourselves, but it's not
+	// guaranteed if we were started in a container.
+	if self, err := os.Readlink("/proc/self"); err != nil || self != strconv.Itoa(os.Getpid()) {
+		return ""
+	}
+	link := fmt.Sprintf("/proc/%d/cwd", pid)
+	if dirfd != unix.AT_FDCWD {
+		link = fmt.Sprintf("/proc/%d/fd/%d", pid, dirfd)
+	}
+	dir, err := os.Readlink(link)
+	if err != nil || !filepath.IsAbs(dir) {
+		return ""
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,26 @@
+package process
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const fileTracingSupported = true
+
+// sysOpen is the number of the open syscall, which not all architectures have.
+const sysOpen uint64 = unix.SYS_OPEN
+
+type tracedRegs = unix.PtraceRegs
+
+func getTracedRegs(pid int, regs *tracedRegs) error {
+	return unix.PtraceGetRegs(pid, regs)
+}
+
+// syscallArgs returns the syscall number & the first three arguments to it from the given registers.
+func syscallArgs(regs *tracedRegs) (uint64, [3]uint64) {
+	return regs.Orig_rax, [3]uint64{regs.Rdi, regs.Rsi, regs.Rdx}
+}
+
+// syscallReturn returns the return value of a syscall from the given registers.
+func syscallReturn(regs *tracedRegs) int64 {
+	return int64(regs.Rax)
+}
@@ -0,0 +1,29 @@
+package process
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const fileTracingSupported = true
+
+// sysOpen would be the number of the open syscall, but arm64 doesn't have one.
+const sysOpen = ^uint64(0)
+
+type tracedRegs = unix.PtraceRegsArm64
+
+// ntPrstatus is the register set containing the general-purpose registers (see elf.NT_PRSTATUS).
+const ntPrstatus = 1
+
+func getTracedRegs(pid int, regs *tracedRegs) error {
+	return unix.PtraceGetRegSetArm64(pid, ntPrstatus, regs)
+}
+
+// syscallArgs returns the syscall number & the first three arguments to it from the given registers.
+func syscallArgs(regs *tracedRegs) (uint64, [3]uint64) {
+	return regs.Regs[8], [3]uint64{regs.Regs[0], regs.Regs[1], regs.Regs[2]}
+}
+
+// syscallReturn returns the return value of a syscall from the given registers.
+func syscallReturn(regs *tracedRegs) int64 {
+	return int64(regs.Regs[0])
+}
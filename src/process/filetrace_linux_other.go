@@ -0,0 +1,28 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package process
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const fileTracingSupported = false
+
+const sysOpen = ^uint64(0)
+
+type tracedRegs = unix.PtraceRegs
+
+func getTracedRegs(pid int, regs *tracedRegs) error {
+	return fmt.Errorf("file tracing is not supported on this architecture")
+}
+
+func syscallArgs(regs *tracedRegs) (uint64, [3]uint64) {
+	return 0, [3]uint64{}
+}
+
+func syscallReturn(regs *tracedRegs) int64 {
+	return -1
+}
@@ -0,0 +1,134 @@
+package process
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTracer(t *testing.T) {
+	if !fileTracingSupported {
+		t.Skip("file tracing isn't supported on this architecture")
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "in.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "in2.txt"), []byte("hello"), 0644))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cmd := exec.Command("bash", "-c", "cat in.txt > out.txt; (cd sub && cat in2.txt); cat missing.txt; exit 3")
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
+	err := cmd.Start()
+	skipIfPtraceNotPermitted(t, err)
+	require.NoError(t, err)
+	tracer := newFileTracer()
+	code, err := tracer.Run(cmd.Process.Pid)
+	if errors.Is(err, syscall.EPERM) {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	skipIfPtraceNotPermitted(t, err)
+	require.NoError(t, err)
+	assert.Equal(t, 3, code)
+
+	assert.Contains(t, tracer.files, filepath.Join(dir, "in.txt"))
+	assert.Contains(t, tracer.files, filepath.Join(dir, "sub", "in2.txt"))
+	// This was written, not read.
+	assert.NotContains(t, tracer.files, filepath.Join(dir, "out.txt"))
+	// This failed to open.
+	assert.NotContains(t, tracer.files, filepath.Join(dir, "missing.txt"))
+	assert.Contains(t, tracer.missing, filepath.Join(dir, "missing.txt"))
+	assert.NotContains(t, tracer.missing, filepath.Join(dir, "in.txt"))
+	// cat was executed, which counts too.
+	cat, _ := exec.LookPath("cat")
+	cat, _ = filepath.EvalSymlinks(cat)
+	found := false
+	for f := range tracer.files {
+		if resolved, _ := filepath.EvalSymlinks(f); resolved == cat {
+			found = true
+		}
+	}
+	assert.True(t, found, "cat should have been traced")
+}
+
+func TestFileTracerInNamespaces(t *testing.T) {
+	if !fileTracingSupported {
+		t.Skip("file tracing isn't supported on this architecture")
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "in.txt"), []byte("hello"), 0644))
+	t.Setenv(traceCloneflagsVar, strconv.Itoa(syscall.CLONE_NEWUSER|syscall.CLONE_NEWPID))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cmd, err := tracedCommand([]string{"bash", "-c", "cat in.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, "", os.Getenv(traceCloneflagsVar))
+	cmd.Dir = dir
+	err = cmd.Start()
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EINVAL) {
+		t.Skipf("user namespaces aren't permitted here: %s", err)
+	}
+	skipIfPtraceNotPermitted(t, err)
+	require.NoError(t, err)
+	tracer := newFileTracer()
+	code, err := tracer.Run(cmd.Process.Pid)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	// This was opened by a relative path from inside the PID namespace.
+	assert.Contains(t, tracer.files, filepath.Join(dir, "in.txt"))
+}
+
+// skipIfPtraceNotPermitted skips the test if the error shows we aren't allowed to use ptrace here,
+// which is common in containers.
+func skipIfPtraceNotPermitted(t *testing.T, err error) {
+	t.Helper()
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("ptrace isn't permitted here: %s", err)
+	}
+}
+
+func TestReadTraceOutput(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "trace")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString("!/etc/missing\n/usr/bin/bash\n/etc/passwd\n")
+	require.NoError(t, err)
+	files, missing, err := readTraceOutput(f)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/usr/bin/bash", "/etc/passwd"}, files)
+	assert.Equal(t, []string{"/etc/missing"}, missing)
+}
+
+func TestTraceCommand(t *testing.T) {
+	e := New()
+	e.tracer = "/usr/local/bin/plz"
+	cmd := exec.Command("/bin/true", "wibble")
+	e.traceCommand(cmd, os.Stderr)
+	assert.Equal(t, "/usr/local/bin/plz", cmd.Path)
+	assert.Equal(t, []string{"/usr/local/bin/plz", "trace_files", "/bin/true", "wibble"}, cmd.Args)
+	assert.Equal(t, []*os.File{os.Stderr}, cmd.ExtraFiles)
+}
+
+func TestTraceCommandMovesNamespaces(t *testing.T) {
+	e := NewSandboxingExecutor(false, NamespaceAlways, "")
+	e.tracer = "/usr/local/bin/plz"
+	cmd := e.ExecCommand(SandboxConfig{Network: true}, false, "/bin/true")
+	cmd.Env = []string{"A=B"}
+	flags := cmd.SysProcAttr.Cloneflags
+	require.NotZero(t, flags)
+	e.traceCommand(cmd, os.Stderr)
+	assert.Zero(t, cmd.SysProcAttr.Cloneflags)
+	assert.Nil(t, cmd.SysProcAttr.UidMappings)
+	assert.Equal(t, []string{"A=B", traceCloneflagsVar + "=" + strconv.FormatUint(uint64(flags), 10)}, cmd.Env)
+}
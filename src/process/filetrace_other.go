@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+const fileTracingSupported = false
+
+// TraceFiles is only supported on Linux.
+func TraceFiles(args []string) (int, error) {
+	return 1, fmt.Errorf("file tracing is only supported on Linux")
+}
+
+// moveNamespacesToTracee is a no-op since there are no namespaces.
+func moveNamespacesToTracee(cmd *exec.Cmd) {}
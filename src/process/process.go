@@ -12,6 +12,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/dustin/go-humanize"
+
 	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/cli/logging"
 )
@@ -36,6 +38,11 @@ type Executor struct {
 	usePleaseSandbox bool
 	processes        map[*exec.Cmd]<-chan error
 	mutex            sync.Mutex
+	// Creates cgroups for each command, if enabled. May be nil.
+	cgroups        *cgroupManager
+	cgroupDefaults Limits
+	// The path to the plz binary that traces the files each command opens, if enabled.
+	tracer string
 }
 
 func NewSandboxingExecutor(usePleaseSandbox bool, namespace NamespacingPolicy, sandboxTool string) *Executor {
@@ -87,6 +94,14 @@ type Target interface {
 // If showOutput is true then output will be printed to stderr as well as returned.
 // It returns the stdout only, combined stdout and stderr and any error that occurred.
 func (e *Executor) ExecWithTimeout(ctx context.Context, target Target, dir string, env []string, timeout time.Duration, showOutput, attachStdin, attachStdout, foreground bool, sandbox SandboxConfig, argv []string) ([]byte, []byte, error) {
+	out, combined, _, err := e.ExecWithLimits(ctx, target, dir, env, timeout, showOutput, attachStdin, attachStdout, foreground, sandbox, Limits{}, argv)
+	return out, combined, err
+}
+
+// ExecWithLimits is like ExecWithTimeout, but if the executor has cgroups enabled the command runs in its own
+// cgroup with the given limits applied. It also returns the resources that the command used, or nil if
+// neither cgroups nor file tracing are enabled.
+func (e *Executor) ExecWithLimits(ctx context.Context, target Target, dir string, env []string, timeout time.Duration, showOutput, attachStdin, attachStdout, foreground bool, sandbox SandboxConfig, limits Limits, argv []string) ([]byte, []byte, *Usage, error) {
 	// We deliberately don't attach this context to the command, so we have better
 	// control over how the process gets terminated.
 	ctx, cancel := context.WithTimeout(ctx, timeout)
@@ -95,6 +110,30 @@ func (e *Executor) ExecWithTimeout(ctx context.Context, target Target, dir strin
 	cmd.Dir = dir
 	cmd.Env = append(cmd.Env, env...)
 
+	var cg *cgroup
+	if e.cgroups != nil {
+		limits = limits.merge(e.cgroupDefaults)
+		c, err := e.cgroups.New(limits)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create cgroup: %w", err)
+		}
+		defer c.Remove()
+		c.Attach(cmd)
+		cg = c
+	}
+
+	var traceOutput *os.File
+	if e.tracer != "" && cmd.Err == nil {
+		f, err := os.CreateTemp("", "plz-trace-")
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create file trace output: %w", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		e.traceCommand(cmd, f)
+		traceOutput = f
+	}
+
 	var out bytes.Buffer
 	var outerr safeBuffer
 	var progress *float32
@@ -125,7 +164,7 @@ func (e *Executor) ExecWithTimeout(ctx context.Context, target Target, dir strin
 	// child processes can't handle themselves.
 	err := cmd.Start()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	ch := make(chan error)
 	e.registerProcess(cmd, ch)
@@ -138,7 +177,29 @@ func (e *Executor) ExecWithTimeout(ctx context.Context, target Target, dir strin
 		err = ctx.Err()
 		e.KillProcess(cmd)
 	}
-	return out.Bytes(), outerr.Bytes(), err
+	if cg == nil && traceOutput == nil {
+		return out.Bytes(), outerr.Bytes(), nil, err
+	}
+	usage := &Usage{}
+	if cg != nil {
+		// Kill anything it left running in the background (which might have escaped the process group).
+		cg.Kill()
+		usage = cg.Usage()
+		if err != nil && usage.OOMKilled && limits.Memory > 0 {
+			err = fmt.Errorf("%w (killed for exceeding its memory limit of %s)", err, humanize.IBytes(limits.Memory))
+		} else if err != nil && usage.OOMKilled {
+			err = fmt.Errorf("%w (killed for running out of memory)", err)
+		}
+	}
+	if traceOutput != nil {
+		files, missing, traceErr := readTraceOutput(traceOutput)
+		if traceErr != nil {
+			log.Warning("Failed to read files traced for %s: %s", cmd, traceErr)
+		}
+		usage.Files = files
+		usage.Missing = missing
+	}
+	return out.Bytes(), outerr.Bytes(), usage, err
 }
 
 // runCommand runs a command and signals on the given channel when it's done.
@@ -155,8 +216,15 @@ func (e *Executor) ExecWithTimeoutShell(target Target, dir string, env []string,
 
 // ExecWithTimeoutShellStdStreams is as ExecWithTimeoutShell but optionally attaches stdin to the subprocess.
 func (e *Executor) ExecWithTimeoutShellStdStreams(target Target, dir string, env []string, timeout time.Duration, showOutput, foreground bool, sandbox SandboxConfig, cmd string, attachStdStreams bool) ([]byte, []byte, error) {
+	out, combined, _, err := e.ExecWithLimitsShell(target, dir, env, timeout, showOutput, foreground, sandbox, Limits{}, cmd, attachStdStreams)
+	return out, combined, err
+}
+
+// ExecWithLimitsShell is as ExecWithTimeoutShellStdStreams but applies limits and returns resource usage
+// in the same way as ExecWithLimits.
+func (e *Executor) ExecWithLimitsShell(target Target, dir string, env []string, timeout time.Duration, showOutput, foreground bool, sandbox SandboxConfig, limits Limits, cmd string, attachStdStreams bool) ([]byte, []byte, *Usage, error) {
 	c := BashCommand("bash", cmd, target.ShouldExitOnError())
-	return e.ExecWithTimeout(context.Background(), target, dir, env, timeout, showOutput, attachStdStreams, attachStdStreams, foreground, sandbox, c)
+	return e.ExecWithLimits(context.Background(), target, dir, env, timeout, showOutput, attachStdStreams, attachStdStreams, foreground, sandbox, limits, c)
 }
 
 // KillProcess kills a process, attempting to send it a SIGTERM first followed by a SIGKILL
@@ -62,17 +62,7 @@ func printTargetDot(out io.Writer, state *core.BuildState, target *core.BuildTar
 
 	if state.ShouldInclude(target) && (hidden || !target.HasParent()) {
 		if !done[target.Label] {
-			shape := "ellipse"
-			if target.IsFilegroup {
-				shape = "folder"
-			} else if target.IsRemoteFile {
-				shape = "octagon"
-			} else if target.IsTextFile {
-				shape = "note"
-			} else if target.IsBinary {
-				shape = "component"
-			}
-			fmt.Fprintf(out, "   node [shape=%s] \"%s\";\n", shape, target)
+			fmt.Fprintf(out, "   node [shape=%s] \"%s\";\n", dotShape(target), target)
 		}
 		if parent != nil {
 			fmt.Fprintf(out, "   \"%s\" -> \"%s\";\n", parent, target)
@@ -88,3 +78,17 @@ func printTargetDot(out io.Writer, state *core.BuildState, target *core.BuildTar
 		printTargetDot(out, state, dep, target, done, hidden, currentLevel, targetLevel)
 	}
 }
+
+// dotShape returns the shape of the node we use to represent a target in dot format.
+func dotShape(target *core.BuildTarget) string {
+	if target.IsFilegroup {
+		return "folder"
+	} else if target.IsRemoteFile {
+		return "octagon"
+	} else if target.IsTextFile {
+		return "note"
+	} else if target.IsBinary {
+		return "component"
+	}
+	return "ellipse"
+}
@@ -0,0 +1,295 @@
+// A small expression language for combining queries, e.g.
+//   plz query expr 'deps(//src/core) except //third_party/...'
+// The syntax is deliberately close to Bazel's query language; expressions are build label patterns,
+// functions of other expressions, or set operations (union, intersect, except) between them.
+
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// An Expression is a parsed query expression.
+type Expression struct {
+	root   exprNode
+	labels []core.BuildLabel
+}
+
+// Labels returns the build labels that appear in the expression. These (and their dependencies) need
+// to be parsed before the expression can be evaluated.
+func (expr *Expression) Labels() []core.BuildLabel {
+	return expr.labels
+}
+
+// An exprNode is a single node in the syntax tree of an expression.
+type exprNode interface {
+	eval(e *evaluator) (targetSet, error)
+}
+
+// A patternNode is a build label or pattern, e.g. //src/core:core or //src/...
+type patternNode struct {
+	label core.BuildLabel
+}
+
+// A setOpNode is a binary set operation (union, intersect or except).
+type setOpNode struct {
+	op          string
+	left, right exprNode
+}
+
+// A funcNode is a call to one of the built-in functions.
+type funcNode struct {
+	name string
+	args []funcArg
+}
+
+// A funcArg is a single argument to a function. Only one of the fields is set, depending on its type.
+type funcArg struct {
+	expr  exprNode
+	str   string
+	regex *regexp.Regexp
+	n     int
+}
+
+type argType int
+
+const (
+	exprArg argType = iota
+	stringArg
+	regexArg
+	intArg
+)
+
+// exprFunction describes the signature of one of the built-in functions.
+type exprFunction struct {
+	args     []argType
+	optional int // The number of trailing arguments that can be omitted.
+}
+
+var exprFunctions = map[string]exprFunction{
+	"deps":     {args: []argType{exprArg, intArg}, optional: 1},
+	"rdeps":    {args: []argType{exprArg, exprArg, intArg}, optional: 1},
+	"kind":     {args: []argType{regexArg, exprArg}},
+	"attr":     {args: []argType{stringArg, regexArg, exprArg}},
+	"labels":   {args: []argType{regexArg, exprArg}},
+	"tests":    {args: []argType{exprArg}},
+	"somepath": {args: []argType{exprArg, exprArg}},
+}
+
+// setOps maps the operators we accept to their canonical names.
+var setOps = map[string]string{
+	"union":     "union",
+	"+":         "union",
+	"intersect": "intersect",
+	"^":         "intersect",
+	"except":    "except",
+	"-":         "except",
+}
+
+type tokenType int
+
+const (
+	eofToken tokenType = iota
+	wordToken
+	stringToken
+	punctuationToken
+)
+
+type exprToken struct {
+	typ   tokenType
+	value string
+	pos   int
+}
+
+func (tok exprToken) String() string {
+	switch tok.typ {
+	case eofToken:
+		return "end of expression"
+	case stringToken:
+		return strconv.Quote(tok.value)
+	}
+	return "'" + tok.value + "'"
+}
+
+// tokenise splits an expression into tokens. Words are runs of anything other than whitespace, parentheses,
+// commas and quotes, which is permissive enough to cover build labels and most regular expressions.
+func tokenise(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, exprToken{typ: punctuationToken, value: s[i : i+1], pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, exprToken{typ: stringToken, value: s[i+1 : i+1+end], pos: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t\n\r(),\"'", rune(s[i])) {
+				i++
+			}
+			tokens = append(tokens, exprToken{typ: wordToken, value: s[start:i], pos: start})
+		}
+	}
+	return append(tokens, exprToken{typ: eofToken, pos: len(s)}), nil
+}
+
+// ParseExpression parses a query expression.
+func ParseExpression(s string) (*Expression, error) {
+	tokens, err := tokenise(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	} else if tok := p.next(); tok.typ != eofToken {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+	return &Expression{root: root, labels: p.labels}, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	labels []core.BuildLabel
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[0]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[0]
+	if tok.typ != eofToken {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *exprParser) expect(value string) error {
+	if tok := p.next(); tok.typ != punctuationToken || tok.value != value {
+		return fmt.Errorf("expected '%s', got %s at position %d", value, tok, tok.pos)
+	}
+	return nil
+}
+
+// parseExpr parses a series of terms joined by set operators. As in Bazel they all have the same precedence
+// and associate to the left, so parentheses are needed to group them any other way.
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		op, present := setOps[tok.value]
+		if tok.typ != wordToken || !present {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &setOpNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	tok := p.next()
+	switch tok.typ {
+	case punctuationToken:
+		if tok.value != "(" {
+			break
+		}
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case wordToken:
+		if next := p.peek(); next.typ == punctuationToken && next.value == "(" {
+			return p.parseFunc(tok)
+		} else if _, present := setOps[tok.value]; present {
+			break
+		}
+		return p.parsePattern(tok)
+	case stringToken:
+		return p.parsePattern(tok)
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+}
+
+func (p *exprParser) parsePattern(tok exprToken) (exprNode, error) {
+	label, err := core.ParseMaybeRelativeBuildLabel(tok.value)
+	if err != nil {
+		return nil, fmt.Errorf("%s at position %d", err, tok.pos)
+	}
+	p.labels = append(p.labels, label)
+	return &patternNode{label: label}, nil
+}
+
+func (p *exprParser) parseFunc(name exprToken) (exprNode, error) {
+	f, present := exprFunctions[name.value]
+	if !present {
+		return nil, fmt.Errorf("unknown function %s at position %d", name.value, name.pos)
+	}
+	p.next() // The opening parenthesis
+	node := &funcNode{name: name.value}
+	for i, typ := range f.args {
+		if i > 0 {
+			if tok := p.peek(); tok.typ == punctuationToken && tok.value == ")" && i >= len(f.args)-f.optional {
+				break
+			} else if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseArg(typ)
+		if err != nil {
+			return nil, err
+		}
+		node.args = append(node.args, arg)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, fmt.Errorf("%s (%s takes %d arguments)", err, name.value, len(f.args))
+	}
+	return node, nil
+}
+
+func (p *exprParser) parseArg(typ argType) (funcArg, error) {
+	if typ == exprArg {
+		node, err := p.parseExpr()
+		return funcArg{expr: node}, err
+	}
+	tok := p.next()
+	if tok.typ != wordToken && tok.typ != stringToken {
+		return funcArg{}, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+	switch typ {
+	case regexArg:
+		re, err := regexp.Compile(tok.value)
+		if err != nil {
+			return funcArg{}, fmt.Errorf("invalid regular expression at position %d: %s", tok.pos, err)
+		}
+		return funcArg{regex: re}, nil
+	case intArg:
+		n, err := strconv.Atoi(tok.value)
+		if err != nil {
+			return funcArg{}, fmt.Errorf("expected an integer at position %d, got %s", tok.pos, tok)
+		}
+		return funcArg{n: n}, nil
+	}
+	return funcArg{str: tok.value}, nil
+}
@@ -0,0 +1,354 @@
+package query
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// Expr evaluates a query expression and prints the resulting set of targets in the given format.
+// Hidden targets are only printed if hidden is true, although they are always followed while evaluating it.
+func Expr(state *core.BuildState, expr *Expression, hidden bool, format string) error {
+	return expression(os.Stdout, state, expr, hidden, format)
+}
+
+func expression(out io.Writer, state *core.BuildState, expr *Expression, hidden bool, format string) error {
+	e := &evaluator{state: state, graph: state.Graph, hidden: hidden}
+	all, err := expr.root.eval(e)
+	if err != nil {
+		return err
+	}
+	result := targetSet{}
+	for t := range all {
+		if state.ShouldInclude(t) && (hidden || !t.HasParent()) {
+			result[t] = struct{}{}
+		}
+	}
+	switch format {
+	case "text", "":
+		for _, t := range result.Sorted() {
+			fmt.Fprintln(out, t.Label)
+		}
+		return nil
+	case "json":
+		return writeExpressionJSON(out, all, result)
+	case "dot":
+		writeExpressionDot(out, all, result)
+		return nil
+	}
+	return fmt.Errorf("unknown output format %s", format)
+}
+
+// A targetSet is a set of targets, which is what every expression evaluates to.
+type targetSet map[*core.BuildTarget]struct{}
+
+// Sorted returns the targets in this set, sorted by label.
+func (set targetSet) Sorted() []*core.BuildTarget {
+	ret := make([]*core.BuildTarget, 0, len(set))
+	for t := range set {
+		ret = append(ret, t)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label.Less(ret[j].Label) })
+	return ret
+}
+
+// filter returns the subset of this set that matches the given function.
+func (set targetSet) filter(f func(*core.BuildTarget) bool) targetSet {
+	ret := targetSet{}
+	for t := range set {
+		if f(t) {
+			ret[t] = struct{}{}
+		}
+	}
+	return ret
+}
+
+type evaluator struct {
+	state  *core.BuildState
+	graph  *core.BuildGraph
+	hidden bool
+}
+
+func (node *patternNode) eval(e *evaluator) (targetSet, error) {
+	ret := targetSet{}
+	for _, l := range e.state.ExpandLabels([]core.BuildLabel{node.label}) {
+		t := e.graph.Target(l)
+		if t == nil {
+			return nil, fmt.Errorf("no such target %s", l)
+		}
+		ret[t] = struct{}{}
+	}
+	return ret, nil
+}
+
+func (node *setOpNode) eval(e *evaluator) (targetSet, error) {
+	left, err := node.left.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	right, err := node.right.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	switch node.op {
+	case "union":
+		ret := make(targetSet, len(left)+len(right))
+		for t := range left {
+			ret[t] = struct{}{}
+		}
+		for t := range right {
+			ret[t] = struct{}{}
+		}
+		return ret, nil
+	case "intersect":
+		return left.filter(func(t *core.BuildTarget) bool {
+			_, present := right[t]
+			return present
+		}), nil
+	}
+	return left.filter(func(t *core.BuildTarget) bool {
+		_, present := right[t]
+		return !present
+	}), nil
+}
+
+func (node *funcNode) eval(e *evaluator) (targetSet, error) {
+	// The last expression argument is always the set that the function applies to.
+	var sets []targetSet
+	for _, arg := range node.args {
+		if arg.expr != nil {
+			set, err := arg.expr.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			sets = append(sets, set)
+		}
+	}
+	set := sets[len(sets)-1]
+	switch node.name {
+	case "deps":
+		return e.walk(set, node.depth(1), dependencies), nil
+	case "rdeps":
+		return e.rdeps(sets[0], set, node.depth(2)), nil
+	case "kind":
+		return set.filter(func(t *core.BuildTarget) bool {
+			return node.args[0].regex.MatchString(t.Kind)
+		}), nil
+	case "labels":
+		return set.filter(func(t *core.BuildTarget) bool {
+			for _, label := range t.Labels {
+				if node.args[0].regex.MatchString(label) {
+					return true
+				}
+			}
+			return false
+		}), nil
+	case "attr":
+		return set.filter(func(t *core.BuildTarget) bool {
+			for _, value := range attrValues(t, node.args[0].str) {
+				if node.args[1].regex.MatchString(value) {
+					return true
+				}
+			}
+			return false
+		}), nil
+	case "tests":
+		return set.filter((*core.BuildTarget).IsTest), nil
+	case "somepath":
+		return e.somepath(sets[0], set), nil
+	}
+	return nil, fmt.Errorf("unknown function %s", node.name)
+}
+
+// depth returns the depth argument to a function at the given index, or -1 (unlimited) if it wasn't given.
+func (node *funcNode) depth(idx int) int {
+	if idx < len(node.args) {
+		return node.args[idx].n
+	}
+	return -1
+}
+
+// dependencies returns the direct dependencies of a target, including its subrepo if it has one.
+func dependencies(target *core.BuildTarget) []*core.BuildTarget {
+	deps := target.Dependencies()
+	if target.Subrepo != nil && target.Subrepo.Target != nil {
+		deps = append(deps, target.Subrepo.Target)
+	}
+	return deps
+}
+
+// walk returns the targets reachable from the given set within the given depth (unlimited if it's negative).
+// As with `plz query deps`, hidden targets don't count towards the depth unless we are showing them.
+func (e *evaluator) walk(from targetSet, depth int, next func(*core.BuildTarget) []*core.BuildTarget) targetSet {
+	depths := make(map[*core.BuildTarget]int, len(from))
+	queue := list.New()
+	for t := range from {
+		depths[t] = 0
+		queue.PushBack(t)
+	}
+	// Edges cost either 0 or 1, so we push the free ones to the front of the queue to visit them first.
+	for queue.Len() > 0 {
+		t := queue.Remove(queue.Front()).(*core.BuildTarget)
+		for _, n := range next(t) {
+			cost := 1
+			if !e.hidden && n.HasParent() {
+				cost = 0
+			}
+			d := depths[t] + cost
+			if old, present := depths[n]; (present && old <= d) || (depth >= 0 && d > depth) {
+				continue
+			}
+			depths[n] = d
+			if cost == 0 {
+				queue.PushFront(n)
+			} else {
+				queue.PushBack(n)
+			}
+		}
+	}
+	ret := make(targetSet, len(depths))
+	for t := range depths {
+		ret[t] = struct{}{}
+	}
+	return ret
+}
+
+// rdeps returns the reverse dependencies of a set of targets within the transitive closure of the universe.
+func (e *evaluator) rdeps(universe, set targetSet, depth int) targetSet {
+	universe = e.walk(universe, -1, dependencies)
+	revdeps := map[*core.BuildTarget][]*core.BuildTarget{}
+	for t := range universe {
+		for _, dep := range dependencies(t) {
+			revdeps[dep] = append(revdeps[dep], t)
+		}
+	}
+	return e.walk(set.filter(func(t *core.BuildTarget) bool {
+		_, present := universe[t]
+		return present
+	}), depth, func(t *core.BuildTarget) []*core.BuildTarget {
+		return revdeps[t]
+	})
+}
+
+// somepath returns the targets on a dependency path from any of one set of targets to any of another.
+func (e *evaluator) somepath(from, to targetSet) targetSet {
+	s := somepath{
+		graph: e.graph,
+		memo:  map[core.BuildLabel]map[core.BuildLabel]struct{}{},
+	}
+	ret := targetSet{}
+	for _, t1 := range from.Sorted() {
+		for _, t2 := range to.Sorted() {
+			if path := s.somePath(t1.Label, t2.Label); len(path) != 0 {
+				for _, l := range path {
+					ret[e.graph.TargetOrDie(l)] = struct{}{}
+				}
+				return ret
+			}
+		}
+	}
+	return ret
+}
+
+// attrValues returns the values of the given attribute of a target as strings, as they'd be printed by
+// `plz query print --field`. Lists and dicts produce one string per element.
+func attrValues(target *core.BuildTarget, name string) []string {
+	value, present := targetToValueMap(nil, []string{name}, target)[name]
+	if !present {
+		return nil
+	}
+	var ret []string
+	var flatten func(v reflect.Value)
+	flatten = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				flatten(v.Index(i))
+			}
+		case reflect.Map:
+			iter := v.MapRange()
+			for iter.Next() {
+				flatten(iter.Value())
+			}
+		case reflect.Interface, reflect.Pointer:
+			if !v.IsNil() {
+				flatten(v.Elem())
+			}
+		default:
+			ret = append(ret, fmt.Sprint(v.Interface()))
+		}
+	}
+	flatten(reflect.ValueOf(value))
+	return ret
+}
+
+// visibleDeps returns the dependencies of a target that are in the given result set. Dependencies that
+// were evaluated but aren't in the result (e.g. because they're hidden) are followed through to the
+// targets that are, so the structure of the graph is preserved.
+func visibleDeps(target *core.BuildTarget, all, result targetSet) []*core.BuildTarget {
+	done := targetSet{}
+	var ret []*core.BuildTarget
+	var visit func(t *core.BuildTarget)
+	visit = func(t *core.BuildTarget) {
+		for _, dep := range dependencies(t) {
+			if _, present := done[dep]; present {
+				continue
+			}
+			done[dep] = struct{}{}
+			if _, present := result[dep]; present {
+				ret = append(ret, dep)
+			} else if _, present := all[dep]; present {
+				visit(dep)
+			}
+		}
+	}
+	visit(target)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label.Less(ret[j].Label) })
+	return ret
+}
+
+// An exprJSONTarget is the JSON representation of a single target in the result of an expression.
+type exprJSONTarget struct {
+	Label string   `json:"label"`
+	Kind  string   `json:"kind,omitempty"`
+	Deps  []string `json:"deps,omitempty"`
+}
+
+func writeExpressionJSON(out io.Writer, all, result targetSet) error {
+	targets := []exprJSONTarget{}
+	for _, t := range result.Sorted() {
+		target := exprJSONTarget{Label: t.Label.String(), Kind: t.Kind}
+		for _, dep := range visibleDeps(t, all, result) {
+			target.Deps = append(target.Deps, dep.Label.String())
+		}
+		targets = append(targets, target)
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "    ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(targets)
+}
+
+func writeExpressionDot(out io.Writer, all, result targetSet) {
+	fmt.Fprintf(out, "digraph query {\n")
+	fmt.Fprintf(out, "  fontname=\"Helvetica,Arial,sans-serif\"\n")
+	fmt.Fprintf(out, "  node [fontname=\"Helvetica,Arial,sans-serif\"]\n")
+	fmt.Fprintf(out, "  edge [fontname=\"Helvetica,Arial,sans-serif\"]\n")
+	fmt.Fprintf(out, "  rankdir=\"LR\"\n")
+	sorted := result.Sorted()
+	for _, t := range sorted {
+		fmt.Fprintf(out, "  node [shape=%s] \"%s\";\n", dotShape(t), t.Label)
+	}
+	for _, t := range sorted {
+		for _, dep := range visibleDeps(t, all, result) {
+			fmt.Fprintf(out, "  \"%s\" -> \"%s\";\n", t.Label, dep.Label)
+		}
+	}
+	fmt.Fprintf(out, "}\n")
+}
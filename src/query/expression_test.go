@@ -0,0 +1,149 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// expressionTestState builds a small graph:
+//
+//	//package:leaf -> //package:_leaf#lib -> //package:branch -> //package:root
+//	//package:leaf_test -> //package:leaf
+func expressionTestState() *core.BuildState {
+	state := core.NewDefaultBuildState()
+	pkg := core.NewPackage("package")
+	add := func(name, kind string, deps ...string) *core.BuildTarget {
+		t := core.NewBuildTarget(core.ParseBuildLabel("//package:"+name, ""))
+		t.Kind = kind
+		for _, dep := range deps {
+			t.AddDependency(core.ParseBuildLabel("//package:"+dep, ""))
+		}
+		pkg.AddTarget(t)
+		state.Graph.AddTarget(t)
+		return t
+	}
+	root := add("root", "go_library")
+	root.Command = "go build"
+	branch := add("branch", "go_library", "root")
+	branch.AddLabel("go")
+	lib := add("_leaf#lib", "go_binary", "branch")
+	leaf := add("leaf", "go_binary", "_leaf#lib")
+	leaf.AddLabel("go")
+	leaf.IsBinary = true
+	test := add("leaf_test", "gentest", "leaf")
+	test.Test = &core.TestFields{}
+	state.Graph.AddPackage(pkg)
+	for _, t := range []*core.BuildTarget{branch, lib, leaf, test} {
+		if err := t.ResolveDependencies(state.Graph); err != nil {
+			panic(err)
+		}
+	}
+	return state
+}
+
+func evalExpression(t *testing.T, expr string, hidden bool, format string) string {
+	t.Helper()
+	e, err := ParseExpression(expr)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, expression(&buf, expressionTestState(), e, hidden, format))
+	return buf.String()
+}
+
+func evalLabels(t *testing.T, expr string) []string {
+	t.Helper()
+	return strings.Fields(evalExpression(t, expr, false, "text"))
+}
+
+func TestParseExpressionLabels(t *testing.T) {
+	e, err := ParseExpression("somepath(//src/core:core, '//third_party/...') except deps(//src:please)")
+	require.NoError(t, err)
+	assert.Equal(t, []core.BuildLabel{
+		{PackageName: "src/core", Name: "core"},
+		{PackageName: "third_party", Name: "..."},
+		{PackageName: "src", Name: "please"},
+	}, e.Labels())
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"deps(//src/core:core",
+		"deps(//src/core:core, two)",
+		"deps(//src/core:core, 1, 2)",
+		"rdeps(//src/core:core)",
+		"wibble(//src/core:core)",
+		"kind('(', //src/core:core)",
+		"//src/core:core union",
+		"//src/core:core //src/fs:fs",
+		"(//src/core:core",
+		"'//src/core:core",
+	} {
+		_, err := ParseExpression(expr)
+		assert.Error(t, err, "expected an error parsing %s", expr)
+	}
+}
+
+func TestExpressionDeps(t *testing.T) {
+	assert.Equal(t, []string{"//package:branch", "//package:leaf", "//package:root"}, evalLabels(t, "deps(//package:leaf)"))
+	// The hidden target in between doesn't count towards the depth.
+	assert.Equal(t, []string{"//package:branch", "//package:leaf"}, evalLabels(t, "deps(//package:leaf, 1)"))
+	assert.Equal(t, []string{"//package:leaf"}, evalLabels(t, "deps(//package:leaf, 0)"))
+}
+
+func TestExpressionDepsHidden(t *testing.T) {
+	out := evalExpression(t, "deps(//package:leaf, 1)", true, "text")
+	assert.Equal(t, "//package:_leaf#lib\n//package:leaf\n", out)
+}
+
+func TestExpressionRdeps(t *testing.T) {
+	assert.Equal(t, []string{"//package:branch", "//package:leaf", "//package:leaf_test", "//package:root"}, evalLabels(t, "rdeps(//package:all, //package:root)"))
+	assert.Equal(t, []string{"//package:branch", "//package:root"}, evalLabels(t, "rdeps(//package:all, //package:root, 1)"))
+	// Only things within the universe are considered.
+	assert.Equal(t, []string{"//package:branch", "//package:leaf", "//package:root"}, evalLabels(t, "rdeps(//package:leaf, //package:root)"))
+}
+
+func TestExpressionSetOperations(t *testing.T) {
+	assert.Equal(t, []string{"//package:leaf", "//package:root"}, evalLabels(t, "//package:leaf union //package:root"))
+	assert.Equal(t, []string{"//package:branch", "//package:root"}, evalLabels(t, "deps(//package:leaf) intersect deps(//package:branch)"))
+	assert.Equal(t, []string{"//package:leaf"}, evalLabels(t, "deps(//package:leaf) - deps(//package:branch)"))
+	// Operators associate to the left.
+	assert.Equal(t, []string{"//package:branch", "//package:root"}, evalLabels(t, "deps(//package:leaf) except //package:leaf + //package:root"))
+	assert.Equal(t, []string{"//package:branch"}, evalLabels(t, "deps(//package:leaf) except (//package:leaf + //package:root)"))
+}
+
+func TestExpressionFilters(t *testing.T) {
+	assert.Equal(t, []string{"//package:branch", "//package:root"}, evalLabels(t, "kind(go_library, //package:all)"))
+	assert.Equal(t, []string{"//package:leaf", "//package:leaf_test"}, evalLabels(t, "kind('^(go_binary|gentest)$', //package:all)"))
+	assert.Equal(t, []string{"//package:branch", "//package:leaf"}, evalLabels(t, "labels(^go$, //package:all)"))
+	assert.Equal(t, []string{"//package:leaf_test"}, evalLabels(t, "tests(//package:all)"))
+	assert.Equal(t, []string{"//package:root"}, evalLabels(t, "attr(cmd, build, //package:all)"))
+	assert.Equal(t, []string{"//package:leaf"}, evalLabels(t, "attr(binary, true, //package:all)"))
+}
+
+func TestExpressionSomepath(t *testing.T) {
+	assert.Equal(t, []string{"//package:branch", "//package:leaf", "//package:root"}, evalLabels(t, "somepath(//package:leaf, //package:root)"))
+	assert.Empty(t, evalLabels(t, "somepath(//package:root, //package:leaf)"))
+}
+
+func TestExpressionJSON(t *testing.T) {
+	out := evalExpression(t, "deps(//package:leaf, 1)", false, "json")
+	assert.JSONEq(t, `[
+		{"label": "//package:branch", "kind": "go_library"},
+		{"label": "//package:leaf", "kind": "go_binary", "deps": ["//package:branch"]}
+	]`, out)
+}
+
+func TestExpressionDot(t *testing.T) {
+	out := evalExpression(t, "deps(//package:leaf)", false, "dot")
+	assert.Contains(t, out, `node [shape=component] "//package:leaf";`)
+	assert.Contains(t, out, `"//package:leaf" -> "//package:branch";`)
+	assert.Contains(t, out, `"//package:branch" -> "//package:root";`)
+	assert.NotContains(t, out, "_leaf#lib")
+}
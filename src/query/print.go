@@ -378,7 +378,10 @@ func (p *printer) genericPrint(v reflect.Value) (string, bool) {
 	case reflect.Uint8, reflect.Uint16:
 		return strconv.FormatUint(v.Uint(), 10), true
 	case reflect.Struct, reflect.Interface:
-		if stringer, ok := v.Interface().(fmt.Stringer); ok {
+		if provider, ok := v.Interface().(core.Provider); ok {
+			// Providers already print in BUILD language syntax so don't need quoting.
+			return provider.String(), true
+		} else if stringer, ok := v.Interface().(fmt.Stringer); ok {
 			return p.quote(stringer.String()), true
 		}
 		return "", false
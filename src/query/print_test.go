@@ -135,6 +135,16 @@ type postBuildFunction struct{}
 func (f postBuildFunction) Call(target *core.BuildTarget, output string) error { return nil }
 func (f postBuildFunction) String() string                                     { return "<func ref>" }
 
+type testProvider struct{}
+
+func (p testProvider) String() string {
+	return `struct(import_path="github.com/example/lib")`
+}
+
+func (p testProvider) MarshalJSON() ([]byte, error) {
+	return []byte(`{"import_path":"github.com/example/lib"}`), nil
+}
+
 func TestPostBuildOutput(t *testing.T) {
 	target := core.NewBuildTarget(core.ParseBuildLabel("//src/query:test_post_build_output", ""))
 	target.PostBuildFunction = postBuildFunction{}
@@ -154,6 +164,25 @@ func TestPostBuildOutput(t *testing.T) {
 	assert.Equal(t, expected, s)
 }
 
+func TestProvidersOutput(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/query:test_providers_output", ""))
+	target.AddProvider("go", testProvider{})
+	s := testPrint(target)
+	expected := `  build_rule(
+      name = 'test_providers_output',
+      providers = {
+          'go': struct(import_path="github.com/example/lib"),
+      },
+  )
+
+`
+	assert.Equal(t, expected, s)
+
+	b, err := json.Marshal(targetToValueMap(order, []string{"providers"}, target))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"providers": {"go": {"import_path": "github.com/example/lib"}}}`, string(b))
+}
+
 func TestPrintFields(t *testing.T) {
 	target := core.NewBuildTarget(core.ParseBuildLabel("//src/query:test_print_fields", ""))
 	target.AddLabel("go")
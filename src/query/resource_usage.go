@@ -0,0 +1,27 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/thought-machine/please/src/build"
+	"github.com/thought-machine/please/src/core"
+)
+
+// ResourceUsage prints the peak memory and CPU time used the last time each of the given targets was built.
+// These are only known for targets that were built locally with cgroups enabled.
+func ResourceUsage(state *core.BuildState, labels []core.BuildLabel) {
+	for _, label := range labels {
+		target := state.Graph.TargetOrDie(label)
+		if usage := build.LastResourceUsage(target); usage == nil {
+			fmt.Printf("%s: not measured\n", label)
+		} else {
+			fmt.Printf("%s: %s peak memory, %s CPU time", label, humanize.IBytes(usage.PeakMemory), usage.CPUTime)
+			if !target.Resources.IsZero() {
+				fmt.Printf(" (requested %d CPUs, %s memory)", target.Resources.CPU, humanize.IBytes(target.Resources.Memory))
+			}
+			fmt.Printf("\n")
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/thought-machine/please/src/build"
+	"github.com/thought-machine/please/src/core"
+)
+
+// WhyRebuilt prints an explanation of why each of the given targets was rebuilt the last time it was
+// built, and whether anything has changed since that would cause it to be rebuilt again.
+func WhyRebuilt(state *core.BuildState, labels []core.BuildLabel) {
+	for _, label := range labels {
+		last, now := build.WhyRebuilt(state, state.Graph.TargetOrDie(label))
+		fmt.Printf("%s:\n", label)
+		if len(last) > 0 {
+			fmt.Printf("  Last rebuilt because:\n")
+			for _, reason := range last {
+				fmt.Printf("    %s\n", reason)
+			}
+		}
+		if len(now) == 0 {
+			fmt.Printf("  Up to date; nothing has changed since it was last built.\n")
+		} else {
+			fmt.Printf("  Would be rebuilt now because:\n")
+			for _, reason := range now {
+				fmt.Printf("    %s\n", reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Package dial contains the parts of connecting to a remote execution server that are shared between
+// remote execution and the remote cache.
+package dial
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"google.golang.org/grpc"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// Options returns the dial options needed to authenticate to the remote server, i.e. a token
+// from Remote.TokenFile if one is set.
+func Options(config *core.Configuration) ([]grpc.DialOption, error) {
+	if config.Remote.TokenFile == "" {
+		return nil, nil
+	}
+	token, err := os.ReadFile(config.Remote.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load token from file: %s", err)
+	}
+	return []grpc.DialOption{grpc.WithPerRPCCredentials(preSharedToken(string(token)))}, nil
+}
+
+// Params returns the parameters for connecting to the remote execution & CAS servers with the given dial options.
+func Params(config *core.Configuration, opts []grpc.DialOption) client.DialParams {
+	return client.DialParams{
+		Service:            config.Remote.URL,
+		CASService:         config.Remote.CASURL,
+		NoSecurity:         !config.Remote.Secure,
+		TransportCredsOnly: config.Remote.Secure,
+		DialOpts:           opts,
+	}
+}
+
+// preSharedToken returns a gRPC credential provider for a pre-shared token.
+func preSharedToken(token string) tokenCredProvider {
+	return tokenCredProvider{
+		"authorization": "Bearer " + strings.TrimSpace(token),
+	}
+}
+
+type tokenCredProvider map[string]string
+
+func (cred tokenCredProvider) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return cred, nil
+}
+
+func (cred tokenCredProvider) RequireTransportSecurity() bool {
+	return false // Allow these to be provided over an insecure channel; this facilitates e.g. service meshes like Istio.
+}
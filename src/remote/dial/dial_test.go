@@ -0,0 +1,47 @@
+package dial
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestOptions(t *testing.T) {
+	config := core.DefaultConfiguration()
+	opts, err := Options(config)
+	assert.NoError(t, err)
+	assert.Empty(t, opts)
+
+	config.Remote.TokenFile = filepath.Join(t.TempDir(), "token")
+	_, err = Options(config)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(config.Remote.TokenFile, []byte("abc123\n"), 0644))
+	opts, err = Options(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(opts))
+}
+
+func TestPreSharedToken(t *testing.T) {
+	md, err := preSharedToken(" abc123\n").GetRequestMetadata(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"authorization": "Bearer abc123"}, md)
+}
+
+func TestParams(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Remote.URL = "remote:443"
+	config.Remote.CASURL = "cas:443"
+	config.Remote.Secure = true
+	params := Params(config, nil)
+	assert.Equal(t, "remote:443", params.Service)
+	assert.Equal(t, "cas:443", params.CASService)
+	assert.False(t, params.NoSecurity)
+	assert.True(t, params.TransportCredsOnly)
+}
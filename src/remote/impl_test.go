@@ -55,6 +55,7 @@ type testServer struct {
 	blobs                         map[string][]byte
 	bytestreams                   map[string][]byte
 	mockActionResult              *pb.ActionResult
+	executeFailures               []codes.Code
 }
 
 func (s *testServer) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.ServerCapabilities, error) {
@@ -86,6 +87,7 @@ func (s *testServer) Reset() {
 	s.blobs = map[string][]byte{}
 	s.bytestreams = map[string][]byte{}
 	s.mockActionResult = nil
+	s.executeFailures = nil
 }
 
 func (s *testServer) GetActionResult(ctx context.Context, req *pb.GetActionResultRequest) (*pb.ActionResult, error) {
@@ -254,6 +256,23 @@ func (s *testServer) Execute(req *pb.ExecuteRequest, srv pb.Execution_ExecuteSer
 		a.MarshalFrom(msg)
 		return a
 	}
+	// Fail with the next queued status (if any) as though the server couldn't run the action.
+	if len(s.executeFailures) > 0 {
+		code := s.executeFailures[0]
+		s.executeFailures = s.executeFailures[1:]
+		return srv.Send(&longrunningpb.Operation{
+			Name: "geoff",
+			Done: true,
+			Result: &longrunningpb.Operation_Response{
+				Response: mm(&pb.ExecuteResponse{
+					Status: &rpcstatus.Status{
+						Code:    int32(code),
+						Message: "the server is having a bad day",
+					},
+				}),
+			},
+		})
+	}
 	srv.Send(&longrunningpb.Operation{
 		Name: "geoff",
 		Metadata: mm(&pb.ExecuteOperationMetadata{
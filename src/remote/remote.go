@@ -6,6 +6,7 @@ package remote
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	iofs "io/fs"
 	"os"
@@ -38,6 +39,7 @@ import (
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 	"github.com/thought-machine/please/src/metrics"
+	"github.com/thought-machine/please/src/remote/dial"
 	remotefs "github.com/thought-machine/please/src/remote/fs"
 	"github.com/thought-machine/please/src/remote/fs/cache"
 )
@@ -116,6 +118,9 @@ type Client struct {
 	// Passed to various SDK functions.
 	fileMetadataCache filemetadata.Cache
 
+	// Policy for retrying actions that fail due to transient infrastructure problems.
+	retryPolicy *retryPolicy
+
 	// existingBlobs is used to track the set of existing blobs remotely.
 	existingBlobs     map[string]struct{}
 	existingBlobMutex sync.Mutex
@@ -201,18 +206,18 @@ func (c *Client) initExec() error {
 		id, _ := uuid.NewRandom()
 		c.buildID = id.String()
 	}
+	retryPolicy, err := newRetryPolicy(c.state.Config)
+	if err != nil {
+		return err
+	}
+	c.retryPolicy = retryPolicy
 	// Create a copy of the state where we can modify the config
 	dialOpts, err := c.dialOpts()
 	if err != nil {
 		return err
 	}
-	client, err := client.NewClient(context.Background(), c.instance, client.DialParams{
-		Service:            c.state.Config.Remote.URL,
-		CASService:         c.state.Config.Remote.CASURL,
-		NoSecurity:         !c.state.Config.Remote.Secure,
-		TransportCredsOnly: c.state.Config.Remote.Secure,
-		DialOpts:           dialOpts,
-	}, client.UseBatchOps(true), &client.TreeSymlinkOpts{Preserved: true}, client.RetryTransient(), client.RPCTimeouts(map[string]time.Duration{
+	var initErr *client.InitError
+	client, err := client.NewClient(context.Background(), c.instance, dial.Params(c.state.Config, dialOpts), client.UseBatchOps(true), &client.TreeSymlinkOpts{Preserved: true}, client.RetryTransient(), client.RPCTimeouts(map[string]time.Duration{
 		"default":          time.Duration(c.state.Config.Remote.Timeout),
 		"GetCapabilities":  5 * time.Second,
 		"BatchUpdateBlobs": time.Minute,
@@ -221,7 +226,10 @@ func (c *Client) initExec() error {
 		"Execute":          0,
 		"WaitExecution":    0,
 	}))
-	if err != nil {
+	if errors.As(err, &initErr) {
+		// Keep the underlying status so we can tell later if the server was unavailable.
+		return status.Errorf(status.Code(initErr.Err), "%s", initErr)
+	} else if err != nil {
 		return err
 	}
 	c.client = client
@@ -329,14 +337,37 @@ func (c *Client) SubrepoFS(target *core.BuildTarget, root string) iofs.FS {
 	return remotefs.New(c.remoteFSClient, tree, root)
 }
 
+// OutputFS returns a virtual filesystem over the outputs of a target that has been built remotely.
+// Files are only fetched from the CAS as they are read.
+func (c *Client) OutputFS(target *core.BuildTarget) (iofs.FS, error) {
+	if err := c.CheckInitialised(); err != nil {
+		return nil, err
+	} else if target.RunsLocally() {
+		return nil, fmt.Errorf("%s was built locally, not remotely", target)
+	}
+	d, present := c.unstampedBuildActionDigests.m.Load(target.Label)
+	if !present {
+		return nil, fmt.Errorf("%s has not been built remotely", target)
+	}
+	_, ar := c.retrieveResults(target, nil, d.(*pb.Digest), false, false, 0)
+	if ar == nil {
+		return nil, fmt.Errorf("Failed to retrieve action result for %s", target)
+	}
+	tree, err := c.outputTree(target, ar)
+	if err != nil {
+		return nil, err
+	}
+	return remotefs.New(c.remoteFSClient, c.normaliseTree(tree), "."), nil
+}
+
 // Build executes a remote build of the given target.
 func (c *Client) Build(target *core.BuildTarget) (*core.BuildMetadata, error) {
 	if err := c.CheckInitialised(); err != nil {
-		return nil, err
+		return nil, markUnavailable(err)
 	}
 	metadata, ar, _, err := c.build(target)
 	if err != nil {
-		return metadata, err
+		return metadata, markUnavailable(err)
 	}
 	if c.state.TargetHasher != nil {
 		hash, _ := hex.DecodeString(c.outputHash(ar))
@@ -430,7 +461,7 @@ func (c *Client) build(target *core.BuildTarget) (*core.BuildMetadata, *pb.Actio
 
 // Download downloads outputs for the given target.
 func (c *Client) Download(target *core.BuildTarget) error {
-	if target.Local {
+	if target.RunsLocally() {
 		return nil // No download needed since this target was built locally
 	}
 	return c.download(target, func() error {
@@ -586,7 +617,7 @@ func moveDirToOutDir(target *core.BuildTarget, dir string) error {
 // It returns the results (and coverage if appropriate) as bytes to be parsed elsewhere.
 func (c *Client) Test(target *core.BuildTarget, run int) (metadata *core.BuildMetadata, err error) {
 	if err := c.CheckInitialised(); err != nil {
-		return nil, err
+		return nil, markUnavailable(err)
 	}
 	command, digest, err := c.buildAction(target, true, false, run)
 	if err != nil {
@@ -600,7 +631,7 @@ func (c *Client) Test(target *core.BuildTarget, run int) (metadata *core.BuildMe
 			log.Warningf("%v: failed to download test outputs: %v", target.Label, dlErr)
 		}
 	}
-	return metadata, err
+	return metadata, markUnavailable(err)
 }
 
 // retrieveResults retrieves target results from where it can (either from the local cache or from remote).
@@ -660,7 +691,7 @@ func (c *Client) execute(target *core.BuildTarget, command *pb.Command, digest *
 	// We didn't actually upload the inputs before, so we must do so now.
 	command, digest, err := c.uploadAction(target, isTest, false, run)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to upload build action: %s", err)
+		return nil, nil, fmt.Errorf("Failed to upload build action: %w", err)
 	}
 	// Remote actions & filegroups get special treatment at this point.
 	if target.IsFilegroup {
@@ -682,7 +713,26 @@ func (c *Client) execute(target *core.BuildTarget, command *pb.Command, digest *
 
 // reallyExecute is like execute but after the initial cache check etc.
 // The action & sources must have already been uploaded.
+// Actions that fail due to transient infrastructure problems are retried according to the retry policy;
+// this is on top of the SDK's retries of individual RPCs, which only cover brief interruptions.
 func (c *Client) reallyExecute(target *core.BuildTarget, command *pb.Command, digest *pb.Digest, needStdout, isTest, skipCacheLookup bool, run int) (*core.BuildMetadata, *pb.ActionResult, error) {
+	for retries := 0; ; retries++ {
+		metadata, ar, err := c.executeOnce(target, command, digest, needStdout, isTest, skipCacheLookup, run)
+		// If we'd fall back to running it locally there's no point waiting to try again.
+		if !c.retryPolicy.ShouldRetry(err, retries) || c.state.ShouldFallBackLocally(target, markUnavailable(err)) {
+			return metadata, ar, err
+		}
+		backoff := c.retryPolicy.Backoff(retries)
+		log.Warning("Remote execution of %s failed (%s), retrying in %s (attempt %d of %d)", target, status.Code(err), backoff.Round(time.Millisecond), retries+1, c.retryPolicy.maxRetries)
+		log.Debug("Error executing %s: %s", target, err)
+		target.AddRemoteRetry()
+		c.logActionResult(target, run, fmt.Sprintf("Retrying (%s)...", status.Code(err)), "")
+		time.Sleep(backoff)
+	}
+}
+
+// executeOnce makes a single attempt at remotely executing an action.
+func (c *Client) executeOnce(target *core.BuildTarget, command *pb.Command, digest *pb.Digest, needStdout, isTest, skipCacheLookup bool, run int) (*core.BuildMetadata, *pb.ActionResult, error) {
 	executing := false
 	c.logActionResult(target, run, "Submitting job...", "")
 	updateProgress := func(metadata *pb.ExecuteOperationMetadata) {
@@ -731,7 +781,13 @@ func (c *Client) reallyExecute(target *core.BuildTarget, command *pb.Command, di
 		}
 	}()
 
-	resp, err := c.client.ExecuteAndWaitProgress(c.contextWithMetadata(target), &pb.ExecuteRequest{
+	execCtx := c.contextWithMetadata(target)
+	if queueTimeout := c.queueTimeout(target); queueTimeout > 0 {
+		var execCancel context.CancelFunc
+		execCtx, execCancel = context.WithTimeout(execCtx, timeout(target, isTest)+queueTimeout)
+		defer execCancel()
+	}
+	resp, err := c.client.ExecuteAndWaitProgress(execCtx, &pb.ExecuteRequest{
 		InstanceName:    c.instance,
 		ActionDigest:    digest,
 		SkipCacheLookup: skipCacheLookup,
@@ -746,7 +802,11 @@ func (c *Client) reallyExecute(target *core.BuildTarget, command *pb.Command, di
 				return metadata, ar, nil
 			}
 		}
-		return nil, nil, c.wrapActionErr(fmt.Errorf("Failed to execute %s: %s", target, err), digest)
+		if execCtx.Err() == context.DeadlineExceeded {
+			// This is our own deadline expiring, which means the server didn't complete the action in time.
+			return nil, nil, &core.RemoteInfraError{Err: c.wrapActionErr(status.Errorf(codes.DeadlineExceeded, "Timed out waiting for remote execution of %s", target), digest)}
+		}
+		return nil, nil, c.retryPolicy.markTransient(c.wrapActionErr(fmt.Errorf("Failed to execute %s: %w", target, err), digest))
 	}
 	switch result := resp.Result.(type) {
 	case *longrunningpb.Operation_Error:
@@ -776,6 +836,11 @@ func (c *Client) reallyExecute(target *core.BuildTarget, command *pb.Command, di
 				}
 			}
 		}
+		// The server couldn't run the action for reasons beyond its control; we don't try to
+		// interpret any result it might have sent.
+		if c.retryPolicy.IsTransient(respErr) {
+			return nil, nil, c.retryPolicy.markTransient(respErr)
+		}
 		if resp.Result == nil { // This is optional on failure.
 			return nil, nil, respErr
 		}
@@ -1,6 +1,7 @@
 package remote
 
 import (
+	iofs "io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -8,11 +9,15 @@ import (
 	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/retry"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 )
@@ -60,6 +65,77 @@ func TestExecuteBuild(t *testing.T) {
 	assert.Equal(t, []byte("hello\n"), metadata.Stdout)
 }
 
+func TestExecuteRetriesTransientFailures(t *testing.T) {
+	target, err := executeWithFailures(t, "target_retry", 3, codes.Unavailable, codes.Aborted)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, target.RemoteRetries())
+	assert.Empty(t, server.executeFailures)
+}
+
+func TestExecuteInfraFailure(t *testing.T) {
+	target, err := executeWithFailures(t, "target_retry2", 2, codes.Aborted, codes.Aborted, codes.Aborted)
+	assert.Error(t, err)
+	assert.True(t, core.IsInfraFailure(err))
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, 2, target.RemoteRetries())
+}
+
+func TestExecuteNonTransientFailure(t *testing.T) {
+	target, err := executeWithFailures(t, "target_retry3", 3, codes.InvalidArgument)
+	assert.Error(t, err)
+	assert.False(t, core.IsInfraFailure(err))
+	assert.Equal(t, 0, target.RemoteRetries())
+}
+
+func TestExecuteDoesntRetryWhenFallingBack(t *testing.T) {
+	target, err := executeWithFailuresAndFallback(t, "target_retry4", 3, true, codes.Unavailable, codes.Unavailable)
+	assert.Error(t, err)
+	var unavailable *core.RemoteUnavailableError
+	assert.ErrorAs(t, err, &unavailable)
+	assert.Equal(t, 0, target.RemoteRetries())
+	assert.Equal(t, []codes.Code{codes.Unavailable}, server.executeFailures)
+}
+
+func TestQueueTimeout(t *testing.T) {
+	c := newClient()
+	c.state.Config.Remote.QueueTimeout = cli.Duration(5 * time.Minute)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target_timeout"})
+	assert.Equal(t, 5*time.Minute, c.queueTimeout(target))
+	target.AddLabel("remote-queue-timeout:wibble")
+	assert.Equal(t, 5*time.Minute, c.queueTimeout(target))
+	target.AddLabel("remote-queue-timeout:30m")
+	assert.Equal(t, 30*time.Minute, c.queueTimeout(target))
+}
+
+// executeWithFailures builds a target remotely, with the server failing the first few attempts with the given codes.
+func executeWithFailures(t *testing.T, name string, maxRetries int, failures ...codes.Code) (*core.BuildTarget, error) {
+	t.Helper()
+	return executeWithFailuresAndFallback(t, name, maxRetries, false, failures...)
+}
+
+func executeWithFailuresAndFallback(t *testing.T, name string, maxRetries int, localFallback bool, failures ...codes.Code) (*core.BuildTarget, error) {
+	t.Helper()
+	t.Cleanup(server.Reset)
+	server.executeFailures = failures
+	c := newClient()
+	c.state.Config.Remote.LocalFallback = localFallback
+	require.NoError(t, c.CheckInitialised())
+	c.retryPolicy.maxRetries = maxRetries
+	c.retryPolicy.backoff = time.Millisecond
+	// Stop the SDK retrying the individual RPCs so we see the failures here.
+	c.client.Retrier.Backoff = retry.Immediately(retry.Attempts(1))
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: name})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("out2.txt")
+	target.BuildTimeout = time.Minute
+	target.Command = "echo hello && echo test > $OUT"
+	// Force it to really execute rather than using any cached result from a previous run.
+	c.state.ForceRebuild = true
+	c.state.AddOriginalTarget(target.Label, true)
+	_, err := c.Build(target)
+	return target, err
+}
+
 type postBuildFunction func(*core.BuildTarget, string) error //nolint:unused
 
 //nolint:unused
@@ -273,6 +349,66 @@ func TestOutDirsSetOutsOnTarget(t *testing.T) {
 	}
 }
 
+func TestOutputFS(t *testing.T) {
+	defer server.Reset()
+	c := newClientInstance("mock")
+
+	foo := []byte("this is the content of foo")
+	fooDigest := digest.NewFromBlob(foo)
+	bar := []byte("this is the content of bar")
+	barDigest := digest.NewFromBlob(bar)
+	tree := mustMarshal(&pb.Tree{
+		Root: &pb.Directory{
+			Files: []*pb.FileNode{{Name: "bar.txt", Digest: barDigest.ToProto()}},
+		},
+	})
+	treeDigest := digest.NewFromBlob(tree)
+	server.blobs[treeDigest.Hash] = tree
+	server.blobs[fooDigest.Hash] = foo
+	server.blobs[barDigest.Hash] = bar
+	server.mockActionResult = &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{
+			{Path: "sub/foo.txt", Digest: fooDigest.ToProto()},
+		},
+		OutputDirectories: []*pb.OutputDirectory{
+			{Path: "sub/dir", TreeDigest: treeDigest.ToProto()},
+		},
+		ExecutionMetadata: &pb.ExecutedActionMetadata{
+			Worker:                      "kev",
+			QueuedTimestamp:             timestamppb.Now(),
+			ExecutionStartTimestamp:     timestamppb.Now(),
+			ExecutionCompletedTimestamp: timestamppb.Now(),
+		},
+	}
+
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "output_fs"})
+	target.AddOutput("sub/foo.txt")
+	target.AddOutput("sub/dir")
+	target.Command = "echo hello"
+	c.state.Graph.AddTarget(target)
+	_, err := c.Build(target)
+	require.NoError(t, err)
+
+	fsys, err := c.OutputFS(target)
+	require.NoError(t, err)
+	b, err := iofs.ReadFile(fsys, "sub/foo.txt")
+	require.NoError(t, err)
+	assert.Equal(t, foo, b)
+	b, err = iofs.ReadFile(fsys, "sub/dir/bar.txt")
+	require.NoError(t, err)
+	assert.Equal(t, bar, b)
+	entries, err := iofs.ReadDir(fsys, "sub")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "dir", entries[0].Name())
+	assert.True(t, entries[0].IsDir())
+	assert.Equal(t, "foo.txt", entries[1].Name())
+
+	// A target that hasn't been built shouldn't work.
+	_, err = c.OutputFS(core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "unbuilt"}))
+	assert.Error(t, err)
+}
+
 func TestDirectoryMetadataStore(t *testing.T) {
 	cacheDuration := time.Hour
 	now := time.Now().UTC()
@@ -346,6 +482,40 @@ func TestTargetPlatform(t *testing.T) {
 	}, cmd.Platform) //nolint:staticcheck
 }
 
+func TestTargetPlatformResources(t *testing.T) {
+	c := newClientInstance("platform_resources_test")
+	c.state.Config.Remote.CPUPlatformProperty = "min-cores"
+	c.state.Config.Remote.MemoryPlatformProperty = "min-ram"
+	c.platform = convertPlatform(c.state.Config.Remote.Platform)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target"})
+	target.Resources = core.ResourceRequests{CPU: 4, Memory: 1 << 30}
+	cmd, err := c.buildCommand(target, &pb.Directory{}, false, false, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, &pb.Platform{
+		Properties: []*pb.Platform_Property{
+			{
+				Name:  "min-cores",
+				Value: "4",
+			},
+			{
+				Name:  "min-ram",
+				Value: "1073741824",
+			},
+			{
+				Name:  "OSFamily",
+				Value: "linux",
+			},
+		},
+	}, cmd.Platform) //nolint:staticcheck
+
+	// Only the properties that are configured are sent.
+	c.state.Config.Remote.MemoryPlatformProperty = ""
+	target.Resources = core.ResourceRequests{Memory: 1 << 30}
+	cmd, err = c.buildCommand(target, &pb.Directory{}, false, false, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, c.platform, cmd.Platform) //nolint:staticcheck
+}
+
 // Store is a small hack that stores a target's outputs for testing only.
 func (c *Client) Store(target *core.BuildTarget) error {
 	if err := c.CheckInitialised(); err != nil {
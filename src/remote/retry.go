@@ -0,0 +1,76 @@
+package remote
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A retryPolicy describes how we retry remote actions that fail because of transient problems
+// with the remote infrastructure.
+type retryPolicy struct {
+	maxRetries          int
+	codes               map[codes.Code]bool
+	backoff, maxBackoff time.Duration
+}
+
+// newRetryPolicy creates a new retryPolicy from the given config.
+func newRetryPolicy(config *core.Configuration) (*retryPolicy, error) {
+	p := &retryPolicy{
+		maxRetries: config.Remote.MaxRetries,
+		codes:      make(map[codes.Code]bool, len(config.Remote.RetryOn)),
+		backoff:    time.Duration(config.Remote.RetryBackoff),
+		maxBackoff: time.Duration(config.Remote.MaxRetryBackoff),
+	}
+	for _, name := range config.Remote.RetryOn {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(`"` + strings.ToUpper(name) + `"`)); err != nil {
+			return nil, fmt.Errorf("Invalid status code in remote.retryon: %s", name)
+		}
+		p.codes[code] = true
+	}
+	if p.maxBackoff < p.backoff {
+		p.maxBackoff = p.backoff
+	}
+	return p, nil
+}
+
+// IsTransient returns true if the given error is one we consider transient.
+func (p *retryPolicy) IsTransient(err error) bool {
+	return err != nil && p.codes[status.Code(err)]
+}
+
+// ShouldRetry returns true if we should retry after the given error, having already retried the given number of times.
+func (p *retryPolicy) ShouldRetry(err error, retries int) bool {
+	return retries < p.maxRetries && core.IsInfraFailure(err) && p.IsTransient(err)
+}
+
+// Backoff returns the length of time to wait before the next retry, having already retried the given number of times.
+// The delay grows exponentially up to the maximum, and is jittered so retries from many actions don't happen in lockstep.
+func (p *retryPolicy) Backoff(retries int) time.Duration {
+	delay := p.backoff
+	for i := 0; i < retries && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// markTransient marks errors that the policy considers transient as infrastructure failures.
+func (p *retryPolicy) markTransient(err error) error {
+	if p.IsTransient(err) {
+		return &core.RemoteInfraError{Err: err}
+	}
+	return err
+}
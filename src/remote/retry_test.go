@@ -0,0 +1,71 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func newTestRetryPolicy(t *testing.T) *retryPolicy {
+	t.Helper()
+	config := core.DefaultConfiguration()
+	config.Remote.RetryBackoff = cli.Duration(time.Second)
+	config.Remote.MaxRetryBackoff = cli.Duration(10 * time.Second)
+	p, err := newRetryPolicy(config)
+	require.NoError(t, err)
+	return p
+}
+
+func TestRetryPolicyInvalidCode(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Remote.RetryOn = []string{"UNAVAILABLE", "WIBBLE"}
+	_, err := newRetryPolicy(config)
+	assert.Error(t, err)
+}
+
+func TestRetryPolicyLowerCaseCode(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Remote.RetryOn = []string{"internal"}
+	p, err := newRetryPolicy(config)
+	require.NoError(t, err)
+	assert.True(t, p.IsTransient(status.Error(codes.Internal, "oh no")))
+	assert.False(t, p.IsTransient(status.Error(codes.Unavailable, "oh no")))
+}
+
+func TestRetryPolicyClassification(t *testing.T) {
+	p := newTestRetryPolicy(t)
+	assert.True(t, p.IsTransient(status.Error(codes.Unavailable, "oh no")))
+	assert.True(t, p.IsTransient(fmt.Errorf("wrapped: %w", status.Error(codes.ResourceExhausted, "oh no"))))
+	assert.False(t, p.IsTransient(status.Error(codes.InvalidArgument, "oh no")))
+	assert.False(t, p.IsTransient(context.DeadlineExceeded)) // The action timed out, that's not transient.
+	assert.False(t, p.IsTransient(nil))
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	p := newTestRetryPolicy(t)
+	err := p.markTransient(status.Error(codes.Aborted, "oh no"))
+	assert.True(t, core.IsInfraFailure(err))
+	assert.True(t, p.ShouldRetry(err, 0))
+	assert.True(t, p.ShouldRetry(err, 2))
+	assert.False(t, p.ShouldRetry(err, 3))
+	assert.False(t, p.ShouldRetry(status.Error(codes.Aborted, "not marked"), 0))
+	assert.False(t, p.ShouldRetry(p.markTransient(status.Error(codes.NotFound, "oh no")), 0))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := newTestRetryPolicy(t)
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		backoff := p.Backoff(i)
+		assert.GreaterOrEqual(t, backoff, expected/2, "retry %d", i)
+		assert.LessOrEqual(t, backoff, expected, "retry %d", i)
+	}
+}
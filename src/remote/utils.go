@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +31,7 @@ import (
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 	"github.com/thought-machine/please/src/metrics"
+	"github.com/thought-machine/please/src/remote/dial"
 	remotefs "github.com/thought-machine/please/src/remote/fs"
 )
 
@@ -174,6 +176,58 @@ func (c *Client) outputTree(target *core.BuildTarget, ar *pb.ActionResult) (*pb.
 	return o, nil
 }
 
+// normaliseTree rearranges a tree returned by outputTree, whose root can contain entries in subdirectories,
+// into a well-formed one where every directory only contains its immediate children.
+func (c *Client) normaliseTree(tree *pb.Tree) *pb.Tree {
+	type node struct {
+		dir      *pb.Directory
+		children map[string]*node
+	}
+	root := &node{dir: &pb.Directory{NodeProperties: tree.Root.NodeProperties}, children: map[string]*node{}}
+	var get func(name string) *node
+	get = func(name string) *node {
+		if name == "." || name == "" {
+			return root
+		}
+		parent := get(filepath.Dir(name))
+		base := filepath.Base(name)
+		n, present := parent.children[base]
+		if !present {
+			n = &node{dir: &pb.Directory{}, children: map[string]*node{}}
+			parent.children[base] = n
+		}
+		return n
+	}
+	for _, f := range tree.Root.Files {
+		d := get(filepath.Dir(f.Name)).dir
+		d.Files = append(d.Files, &pb.FileNode{Name: filepath.Base(f.Name), Digest: f.Digest, IsExecutable: f.IsExecutable, NodeProperties: f.NodeProperties})
+	}
+	for _, dn := range tree.Root.Directories {
+		d := get(filepath.Dir(dn.Name)).dir
+		d.Directories = append(d.Directories, &pb.DirectoryNode{Name: filepath.Base(dn.Name), Digest: dn.Digest})
+	}
+	for _, s := range tree.Root.Symlinks {
+		d := get(filepath.Dir(s.Name)).dir
+		d.Symlinks = append(d.Symlinks, &pb.SymlinkNode{Name: filepath.Base(s.Name), Target: s.Target, NodeProperties: s.NodeProperties})
+	}
+	ret := &pb.Tree{Root: root.dir, Children: tree.Children}
+	var finalise func(n *node) *pb.Digest
+	finalise = func(n *node) *pb.Digest {
+		for name, child := range n.children {
+			n.dir.Directories = append(n.dir.Directories, &pb.DirectoryNode{Name: name, Digest: finalise(child)})
+		}
+		sort.Slice(n.dir.Files, func(i, j int) bool { return n.dir.Files[i].Name < n.dir.Files[j].Name })
+		sort.Slice(n.dir.Directories, func(i, j int) bool { return n.dir.Directories[i].Name < n.dir.Directories[j].Name })
+		sort.Slice(n.dir.Symlinks, func(i, j int) bool { return n.dir.Symlinks[i].Name < n.dir.Symlinks[j].Name })
+		if n != root {
+			ret.Children = append(ret.Children, n.dir)
+		}
+		return c.digestMessage(n.dir)
+	}
+	finalise(root)
+	return ret
+}
+
 // setOutputDirectoryOuts sets the output on the target based on the outputs in the action result
 func (c *Client) setOutputDirectoryOuts(target *core.BuildTarget, actionResultFS *remotefs.CASFileSystem, outDir core.OutputDirectory) error {
 	outDirFS := actionResultFS.ChangeDir(outDir.Dir())
@@ -375,7 +429,7 @@ func convertError(err *rpcstatus.Status) error {
 
 	msg := status.ErrorProto(err)
 	for _, detail := range err.Details {
-		msg = fmt.Errorf("%s %s", msg, detail.Value)
+		msg = fmt.Errorf("%w %s", msg, detail.Value)
 	}
 	return msg
 }
@@ -389,6 +443,15 @@ func wrap(err error, msg string, args ...interface{}) error {
 	return status.Errorf(s.Code(), fmt.Sprintf(msg, args...)+": "+s.Message())
 }
 
+// markUnavailable marks errors that mean the server couldn't run an action (as opposed to the action
+// itself failing), so the caller can choose to run it elsewhere.
+func markUnavailable(err error) error {
+	if code := status.Code(err); code == codes.Unavailable || code == codes.ResourceExhausted {
+		return &core.RemoteUnavailableError{Err: err}
+	}
+	return err
+}
+
 // timeout returns either a build or test timeout from a target.
 func timeout(target *core.BuildTarget, test bool) time.Duration {
 	if test {
@@ -397,6 +460,20 @@ func timeout(target *core.BuildTarget, test bool) time.Duration {
 	return target.BuildTimeout
 }
 
+// queueTimeout returns how long to wait for a target's remote action beyond its own build or test timeout.
+// Targets can override remote.queuetimeout with a label like remote-queue-timeout:10m; 0 means no limit.
+func (c *Client) queueTimeout(target *core.BuildTarget) time.Duration {
+	for _, label := range target.PrefixedLabels("remote-queue-timeout:") {
+		d, err := time.ParseDuration(label)
+		if err != nil {
+			log.Warning("Invalid remote-queue-timeout label on %s: %s; will ignore", target, err)
+			continue
+		}
+		return d
+	}
+	return time.Duration(c.state.Config.Remote.QueueTimeout)
+}
+
 // A dirBuilder is for helping build up a tree of Directory protos.
 //
 // This is pretty awkward; we need to recursively build a whole set of directories
@@ -555,9 +632,16 @@ func convertPlatform(properties []string) *pb.Platform {
 	return platform
 }
 
-// targetPlatformProperties returns the platform properties for a target, including any global ones.
+// targetPlatformProperties returns the platform properties for a target, including any global ones
+// and any that correspond to the resources it requests.
 func (c *Client) targetPlatformProperties(target *core.BuildTarget) *pb.Platform {
 	labels := target.PrefixedLabels("remote-platform-property:")
+	if cpu := c.state.Config.Remote.CPUPlatformProperty; cpu != "" && target.Resources.CPU > 0 {
+		labels = append(labels, cpu+"="+strconv.Itoa(target.Resources.CPU))
+	}
+	if mem := c.state.Config.Remote.MemoryPlatformProperty; mem != "" && target.Resources.Memory > 0 {
+		labels = append(labels, mem+"="+strconv.FormatUint(target.Resources.Memory, 10))
+	}
 	if len(labels) == 0 {
 		return c.platform
 	}
@@ -612,14 +696,8 @@ func (c *Client) dialOpts() ([]grpc.DialOption, error) {
 		grpc.WithChainUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
 		grpc.WithChainStreamInterceptor(grpc_prometheus.StreamClientInterceptor),
 	}
-	if c.state.Config.Remote.TokenFile == "" {
-		return opts, nil
-	}
-	token, err := os.ReadFile(c.state.Config.Remote.TokenFile)
-	if err != nil {
-		return opts, fmt.Errorf("Failed to load token from file: %s", err)
-	}
-	return append(opts, grpc.WithPerRPCCredentials(preSharedToken(string(token)))), nil
+	auth, err := dial.Options(c.state.Config)
+	return append(opts, auth...), err
 }
 
 // outputHash returns an output hash for a target. If it has a single output it's the hash
@@ -633,23 +711,6 @@ func (c *Client) outputHash(ar *pb.ActionResult) string {
 	return c.digestMessage(ar).Hash
 }
 
-// preSharedToken returns a gRPC credential provider for a pre-shared token.
-func preSharedToken(token string) tokenCredProvider {
-	return tokenCredProvider{
-		"authorization": "Bearer " + strings.TrimSpace(token),
-	}
-}
-
-type tokenCredProvider map[string]string
-
-func (cred tokenCredProvider) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	return cred, nil
-}
-
-func (cred tokenCredProvider) RequireTransportSecurity() bool {
-	return false // Allow these to be provided over an insecure channel; this facilitates e.g. service meshes like Istio.
-}
-
 // contextWithMetadata returns a context with metadata corresponding to the given build target.
 func (c *Client) contextWithMetadata(target *core.BuildTarget) context.Context {
 	const key = "build.bazel.remote.execution.v2.requestmetadata-bin" // as defined by the proto
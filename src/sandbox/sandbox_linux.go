@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -21,6 +22,8 @@ import (
 const mdLazytime = 1 << 25
 
 const sandboxDirsVar = "SANDBOX_DIRS"
+const sandboxStrictVar = "SANDBOX_STRICT"
+const sandboxPathsVar = "SANDBOX_PATHS"
 
 var sandboxMountDir = core.SandboxDir
 
@@ -37,6 +40,7 @@ func Sandbox(args []string) error {
 
 	unshareMount := os.Getenv("SHARE_MOUNT") != "1"
 	unshareNetwork := os.Getenv("SHARE_NETWORK") != "1"
+	strict := os.Getenv(sandboxStrictVar) == "1"
 	user := os.Getenv("SANDBOX_UID")
 
 	if unshareMount {
@@ -45,11 +49,15 @@ func Sandbox(args []string) error {
 			return fmt.Errorf("$TMP_DIR is not set but required. It must contain the directory path to be sandboxed")
 		}
 
-		if err := sandboxDir(tmpDirEnv); err != nil {
+		if strict {
+			if err := strictSandboxDir(tmpDirEnv, strings.Split(os.Getenv(sandboxPathsVar), ",")); err != nil {
+				return err
+			}
+		} else if err := sandboxDir(tmpDirEnv); err != nil {
 			return err
 		}
 
-		if err := mountSandboxDirs(); err != nil {
+		if err := mountSandboxDirs(strict); err != nil {
 			return fmt.Errorf("Failed to mount over sandboxed dirs: %w", err)
 		}
 
@@ -59,7 +67,12 @@ func Sandbox(args []string) error {
 			return fmt.Errorf("Failed to chdir to %s: %s", sandboxMountDir, err)
 		}
 
-		if err := mountProc(); err != nil {
+		if strict {
+			// Anything we looked up before might not be visible any more.
+			if cmd, err = exec.LookPath(args[0]); err != nil {
+				return fmt.Errorf("%s is not available in the strict sandbox: %s", args[0], err)
+			}
+		} else if err := mountProc(); err != nil {
 			return err
 		}
 	}
@@ -144,6 +157,138 @@ func sandboxDir(dir string) error {
 	return nil
 }
 
+// strictSandboxDir sets up a new root filesystem that contains only the given directory (mounted at the usual
+// sandbox location) and the given paths from the host, which are mounted read-only, and switches into it.
+func strictSandboxDir(dir string, paths []string) error {
+	if strings.HasPrefix(dir, "/tmp") {
+		return fmt.Errorf("Not mounting /tmp as %s is a subdir", dir)
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("Failed to mount root: %w", err)
+	}
+
+	// The new root is a tmpfs, which we populate with only what the action is allowed to see.
+	// We mount it at /tmp because that's somewhere we know exists (and we'd be hiding it anyway).
+	const root = "/tmp"
+	flags := mdLazytime | syscall.MS_NOATIME | syscall.MS_NODEV | syscall.MS_NOSUID
+	if err := syscall.Mount("", root, "tmpfs", uintptr(flags), ""); err != nil {
+		return fmt.Errorf("Failed to mount new root: %w", err)
+	}
+
+	mounted := []string{}
+	for len(paths) > 0 {
+		path := paths[0]
+		paths = paths[1:]
+		if path == "" || !filepath.IsAbs(path) || core.IsWithin(path, mounted) {
+			continue
+		}
+		link, err := bindReadOnly(path, filepath.Join(root, path))
+		if err != nil {
+			return fmt.Errorf("Failed to mount %s in sandbox: %w", path, err)
+		}
+		mounted = append(mounted, path)
+		if link != "" {
+			// Symlinks are recreated as-is, so whatever they point to needs to be there too.
+			paths = append(paths, link)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "tmp"), 0777); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to make /tmp: %w", err)
+	} else if err := os.Chmod(filepath.Join(root, "tmp"), os.ModeSticky|0777); err != nil {
+		return err
+	}
+	sandbox := filepath.Join(root, sandboxMountDir)
+	if err := os.MkdirAll(sandbox, os.ModeDir|0775); err != nil {
+		return fmt.Errorf("Failed to make %s: %w", sandboxMountDir, err)
+	}
+	if err := syscall.Mount(dir, sandbox, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("Failed to bind %s to %s : %w", dir, sandboxMountDir, err)
+	}
+
+	// This has to happen before we pivot; we aren't allowed to mount a new /proc unless there's
+	// already one that's fully visible.
+	if err := os.Mkdir(filepath.Join(root, "proc"), 0555); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to make /proc: %w", err)
+	} else if err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", 0, ""); err != nil {
+		return fmt.Errorf("Failed to mount /proc: %w", err)
+	}
+
+	const oldRoot = "/.oldroot"
+	if err := os.Mkdir(filepath.Join(root, oldRoot), 0700); err != nil {
+		return fmt.Errorf("Failed to make %s: %w", oldRoot, err)
+	} else if err := unix.PivotRoot(root, filepath.Join(root, oldRoot)); err != nil {
+		return fmt.Errorf("Failed to pivot root: %w", err)
+	} else if err := os.Chdir("/"); err != nil {
+		return err
+	} else if err := unix.Unmount(oldRoot, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("Failed to unmount old root: %w", err)
+	} else if err := os.Remove(oldRoot); err != nil {
+		return err
+	}
+
+	if err := os.Setenv("TMPDIR", "/tmp"); err != nil {
+		return fmt.Errorf("Failed to set $TMPDIR: %w", err)
+	}
+	return nil
+}
+
+// bindReadOnly mounts the given path from the host to the given destination, read-only.
+// Paths that don't exist are skipped. Symlinks are recreated rather than mounted, in which case
+// the path they resolve to on the host is returned.
+func bindReadOnly(path, dest string) (string, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	} else if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", nil // Dangling symlink, there's nothing for it to point to.
+		}
+		return resolved, os.Symlink(target, dest)
+	} else if info.IsDir() {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return "", err
+		}
+	} else if f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return "", err
+	} else {
+		f.Close()
+	}
+	if err := syscall.Mount(path, dest, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return "", err
+	}
+	// Remounting has to preserve any flags that were already set on the mount, otherwise the kernel won't let us.
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dest, &stat); err != nil {
+		return "", err
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for st, ms := range map[int64]uintptr{
+		unix.ST_NOSUID:     syscall.MS_NOSUID,
+		unix.ST_NODEV:      syscall.MS_NODEV,
+		unix.ST_NOEXEC:     syscall.MS_NOEXEC,
+		unix.ST_NOATIME:    syscall.MS_NOATIME,
+		unix.ST_NODIRATIME: syscall.MS_NODIRATIME,
+		unix.ST_RELATIME:   syscall.MS_RELATIME,
+	} {
+		if int64(stat.Flags)&st != 0 {
+			flags |= ms
+		}
+	}
+	return "", syscall.Mount("", dest, "", flags, "")
+}
+
 func mountProc() error {
 	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
 		return fmt.Errorf("Failed to mount /proc: %w", err)
@@ -151,11 +296,15 @@ func mountProc() error {
 	return nil
 }
 
-func mountSandboxDirs() error {
+// mountSandboxDirs mounts an empty filesystem over each of the dirs to hide. In strict mode any that aren't
+// visible in the sandbox anyway are skipped.
+func mountSandboxDirs(strict bool) error {
 	dirs := strings.Split(os.Getenv(sandboxDirsVar), ",")
 	for _, d := range dirs {
 		if d == "" {
 			continue
+		} else if _, err := os.Stat(d); strict && os.IsNotExist(err) {
+			continue
 		}
 		if err := syscall.Mount("", d, "tmpfs", mdLazytime|syscall.MS_NOATIME|syscall.MS_NODEV|syscall.MS_NOSUID, ""); err != nil {
 			return fmt.Errorf("Failed to mount sandbox dir %s: %w", d, err)
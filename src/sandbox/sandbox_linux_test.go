@@ -0,0 +1,93 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sandboxTestCmdVar is set when the test binary is re-executed to run a command in the sandbox, since
+// Sandbox replaces the current process.
+const sandboxTestCmdVar = "SANDBOX_TEST_CMD"
+
+func TestMain(m *testing.M) {
+	if cmd := os.Getenv(sandboxTestCmdVar); cmd != "" {
+		if err := Sandbox([]string{"bash", "-c", cmd}); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestStrictSandbox(t *testing.T) {
+	// None of this can be under /tmp, since the sandbox mounts over it.
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	dir, err := os.MkdirTemp(wd, "strict_sandbox_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	write := func(name string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(name), 0644))
+		return path
+	}
+	write("tmp/in.txt")
+	visible := write("tools/tool.txt")
+	undeclared := write("src/undeclared.txt")
+
+	paths := []string{filepath.Dir(visible)}
+	for _, p := range []string{"/bin", "/usr", "/lib", "/lib32", "/lib64", "/etc"} {
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	run := func(command string) (string, error) {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(),
+			sandboxTestCmdVar+"="+command,
+			"TMP_DIR="+filepath.Join(dir, "tmp"),
+			sandboxStrictVar+"=1",
+			sandboxPathsVar+"="+strings.Join(paths, ","),
+			"SHARE_NETWORK=1",
+		)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+			UidMappings: []syscall.SysProcIDMap{{HostID: os.Getuid(), Size: 1, ContainerID: 0}},
+			GidMappings: []syscall.SysProcIDMap{{HostID: os.Getgid(), Size: 1, ContainerID: 0}},
+		}
+		out, err := cmd.CombinedOutput()
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EINVAL) {
+			t.Skipf("unprivileged user namespaces aren't permitted here: %s", err)
+		}
+		return string(out), err
+	}
+
+	out, err := run("cat in.txt")
+	require.NoError(t, err, out)
+	assert.Equal(t, "tmp/in.txt", out)
+
+	out, err = run("cat " + visible)
+	require.NoError(t, err, out)
+	assert.Equal(t, "tools/tool.txt", out)
+
+	out, err = run("echo wibble > " + visible)
+	assert.Error(t, err)
+	assert.Contains(t, out, "Read-only file system")
+	b, err := os.ReadFile(visible)
+	require.NoError(t, err)
+	assert.Equal(t, "tools/tool.txt", string(b))
+
+	out, err = run("cat " + undeclared)
+	assert.Error(t, err)
+	assert.Contains(t, out, "No such file or directory")
+}
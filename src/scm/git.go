@@ -1,15 +1,17 @@
 // Package scm abstracts operations on various tools like git
-// Currently, only git is supported.
+// Currently git, Mercurial and Sapling are supported.
 package scm
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sourcegraph/go-diff/diff"
@@ -22,8 +24,17 @@ var defaultIgnoredFiles = []string{"plz-out", ".plzconfig.local"}
 const ignoreFileName = ".gitignore"
 
 // git implements operations on a git repository.
+// Where possible it reads the repository directly rather than invoking the git CLI, falling back
+// to it for anything the native implementation doesn't support.
 type git struct {
 	repoRoot string
+
+	nativeOnce sync.Once
+	repo       *gitRepo
+
+	// memo caches the results of operations that are repeated a lot during parsing.
+	// It's reset on checkout since that's the only way we change the repo.
+	memo sync.Map
 }
 
 type gitIgnore struct {
@@ -49,6 +60,16 @@ func (g *git) DescribeIdentifier(revision string) string {
 // and the current revision's commit hash otherwise; this will not permanently identify the current
 // revision, as the HEAD of the branch may change in future.
 func (g *git) CurrentRevIdentifier(permanent bool) string {
+	if repo := g.native(); repo != nil {
+		ref, hash, err := repo.Head()
+		if err == nil {
+			if !permanent && ref != "" {
+				return shortRefName(ref)
+			}
+			return hash
+		}
+		log.Debug("Failed to read HEAD natively, falling back to git CLI: %s", err)
+	}
 	if !permanent {
 		out, err := exec.Command("git", "symbolic-ref", "-q", "--short", "HEAD").CombinedOutput()
 		if err == nil {
@@ -67,6 +88,11 @@ func (g *git) ChangesIn(diffSpec string, relativeTo string) []string {
 	if relativeTo == "" {
 		relativeTo = g.repoRoot
 	}
+	if files, err := g.changesInNative(diffSpec); err == nil {
+		return g.fixGitRelativePaths(files, relativeTo)
+	} else if g.native() != nil {
+		log.Debug("Failed to determine changes in %s natively, falling back to git CLI: %s", diffSpec, err)
+	}
 	files := make([]string, 0)
 	command := []string{"diff-tree", "--no-commit-id", "--name-only", "-r", diffSpec}
 	out, err := exec.Command("git", command...).CombinedOutput()
@@ -86,6 +112,14 @@ func (g *git) ChangedFiles(fromCommit string, includeUntracked bool, relativeTo
 		relativeTo = g.repoRoot
 	}
 	relSuffix := []string{"--", relativeTo}
+	if files, err := g.changedFilesNative(fromCommit, relativeTo); err == nil {
+		if includeUntracked {
+			files = append(files, g.untrackedFiles(relativeTo)...)
+		}
+		return g.fixGitRelativePaths(files, relativeTo)
+	} else if g.native() != nil {
+		log.Debug("Failed to determine changed files natively, falling back to git CLI: %s", err)
+	}
 	command := []string{"diff", "--name-only", "HEAD"}
 
 	out, err := exec.Command("git", append(command, relSuffix...)...).CombinedOutput()
@@ -107,13 +141,7 @@ func (g *git) ChangedFiles(fromCommit string, includeUntracked bool, relativeTo
 		files = append(files, committedChanges...)
 	}
 	if includeUntracked {
-		command = []string{"ls-files", "--other", "--exclude-standard"}
-		out, err = exec.Command("git", append(command, relSuffix...)...).CombinedOutput()
-		if err != nil {
-			log.Fatalf("unable to determine untracked files: %s\nOutput:\n%s", err, string(out))
-		}
-		untracked := strings.Split(string(out), "\n")
-		files = append(files, untracked...)
+		files = append(files, g.untrackedFiles(relativeTo)...)
 	}
 	// git will report changed files relative to the worktree: re-relativize to relativeTo
 	normalized := make([]string, 0)
@@ -123,6 +151,135 @@ func (g *git) ChangedFiles(fromCommit string, includeUntracked bool, relativeTo
 	return normalized
 }
 
+// untrackedFiles returns any untracked files that aren't ignored.
+func (g *git) untrackedFiles(relativeTo string) []string {
+	if repo := g.native(); repo != nil {
+		files, err := repo.UntrackedFiles(g.repoRoot, 0)
+		if err == nil {
+			return g.filterRelativeTo(files, relativeTo)
+		}
+		log.Debug("Failed to determine untracked files natively, falling back to git CLI: %s", err)
+	}
+	command := []string{"ls-files", "--other", "--exclude-standard"}
+	out, err := exec.Command("git", append(command, "--", relativeTo)...).CombinedOutput()
+	if err != nil {
+		log.Fatalf("unable to determine untracked files: %s\nOutput:\n%s", err, string(out))
+	}
+	return strings.Split(string(out), "\n")
+}
+
+// native returns the native reader for this repo, or nil if it can't be read natively.
+func (g *git) native() *gitRepo {
+	g.nativeOnce.Do(func() {
+		repo, err := openGitRepo(g.repoRoot)
+		if err != nil {
+			log.Debug("Can't read git repo natively, will use the git CLI instead: %s", err)
+			return
+		}
+		g.repo = repo
+	})
+	return g.repo
+}
+
+// changesInNative returns the files changed in a single commit. Merge and root commits aren't supported since
+// diff-tree doesn't show anything for them by default.
+func (g *git) changesInNative(diffSpec string) ([]string, error) {
+	repo := g.native()
+	if repo == nil {
+		return nil, fmt.Errorf("cannot read repo natively")
+	}
+	hash, err := repo.Resolve(diffSpec)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.Commit(hash)
+	if err != nil {
+		return nil, err
+	} else if len(commit.Parents) != 1 {
+		return nil, fmt.Errorf("%s has %d parents", diffSpec, len(commit.Parents))
+	}
+	before, err := repo.CommitFiles(commit.Parents[0])
+	if err != nil {
+		return nil, err
+	}
+	after, err := repo.FlattenTree(commit.Tree)
+	if err != nil {
+		return nil, err
+	}
+	return diffTrees(before, after), nil
+}
+
+// changedFilesNative returns the files that have changed in the working tree, plus any changed since the
+// merge base with fromCommit if given. Paths are relative to the repo root.
+func (g *git) changedFilesNative(fromCommit, relativeTo string) ([]string, error) {
+	repo := g.native()
+	if repo == nil {
+		return nil, fmt.Errorf("cannot read repo natively")
+	}
+	_, head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	files, err := repo.ChangedFiles(g.repoRoot, head)
+	if err != nil {
+		return nil, err
+	}
+	if fromCommit != "" {
+		from, err := repo.Resolve(fromCommit)
+		if err != nil {
+			return nil, err
+		}
+		base, err := repo.MergeBase(from, head)
+		if err != nil {
+			return nil, err
+		}
+		before, err := repo.CommitFiles(base)
+		if err != nil {
+			return nil, err
+		}
+		after, err := repo.CommitFiles(head)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, diffTrees(before, after)...)
+	}
+	return g.filterRelativeTo(files, relativeTo), nil
+}
+
+// filterRelativeTo returns the files (which are relative to the repo root) that are within the given directory.
+func (g *git) filterRelativeTo(files []string, relativeTo string) []string {
+	prefix, err := filepath.Rel(g.repoRoot, relativeTo)
+	if err != nil || prefix == "." {
+		return files
+	}
+	prefix = filepath.ToSlash(prefix)
+	filtered := files[:0]
+	for _, f := range files {
+		if f == prefix || strings.HasPrefix(f, prefix+"/") {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+// shortRefName returns the short form of a ref name, e.g. master for refs/heads/master.
+func shortRefName(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/", "refs/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
+}
+
+func (g *git) fixGitRelativePaths(files []string, relativeTo string) []string {
+	ret := make([]string, len(files))
+	for i, f := range files {
+		ret[i] = g.fixGitRelativePath(f, relativeTo)
+	}
+	return ret
+}
+
 func (g *git) fixGitRelativePath(worktreePath, relativeTo string) string {
 	p, err := filepath.Rel(relativeTo, filepath.Join(g.repoRoot, worktreePath))
 	if err != nil {
@@ -160,7 +317,13 @@ func (g *git) IgnoreFiles(path string, files []string) error {
 		files = defaultIgnoredFiles
 	}
 
-	ignore, err := openGitignore(filepath.Join(g.repoRoot, path))
+	return updateIgnoreFile(filepath.Join(g.repoRoot, path), files)
+}
+
+// updateIgnoreFile appends any of the given entries that aren't already present to an ignore file,
+// below a marker line indicating they're managed by Please.
+func updateIgnoreFile(filename string, files []string) error {
+	ignore, err := openGitignore(filename)
 	if err != nil {
 		return err
 	}
@@ -207,19 +370,20 @@ func (g *git) ChangedLines() (map[string][]int, error) {
 	if err != nil {
 		return nil, fmt.Errorf("git diff failed: %s\nOutput:\n%s", err, string(out))
 	}
-	return g.parseChangedLines(out)
+	return parseChangedLines(out)
 }
 
-func (g *git) parseChangedLines(input []byte) (map[string][]int, error) {
+// parseChangedLines parses a unified diff (in git's format) into a map of filename -> changed line numbers.
+func parseChangedLines(input []byte) (map[string][]int, error) {
 	m := map[string][]int{}
 	fds, err := diff.ParseMultiFileDiff(input)
 	for _, fd := range fds {
-		m[strings.TrimPrefix(fd.NewName, "b/")] = g.parseHunks(fd.Hunks)
+		m[strings.TrimPrefix(fd.NewName, "b/")] = parseHunks(fd.Hunks)
 	}
 	return m, err
 }
 
-func (g *git) parseHunks(hunks []*diff.Hunk) []int {
+func parseHunks(hunks []*diff.Hunk) []int {
 	ret := []int{}
 	for _, hunk := range hunks {
 		for i := 0; i < int(hunk.NewLines); i++ {
@@ -230,6 +394,10 @@ func (g *git) parseHunks(hunks []*diff.Hunk) []int {
 }
 
 func (g *git) Checkout(revision string) error {
+	g.memo.Range(func(key, value any) bool {
+		g.memo.Delete(key)
+		return true
+	})
 	if out, err := exec.Command("git", "checkout", revision).CombinedOutput(); err != nil {
 		return fmt.Errorf("git checkout of %s failed: %s\nOutput:\n%s", revision, err, string(out))
 	}
@@ -237,6 +405,13 @@ func (g *git) Checkout(revision string) error {
 }
 
 func (g *git) CurrentRevDate(format string) string {
+	if repo := g.native(); repo != nil {
+		if _, hash, err := repo.Head(); err == nil {
+			if commit, err := repo.Commit(hash); err == nil {
+				return commit.Committer.Time.Local().Format(format)
+			}
+		}
+	}
 	out, err := exec.Command("git", "show", "-s", "--format=%ct").CombinedOutput()
 	if err != nil {
 		return "Unknown"
@@ -278,3 +453,139 @@ func (g *git) getUnIgnored(files ...string) []string {
 	}
 	return unignored
 }
+
+// Branch returns the name of the current branch, as `git symbolic-ref -q HEAD` would.
+// If HEAD is detached it returns the last ref name pointing at it instead.
+func (g *git) Branch(short bool) (string, error) {
+	return g.memoise(fmt.Sprintf("branch %v", short), func() (string, error) {
+		if repo := g.native(); repo != nil {
+			if ref, _, err := repo.Head(); err == nil && ref != "" {
+				if short {
+					return shortRefName(ref), nil
+				}
+				return ref, nil
+			}
+		}
+		args := []string{"symbolic-ref", "-q"}
+		if short {
+			args = append(args, "--short")
+		}
+		out, symRefErr := exec.Command("git", append(args, "HEAD")...).Output()
+		if symRefErr == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
+		// We're in a detached head
+		out, err := exec.Command("git", "show", "-q", "--format=%D").Output()
+		if err != nil {
+			return "", fmt.Errorf("git show failed: %w", err)
+		}
+		if fields := strings.Fields(string(out)); len(fields) > 0 {
+			return fields[len(fields)-1], nil
+		}
+		return "", fmt.Errorf("git symbolic-ref failed: %w", symRefErr)
+	})
+}
+
+// Show returns information about the current commit, as `git show -s --format=<format>` would.
+// The format must be a single verb.
+func (g *git) Show(format string) (string, error) {
+	return g.memoise("show "+format, func() (string, error) {
+		if repo := g.native(); repo != nil {
+			if _, hash, err := repo.Head(); err == nil {
+				if commit, err := repo.Commit(hash); err == nil {
+					if s, ok := formatCommit(commit, format); ok {
+						return strings.TrimSpace(s), nil
+					}
+				}
+			}
+		}
+		out, err := exec.Command("git", "show", "-s", "--format="+format).Output()
+		if err != nil {
+			return "", fmt.Errorf("git show failed: %w", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	})
+}
+
+// formatCommit formats a single verb for a commit in the same way as git show --format.
+// It returns false for verbs that aren't supported.
+func formatCommit(commit *gitCommit, format string) (string, bool) {
+	subject, body, _ := strings.Cut(strings.TrimLeft(commit.Message, "\n"), "\n\n")
+	switch format {
+	case "%H":
+		return commit.Hash, true
+	case "%T":
+		return commit.Tree, true
+	case "%P":
+		return strings.Join(commit.Parents, " "), true
+	case "%an":
+		return commit.Author.Name, true
+	case "%ae":
+		return commit.Author.Email, true
+	case "%at":
+		return strconv.FormatInt(commit.Author.Time.Unix(), 10), true
+	case "%cn":
+		return commit.Committer.Name, true
+	case "%ce":
+		return commit.Committer.Email, true
+	case "%ct":
+		return strconv.FormatInt(commit.Committer.Time.Unix(), 10), true
+	case "%ci":
+		return commit.Committer.Time.Format("2006-01-02 15:04:05 -0700"), true
+	case "%cI":
+		return commit.Committer.Time.Format("2006-01-02T15:04:05-07:00"), true
+	case "%cs":
+		return commit.Committer.Time.Format("2006-01-02"), true
+	case "%e":
+		return commit.Encoding, true
+	case "%s":
+		// The subject is the first paragraph, joined onto one line.
+		return strings.Join(strings.Fields(subject), " "), true
+	case "%b":
+		return body, true
+	case "%B":
+		return commit.Message, true
+	case "%n":
+		return "\n", true
+	case "%%":
+		return "%", true
+	}
+	return "", false
+}
+
+// IsClean returns true if there are no changes in the working tree, including untracked files.
+func (g *git) IsClean() (bool, error) {
+	clean, err := g.memoise("clean", func() (string, error) {
+		if files, err := g.changedFilesNative("", g.repoRoot); err != nil {
+			log.Debug("Failed to determine changed files natively, falling back to git CLI: %s", err)
+		} else if len(files) > 0 {
+			return "false", nil
+		} else if untracked, err := g.repo.UntrackedFiles(g.repoRoot, 1); err != nil {
+			log.Debug("Failed to determine untracked files natively, falling back to git CLI: %s", err)
+		} else {
+			return strconv.FormatBool(len(untracked) == 0), nil
+		}
+		cmd := exec.Command("git", "status", "--porcelain")
+		cmd.Dir = g.repoRoot
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("git status failed: %w", err)
+		}
+		return strconv.FormatBool(len(bytes.TrimSpace(out)) == 0), nil
+	})
+	return clean == "true", err
+}
+
+// memoise returns the result of a function, caching it until the next checkout.
+func (g *git) memoise(key string, f func() (string, error)) (string, error) {
+	type result struct {
+		value string
+		err   error
+	}
+	if r, present := g.memo.Load(key); present {
+		return r.(result).value, r.(result).err
+	}
+	value, err := f()
+	g.memo.Store(key, result{value: value, err: err})
+	return value, err
+}
@@ -10,8 +10,7 @@ import (
 func TestParseChangedLines(t *testing.T) {
 	b, err := os.ReadFile("src/scm/test_data/git.diff")
 	assert.NoError(t, err)
-	g := git{}
-	m, err := g.parseChangedLines(b)
+	m, err := parseChangedLines(b)
 	assert.NoError(t, err)
 	assert.Equal(t, map[string][]int{
 		"test/python_rules/behave/BUILD":                                      {8},
@@ -0,0 +1,145 @@
+package scm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// systemGitConfigs are the places the system-wide config usually lives. Its real location depends on how git
+// was built, so we check the common ones.
+var systemGitConfigs = []string{"/etc/gitconfig", "/usr/local/etc/gitconfig", "/opt/homebrew/etc/gitconfig"}
+
+// Config returns the options set in the core section of the system, global and repo config, keyed by their
+// lower-cased names. Later files take precedence over earlier ones, as they do for git.
+// It returns an error if any of the config uses includes or is set via the environment, since we don't
+// attempt to evaluate those ourselves.
+func (r *gitRepo) Config() (map[string]string, error) {
+	r.configOnce.Do(func() {
+		r.config, r.configErr = r.readConfig()
+	})
+	return r.config, r.configErr
+}
+
+func (r *gitRepo) readConfig() (map[string]string, error) {
+	if os.Getenv("GIT_CONFIG_PARAMETERS") != "" || os.Getenv("GIT_CONFIG_COUNT") != "" || os.Getenv("GIT_CONFIG") != "" {
+		return nil, fmt.Errorf("git config is set in the environment")
+	}
+	config := map[string]string{}
+	for _, filename := range r.configFiles() {
+		if err := readConfigFile(filename, config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// configFiles returns the config files that apply to this repo, in increasing order of precedence.
+func (r *gitRepo) configFiles() []string {
+	var files []string
+	if noSystem := os.Getenv("GIT_CONFIG_NOSYSTEM"); noSystem == "" || noSystem == "0" || noSystem == "false" {
+		if system := os.Getenv("GIT_CONFIG_SYSTEM"); system != "" {
+			files = append(files, system)
+		} else {
+			files = append(files, systemGitConfigs...)
+		}
+	}
+	if global := os.Getenv("GIT_CONFIG_GLOBAL"); global != "" {
+		files = append(files, global)
+	} else {
+		home, _ := os.UserHomeDir()
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			files = append(files, filepath.Join(xdg, "git/config"))
+		} else if home != "" {
+			files = append(files, filepath.Join(home, ".config/git/config"))
+		}
+		if home != "" {
+			files = append(files, filepath.Join(home, ".gitconfig"))
+		}
+	}
+	return append(files, filepath.Join(r.commonDir, "config"), filepath.Join(r.gitDir, "config.worktree"))
+}
+
+// readConfigFile reads the core section of a single config file into the given map.
+// It's not an error for the file not to exist.
+func readConfigFile(filename string, config map[string]string) error {
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	section := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		} else if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end == -1 {
+				return fmt.Errorf("%s: invalid section header %s", filename, line)
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1:end]))
+			if section == "include" || strings.HasPrefix(section, "includeif") {
+				return fmt.Errorf("%s uses includes", filename)
+			}
+			// Options can follow the header on the same line.
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" {
+				continue
+			}
+		}
+		if section != "core" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			value = "true" // A key on its own is a boolean that's set.
+		}
+		config[strings.ToLower(strings.TrimSpace(key))] = configString(value)
+	}
+	return nil
+}
+
+// configString returns the value of a config option with any comment, quotes & escapes removed.
+func configString(value string) string {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"':
+			quoted = !quoted
+		case '#', ';':
+			if !quoted {
+				return strings.TrimSpace(b.String())
+			}
+			b.WriteByte(c)
+		case '\\':
+			if i++; i < len(value) {
+				switch value[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(value[i])
+				}
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// configBool interprets a boolean config option, returning def if it's unset.
+func configBool(config map[string]string, name string, def bool) bool {
+	switch strings.ToLower(config[name]) {
+	case "":
+		return def
+	case "false", "no", "off", "0":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package scm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, run := testGitRepo(t)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "")
+	system := filepath.Join(dir, "system")
+	t.Setenv("GIT_CONFIG_SYSTEM", system)
+	require.NoError(t, os.WriteFile(system, []byte("[core]\n\texcludesFile = ~/ignore\n\tautocrlf = true\n\tpreloadIndex\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".gitconfig"), []byte("[core]\n\tautocrlf = \"input\" ; a comment\n[user]\n\tname = Someone\n"), 0644))
+	run("config", "core.autocrlf", "false")
+
+	repo, err := openGitRepo(dir)
+	require.NoError(t, err)
+	config, err := repo.Config()
+	require.NoError(t, err)
+	assert.Equal(t, "~/ignore", config["excludesfile"])
+	assert.Equal(t, "false", config["autocrlf"])
+	assert.Equal(t, "true", config["preloadindex"])
+	assert.NotContains(t, config, "name")
+}
+
+func TestGlobalConfigDisablesNativeStatus(t *testing.T) {
+	dir, _ := testGitRepo(t)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".gitconfig"), []byte("[core]\n\tautocrlf = input\n"), 0644))
+	g := &git{repoRoot: dir}
+	_, err := g.changedFilesNative("", dir)
+	assert.Error(t, err)
+}
+
+func TestConfigIncludesAreNotSupported(t *testing.T) {
+	dir, _ := testGitRepo(t)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".gitconfig"), []byte("[includeIf \"gitdir:~/work/\"]\n\tpath = work.gitconfig\n"), 0644))
+	repo, err := openGitRepo(dir)
+	require.NoError(t, err)
+	_, err = repo.Config()
+	assert.Error(t, err)
+}
@@ -0,0 +1,266 @@
+package scm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// An ignorePattern is a single pattern from a .gitignore or exclude file.
+type ignorePattern struct {
+	re *regexp.Regexp
+	// base is the directory the pattern applies within, relative to the repo root with a trailing slash.
+	base     string
+	negate   bool
+	dirOnly  bool
+	anchored bool // Patterns containing a slash match the whole path under base, others just the last component.
+}
+
+// matches returns true if this pattern matches the given path, which is relative to the repo root.
+func (p *ignorePattern) matches(path string, isDir bool) bool {
+	if (p.dirOnly && !isDir) || !strings.HasPrefix(path, p.base) {
+		return false
+	}
+	path = path[len(p.base):]
+	if !p.anchored {
+		path = path[strings.LastIndexByte(path, '/')+1:]
+	}
+	return p.re.MatchString(path)
+}
+
+// isIgnored returns true if the given path is ignored by a set of patterns, which are in increasing order of precedence.
+func isIgnored(patterns []ignorePattern, path string, isDir bool) bool {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if patterns[i].matches(path, isDir) {
+			return !patterns[i].negate
+		}
+	}
+	return false
+}
+
+// readIgnoreFile reads the patterns from an ignore file. It's not an error for the file not to exist.
+func readIgnoreFile(filename, base string, foldCase bool) ([]ignorePattern, error) {
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var patterns []ignorePattern
+	for _, line := range strings.Split(string(b), "\n") {
+		p, err := parseIgnorePattern(strings.TrimSuffix(line, "\r"), base, foldCase)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		} else if p.re != nil {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, nil
+}
+
+// parseIgnorePattern parses a single line of an ignore file. The returned pattern is empty if the line is blank or a comment.
+func parseIgnorePattern(line, base string, foldCase bool) (ignorePattern, error) {
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	p := ignorePattern{base: base}
+	if line == "" || line[0] == '#' {
+		return p, nil
+	} else if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, nil
+	}
+	if strings.Contains(line, "[:") {
+		return p, fmt.Errorf("character classes aren't supported: %s", line)
+	}
+	p.anchored = strings.Contains(line, "/")
+	re := "^" + ignoreRegex(strings.TrimPrefix(line, "/")) + "$"
+	if foldCase {
+		re = "(?i)" + re
+	}
+	compiled, err := regexp.Compile(re)
+	if err != nil {
+		return p, fmt.Errorf("unsupported pattern %s: %w", line, err)
+	}
+	p.re = compiled
+	return p, nil
+}
+
+// ignoreRegex converts a gitignore glob into the equivalent regular expression.
+func ignoreRegex(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			// ** only matches across directories when it's a whole path component.
+			if strings.HasPrefix(pattern[i:], "**") && (i == 0 || pattern[i-1] == '/') && (i+2 == len(pattern) || pattern[i+2] == '/') {
+				if i+2 == len(pattern) {
+					b.WriteString(".*")
+					i++
+				} else {
+					b.WriteString("(?:.*/)?")
+					i += 2
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == 0 || (end == 1 && pattern[i+1] == '!') {
+				// A ] immediately after the opening bracket is part of the class.
+				if next := strings.IndexByte(pattern[i+end+2:], ']'); next != -1 {
+					end += next + 1
+				} else {
+					end = -1
+				}
+			}
+			if end == -1 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			b.WriteByte('[')
+			if strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^") {
+				b.WriteByte('^')
+				class = class[1:]
+			}
+			for j := 0; j < len(class); j++ {
+				if class[j] == '\\' && j+1 < len(class) {
+					j++
+				}
+				if class[j] == '\\' || class[j] == ']' || class[j] == '[' {
+					b.WriteByte('\\')
+				}
+				b.WriteByte(class[j])
+			}
+			b.WriteByte(']')
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// UntrackedFiles returns the files in the working tree that are neither in the index nor ignored, i.e. the equivalent
+// of `git ls-files --other --exclude-standard`. Paths are relative to the repo root; untracked nested repos are
+// listed as a single directory, as git does. If limit is positive it stops once it has found that many.
+func (r *gitRepo) UntrackedFiles(repoRoot string, limit int) ([]string, error) {
+	index, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	config, err := r.Config()
+	if err != nil {
+		return nil, err
+	}
+	w := &untrackedWalker{
+		root:     repoRoot,
+		tracked:  make(map[string]bool, len(index.Entries)),
+		foldCase: configBool(config, "ignorecase", false),
+		limit:    limit,
+	}
+	for _, entry := range index.Entries {
+		w.tracked[w.key(entry.Path)] = true
+	}
+	// These have lower precedence than any .gitignore file in the tree.
+	var patterns []ignorePattern
+	for _, filename := range []string{excludesFile(config), filepath.Join(r.commonDir, "info/exclude")} {
+		if filename == "" {
+			continue
+		}
+		p, err := readIgnoreFile(filename, "", w.foldCase)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p...)
+	}
+	if err := w.walk("", patterns); err != nil {
+		return nil, err
+	}
+	return w.files, nil
+}
+
+// excludesFile returns the user's global ignore file.
+func excludesFile(config map[string]string) string {
+	home, _ := os.UserHomeDir()
+	if filename := config["excludesfile"]; filename != "" {
+		if strings.HasPrefix(filename, "~/") && home != "" {
+			return filepath.Join(home, filename[2:])
+		}
+		return filename
+	} else if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "git/ignore")
+	} else if home != "" {
+		return filepath.Join(home, ".config/git/ignore")
+	}
+	return ""
+}
+
+// An untrackedWalker walks the working tree looking for untracked files.
+type untrackedWalker struct {
+	root     string
+	tracked  map[string]bool
+	foldCase bool
+	limit    int
+	files    []string
+}
+
+func (w *untrackedWalker) key(path string) string {
+	if w.foldCase {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// walk walks a single directory, which is relative to the repo root and either empty or ends in a slash.
+// Ignored directories aren't descended into, since nothing in them can be untracked.
+func (w *untrackedWalker) walk(dir string, patterns []ignorePattern) error {
+	gitignore, err := readIgnoreFile(filepath.Join(w.root, dir, ".gitignore"), dir, w.foldCase)
+	if err != nil {
+		return err
+	}
+	// Make sure we don't write into our parent's slice.
+	patterns = append(patterns[:len(patterns):len(patterns)], gitignore...)
+	entries, err := os.ReadDir(filepath.Join(w.root, dir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == ".git" {
+			continue
+		}
+		path := dir + entry.Name()
+		if entry.IsDir() {
+			if w.tracked[w.key(path)] || isIgnored(patterns, path, true) {
+				continue // A submodule, or ignored.
+			} else if _, err := os.Lstat(filepath.Join(w.root, path, ".git")); err == nil {
+				w.files = append(w.files, path+"/")
+			} else if err := w.walk(path+"/", patterns); err != nil {
+				return err
+			}
+		} else if !w.tracked[w.key(path)] && !isIgnored(patterns, path, false) {
+			w.files = append(w.files, path)
+		}
+		if w.limit > 0 && len(w.files) >= w.limit {
+			return nil
+		}
+	}
+	return nil
+}
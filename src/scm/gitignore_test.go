@@ -0,0 +1,111 @@
+package scm
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		isDir         bool
+		expected      bool
+	}{
+		{"*.o", "a.o", false, true},
+		{"*.o", "pkg/sub/a.o", false, true},
+		{"*.o", "a.out", false, false},
+		{"/a.o", "pkg/a.o", false, false},
+		{"pkg/*.o", "pkg/a.o", false, true},
+		{"pkg/*.o", "pkg/sub/a.o", false, false},
+		{"out/", "out", true, true},
+		{"out/", "out", false, false},
+		{"**/out", "pkg/sub/out", true, true},
+		{"pkg/**", "pkg/sub/a.o", false, true},
+		{"pkg/**", "pkg", true, false},
+		{"pkg/**/a.o", "pkg/a.o", false, true},
+		{"pkg/**/a.o", "pkg/x/y/a.o", false, true},
+		{"a?c", "abc", false, true},
+		{"a?c", "a/c", false, false},
+		{"[ab].txt", "b.txt", false, true},
+		{"[!ab].txt", "b.txt", false, false},
+		{"[!ab].txt", "c.txt", false, true},
+		{"\\#hash", "#hash", false, true},
+		{"trailing   ", "trailing", false, true},
+		{"a.(b)+", "a.(b)+", false, true},
+	} {
+		p, err := parseIgnorePattern(test.pattern, "", false)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, p.matches(test.path, test.isDir), "%s matching %s", test.pattern, test.path)
+	}
+}
+
+func TestIgnorePatternsNested(t *testing.T) {
+	root, err := parseIgnorePattern("*.log", "", false)
+	require.NoError(t, err)
+	nested, err := parseIgnorePattern("!keep.log", "pkg/", false)
+	require.NoError(t, err)
+	patterns := []ignorePattern{root, nested}
+	assert.True(t, isIgnored(patterns, "a.log", false))
+	assert.True(t, isIgnored(patterns, "keep.log", false))
+	assert.False(t, isIgnored(patterns, "pkg/keep.log", false))
+	assert.True(t, isIgnored(patterns, "pkg/other.log", false))
+}
+
+func TestNativeUntrackedFiles(t *testing.T) {
+	dir, run := testGitRepo(t)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	write := func(name, contents string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+	write(".gitignore", "*.log\n/plz-out\nbuild/\n")
+	write("pkg/.gitignore", "!keep.log\n*.tmp\n")
+	write(".git/info/exclude", "excluded.txt\n")
+	write(".config/git/ignore", "global.txt\n")
+	for _, name := range []string{"a.log", "pkg/keep.log", "pkg/sub/other.log", "plz-out/bin/x", "pkg/plz-out/x", "build/x", "pkg/sub/build/y",
+		"x.tmp", "pkg/x.tmp", "excluded.txt", "pkg/excluded.txt", "global.txt", "untracked.txt", "pkg/sub/untracked.txt"} {
+		write(name, name+"\n")
+	}
+	run("add", ".gitignore")
+	run("init", "-q", "nested")
+
+	repo, err := openGitRepo(dir)
+	require.NoError(t, err)
+	files, err := repo.UntrackedFiles(dir, 0)
+	require.NoError(t, err)
+	sort.Strings(files)
+	assert.Equal(t, strings.Split(run("ls-files", "--other", "--exclude-standard"), "\n"), files)
+
+	files, err = repo.UntrackedFiles(dir, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	g := &git{repoRoot: dir}
+	clean, err := g.IsClean()
+	require.NoError(t, err)
+	assert.False(t, clean)
+}
+
+func TestNativeIsCleanIgnoresIgnoredFiles(t *testing.T) {
+	dir, run := testGitRepo(t)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("plz-out\n"), 0644))
+	run("add", ".gitignore")
+	run("commit", "-q", "-m", "Ignore plz-out")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "plz-out/bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plz-out/bin/x"), nil, 0644))
+	g := &git{repoRoot: dir}
+	clean, err := g.IsClean()
+	require.NoError(t, err)
+	assert.True(t, clean)
+}
@@ -0,0 +1,742 @@
+package scm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/heap"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// gitRepo reads objects and refs directly from a git repository's metadata, which avoids forking
+// the git CLI for the common read-only operations we need.
+// It only supports the commonly used subset of git's storage formats; anything else (e.g. SHA-256 repos,
+// reftables or alternates) returns an error and callers are expected to fall back to the CLI.
+type gitRepo struct {
+	// gitDir is the per-worktree directory holding HEAD and the index.
+	gitDir string
+	// commonDir holds objects & refs; it's the same as gitDir except for linked worktrees.
+	commonDir string
+
+	packsOnce sync.Once
+	packs     []*gitPack
+	packsErr  error
+
+	configOnce sync.Once
+	config     map[string]string
+	configErr  error
+
+	mutex   sync.Mutex
+	commits map[string]*gitCommit
+}
+
+// A gitCommit is a parsed commit object.
+type gitCommit struct {
+	Hash      string
+	Tree      string
+	Parents   []string
+	Author    gitSignature
+	Committer gitSignature
+	Encoding  string
+	Message   string
+}
+
+// A gitSignature is the author or committer of a commit.
+type gitSignature struct {
+	Name  string
+	Email string
+	Time  time.Time
+}
+
+// A gitTreeEntry is a single entry in a (flattened) tree.
+type gitTreeEntry struct {
+	Mode uint32
+	Hash string
+}
+
+// Modes used in trees & the index.
+const (
+	gitModeDir     = 0040000
+	gitModeFile    = 0100644
+	gitModeExec    = 0100755
+	gitModeSymlink = 0120000
+	gitModeGitlink = 0160000
+)
+
+// openGitRepo opens the git repository at the given root.
+func openGitRepo(repoRoot string) (*gitRepo, error) {
+	gitDir := filepath.Join(repoRoot, ".git")
+	info, err := os.Stat(gitDir)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		// This is a linked worktree or submodule, where .git is a file pointing to the real location.
+		b, err := os.ReadFile(gitDir)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(s, "gitdir: ") {
+			return nil, fmt.Errorf("unknown .git file format: %s", s)
+		}
+		gitDir = absPath(repoRoot, strings.TrimPrefix(s, "gitdir: "))
+	}
+	repo := &gitRepo{gitDir: gitDir, commonDir: gitDir, commits: map[string]*gitCommit{}}
+	if b, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		repo.commonDir = absPath(gitDir, strings.TrimSpace(string(b)))
+	}
+	config, err := os.ReadFile(filepath.Join(repo.commonDir, "config"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(config), "\n") {
+		line = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(line), " ", ""))
+		if line == "objectformat=sha256" || line == "refstorage=reftable" {
+			return nil, fmt.Errorf("unsupported repository format: %s", line)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(repo.commonDir, "objects/info/alternates")); err == nil {
+		return nil, fmt.Errorf("repositories with alternates are not supported")
+	}
+	return repo, nil
+}
+
+func absPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(dir, path)
+}
+
+// Head returns the ref that HEAD points to (or the empty string if it's detached) and the commit it resolves to.
+func (r *gitRepo) Head() (ref, hash string, err error) {
+	b, err := os.ReadFile(filepath.Join(r.gitDir, "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+	s := strings.TrimSpace(string(b))
+	if strings.HasPrefix(s, "ref: ") {
+		ref = strings.TrimPrefix(s, "ref: ")
+		hash, err = r.readRef(ref, 0)
+		return ref, hash, err
+	} else if !isHash(s) {
+		return "", "", fmt.Errorf("invalid HEAD: %s", s)
+	}
+	return "", s, nil
+}
+
+// Resolve resolves a revision to a commit hash. Only full hashes and ref names are supported; anything
+// more complex (abbreviated hashes, ~ and ^ suffixes, reflog entries etc) returns an error.
+func (r *gitRepo) Resolve(rev string) (string, error) {
+	hash, err := r.resolveName(rev)
+	if err != nil {
+		return "", err
+	}
+	// Peel any annotated tags.
+	for i := 0; i < 10; i++ {
+		kind, data, err := r.ReadObject(hash)
+		if err != nil {
+			return "", err
+		} else if kind == "commit" {
+			return hash, nil
+		} else if kind != "tag" || !bytes.HasPrefix(data, []byte("object ")) {
+			return "", fmt.Errorf("%s does not refer to a commit", rev)
+		}
+		hash = string(data[7:bytes.IndexByte(data, '\n')])
+	}
+	return "", fmt.Errorf("too many levels of tags for %s", rev)
+}
+
+func (r *gitRepo) resolveName(rev string) (string, error) {
+	if isHash(rev) {
+		return rev, nil
+	} else if rev == "HEAD" {
+		_, hash, err := r.Head()
+		return hash, err
+	}
+	// This is the same order that git uses to disambiguate ref names.
+	for _, pattern := range []string{"%s", "refs/%s", "refs/tags/%s", "refs/heads/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"} {
+		if hash, err := r.readRef(fmt.Sprintf(pattern, rev), 0); err == nil {
+			return hash, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("cannot resolve %s", rev)
+}
+
+// readRef reads a single fully-qualified ref, following symbolic refs.
+// It returns an error satisfying os.IsNotExist if the ref doesn't exist.
+func (r *gitRepo) readRef(name string, depth int) (string, error) {
+	if depth > 5 {
+		return "", fmt.Errorf("too many levels of symbolic refs for %s", name)
+	} else if strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid ref name %s", name)
+	}
+	dir := r.commonDir
+	if !strings.HasPrefix(name, "refs/") || strings.HasPrefix(name, "refs/bisect/") {
+		dir = r.gitDir // Pseudo-refs like HEAD are per-worktree.
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+		s := strings.TrimSpace(string(b))
+		if strings.HasPrefix(s, "ref: ") {
+			return r.readRef(strings.TrimPrefix(s, "ref: "), depth+1)
+		} else if !isHash(s) {
+			return "", fmt.Errorf("invalid ref %s: %s", name, s)
+		}
+		return s, nil
+	} else if !os.IsNotExist(err) && !errors.Is(err, syscall.EISDIR) {
+		return "", err
+	}
+	f, err := os.Open(filepath.Join(r.commonDir, "packed-refs"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if hash, ref, found := strings.Cut(scanner.Text(), " "); found && ref == name {
+			return hash, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", os.ErrNotExist
+}
+
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// ReadObject reads an object from the repo, returning its type and contents.
+func (r *gitRepo) ReadObject(hash string) (string, []byte, error) {
+	if !isHash(hash) {
+		return "", nil, fmt.Errorf("invalid object name %s", hash)
+	}
+	if kind, data, err := r.readLooseObject(hash); err == nil {
+		return kind, data, nil
+	} else if !os.IsNotExist(err) {
+		return "", nil, err
+	}
+	if err := r.loadPacks(); err != nil {
+		return "", nil, err
+	}
+	b, _ := hex.DecodeString(hash)
+	for _, pack := range r.packs {
+		if offset, present := pack.Find(b); present {
+			return pack.Read(r, offset)
+		}
+	}
+	return "", nil, fmt.Errorf("object %s not found", hash)
+}
+
+func (r *gitRepo) readLooseObject(hash string) (string, []byte, error) {
+	f, err := os.Open(filepath.Join(r.commonDir, "objects", hash[:2], hash[2:]))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	zr, err := zlib.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		return "", nil, err
+	}
+	header, data, found := bytes.Cut(b, []byte{0})
+	if !found {
+		return "", nil, fmt.Errorf("invalid object header for %s", hash)
+	}
+	kind, size, _ := strings.Cut(string(header), " ")
+	if n, err := strconv.Atoi(size); err != nil || n != len(data) {
+		return "", nil, fmt.Errorf("invalid object size for %s", hash)
+	}
+	return kind, data, nil
+}
+
+func (r *gitRepo) loadPacks() error {
+	r.packsOnce.Do(func() {
+		matches, err := filepath.Glob(filepath.Join(r.commonDir, "objects/pack/*.idx"))
+		if err != nil {
+			r.packsErr = err
+			return
+		}
+		for _, match := range matches {
+			pack, err := openGitPack(match)
+			if err != nil {
+				r.packsErr = err
+				return
+			}
+			r.packs = append(r.packs, pack)
+		}
+	})
+	return r.packsErr
+}
+
+// Commit reads and parses a commit object.
+func (r *gitRepo) Commit(hash string) (*gitCommit, error) {
+	r.mutex.Lock()
+	commit, present := r.commits[hash]
+	r.mutex.Unlock()
+	if present {
+		return commit, nil
+	}
+	kind, data, err := r.ReadObject(hash)
+	if err != nil {
+		return nil, err
+	} else if kind != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", hash, kind)
+	}
+	commit, err = parseCommit(hash, data)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commits[hash] = commit
+	return commit, nil
+}
+
+func parseCommit(hash string, data []byte) (*gitCommit, error) {
+	commit := &gitCommit{Hash: hash}
+	header, message, _ := bytes.Cut(data, []byte("\n\n"))
+	commit.Message = string(message)
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			commit.Author, err = parseSignature(value)
+		case "committer":
+			commit.Committer, err = parseSignature(value)
+		case "encoding":
+			commit.Encoding = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit %s: %s", hash, err)
+		}
+	}
+	if commit.Tree == "" {
+		return nil, fmt.Errorf("invalid commit %s: no tree", hash)
+	}
+	return commit, nil
+}
+
+// parseSignature parses a signature line, which looks like `Name <email> 1700000000 +0100`.
+func parseSignature(s string) (gitSignature, error) {
+	start := strings.LastIndexByte(s, '<')
+	end := strings.LastIndexByte(s, '>')
+	if start == -1 || end < start {
+		return gitSignature{}, fmt.Errorf("invalid signature %s", s)
+	}
+	sig := gitSignature{Name: strings.TrimSpace(s[:start]), Email: s[start+1 : end]}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) != 2 {
+		return gitSignature{}, fmt.Errorf("invalid signature %s", s)
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return gitSignature{}, err
+	}
+	tz, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return gitSignature{}, err
+	}
+	offset := (tz/100*60 + tz%100) * 60
+	sig.Time = time.Unix(timestamp, 0).In(time.FixedZone("", offset))
+	return sig, nil
+}
+
+// FlattenTree returns all the non-tree entries in a tree, recursively, keyed by their path.
+func (r *gitRepo) FlattenTree(hash string) (map[string]gitTreeEntry, error) {
+	entries := map[string]gitTreeEntry{}
+	return entries, r.flattenTree(hash, "", entries)
+}
+
+func (r *gitRepo) flattenTree(hash, prefix string, entries map[string]gitTreeEntry) error {
+	kind, data, err := r.ReadObject(hash)
+	if err != nil {
+		return err
+	} else if kind != "tree" {
+		return fmt.Errorf("%s is a %s, not a tree", hash, kind)
+	}
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		null := bytes.IndexByte(data, 0)
+		if space == -1 || null < space || len(data) < null+21 {
+			return fmt.Errorf("invalid tree %s", hash)
+		}
+		mode, err := strconv.ParseUint(string(data[:space]), 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid tree %s: %s", hash, err)
+		}
+		name := prefix + string(data[space+1:null])
+		entryHash := hex.EncodeToString(data[null+1 : null+21])
+		data = data[null+21:]
+		if mode == gitModeDir {
+			if err := r.flattenTree(entryHash, name+"/", entries); err != nil {
+				return err
+			}
+		} else {
+			entries[name] = gitTreeEntry{Mode: uint32(mode), Hash: entryHash}
+		}
+	}
+	return nil
+}
+
+// CommitFiles returns the flattened tree of the given commit.
+func (r *gitRepo) CommitFiles(hash string) (map[string]gitTreeEntry, error) {
+	commit, err := r.Commit(hash)
+	if err != nil {
+		return nil, err
+	}
+	return r.FlattenTree(commit.Tree)
+}
+
+// diffTrees returns the paths that differ between two flattened trees, in sorted order.
+func diffTrees(a, b map[string]gitTreeEntry) []string {
+	var paths []string
+	for path, entry := range a {
+		if other, present := b[path]; !present || other != entry {
+			paths = append(paths, path)
+		}
+	}
+	for path := range b {
+		if _, present := a[path]; !present {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// MergeBase returns the best common ancestor of two commits.
+// If there are multiple equally good candidates it returns an error, since it's not obvious which to pick.
+func (r *gitRepo) MergeBase(a, b string) (string, error) {
+	if a == b {
+		return a, nil
+	}
+	// This is the same "painting" algorithm that git uses; we walk back from both commits in date order
+	// marking everything we find as reachable from either side, until the only commits left to visit
+	// are ancestors of something already reachable from both.
+	const (
+		fromA = 1 << iota
+		fromB
+		stale
+		result
+	)
+	flags := map[string]int{a: fromA, b: fromB}
+	queue := &commitQueue{}
+	push := func(hash string) error {
+		commit, err := r.Commit(hash)
+		if err != nil {
+			return err
+		}
+		heap.Push(queue, commit)
+		return nil
+	}
+	if err := push(a); err != nil {
+		return "", err
+	} else if err := push(b); err != nil {
+		return "", err
+	}
+	var results []string
+	for queue.Len() > 0 && !queue.allStale(flags, stale) {
+		commit := heap.Pop(queue).(*gitCommit)
+		f := flags[commit.Hash] & (fromA | fromB | stale)
+		if f == fromA|fromB {
+			if flags[commit.Hash]&result == 0 {
+				flags[commit.Hash] |= result
+				results = append(results, commit.Hash)
+			}
+			f |= stale
+		}
+		for _, parent := range commit.Parents {
+			if flags[parent]&f == f {
+				continue
+			}
+			flags[parent] |= f
+			if err := push(parent); err != nil {
+				return "", err
+			}
+		}
+	}
+	if len(results) == 0 {
+		return "", fmt.Errorf("no merge base between %s and %s", a, b)
+	} else if len(results) != 1 {
+		return "", fmt.Errorf("multiple merge bases between %s and %s", a, b)
+	}
+	return results[0], nil
+}
+
+// A commitQueue is a priority queue of commits, most recent first.
+type commitQueue []*gitCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.Time.After(q[j].Committer.Time)
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(*gitCommit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+func (q commitQueue) allStale(flags map[string]int, stale int) bool {
+	for _, commit := range q {
+		if flags[commit.Hash]&stale == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A gitPack is a single packfile and its index.
+type gitPack struct {
+	idx   []byte
+	count int
+	file  *os.File
+	mutex sync.Mutex
+	bases map[int64]packObject
+}
+
+// A packObject is a decoded object from a packfile.
+type packObject struct {
+	Kind string
+	Data []byte
+}
+
+// Types of objects within a packfile.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packKinds = map[int]string{packCommit: "commit", packTree: "tree", packBlob: "blob", packTag: "tag"}
+
+// maxCachedBases is the number of delta bases we retain per pack.
+const maxCachedBases = 256
+
+func openGitPack(idxFile string) (*gitPack, error) {
+	idx, err := os.ReadFile(idxFile)
+	if err != nil {
+		return nil, err
+	} else if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], []byte{0xff, 't', 'O', 'c'}) || binary.BigEndian.Uint32(idx[4:]) != 2 {
+		return nil, fmt.Errorf("unsupported pack index format in %s", idxFile)
+	}
+	count := int(binary.BigEndian.Uint32(idx[8+255*4:]))
+	if len(idx) < 8+256*4+count*(20+4+4) {
+		return nil, fmt.Errorf("truncated pack index %s", idxFile)
+	}
+	f, err := os.Open(strings.TrimSuffix(idxFile, ".idx") + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	return &gitPack{idx: idx, count: count, file: f, bases: map[int64]packObject{}}, nil
+}
+
+// Find returns the offset of an object within the pack, if it's present.
+func (p *gitPack) Find(hash []byte) (int64, bool) {
+	const fanout = 8
+	names := fanout + 256*4
+	lo := 0
+	if hash[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(p.idx[fanout+(int(hash[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(p.idx[fanout+int(hash[0])*4:]))
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.idx[names+(lo+i)*20:names+(lo+i+1)*20], hash) >= 0
+	})
+	if i >= hi || !bytes.Equal(p.idx[names+i*20:names+(i+1)*20], hash) {
+		return 0, false
+	}
+	offsets := names + p.count*(20+4)
+	offset := binary.BigEndian.Uint32(p.idx[offsets+i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset), true
+	}
+	// This is an index into the table of 64-bit offsets for large packs.
+	large := offsets + p.count*4 + int(offset&0x7fffffff)*8
+	if large+8 > len(p.idx) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p.idx[large:])), true
+}
+
+// Read reads the object at the given offset in the pack, resolving any deltas.
+func (p *gitPack) Read(repo *gitRepo, offset int64) (string, []byte, error) {
+	p.mutex.Lock()
+	obj, present := p.bases[offset]
+	p.mutex.Unlock()
+	if present {
+		return obj.Kind, obj.Data, nil
+	}
+	var header [32]byte
+	n, err := p.file.ReadAt(header[:], offset)
+	if err != nil && (err != io.EOF || n == 0) {
+		return "", nil, err
+	}
+	c := header[0]
+	kind := int(c>>4) & 7
+	size := int(c & 0x0f)
+	pos := 1
+	for shift := 4; c&0x80 != 0 && pos < n; shift += 7 {
+		c = header[pos]
+		size |= int(c&0x7f) << shift
+		pos++
+	}
+	var base packObject
+	switch kind {
+	case packOfsDelta:
+		c = header[pos]
+		pos++
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 && pos < n {
+			c = header[pos]
+			pos++
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		if base.Kind, base.Data, err = p.Read(repo, offset-rel); err != nil {
+			return "", nil, err
+		}
+	case packRefDelta:
+		if pos+20 > n {
+			return "", nil, fmt.Errorf("truncated pack entry at %d", offset)
+		}
+		if base.Kind, base.Data, err = repo.ReadObject(hex.EncodeToString(header[pos : pos+20])); err != nil {
+			return "", nil, err
+		}
+		pos += 20
+	default:
+		if _, present := packKinds[kind]; !present {
+			return "", nil, fmt.Errorf("unknown pack object type %d at %d", kind, offset)
+		}
+	}
+	zr, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(p.file, offset+int64(pos), 1<<62)))
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return "", nil, err
+	}
+	if kind != packOfsDelta && kind != packRefDelta {
+		return packKinds[kind], data, nil
+	}
+	data, err = applyDelta(base.Data, data)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid delta at %d: %s", offset, err)
+	}
+	// Cache this since anything that's a delta is likely to be the base of another delta.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.bases) >= maxCachedBases {
+		p.bases = map[int64]packObject{}
+	}
+	p.bases[offset] = packObject{Kind: base.Kind, Data: data}
+	return base.Kind, data, nil
+}
+
+// applyDelta applies a git delta to a base object.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	varint := func() (int, error) {
+		v := 0
+		for shift := 0; len(delta) > 0; shift += 7 {
+			c := delta[0]
+			delta = delta[1:]
+			v |= int(c&0x7f) << shift
+			if c&0x80 == 0 {
+				return v, nil
+			}
+		}
+		return 0, fmt.Errorf("truncated delta header")
+	}
+	srcSize, err := varint()
+	if err != nil {
+		return nil, err
+	} else if srcSize != len(base) {
+		return nil, fmt.Errorf("base size mismatch: %d != %d", srcSize, len(base))
+	}
+	dstSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 != 0 {
+			// Copy from the base object. The low bits say which bytes of the offset & size are present.
+			var offset, size int
+			for i := 0; i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("truncated copy instruction")
+					}
+					offset |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("truncated copy instruction")
+					}
+					size |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > len(base) {
+				return nil, fmt.Errorf("copy out of range")
+			}
+			out = append(out, base[offset:offset+size]...)
+		} else if op != 0 {
+			// Insert the next op bytes literally.
+			if int(op) > len(delta) {
+				return nil, fmt.Errorf("truncated insert instruction")
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		} else {
+			return nil, fmt.Errorf("invalid delta opcode 0")
+		}
+	}
+	if len(out) != dstSize {
+		return nil, fmt.Errorf("result size mismatch: %d != %d", len(out), dstSize)
+	}
+	return out, nil
+}
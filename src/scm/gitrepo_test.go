@@ -0,0 +1,197 @@
+package scm
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testGitRepo creates a git repo in a temporary directory with a little bit of history.
+func testGitRepo(t *testing.T) (string, func(args ...string) string) {
+	dir := t.TempDir()
+	run := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=Author Name",
+			"GIT_AUTHOR_EMAIL=author@example.com",
+			"GIT_AUTHOR_DATE=2023-11-14T22:13:20+0100",
+			"GIT_COMMITTER_NAME=Committer Name",
+			"GIT_COMMITTER_EMAIL=committer@example.com",
+			"GIT_COMMITTER_DATE=2023-11-15T10:00:00-0500",
+			"GIT_CONFIG_NOSYSTEM=1",
+			"HOME="+dir,
+		)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "git %s failed: %s", strings.Join(args, " "), out)
+		return strings.TrimSpace(string(out))
+	}
+	write := func(name, contents string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+	run("init", "-q", "-b", "main")
+	write("a.txt", strings.Repeat("line\n", 100))
+	write("pkg/b.txt", "b\n")
+	write("pkg/sub/c.txt", "c\n")
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(dir, "link")))
+	run("add", "-A")
+	run("commit", "-q", "-m", "Initial commit\n\nWith a body.")
+	run("tag", "-a", "v1", "-m", "version 1")
+	run("checkout", "-q", "-b", "feature")
+	write("a.txt", strings.Repeat("line\n", 100)+"more\n")
+	write("pkg/d.txt", "d\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "Feature commit\nthat wraps")
+	run("checkout", "-q", "main")
+	require.NoError(t, os.Remove(filepath.Join(dir, "pkg/b.txt")))
+	write("e.txt", "e\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "Main commit")
+	return dir, run
+}
+
+func TestNativeGitRepo(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		name := "loose"
+		if packed {
+			name = "packed"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir, run := testGitRepo(t)
+			if packed {
+				run("gc", "-q", "--aggressive")
+				matches, _ := filepath.Glob(filepath.Join(dir, ".git/objects/pack/*.pack"))
+				require.NotEmpty(t, matches)
+			}
+			repo, err := openGitRepo(dir)
+			require.NoError(t, err)
+
+			ref, head, err := repo.Head()
+			require.NoError(t, err)
+			assert.Equal(t, "refs/heads/main", ref)
+			assert.Equal(t, run("rev-parse", "HEAD"), head)
+
+			for _, rev := range []string{"v1", "feature", "main", "HEAD", head} {
+				hash, err := repo.Resolve(rev)
+				assert.NoError(t, err)
+				assert.Equal(t, run("rev-parse", rev+"^{commit}"), hash, rev)
+			}
+			_, err = repo.Resolve("HEAD~1")
+			assert.Error(t, err)
+
+			for _, rev := range []string{"main", "feature", "v1"} {
+				hash, _ := repo.Resolve(rev)
+				files, err := repo.CommitFiles(hash)
+				require.NoError(t, err)
+				expected := map[string]gitTreeEntry{}
+				for _, line := range strings.Split(run("ls-tree", "-r", rev), "\n") {
+					fields := strings.Fields(line)
+					mode := uint32(gitModeFile)
+					if fields[0] == "120000" {
+						mode = gitModeSymlink
+					}
+					expected[fields[3]] = gitTreeEntry{Mode: mode, Hash: fields[2]}
+				}
+				assert.Equal(t, expected, files, rev)
+			}
+
+			kind, data, err := repo.ReadObject(run("rev-parse", "feature:a.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "blob", kind)
+			assert.Equal(t, strings.Repeat("line\n", 100)+"more\n", string(data))
+
+			feature, _ := repo.Resolve("feature")
+			base, err := repo.MergeBase(head, feature)
+			require.NoError(t, err)
+			assert.Equal(t, run("merge-base", "main", "feature"), base)
+
+			commit, err := repo.Commit(feature)
+			require.NoError(t, err)
+			for _, format := range []string{"%H", "%T", "%P", "%an", "%ae", "%at", "%cn", "%ce", "%ct", "%ci", "%cI", "%cs", "%s", "%b", "%B"} {
+				s, ok := formatCommit(commit, format)
+				assert.True(t, ok)
+				assert.Equal(t, run("show", "-s", "--format="+format, "feature"), strings.TrimSpace(s), format)
+			}
+		})
+	}
+}
+
+func TestNativeChangesIn(t *testing.T) {
+	dir, run := testGitRepo(t)
+	g := &git{repoRoot: dir}
+	for _, rev := range []string{"main", "feature"} {
+		files, err := g.changesInNative(rev)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Split(run("diff-tree", "--no-commit-id", "--name-only", "-r", rev), "\n"), files)
+	}
+	// Root commits aren't handled natively.
+	_, err := g.changesInNative("v1")
+	assert.Error(t, err)
+}
+
+func TestNativeChangedFiles(t *testing.T) {
+	dir, run := testGitRepo(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pkg/sub/new.txt"), []byte("new\n"), 0644))
+	run("add", "pkg/sub/new.txt")
+	require.NoError(t, os.Remove(filepath.Join(dir, "pkg/sub/c.txt")))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "e.txt"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "untracked.txt"), []byte("untracked\n"), 0644))
+	g := &git{repoRoot: dir}
+
+	for _, version := range []string{"2", "3", "4"} {
+		run("update-index", "--index-version", version)
+		files, err := g.changedFilesNative("", dir)
+		require.NoError(t, err)
+		sort.Strings(files)
+		assert.Equal(t, strings.Split(run("diff", "--name-only", "HEAD"), "\n"), files, "index version %s", version)
+
+		files, err = g.changedFilesNative("", filepath.Join(dir, "pkg"))
+		require.NoError(t, err)
+		sort.Strings(files)
+		assert.Equal(t, strings.Split(run("diff", "--name-only", "HEAD", "--", "pkg"), "\n"), files)
+	}
+
+	files, err := g.changedFilesNative("feature", dir)
+	require.NoError(t, err)
+	expected := strings.Split(run("diff", "--name-only", "HEAD")+"\n"+run("diff", "--name-only", "feature...HEAD"), "\n")
+	assert.ElementsMatch(t, expected, files)
+}
+
+func TestNativeChangedFilesUnchanged(t *testing.T) {
+	dir, _ := testGitRepo(t)
+	g := &git{repoRoot: dir}
+	files, err := g.changedFilesNative("", dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	clean, err := g.IsClean()
+	require.NoError(t, err)
+	assert.True(t, clean)
+}
+
+func TestNativeChangedFilesRejectsFilters(t *testing.T) {
+	dir, run := testGitRepo(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".gitattributes"), []byte("*.bin filter=lfs diff=lfs merge=lfs -text\n"), 0644))
+	run("add", ".gitattributes")
+	g := &git{repoRoot: dir}
+	_, err := g.changedFilesNative("", dir)
+	assert.Error(t, err)
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world")
+	// Source size 11, target size 12, copy 6 bytes from offset 0, insert "there!"
+	delta := []byte{11, 12, 0x80 | 0x01 | 0x10, 0, 6, 6, 't', 'h', 'e', 'r', 'e', '!'}
+	out, err := applyDelta(base, delta)
+	require.NoError(t, err)
+	assert.Equal(t, "hello there!", string(out))
+	_, err = applyDelta(base, []byte{10, 12})
+	assert.Error(t, err)
+}
@@ -0,0 +1,302 @@
+package scm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A gitIndexEntry is a single entry in the index.
+type gitIndexEntry struct {
+	Path         string
+	Mode         uint32
+	Hash         string
+	Size         uint32
+	Mtime        time.Time
+	Stage        int
+	SkipWorktree bool
+}
+
+// A gitIndex is the parsed contents of the index.
+type gitIndex struct {
+	Entries []gitIndexEntry
+	// Mtime is the modification time of the index file itself, used to detect racily clean entries.
+	Mtime time.Time
+}
+
+// ReadIndex reads and parses the index file.
+func (r *gitRepo) ReadIndex() (*gitIndex, error) {
+	filename := filepath.Join(r.gitDir, "index")
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &gitIndex{}, nil // Nothing has ever been added to the repo.
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseIndex(b)
+	if err != nil {
+		return nil, err
+	}
+	index.Mtime = info.ModTime()
+	return index, nil
+}
+
+func parseIndex(b []byte) (*gitIndex, error) {
+	if len(b) < 12+sha1.Size || !bytes.Equal(b[:4], []byte("DIRC")) {
+		return nil, fmt.Errorf("invalid index file")
+	}
+	version := binary.BigEndian.Uint32(b[4:])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	count := int(binary.BigEndian.Uint32(b[8:]))
+	index := &gitIndex{Entries: make([]gitIndexEntry, 0, count)}
+	data := b[12 : len(b)-sha1.Size]
+	pos := 0
+	prevPath := ""
+	const fixedSize = 62
+	for i := 0; i < count; i++ {
+		if pos+fixedSize > len(data) {
+			return nil, fmt.Errorf("truncated index")
+		}
+		e := data[pos:]
+		flags := binary.BigEndian.Uint16(e[60:])
+		entry := gitIndexEntry{
+			Mtime: time.Unix(int64(binary.BigEndian.Uint32(e[8:])), int64(binary.BigEndian.Uint32(e[12:]))),
+			Mode:  binary.BigEndian.Uint32(e[24:]),
+			Size:  binary.BigEndian.Uint32(e[36:]),
+			Hash:  hex.EncodeToString(e[40:60]),
+			Stage: int(flags>>12) & 3,
+		}
+		n := fixedSize
+		if flags&0x4000 != 0 { // Extended flags, only present in v3+
+			if pos+n+2 > len(data) {
+				return nil, fmt.Errorf("truncated index")
+			}
+			extended := binary.BigEndian.Uint16(e[n:])
+			entry.SkipWorktree = extended&0x4000 != 0
+			n += 2
+		}
+		if version == 4 {
+			// Paths are prefix-compressed against the previous entry, and there's no padding.
+			strip, size := indexVarint(data[pos+n:])
+			if size == 0 || strip > len(prevPath) {
+				return nil, fmt.Errorf("invalid index path compression")
+			}
+			n += size
+			end := bytes.IndexByte(data[pos+n:], 0)
+			if end == -1 {
+				return nil, fmt.Errorf("truncated index")
+			}
+			entry.Path = prevPath[:len(prevPath)-strip] + string(data[pos+n:pos+n+end])
+			n += end + 1
+		} else {
+			end := bytes.IndexByte(data[pos+n:], 0)
+			if end == -1 {
+				return nil, fmt.Errorf("truncated index")
+			}
+			entry.Path = string(data[pos+n : pos+n+end])
+			// Entries are padded with 1-8 NULs to a multiple of 8 bytes.
+			n = (n + end + 8) &^ 7
+		}
+		if entry.Mode == gitModeDir {
+			return nil, fmt.Errorf("sparse indexes are not supported")
+		}
+		index.Entries = append(index.Entries, entry)
+		prevPath = entry.Path
+		pos += n
+	}
+	// Check the extensions for any that would mean the entries we've read are incomplete.
+	for pos+8 <= len(data) {
+		sig := string(data[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(data[pos+4:]))
+		if sig == "link" {
+			return nil, fmt.Errorf("split indexes are not supported")
+		}
+		pos += 8 + size
+	}
+	return index, nil
+}
+
+// indexVarint decodes a variable-length integer as used in v4 indexes, returning it and the number of bytes consumed.
+func indexVarint(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	c := b[0]
+	v := int(c & 0x7f)
+	i := 1
+	for c&0x80 != 0 {
+		if i >= len(b) {
+			return 0, 0
+		}
+		c = b[i]
+		i++
+		v = ((v + 1) << 7) | int(c&0x7f)
+	}
+	return v, i
+}
+
+// ChangedFiles returns the files that differ between the given commit and the working tree, i.e. the
+// equivalent of `git diff --name-only <commit>`. If commit is empty it's compared to an empty tree.
+// Untracked files are not considered.
+func (r *gitRepo) ChangedFiles(repoRoot, commit string) ([]string, error) {
+	index, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	config, err := r.Config()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkNoFilters(repoRoot, index, config); err != nil {
+		return nil, err
+	}
+	tree := map[string]gitTreeEntry{}
+	if commit != "" {
+		if tree, err = r.CommitFiles(commit); err != nil {
+			return nil, err
+		}
+	}
+	fileMode := configBool(config, "filemode", true)
+	changed := map[string]bool{}
+	seen := make(map[string]bool, len(index.Entries))
+	for _, entry := range index.Entries {
+		seen[entry.Path] = true
+		if entry.Stage != 0 {
+			changed[entry.Path] = true // Unmerged
+			continue
+		}
+		current, err := r.worktreeEntry(repoRoot, index, entry, fileMode)
+		if os.IsNotExist(err) {
+			changed[entry.Path] = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if committed, present := tree[entry.Path]; !present || committed != current {
+			changed[entry.Path] = true
+		}
+	}
+	for path := range tree {
+		if !seen[path] {
+			changed[path] = true // Removed from the index
+		}
+	}
+	files := make([]string, 0, len(changed))
+	for path := range changed {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// worktreeEntry returns the mode & hash of a file in the working tree.
+// It avoids hashing files whose stat info shows they haven't changed since they were added to the index.
+func (r *gitRepo) worktreeEntry(repoRoot string, index *gitIndex, entry gitIndexEntry, fileMode bool) (gitTreeEntry, error) {
+	indexed := gitTreeEntry{Mode: entry.Mode, Hash: entry.Hash}
+	if entry.SkipWorktree || entry.Mode == gitModeGitlink {
+		return indexed, nil
+	}
+	filename := filepath.Join(repoRoot, entry.Path)
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return gitTreeEntry{}, err
+	}
+	mode := uint32(gitModeFile)
+	if info.Mode()&os.ModeSymlink != 0 {
+		mode = gitModeSymlink
+	} else if !info.Mode().IsRegular() {
+		return gitTreeEntry{}, os.ErrNotExist // e.g. a file replaced with a directory
+	} else if !fileMode {
+		if entry.Mode == gitModeExec {
+			mode = gitModeExec
+		}
+	} else if info.Mode()&0100 != 0 {
+		mode = gitModeExec
+	}
+	// Entries modified at or after the index was written are "racily clean"; their stat info can't be trusted.
+	if mode == entry.Mode && uint32(info.Size()) == entry.Size && info.ModTime().Unix() == entry.Mtime.Unix() && info.ModTime().Before(index.Mtime.Truncate(time.Second)) {
+		return indexed, nil
+	}
+	hash, err := hashBlob(filename, info)
+	if err != nil {
+		return gitTreeEntry{}, err
+	}
+	return gitTreeEntry{Mode: mode, Hash: hash}, nil
+}
+
+// hashBlob returns the git object hash of a file in the working tree.
+func hashBlob(filename string, info os.FileInfo) (string, error) {
+	h := sha1.New()
+	if info.Mode()&os.ModeSymlink != 0 {
+		dest, err := os.Readlink(filename)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "blob %d\x00%s", len(dest), dest)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fmt.Fprintf(h, "blob %d\x00", info.Size())
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkNoFilters returns an error if any attributes or config are set that could make git transform files
+// on their way in or out of the working tree (e.g. line ending conversion or LFS), since that would make
+// the hashes of files in the working tree differ from the ones git would calculate.
+func (r *gitRepo) checkNoFilters(repoRoot string, index *gitIndex, config map[string]string) error {
+	if configBool(config, "autocrlf", false) { // This includes "input"
+		return fmt.Errorf("core.autocrlf is set")
+	}
+	attributes := []string{filepath.Join(r.commonDir, "info/attributes")}
+	for _, entry := range index.Entries {
+		if path.Base(entry.Path) == ".gitattributes" {
+			attributes = append(attributes, filepath.Join(repoRoot, entry.Path))
+		}
+	}
+	for _, filename := range attributes {
+		f, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			for _, field := range fields[1:] {
+				attr := strings.TrimLeft(field, "-!")
+				attr, _, _ = strings.Cut(attr, "=")
+				if attr == "filter" || attr == "text" || attr == "eol" || attr == "crlf" || attr == "ident" || attr == "working-tree-encoding" {
+					f.Close()
+					return fmt.Errorf("%s sets the %s attribute", filename, attr)
+				}
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package scm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const hgIgnoreFileName = ".hgignore"
+
+// hg implements operations on a Mercurial or Sapling repository.
+// Sapling's CLI is derived from Mercurial's so we can drive both the same way; the main difference
+// is that Sapling reads .gitignore files throughout the repo whereas Mercurial only has a single .hgignore.
+type hg struct {
+	repoRoot string
+	// tool is the binary to invoke, either hg or sl.
+	tool string
+}
+
+// run runs the tool with the given arguments and returns its stdout.
+func (h *hg) run(args ...string) ([]byte, error) {
+	cmd := exec.Command(h.tool, args...)
+	cmd.Dir = h.repoRoot
+	// HGPLAIN disables any user configuration that would change the output format (aliases, colour, etc).
+	cmd.Env = append(os.Environ(), "HGPLAIN=1")
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return out, fmt.Errorf("%s %s failed: %s\nOutput:\n%s", h.tool, args[0], err, string(exitErr.Stderr))
+	}
+	return out, err
+}
+
+// mustRun is like run but dies on any errors.
+func (h *hg) mustRun(args ...string) []byte {
+	out, err := h.run(args...)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return out
+}
+
+// DescribeIdentifier returns the string that is a "human-readable" identifier of the given revision.
+func (h *hg) DescribeIdentifier(revision string) string {
+	return strings.TrimSpace(string(h.mustRun("log", "-r", revision, "-T", "{node|short}")))
+}
+
+// CurrentRevIdentifier returns the string that specifies what the current revision is.
+//
+// If "permanent" is false and there is an active bookmark, its name is returned; otherwise
+// this is the full hash of the current commit.
+func (h *hg) CurrentRevIdentifier(permanent bool) string {
+	if !permanent {
+		if out, err := h.run("log", "-r", ".", "-T", "{activebookmark}"); err == nil && len(out) > 0 {
+			return strings.TrimSpace(string(out))
+		}
+	}
+	return strings.TrimSpace(string(h.mustRun("log", "-r", ".", "-T", "{node}")))
+}
+
+// ChangesIn returns a list of modified files in the given revset.
+func (h *hg) ChangesIn(diffSpec string, relativeTo string) []string {
+	out := h.mustRun("log", "-r", diffSpec, "-T", `{join(files, "\n")}\n`)
+	return h.relativise(h.lines(out), relativeTo)
+}
+
+// ChangedFiles returns a list of modified files since the given commit, optionally including untracked files.
+func (h *hg) ChangedFiles(fromCommit string, includeUntracked bool, relativeTo string) []string {
+	if relativeTo == "" {
+		relativeTo = h.repoRoot
+	}
+	files := h.status(relativeTo, "-mard")
+	if fromCommit != "" {
+		// Diff from the common ancestor so we only get changes that have occurred on the current stack.
+		files = append(files, h.status(relativeTo, "--rev", "ancestor("+fromCommit+", .)", "--rev", ".")...)
+	}
+	if includeUntracked {
+		files = append(files, h.status(relativeTo, "-u")...)
+	}
+	return h.relativise(files, relativeTo)
+}
+
+// status runs hg status with the given flags, returning files under the given directory relative to the repo root.
+func (h *hg) status(dir string, flags ...string) []string {
+	args := append([]string{"status", "-T", `{path}\n`}, flags...)
+	return h.lines(h.mustRun(append(args, "--", dir)...))
+}
+
+// lines splits the output of a command into lines, dropping any blank ones.
+func (h *hg) lines(out []byte) []string {
+	var ret []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+// relativise converts paths relative to the repo root into ones relative to the given directory.
+func (h *hg) relativise(files []string, relativeTo string) []string {
+	if relativeTo == "" {
+		relativeTo = h.repoRoot
+	}
+	ret := make([]string, len(files))
+	for i, f := range files {
+		p, err := filepath.Rel(relativeTo, filepath.Join(h.repoRoot, f))
+		if err != nil {
+			log.Fatalf("unable to determine relative path for %s and %s", h.repoRoot, relativeTo)
+		}
+		ret[i] = p
+	}
+	return ret
+}
+
+// IgnoreFiles marks the given files to be ignored. For Sapling they're written into the given .gitignore;
+// Mercurial only supports a single ignore file at the root so they're rooted there instead.
+func (h *hg) IgnoreFiles(path string, files []string) error {
+	// If we're generating the ignore in the root of the project, we should ignore some Please stuff too
+	if filepath.Dir(path) == "." && files == nil {
+		files = defaultIgnoredFiles
+	}
+	if h.tool != "hg" {
+		return updateIgnoreFile(filepath.Join(h.repoRoot, path), files)
+	}
+	dir := filepath.Dir(path)
+	entries := make([]string, len(files))
+	for i, file := range files {
+		entries[i] = "path:" + filepath.ToSlash(filepath.Join(dir, file))
+	}
+	return updateIgnoreFile(filepath.Join(h.repoRoot, hgIgnoreFileName), entries)
+}
+
+// GetIgnoreFile returns the ignore file that applies to the given directory.
+func (h *hg) GetIgnoreFile(path string) string {
+	if h.tool != "hg" {
+		return filepath.Join(path, ignoreFileName)
+	}
+	return hgIgnoreFileName
+}
+
+func (h *hg) Remove(names []string) error {
+	_, err := h.run(append([]string{"remove", "--"}, names...)...)
+	return err
+}
+
+// ChangedLines returns the lines changed since the most recent public ancestor of the current revision.
+func (h *hg) ChangedLines() (map[string][]int, error) {
+	out, err := h.run("diff", "--git", "--unified=0", "-r", "max(::. and public())")
+	if err != nil {
+		return nil, err
+	}
+	return parseChangedLines(out)
+}
+
+func (h *hg) Checkout(revision string) error {
+	_, err := h.run("update", revision)
+	return err
+}
+
+func (h *hg) CurrentRevDate(format string) string {
+	out, err := h.run("log", "-r", ".", "-T", "{date|hgdate}")
+	if err != nil {
+		return "Unknown"
+	}
+	// hgdate is formatted as "<unix timestamp> <timezone offset>".
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "Unknown"
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err.Error()
+	}
+	return time.Unix(timestamp, 0).Format(format)
+}
+
+func (h *hg) AreIgnored(files ...string) bool {
+	if len(files) == 0 {
+		return true
+	}
+	out, err := h.run(append([]string{"status", "-i", "-T", `{path}\n`, "--"}, files...)...)
+	if err != nil {
+		return false
+	}
+	ignored := map[string]bool{}
+	for _, f := range h.lines(out) {
+		ignored[f] = true
+	}
+	for _, f := range files {
+		if !ignored[filepath.ToSlash(filepath.Clean(f))] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package scm
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDetectsHg(t *testing.T) {
+	dir := t.TempDir()
+	assert.Equal(t, &plainDir{repoRoot: dir}, New(dir))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, ".sl"), 0755))
+	assert.Equal(t, &hg{repoRoot: dir, tool: "sl"}, New(dir))
+}
+
+func TestHgIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	h := &hg{repoRoot: dir, tool: "hg"}
+	assert.Equal(t, ".hgignore", h.GetIgnoreFile("src/foo"))
+	require.NoError(t, h.IgnoreFiles(".gitignore", nil))
+	require.NoError(t, h.IgnoreFiles(h.GetIgnoreFile("src/foo"), []string{"src/foo/generated.go"}))
+	require.NoError(t, h.IgnoreFiles(h.GetIgnoreFile("src/foo"), []string{"src/foo/generated.go"}))
+	b, err := os.ReadFile(filepath.Join(dir, ".hgignore"))
+	require.NoError(t, err)
+	assert.Equal(t, "\n"+pleaseDoNotEdit+"\npath:plz-out\npath:.plzconfig.local\npath:src/foo/generated.go\n", string(b))
+}
+
+func TestSaplingIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	h := &hg{repoRoot: dir, tool: "sl"}
+	assert.Equal(t, "src/foo/.gitignore", h.GetIgnoreFile("src/foo"))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "src/foo"), 0755))
+	require.NoError(t, h.IgnoreFiles("src/foo/.gitignore", []string{"generated.go"}))
+	b, err := os.ReadFile(filepath.Join(dir, "src/foo/.gitignore"))
+	require.NoError(t, err)
+	assert.Equal(t, "\n"+pleaseDoNotEdit+"\ngenerated.go\n", string(b))
+}
+
+func TestHgRepo(t *testing.T) {
+	for _, tool := range []string{"hg", "sl"} {
+		t.Run(tool, func(t *testing.T) {
+			if _, err := exec.LookPath(tool); err != nil {
+				t.Skipf("%s is not installed", tool)
+			}
+			dir := t.TempDir()
+			h := &hg{repoRoot: dir, tool: tool}
+			mustRun := func(args ...string) {
+				_, err := h.run(args...)
+				require.NoError(t, err)
+			}
+			writeFile := func(name, contents string) {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+			}
+			mustRun("init", dir)
+			writeFile("a.txt", "a\nb\nc\n")
+			writeFile("pkg/b.txt", "b\n")
+			mustRun("commit", "-A", "-u", "test", "-d", "1700000000 0", "-m", "initial")
+			mustRun("phase", "--public", "-r", ".")
+			first := h.CurrentRevIdentifier(true)
+			assert.Len(t, first, 40)
+			assert.Equal(t, "2023-11-14", h.CurrentRevDate("2006-01-02"))
+
+			writeFile("pkg/c.txt", "c\n")
+			mustRun("commit", "-A", "-u", "test", "-m", "second")
+			assert.Equal(t, []string{"pkg/c.txt"}, h.ChangesIn(".", ""))
+			assert.Equal(t, []string{"c.txt"}, h.ChangesIn(".", filepath.Join(dir, "pkg")))
+
+			writeFile("a.txt", "a\nx\nc\n")
+			writeFile("untracked.txt", "d\n")
+			assert.ElementsMatch(t, []string{"a.txt"}, h.ChangedFiles("", false, ""))
+			assert.ElementsMatch(t, []string{"a.txt", "untracked.txt"}, h.ChangedFiles("", true, ""))
+			assert.ElementsMatch(t, []string{"a.txt", "pkg/c.txt"}, h.ChangedFiles(first, false, ""))
+
+			lines, err := h.ChangedLines()
+			require.NoError(t, err)
+			assert.Equal(t, map[string][]int{"a.txt": {2}, "pkg/c.txt": {1}}, lines)
+
+			require.NoError(t, h.IgnoreFiles(h.GetIgnoreFile("."), []string{"untracked.txt"}))
+			assert.True(t, h.AreIgnored("untracked.txt"))
+			assert.False(t, h.AreIgnored("a.txt"))
+
+			mustRun("revert", "--all")
+			require.NoError(t, h.Checkout(first))
+			assert.Equal(t, first, h.CurrentRevIdentifier(true))
+			assert.NoFileExists(t, filepath.Join(dir, "pkg/c.txt"))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package scm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/fs"
+)
+
+// sinceFormats are the formats that we accept for the point in time to find changes since in a plain directory.
+var sinceFormats = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// A plainDir is used when the repo isn't under any version control that we know of.
+// It has no revisions, so it finds changed files by their modification times, and can't do much else.
+type plainDir struct {
+	repoRoot string
+}
+
+func (p *plainDir) GetIgnoreFile(string) string {
+	return "<unknown>"
+}
+
+func (p *plainDir) DescribeIdentifier(sha string) string {
+	return "<unknown>"
+}
+
+func (p *plainDir) CurrentRevIdentifier(permanent bool) string {
+	return "<unknown>"
+}
+
+func (p *plainDir) ChangesIn(diffSpec string, relativeTo string) []string {
+	log.Fatalf("unable to determine changes in %s: %s is not under version control", diffSpec, p.repoRoot)
+	return nil
+}
+
+// ChangedFiles returns the files modified since the given time, since there are no commits to compare against.
+// Untracked files are always included since nothing is tracked.
+func (p *plainDir) ChangedFiles(since string, includeUntracked bool, relativeTo string) []string {
+	t, err := parseSince(since)
+	if err != nil {
+		log.Fatalf("unable to find changes: %s", err)
+	}
+	if relativeTo == "" {
+		relativeTo = p.repoRoot
+	}
+	files := []string{}
+	if err := fs.Walk(p.repoRoot, func(name string, isDir bool) error {
+		if base := filepath.Base(name); isDir && name != p.repoRoot && (strings.HasPrefix(base, ".") || base == "plz-out") {
+			return filepath.SkipDir
+		} else if isDir {
+			return nil
+		}
+		if info, err := os.Lstat(name); err != nil {
+			return err
+		} else if info.ModTime().After(t) {
+			rel, err := filepath.Rel(relativeTo, name)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	}); err != nil {
+		log.Fatalf("unable to find changes: %s", err)
+	}
+	return files
+}
+
+// parseSince parses the time to find changes since.
+func parseSince(since string) (time.Time, error) {
+	for _, format := range sinceFormats {
+		if t, err := time.ParseInLocation(format, since, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("this repo isn't under version control, so changes can only be found since a time (e.g. 2006-01-02T15:04:05Z), not %q", since)
+}
+
+func (p *plainDir) IgnoreFiles(string, []string) error {
+	return fmt.Errorf("don't know how to mark files as ignored: unsupported SCM")
+}
+
+// Remove deletes the given files, since there's nothing else to remove them from.
+func (p *plainDir) Remove(names []string) error {
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(p.repoRoot, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *plainDir) ChangedLines() (map[string][]int, error) {
+	return nil, fmt.Errorf("unknown SCM, can't calculate changed lines")
+}
+
+func (p *plainDir) Checkout(revision string) error {
+	return fmt.Errorf("can't check out %s: %s is not under version control", revision, p.repoRoot)
+}
+
+func (p *plainDir) CurrentRevDate(format string) string {
+	return "Unknown"
+}
+
+func (p *plainDir) AreIgnored(files ...string) bool {
+	return false
+}
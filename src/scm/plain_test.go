@@ -0,0 +1,46 @@
+package scm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlainDirChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, file := range []string{"old.txt", "src/new.txt", "src/old.txt", "plz-out/gen/new.txt", ".git-like/new.txt"} {
+		path := filepath.Join(dir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+		if filepath.Base(file) == "old.txt" {
+			require.NoError(t, os.Chtimes(path, old, old))
+		}
+	}
+	p := New(dir)
+	assert.Equal(t, []string{"src/new.txt"}, p.ChangedFiles("2021-01-01", true, ""))
+	assert.Equal(t, []string{"new.txt"}, p.ChangedFiles("2021-01-01T00:00:00Z", true, filepath.Join(dir, "src")))
+	assert.ElementsMatch(t, []string{"old.txt", "src/new.txt", "src/old.txt"}, p.ChangedFiles("2019-12-31 12:00:00", true, ""))
+}
+
+func TestParseSince(t *testing.T) {
+	ts, err := parseSince("2021-02-03T04:05:06Z")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2021, time.February, 3, 4, 5, 6, 0, time.UTC), ts.UTC())
+	_, err = parseSince("origin/master")
+	assert.Error(t, err)
+}
+
+func TestPlainDirRemove(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0644))
+	p := New(dir)
+	assert.False(t, Versioned(p))
+	assert.NoError(t, p.Remove([]string{"a.txt"}))
+	assert.NoFileExists(t, filepath.Join(dir, "a.txt"))
+	assert.Error(t, p.Checkout("abc123"))
+}
@@ -1,8 +1,9 @@
 // Package scm abstracts operations on various tools like git
-// Currently, only git is supported.
+// Currently git, Mercurial and Sapling are supported, as well as plain directories that aren't under version control.
 package scm
 
 import (
+	"os/exec"
 	"path/filepath"
 
 	"github.com/thought-machine/please/src/cli/logging"
@@ -40,30 +41,48 @@ type SCM interface {
 	AreIgnored(files ...string) bool
 }
 
+// A Git is an SCM backed by git, which can also provide the information needed by the git_* builtins.
+// Results are cached for the lifetime of the instance (or until Checkout is called).
+type Git interface {
+	SCM
+	// Branch returns the name of the current branch, optionally in its short form.
+	Branch(short bool) (string, error)
+	// Show returns information about the current commit, as `git show -s --format=<format>` would.
+	Show(format string) (string, error)
+	// IsClean returns true if there are no changes in the working tree, including untracked files.
+	IsClean() (bool, error)
+}
+
 // New returns a new SCM instance for this repo root.
-// It returns nil if there is no known implementation there.
+// If it isn't under any version control that we know of, the instance treats it as a plain directory.
 func New(repoRoot string) SCM {
 	if fs.PathExists(filepath.Join(repoRoot, ".git")) {
 		return &git{repoRoot: repoRoot}
+	} else if fs.PathExists(filepath.Join(repoRoot, ".sl")) {
+		return &hg{repoRoot: repoRoot, tool: "sl"}
+	} else if fs.PathExists(filepath.Join(repoRoot, ".hg")) {
+		// Older Sapling checkouts also use .hg, in which case only sl might be installed.
+		if _, err := exec.LookPath("hg"); err != nil {
+			if _, err := exec.LookPath("sl"); err == nil {
+				return &hg{repoRoot: repoRoot, tool: "sl"}
+			}
+		}
+		return &hg{repoRoot: repoRoot, tool: "hg"}
 	}
-	return nil
+	return &plainDir{repoRoot: repoRoot}
 }
 
-// NewFallback returns a new SCM instance for this repo root.
-// If there is no known implementation it returns a stub.
+// NewFallback is like New but warns if the repo root isn't under version control.
 func NewFallback(repoRoot string) SCM {
-	if scm := New(repoRoot); scm != nil {
-		return scm
-	}
-	log.Warning("Cannot determine SCM, revision identifiers will be unavailable and `plz query changes/changed` will not work correctly.")
-	return &stub{}
-}
-
-// MustNew returns a new SCM instance for this repo root. It dies on any errors.
-func MustNew(repoRoot string) SCM {
 	scm := New(repoRoot)
-	if scm == nil {
-		log.Fatalf("Cannot determine SCM implementation")
+	if !Versioned(scm) {
+		log.Warning("Cannot determine SCM, revision identifiers will be unavailable and `plz query changes/changed` will only work with a time to find changes since.")
 	}
 	return scm
 }
+
+// Versioned returns true if the given SCM is backed by an actual version control system.
+func Versioned(scm SCM) bool {
+	_, plain := scm.(*plainDir)
+	return !plain
+}
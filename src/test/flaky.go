@@ -0,0 +1,241 @@
+// Detection of flaky tests.
+//
+// We record the outcome of every test case that runs against the hash of its target; a case that
+// has both passed and failed on the same hash must be flaky since nothing about it changed in between.
+// The history is kept in a file in plz-out so it accumulates across runs.
+
+package test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// HistoryFile is the file we record the history of test outcomes in.
+const HistoryFile = "plz-out/log/test_history.json"
+
+// A History records the outcomes of test cases across runs.
+type History struct {
+	// Targets maps each test target to the history of each of its test cases.
+	Targets map[string]map[string]*TestCaseHistory `json:"targets"`
+}
+
+// TestCaseHistory is the history of a single test case.
+type TestCaseHistory struct {
+	// The hash of the target that Passes and Failures relate to; they're reset when it changes.
+	Hash     string `json:"hash"`
+	Passes   int    `json:"passes"`
+	Failures int    `json:"failures"`
+	// The number of distinct hashes on which this test case has both passed and failed.
+	Flakes    int       `json:"flakes,omitempty"`
+	LastFlake time.Time `json:"last_flake"`
+	LastRun   time.Time `json:"last_run"`
+}
+
+// A FlakyTestCase is a single entry in the flaky test report.
+type FlakyTestCase struct {
+	Label     core.BuildLabel `json:"label"`
+	Name      string          `json:"name"`
+	Flakes    int             `json:"flakes"`
+	LastFlake time.Time       `json:"last_flake"`
+}
+
+var history struct {
+	once    sync.Once
+	mutex   sync.Mutex
+	history *History
+}
+
+// ReadHistory reads the test history from the given file.
+func ReadHistory(filename string) (*History, error) {
+	h := &History{Targets: map[string]map[string]*TestCaseHistory{}}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return h, err
+	} else if err := json.Unmarshal(b, h); err != nil {
+		return h, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	if h.Targets == nil {
+		h.Targets = map[string]map[string]*TestCaseHistory{}
+	}
+	return h, nil
+}
+
+// Write writes this history to the given file.
+func (h *History) Write(filename string) error {
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
+
+// Record adds the outcome of each execution of the given test results to this history.
+func (h *History) Record(label core.BuildLabel, results core.TestSuite) {
+	now := time.Now()
+	hexHash := hex.EncodeToString(results.Hash)
+	cases := h.Targets[label.String()]
+	if cases == nil {
+		cases = map[string]*TestCaseHistory{}
+		h.Targets[label.String()] = cases
+	}
+	for _, testCase := range results.TestCases {
+		name := testCaseName(testCase)
+		c := cases[name]
+		if c == nil {
+			c = &TestCaseHistory{}
+			cases[name] = c
+		}
+		if c.Hash != hexHash {
+			c.Hash = hexHash
+			c.Passes = 0
+			c.Failures = 0
+		}
+		wasFlaky := c.Passes > 0 && c.Failures > 0
+		for _, execution := range testCase.Executions {
+			if execution.Skip != nil {
+				continue
+			} else if execution.Failure != nil || execution.Error != nil {
+				c.Failures++
+			} else {
+				c.Passes++
+			}
+		}
+		if !wasFlaky && c.Passes > 0 && c.Failures > 0 {
+			c.Flakes++
+			c.LastFlake = now
+		}
+		c.LastRun = now
+	}
+}
+
+// Flaky returns all the test cases in this history that have been seen to flake, most often flaking first.
+func (h *History) Flaky() []FlakyTestCase {
+	ret := []FlakyTestCase{}
+	for target, cases := range h.Targets {
+		label, err := core.TryParseBuildLabel(target, "", "")
+		if err != nil {
+			log.Warning("Invalid target in test history: %s", target)
+			continue
+		}
+		for name, c := range cases {
+			if c.Flakes > 0 {
+				ret = append(ret, FlakyTestCase{Label: label, Name: name, Flakes: c.Flakes, LastFlake: c.LastFlake})
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Flakes != ret[j].Flakes {
+			return ret[i].Flakes > ret[j].Flakes
+		} else if ret[i].Label != ret[j].Label {
+			return ret[i].Label.Less(ret[j].Label)
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// PrintFlakyReport prints a human-readable report of flaky test cases.
+// If quarantine is true it instead prints config lines that will quarantine them.
+func PrintFlakyReport(w io.Writer, flaky []FlakyTestCase, quarantine bool) {
+	if quarantine {
+		fmt.Fprintln(w, "[Test]")
+		for _, f := range flaky {
+			fmt.Fprintf(w, "Quarantine = %s:%s\n", f.Label, f.Name)
+		}
+		return
+	} else if len(flaky) == 0 {
+		fmt.Fprintln(w, "No flaky tests have been seen.")
+		return
+	}
+	fmt.Fprintf(w, "%-7s %-20s %s\n", "Flakes", "Last flaked", "Test")
+	for _, f := range flaky {
+		fmt.Fprintf(w, "%-7d %-20s %s:%s\n", f.Flakes, f.LastFlake.Format("2006-01-02 15:04:05"), f.Label, f.Name)
+	}
+}
+
+// recordHistory records the results of a test run in the global history.
+func recordHistory(target *core.BuildTarget, results core.TestSuite) {
+	if results.Cached {
+		return // Nothing new has been learned about it.
+	}
+	history.once.Do(func() {
+		h, err := ReadHistory(HistoryFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warning("Failed to read test history: %s", err)
+		}
+		history.history = h
+	})
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	history.history.Record(target.Label, results)
+}
+
+// WriteHistory writes out the history of any tests that were run in this process.
+func WriteHistory() {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if history.history == nil {
+		return // No tests ran
+	}
+	if err := history.history.Write(HistoryFile); err != nil {
+		log.Warning("Failed to write test history: %s", err)
+	}
+}
+
+// testCaseName returns the name we identify a test case by.
+func testCaseName(testCase core.TestCase) string {
+	if testCase.ClassName == "" {
+		return testCase.Name
+	}
+	return testCase.ClassName + "." + testCase.Name
+}
+
+// quarantined returns the test cases of the given target that are quarantined, and true if the whole target is.
+func quarantined(state *core.BuildState, target *core.BuildTarget) (map[string]bool, bool) {
+	var cases map[string]bool
+	label := target.Label.String()
+	for _, entry := range state.Config.Test.Quarantine {
+		if entry == label {
+			return nil, true
+		} else if name := strings.TrimPrefix(entry, label+":"); name != entry {
+			if cases == nil {
+				cases = map[string]bool{}
+			}
+			cases[name] = true
+		}
+	}
+	return cases, false
+}
+
+// onlyQuarantinedFailures returns true if all the failing test cases of the given target are quarantined.
+func onlyQuarantinedFailures(state *core.BuildState, target *core.BuildTarget) bool {
+	cases, all := quarantined(state, target)
+	if all {
+		return true
+	} else if len(cases) == 0 {
+		return false
+	}
+	failed := false
+	for _, testCase := range target.Test.Results.TestCases {
+		if testCase.Success() == nil && testCase.Skip() == nil {
+			if !cases[testCaseName(testCase)] && !cases[testCase.Name] {
+				return false
+			}
+			failed = true
+		}
+	}
+	return failed
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func testSuite(hash byte, outcomes ...bool) core.TestSuite {
+	testCase := core.TestCase{Name: "TestSomething"}
+	for _, passed := range outcomes {
+		if passed {
+			testCase.Executions = append(testCase.Executions, core.TestExecution{})
+		} else {
+			testCase.Executions = append(testCase.Executions, core.TestExecution{Failure: &core.TestResultFailure{Message: "boom"}})
+		}
+	}
+	return core.TestSuite{TestCases: core.TestCases{testCase}, Hash: []byte{hash}}
+}
+
+func TestHistoryDetectsFlakes(t *testing.T) {
+	label := core.NewBuildLabel("src/test", "flaky_test")
+	h := &History{Targets: map[string]map[string]*TestCaseHistory{}}
+	h.Record(label, testSuite(1, true))
+	h.Record(label, testSuite(2, false))
+	assert.Empty(t, h.Flaky(), "Passing & failing on different hashes is not a flake")
+	h.Record(label, testSuite(2, true))
+	h.Record(label, testSuite(2, false, true))
+	h.Record(label, testSuite(3, false, true))
+
+	flaky := h.Flaky()
+	require.Equal(t, 1, len(flaky))
+	assert.Equal(t, label, flaky[0].Label)
+	assert.Equal(t, "TestSomething", flaky[0].Name)
+	assert.Equal(t, 2, flaky[0].Flakes)
+
+	var buf bytes.Buffer
+	PrintFlakyReport(&buf, flaky, true)
+	assert.Equal(t, "[Test]\nQuarantine = //src/test:flaky_test:TestSomething\n", buf.String())
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history.json")
+	h := &History{Targets: map[string]map[string]*TestCaseHistory{}}
+	h.Record(core.NewBuildLabel("src/test", "flaky_test"), testSuite(1, false, true))
+	require.NoError(t, h.Write(filename))
+	h2, err := ReadHistory(filename)
+	require.NoError(t, err)
+	flaky, flaky2 := h.Flaky(), h2.Flaky()
+	require.Equal(t, 1, len(flaky2))
+	assert.Equal(t, flaky[0].Label, flaky2[0].Label)
+	assert.Equal(t, flaky[0].Flakes, flaky2[0].Flakes)
+	assert.True(t, flaky[0].LastFlake.Equal(flaky2[0].LastFlake))
+}
+
+func TestOnlyQuarantinedFailures(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	target := core.NewBuildTarget(core.NewBuildLabel("src/test", "flaky_test"))
+	target.Test = &core.TestFields{}
+	results := testSuite(1, false)
+	results.TestCases = append(results.TestCases, core.TestCase{Name: "TestOther", Executions: []core.TestExecution{{}}})
+	target.Test.Results = &results
+
+	assert.False(t, onlyQuarantinedFailures(state, target))
+	state.Config.Test.Quarantine = []string{"//src/test:flaky_test:TestOther"}
+	assert.False(t, onlyQuarantinedFailures(state, target))
+	state.Config.Test.Quarantine = []string{"//src/test:flaky_test:TestSomething"}
+	assert.True(t, onlyQuarantinedFailures(state, target))
+	state.Config.Test.Quarantine = []string{"//src/test:flaky_test"}
+	assert.True(t, onlyQuarantinedFailures(state, target))
+}
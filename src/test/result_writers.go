@@ -0,0 +1,230 @@
+// Writers for test results in formats other than the combined XML file.
+
+package test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A ResultsWriter writes the results of a set of test targets in some format.
+type ResultsWriter interface {
+	// Extension returns the file extension that's conventional for this format.
+	Extension() string
+	// Write writes the results of the given targets.
+	Write(w io.Writer, targets []*core.BuildTarget) error
+}
+
+// ResultsWriters are the available writers, keyed by the name of their format.
+var ResultsWriters = map[string]ResultsWriter{
+	"jsonl": jsonLinesWriter{},
+	"tap":   tapWriter{},
+}
+
+// WriteResultsInFormatsOrDie writes test results in each of the given formats. Each one is written
+// alongside the XML results file, with the extension replaced. Dies on any errors.
+func WriteResultsInFormatsOrDie(graph *core.BuildGraph, filename string, formats []string) {
+	if len(formats) == 0 {
+		return
+	}
+	targets := testedTargets(graph)
+	for _, format := range formats {
+		writer, present := ResultsWriters[format]
+		if !present {
+			log.Fatalf("Unknown test results format %s", format)
+		}
+		out := strings.TrimSuffix(filename, filepath.Ext(filename)) + writer.Extension()
+		if err := writeResultsFile(writer, out, targets); err != nil {
+			log.Fatalf("Failed to write test results to %s: %s", out, err)
+		}
+	}
+}
+
+func writeResultsFile(writer ResultsWriter, filename string, targets []*core.BuildTarget) error {
+	if err := os.MkdirAll(filepath.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := writer.Write(f, targets); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// testedTargets returns all the targets in the graph that have test results, sorted by label.
+func testedTargets(graph *core.BuildGraph) []*core.BuildTarget {
+	targets := []*core.BuildTarget{}
+	for _, target := range graph.AllTargets() {
+		if target.IsTest() && target.Test.Results != nil {
+			targets = append(targets, target)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Label.Less(targets[j].Label) })
+	return targets
+}
+
+// Possible statuses of a test case.
+const (
+	statusPassed  = "passed"
+	statusFlaky   = "flaky" // Passed, but only after failing at least once.
+	statusFailed  = "failed"
+	statusErrored = "errored"
+	statusSkipped = "skipped"
+)
+
+// testCaseStatus returns the overall status of a test case.
+func testCaseStatus(testCase core.TestCase) string {
+	if testCase.Success() != nil {
+		if len(testCase.Failures()) > 0 || len(testCase.Errors()) > 0 {
+			return statusFlaky
+		}
+		return statusPassed
+	} else if testCase.Skip() != nil {
+		return statusSkipped
+	} else if len(testCase.Errors()) > 0 {
+		return statusErrored
+	}
+	return statusFailed
+}
+
+// testCaseFailure returns the first failure or error of a test case, or nil if it had none.
+func testCaseFailure(testCase core.TestCase) *core.TestResultFailure {
+	if failures := testCase.Failures(); len(failures) > 0 {
+		return failures[0].Failure
+	} else if errors := testCase.Errors(); len(errors) > 0 {
+		return errors[0].Error
+	}
+	return nil
+}
+
+// jsonLinesWriter writes one JSON object per test case.
+type jsonLinesWriter struct{}
+
+// A jsonTestCase is the record written for each test case.
+type jsonTestCase struct {
+	Target    string  `json:"target"`
+	ClassName string  `json:"class_name,omitempty"`
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Duration  float64 `json:"duration"` // in seconds
+	Retries   int     `json:"retries"`
+	Hash      string  `json:"hash,omitempty"`
+	Cached    bool    `json:"cached"`
+	Message   string  `json:"message,omitempty"`
+}
+
+func (jsonLinesWriter) Extension() string {
+	return ".jsonl"
+}
+
+func (jsonLinesWriter) Write(w io.Writer, targets []*core.BuildTarget) error {
+	enc := json.NewEncoder(w)
+	for _, target := range targets {
+		results := target.Test.Results
+		for _, testCase := range results.TestCases {
+			record := jsonTestCase{
+				Target:    target.Label.String(),
+				ClassName: testCase.ClassName,
+				Name:      testCase.Name,
+				Status:    testCaseStatus(testCase),
+				Retries:   len(testCase.Executions) - 1,
+				Hash:      hex.EncodeToString(results.Hash),
+				Cached:    results.Cached,
+			}
+			if d := testCase.Duration(); d != nil {
+				record.Duration = d.Seconds()
+			}
+			if failure := testCaseFailure(testCase); failure != nil {
+				record.Message = failure.Message
+			}
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tapWriter writes results in the Test Anything Protocol, version 13 (see https://testanything.org).
+type tapWriter struct{}
+
+func (tapWriter) Extension() string {
+	return ".tap"
+}
+
+func (tapWriter) Write(w io.Writer, targets []*core.BuildTarget) error {
+	n := 0
+	for _, target := range targets {
+		n += len(target.Test.Results.TestCases)
+	}
+	if _, err := fmt.Fprintf(w, "TAP version 13\n1..%d\n", n); err != nil {
+		return err
+	}
+	i := 0
+	for _, target := range targets {
+		for _, testCase := range target.Test.Results.TestCases {
+			i++
+			description := tapLine(strings.TrimSpace(target.Label.String() + " " + testCaseName(testCase)))
+			status := testCaseStatus(testCase)
+			var err error
+			switch status {
+			case statusSkipped:
+				_, err = fmt.Fprintf(w, "ok %d - %s # SKIP %s\n", i, description, tapLine(testCase.Skip().Skip.Message))
+			case statusPassed, statusFlaky:
+				_, err = fmt.Fprintf(w, "ok %d - %s\n", i, description)
+			default:
+				_, err = fmt.Fprintf(w, "not ok %d - %s\n", i, description)
+				if err == nil {
+					err = writeTAPDiagnostic(w, status, testCaseFailure(testCase))
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeTAPDiagnostic writes a YAML block describing a test failure.
+func writeTAPDiagnostic(w io.Writer, status string, failure *core.TestResultFailure) error {
+	var b strings.Builder
+	b.WriteString("  ---\n")
+	fmt.Fprintf(&b, "  status: %s\n", status)
+	if failure != nil {
+		writeTAPField(&b, "type", failure.Type)
+		writeTAPField(&b, "message", failure.Message)
+		writeTAPField(&b, "traceback", failure.Traceback)
+	}
+	b.WriteString("  ...\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeTAPField writes a single YAML field, using a block scalar so we don't have to worry about quoting.
+func writeTAPField(b *strings.Builder, name, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(b, "  %s: |-\n", name)
+	for _, line := range strings.Split(strings.TrimRight(value, "\n"), "\n") {
+		fmt.Fprintf(b, "    %s\n", line)
+	}
+}
+
+// tapLine makes a string safe to put on a single TAP line.
+func tapLine(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\n", " "), "#", "\\#")
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func resultsTarget() *core.BuildTarget {
+	second := time.Second
+	target := core.NewBuildTarget(core.NewBuildLabel("src/test", "writer_test"))
+	target.Test = &core.TestFields{
+		Results: &core.TestSuite{
+			Hash:   []byte{0xab, 0xcd},
+			Cached: true,
+			TestCases: core.TestCases{
+				{Name: "TestPass", Executions: []core.TestExecution{{Duration: &second}}},
+				{Name: "TestFlaky", Executions: []core.TestExecution{
+					{Failure: &core.TestResultFailure{Message: "nope"}, Duration: &second},
+					{Duration: &second},
+				}},
+				{Name: "TestFail", ClassName: "Class", Executions: []core.TestExecution{
+					{Failure: &core.TestResultFailure{Type: "AssertionError", Message: "1 != 2", Traceback: "line 1\nline 2\n"}},
+				}},
+				{Name: "TestSkip", Executions: []core.TestExecution{{Skip: &core.TestResultSkip{Message: "not today"}}}},
+			},
+		},
+	}
+	return target
+}
+
+func TestJSONLinesWriter(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, jsonLinesWriter{}.Write(&buf, []*core.BuildTarget{resultsTarget()}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 4, len(lines))
+	records := make([]jsonTestCase, len(lines))
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &records[i]))
+	}
+	assert.Equal(t, jsonTestCase{
+		Target:   "//src/test:writer_test",
+		Name:     "TestPass",
+		Status:   "passed",
+		Duration: 1,
+		Hash:     "abcd",
+		Cached:   true,
+	}, records[0])
+	assert.Equal(t, "flaky", records[1].Status)
+	assert.Equal(t, 1, records[1].Retries)
+	assert.Equal(t, "failed", records[2].Status)
+	assert.Equal(t, "Class", records[2].ClassName)
+	assert.Equal(t, "1 != 2", records[2].Message)
+	assert.Equal(t, "skipped", records[3].Status)
+}
+
+func TestTAPWriter(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, tapWriter{}.Write(&buf, []*core.BuildTarget{resultsTarget()}))
+	assert.Equal(t, `TAP version 13
+1..4
+ok 1 - //src/test:writer_test TestPass
+ok 2 - //src/test:writer_test TestFlaky
+not ok 3 - //src/test:writer_test Class.TestFail
+  ---
+  status: failed
+  type: |-
+    AssertionError
+  message: |-
+    1 != 2
+  traceback: |-
+    line 1
+    line 2
+  ...
+ok 4 - //src/test:writer_test TestSkip # SKIP not today
+`, buf.String())
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
@@ -83,8 +84,7 @@ func LoadPreviousFailures(filename string) ([]core.BuildLabel, []string) {
 	args := []string{}
 	for _, suite := range junit.TestSuites {
 		if suite.Failures > 0 {
-			labels = append(labels, core.NewBuildLabel(
-				strings.ReplaceAll(suite.Package, ".", "/"), suite.Name))
+			labels = append(labels, suite.label())
 			for _, c := range suite.TestCases {
 				if c.Failure != nil || c.Error != nil {
 					args = append(args, c.Name)
@@ -94,3 +94,42 @@ func LoadPreviousFailures(filename string) ([]core.BuildLabel, []string) {
 	}
 	return labels, args
 }
+
+// LoadTestDurations loads the duration of each test target from the given results file.
+// This is used to balance test shards based on the timings of a previous run.
+func LoadTestDurations(filename string) (map[core.BuildLabel]time.Duration, error) {
+	junit, err := readResultsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	durations := map[core.BuildLabel]time.Duration{}
+	for _, suite := range junit.TestSuites {
+		durations[suite.label()] += suite.Duration()
+	}
+	return durations, nil
+}
+
+// readResultsFile reads a combined results file as written by WriteResultsToFileOrDie.
+func readResultsFile(filename string) (*jUnitXMLTestSuites, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	junit := &jUnitXMLTestSuites{}
+	if err := xml.NewDecoder(f).Decode(junit); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	return junit, nil
+}
+
+// label returns the build label of the target this suite came from.
+// Files written before we recorded the label fall back to reconstructing it from the package.
+func (suite *jUnitXMLTestSuite) label() core.BuildLabel {
+	if suite.Label != "" {
+		if label, err := core.TryParseBuildLabel(suite.Label, "", ""); err == nil {
+			return label
+		}
+	}
+	return core.NewBuildLabel(strings.ReplaceAll(suite.Package, ".", "/"), suite.Name)
+}
@@ -80,6 +80,7 @@ func test(state *core.BuildState, label core.BuildLabel, target *core.BuildTarge
 		results.Package = strings.ReplaceAll(target.Label.PackageName, "/", ".")
 		results.Name = target.Label.Name
 		results.Cached = true
+		results.Hash = hash
 		if err != nil {
 			log.Warningf("Failed to parse cached test file (for %v), Rerunning test. %w", target.Label, err)
 			state.Cache.Clean(target)
@@ -187,6 +188,8 @@ func test(state *core.BuildState, label core.BuildLabel, target *core.BuildTarge
 	if state.NumTestRuns == 1 {
 		var results core.TestSuite
 		results, coverage = doFlakeRun(state, target, run, runRemotely)
+		results.Hash = hash
+		recordHistory(target, results)
 		target.AddTestResults(results)
 
 		if target.Test.Results.TestCases.AllSucceeded() {
@@ -198,12 +201,16 @@ func test(state *core.BuildState, label core.BuildLabel, target *core.BuildTarge
 			state.LogTestRunning(target, run, core.TargetTesting, "Testing...")
 			var results core.TestSuite
 			results, coverage = doTest(state, target, runRemotely, 1) // Sequential tests re-use run 1's test dir
+			results.Hash = hash
+			recordHistory(target, results)
 			target.AddTestResults(results)
 		}
 	} else {
 		state.LogTestRunning(target, run, core.TargetTesting, "Testing...")
 		var results core.TestSuite
 		results, coverage = doTest(state, target, runRemotely, run)
+		results.Hash = hash
+		recordHistory(target, results)
 		target.AddTestResults(results)
 	}
 
@@ -235,9 +242,13 @@ func doFlakeRun(state *core.BuildState, target *core.BuildTarget, run int, runRe
 	coverage := &core.TestCoverage{}
 	results := core.TestSuite{}
 
+	flakiness := int(target.Test.Flakiness)
+	if cases, all := quarantined(state, target); (all || len(cases) > 0) && state.Config.Test.QuarantineRetries > flakiness {
+		flakiness = state.Config.Test.QuarantineRetries
+	}
 	// New group of test cases for each group of flaky runs
-	for flakes := 1; flakes <= int(target.Test.Flakiness); flakes++ {
-		state.LogTestRunning(target, run, core.TargetTesting, getFlakeStatus(flakes, int(target.Test.Flakiness)))
+	for flakes := 1; flakes <= flakiness; flakes++ {
+		state.LogTestRunning(target, run, core.TargetTesting, getFlakeStatus(flakes, flakiness))
 
 		testSuite, cov := doTest(state, target, runRemotely, 1) // If we're running flakes, numRuns must be 1
 
@@ -297,6 +308,13 @@ func logTargetResults(state *core.BuildState, target *core.BuildTarget, coverage
 		logTestSuccess(state, target, run, target.Test.Results, coverage)
 		return
 	}
+	if onlyQuarantinedFailures(state, target) {
+		results := target.Test.Results
+		description := fmt.Sprintf("%d %s passed, %d quarantined %s failed.", results.Passes(), pluralise("test", results.Passes()),
+			results.Failures()+results.Errors(), pluralise("test", results.Failures()+results.Errors()))
+		state.LogTestResult(target, run, core.TargetTested, results, coverage, nil, description)
+		return
+	}
 	var resultErr error
 	var resultMsg string
 	if target.Test.Results.Failures() > 0 {
@@ -349,14 +367,28 @@ func testCommandAndEnv(state *core.BuildState, target *core.BuildTarget, run int
 	return replacedCmd, env, err
 }
 
-func runTest(state *core.BuildState, target *core.BuildTarget, run int) ([]byte, error) {
+func runTest(state *core.BuildState, target *core.BuildTarget, run int) ([]byte, *core.ResourceUsage, error) {
 	replacedCmd, env, err := testCommandAndEnv(state, target, run)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	strict := target.Test.Sandbox && state.Config.StrictSandbox()
+	envSlice := env.ToSlice()
+	if strict {
+		envSlice = append(envSlice, core.StrictSandboxEnv(state, target.AllTestTools())...)
+	}
+	log.Debugf("Running test %s#%d\nENVIRONMENT:\n%s\n%s", target.Label, run, envSlice, replacedCmd)
+	_, stderr, usage, err := state.ProcessExecutor.ExecWithLimitsShell(target, target.TestDir(run), envSlice, target.Test.Timeout, state.ShowAllOutput, false, process.NewSandboxConfig(target.Test.Sandbox, target.Test.Sandbox), target.Resources.Limits(), replacedCmd, state.DebugFailingTests)
+	resourceUsage := core.NewResourceUsage(usage)
+	target.SetResourceUsage(resourceUsage)
+	if err != nil && strict {
+		var missing []string
+		if usage != nil {
+			missing = usage.Missing
+		}
+		stderr = append(stderr, core.StrictSandboxHint(stderr, missing, core.StrictSandboxPaths(state, target.AllTestTools()))...)
 	}
-	log.Debugf("Running test %s#%d\nENVIRONMENT:\n%s\n%s", target.Label, run, env, replacedCmd)
-	_, stderr, err := state.ProcessExecutor.ExecWithTimeoutShellStdStreams(target, target.TestDir(run), env.ToSlice(), target.Test.Timeout, state.ShowAllOutput, false, process.NewSandboxConfig(target.Test.Sandbox, target.Test.Sandbox), replacedCmd, state.DebugFailingTests)
-	return stderr, err
+	return stderr, resourceUsage, err
 }
 
 func doTest(state *core.BuildState, target *core.BuildTarget, runRemotely bool, run int) (core.TestSuite, *core.TestCoverage) {
@@ -372,6 +404,7 @@ func doTest(state *core.BuildState, target *core.BuildTarget, runRemotely bool,
 		Properties: parsedSuite.Properties,
 		TestCases:  parsedSuite.TestCases,
 		Cached:     metadata.Cached,
+		Usage:      metadata.ResourceUsage,
 	}, coverage
 }
 
@@ -381,13 +414,25 @@ func doTestResults(state *core.BuildState, target *core.BuildTarget, runRemotely
 
 	if runRemotely {
 		metadata, err = state.RemoteClient.Test(target, run)
-		if metadata == nil {
+		if state.ShouldFallBackLocally(target, err) {
+			log.Warning("Can't run %s remotely, running it locally instead: %s", target.Label, err)
+			if state.LocalLimiter != nil {
+				state.LocalLimiter.Acquire(target)
+				defer state.LocalLimiter.Release(target)
+			}
+			if err := state.DownloadInputsIfNeeded(target, true); err != nil {
+				return new(core.BuildMetadata), nil, nil, err
+			}
+			runRemotely = false
+		} else if metadata == nil {
 			metadata = new(core.BuildMetadata)
 		}
-	} else {
+	}
+	if !runRemotely {
 		var stdout []byte
-		stdout, err = prepareAndRunTest(state, target, run)
-		metadata = &core.BuildMetadata{Stdout: stdout}
+		var usage *core.ResourceUsage
+		stdout, usage, err = prepareAndRunTest(state, target, run)
+		metadata = &core.BuildMetadata{Stdout: stdout, ResourceUsage: usage}
 	}
 
 	coverage := parseCoverageFile(target, filepath.Join(target.TestDir(run), core.CoverageFile), run)
@@ -409,10 +454,10 @@ func doTestResults(state *core.BuildState, target *core.BuildTarget, runRemotely
 }
 
 // prepareAndRunTest sets up a test directory and runs the test.
-func prepareAndRunTest(state *core.BuildState, target *core.BuildTarget, run int) (stdout []byte, err error) {
+func prepareAndRunTest(state *core.BuildState, target *core.BuildTarget, run int) (stdout []byte, usage *core.ResourceUsage, err error) {
 	if err = core.PrepareRuntimeDir(state, target, target.TestDir(run)); err != nil {
 		state.LogBuildError(target.Label, core.TargetTestFailed, err, "Failed to prepare test directory for %s: %s", target.Label, err)
-		return []byte{}, err
+		return []byte{}, nil, err
 	}
 	return runTest(state, target, run)
 }
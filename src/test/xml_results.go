@@ -281,11 +281,13 @@ type jUnitXMLTestSuite struct {
 	Name  string `xml:"name,attr"`
 	Tests int    `xml:"tests,attr"`
 
-	Errors    int    `xml:"errors,attr,omitempty"`
-	Failures  int    `xml:"failures,attr,omitempty"`
-	HostName  string `xml:"hostname,attr,omitempty"`
-	Skipped   int    `xml:"skipped,attr,omitempty"`
-	Package   string `xml:"package,attr,omitempty"`
+	Errors   int    `xml:"errors,attr,omitempty"`
+	Failures int    `xml:"failures,attr,omitempty"`
+	HostName string `xml:"hostname,attr,omitempty"`
+	Skipped  int    `xml:"skipped,attr,omitempty"`
+	Package  string `xml:"package,attr,omitempty"`
+	// Label is the build label of the test target; the package alone can't be turned back into one reliably.
+	Label     string `xml:"label,attr,omitempty"`
 	timed     `xml:"time,attr,omitempty"`
 	Timestamp string `xml:"timestamp,attr,omitempty"`
 
@@ -421,6 +423,35 @@ func WriteResultsToFileOrDie(graph *core.BuildGraph, filename string, storeOutpu
 	}
 }
 
+// MergeResultsFiles combines several results files (for example from separate test shards) into a single one.
+func MergeResultsFiles(filenames []string, out string) error {
+	merged := jUnitXMLTestSuites{}
+	suites := map[string]*jUnitXMLTestSuite{}
+	for _, filename := range filenames {
+		junit, err := readResultsFile(filename)
+		if err != nil {
+			return err
+		}
+		merged.Time += junit.Time
+		for _, suite := range junit.TestSuites {
+			name := suite.Package + "." + suite.Name
+			if existing, present := suites[name]; present {
+				existing.merge(suite)
+			} else {
+				suites[name] = suite
+				merged.TestSuites = append(merged.TestSuites, suite)
+			}
+		}
+	}
+	b, err := xml.MarshalIndent(merged, "", "    ")
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(out), core.DirPermissions); err != nil {
+		return err
+	}
+	return os.WriteFile(out, b, 0644)
+}
+
 // SerialiseResultsToXML serialises some test results to the "standard" XML format.
 func SerialiseResultsToXML(target *core.BuildTarget, indent, storeOutputOnSuccess bool) []byte {
 	s := ""
@@ -428,6 +459,7 @@ func SerialiseResultsToXML(target *core.BuildTarget, indent, storeOutputOnSucces
 		s = "    "
 	}
 	suite := toXMLTestSuite(target.Test.Results, storeOutputOnSuccess)
+	suite.Label = target.Label.String()
 	suites := &jUnitXMLTestSuites{
 		Name:       target.Label.String(),
 		TestSuites: []*jUnitXMLTestSuite{suite},
@@ -482,14 +514,10 @@ func mustSerialiseResults(graph *core.BuildGraph, storeOutputOnSuccess bool) []b
 			testSuite := target.Test.Results
 			if len(testSuite.TestCases) > 0 {
 				xmlTestSuite := toXMLTestSuite(testSuite, storeOutputOnSuccess)
+				xmlTestSuite.Label = target.Label.String()
 				name := testSuite.JavaStyleName()
 				if suite, present := xmlSuites[name]; present {
-					suite.Tests += xmlTestSuite.Tests
-					suite.Errors += xmlTestSuite.Errors
-					suite.Failures += xmlTestSuite.Failures
-					suite.Skipped += xmlTestSuite.Skipped
-					suite.timed.Time += xmlTestSuite.timed.Time
-					suite.TestCases = append(suite.TestCases, xmlTestSuite.TestCases...)
+					suite.merge(xmlTestSuite)
 				} else {
 					xmlSuites[name] = xmlTestSuite
 				}
@@ -507,6 +535,16 @@ func mustSerialiseResults(graph *core.BuildGraph, storeOutputOnSuccess bool) []b
 	return b
 }
 
+// merge adds the results of another test suite to this one.
+func (suite *jUnitXMLTestSuite) merge(other *jUnitXMLTestSuite) {
+	suite.Tests += other.Tests
+	suite.Errors += other.Errors
+	suite.Failures += other.Failures
+	suite.Skipped += other.Skipped
+	suite.timed.Time += other.timed.Time
+	suite.TestCases = append(suite.TestCases, other.TestCases...)
+}
+
 func toXMLProperties(props map[string]string, cached bool) jUnitXMLProperties {
 	out := jUnitXMLProperties{}
 	for k, v := range props {
@@ -6,10 +6,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/thought-machine/please/src/core"
 )
@@ -122,7 +125,7 @@ func xmlTestScenario() *core.BuildTarget {
 }
 
 const expected = `<testsuites name="//src/core:lock_test" time="1">
-    <testsuite name="lock_test" tests="3" failures="1" package="src.core" time="1">
+    <testsuite name="lock_test" tests="3" failures="1" package="src.core" label="//src/core:lock_test" time="1">
         <properties></properties>
         <testcase name="TestAcquireRepoLock" classname="src.core.lock_test" time="0.5">
             <flakyFailure type="">
@@ -138,7 +141,7 @@ const expected = `<testsuites name="//src/core:lock_test" time="1">
 </testsuites>`
 
 const expectedWithSuccessOutput = `<testsuites name="//src/core:lock_test" time="1">
-    <testsuite name="lock_test" tests="3" failures="1" package="src.core" time="1">
+    <testsuite name="lock_test" tests="3" failures="1" package="src.core" label="//src/core:lock_test" time="1">
         <properties></properties>
         <testcase name="TestAcquireRepoLock" classname="src.core.lock_test" time="0.5">
             <flakyFailure type="">
@@ -155,3 +158,35 @@ const expectedWithSuccessOutput = `<testsuites name="//src/core:lock_test" time=
         </testcase>
     </testsuite>
 </testsuites>`
+
+func TestMergeResultsFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.xml")
+	b := filepath.Join(dir, "b.xml")
+	out := filepath.Join(dir, "out.xml")
+	require.NoError(t, os.WriteFile(a, []byte(`<testsuites time="1.5"><testsuite name="t1" package="src.a" tests="1" time="1.5"><testcase name="TestA" time="1.5"></testcase></testsuite></testsuites>`), 0644))
+	require.NoError(t, os.WriteFile(b, []byte(`<testsuites time="2"><testsuite name="t2" package="src.b" tests="1" failures="1" time="2"><testcase name="TestB" time="2"><failure message="boom"></failure></testcase></testsuite></testsuites>`), 0644))
+	require.NoError(t, MergeResultsFiles([]string{a, b}, out))
+
+	durations, err := LoadTestDurations(out)
+	require.NoError(t, err)
+	assert.Equal(t, map[core.BuildLabel]time.Duration{
+		core.NewBuildLabel("src/a", "t1"): 1500 * time.Millisecond,
+		core.NewBuildLabel("src/b", "t2"): 2 * time.Second,
+	}, durations)
+	labels, args := LoadPreviousFailures(out)
+	assert.Equal(t, []core.BuildLabel{core.NewBuildLabel("src/b", "t2")}, labels)
+	assert.Equal(t, []string{"TestB"}, args)
+}
+
+func TestLoadTestDurationsDottedPackage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "results.xml")
+	require.NoError(t, os.WriteFile(filename, []byte(`<testsuites time="1"><testsuite name="t1" package="src.my.pkg" label="//src/my.pkg:t1" tests="1" failures="1" time="1"><testcase name="TestA" time="1"><failure message="boom"></failure></testcase></testsuite></testsuites>`), 0644))
+	durations, err := LoadTestDurations(filename)
+	require.NoError(t, err)
+	assert.Equal(t, map[core.BuildLabel]time.Duration{
+		core.NewBuildLabel("src/my.pkg", "t1"): time.Second,
+	}, durations)
+	labels, _ := LoadPreviousFailures(filename)
+	assert.Equal(t, []core.BuildLabel{core.NewBuildLabel("src/my.pkg", "t1")}, labels)
+}
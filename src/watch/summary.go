@@ -0,0 +1,87 @@
+package watch
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// maxSummaryFiles is the most changed files we name individually in a summary.
+const maxSummaryFiles = 3
+
+// A cycleSummary describes what happened in one cycle of rebuilding after files changed.
+type cycleSummary struct {
+	Cycle                    int
+	Changed                  []string
+	Packages                 int
+	Built, Cached, Unchanged int
+	Failed                   int
+	TestsPassed, TestsFailed int
+	Watching                 int
+	Duration                 time.Duration
+}
+
+// newCycleSummary summarises the results of a build.
+func newCycleSummary(cycle int, changed []string, state *core.BuildState, watching int, duration time.Duration) *cycleSummary {
+	s := &cycleSummary{
+		Cycle:    cycle,
+		Changed:  changed,
+		Packages: len(state.Graph.PackageMap()),
+		Watching: watching,
+		Duration: duration,
+	}
+	for _, target := range state.Graph.AllTargets() {
+		switch target.State() {
+		case core.Built, core.BuiltRemotely:
+			s.Built++
+		case core.Cached:
+			s.Cached++
+		case core.Unchanged, core.Reused, core.ReusedRemotely:
+			s.Unchanged++
+		case core.Failed:
+			s.Failed++
+		}
+		// Tests in the same packages as the ones we're running will be in the graph, but won't have been built.
+		if target.IsTest() && target.Test.Results != nil && target.State() >= core.Built {
+			if target.Test.Results.Failures() > 0 || target.Test.Results.Errors() > 0 {
+				s.TestsFailed++
+			} else {
+				s.TestsPassed++
+			}
+		}
+	}
+	return s
+}
+
+// String implements the fmt.Stringer interface.
+func (s *cycleSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Cycle %d: ", s.Cycle)
+	if len(s.Changed) > maxSummaryFiles {
+		fmt.Fprintf(&b, "%s and %d other files changed", strings.Join(s.Changed[:maxSummaryFiles], ", "), len(s.Changed)-maxSummaryFiles)
+	} else {
+		b.WriteString(strings.Join(s.Changed, ", ") + " changed")
+	}
+	fmt.Fprintf(&b, "; parsed %s, built %s (%d unchanged", plural(s.Packages, "package"), plural(s.Built, "target"), s.Unchanged)
+	if s.Cached > 0 {
+		fmt.Fprintf(&b, ", %d from cache", s.Cached)
+	}
+	b.WriteString(")")
+	if s.Failed > 0 {
+		fmt.Fprintf(&b, ", %d failed", s.Failed)
+	}
+	if s.TestsPassed > 0 || s.TestsFailed > 0 {
+		fmt.Fprintf(&b, "; %s passed, %d failed", plural(s.TestsPassed, "test"), s.TestsFailed)
+	}
+	fmt.Fprintf(&b, " in %s. Watching %s.", s.Duration.Round(10*time.Millisecond), plural(s.Watching, "file"))
+	return b.String()
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -4,8 +4,6 @@ package watch
 import (
 	"context"
 	"fmt"
-	"path/filepath"
-	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -13,7 +11,6 @@ import (
 	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/cli/logging"
 	"github.com/thought-machine/please/src/core"
-	"github.com/thought-machine/please/src/fs"
 	"github.com/thought-machine/please/src/process"
 	"github.com/thought-machine/please/src/run"
 )
@@ -27,19 +24,27 @@ type CallbackFunc func(*core.BuildState, []core.BuildLabel)
 
 // Watch starts watching the sources of the given labels for changes and triggers
 // rebuilds whenever they change.
+// Each rebuild parses packages afresh, so the set of watched files follows changes to BUILD files,
+// globs and dependencies; only the labels whose inputs actually changed are rebuilt or retested.
 // It never returns successfully, it will either watch forever or die.
 func Watch(state *core.BuildState, labels core.BuildLabels, testArgs []string, noTest bool, callback CallbackFunc) {
 	// This hasn't been set before, do it now.
 	if !noTest {
 		state.NeedTests = anyTests(state, labels)
 	}
-	watcher, err := fsnotify.NewWatcher()
+	fsw, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatalf("Error setting up watcher: %s", err)
 	}
+	w := newWatcher(fsw, labels)
 	// This sets up the actual watches. It must be done in a separate goroutine.
-	var files sync.Map
-	go startWatching(watcher, state, labels, &files)
+	// It's computed from the state before the initial build, so it gets an earlier cycle than anything
+	// below and can never replace the sets they compute, whichever finishes first.
+	go func() {
+		w.Update(state, labels, -1)
+		// Drop a message here so they know when it's actually ready to go.
+		fmt.Println("And now my watch begins...")
+	}()
 
 	parentCtx, cancelParent := context.WithCancel(context.Background())
 	cli.AtExit(func() {
@@ -52,100 +57,46 @@ func Watch(state *core.BuildState, labels core.BuildLabels, testArgs []string, n
 	// The initial setup only builds targets, it doesn't test or run things.
 	// Do one of those now if requested.
 	if state.NeedTests || state.NeedRun {
-		build(ctx, state, labels, testArgs, callback)
+		ns := build(ctx, state, labels, labels, testArgs, callback)
+		w.Update(ns, labels, 0)
 	}
 
-	for {
+	for cycle := 1; ; {
 		select {
-		case event := <-watcher.Events:
+		case event := <-fsw.Events:
 			log.Info("Event: %s", event)
-			if _, present := files.Load(event.Name); !present {
+			if !w.Watching(event.Name) {
 				log.Notice("Skipping notification for %s", event.Name)
 				continue
 			}
-			// Kill any previous process.
-			cancel()
-			ctx, cancel = context.WithCancel(parentCtx)
+			paths := []string{event.Name}
 
-			// Quick debounce; poll and discard all events for the next brief period.
+			// Quick debounce; collect all events for the next brief period.
 		outer:
 			for {
 				select {
-				case <-watcher.Events:
+				case event := <-fsw.Events:
+					paths = append(paths, event.Name)
 				case <-time.After(debounceInterval):
 					break outer
 				}
 			}
-			build(ctx, state, labels, testArgs, callback)
-		case err := <-watcher.Errors:
-			log.Error("Error watching files:", err)
-		}
-	}
-}
-
-func startWatching(watcher *fsnotify.Watcher, state *core.BuildState, labels []core.BuildLabel, files *sync.Map) {
-	// Deduplicate seen targets & sources.
-	targets := map[*core.BuildTarget]struct{}{}
-	dirs := map[string]struct{}{}
-
-	var startWatch func(*core.BuildTarget)
-	startWatch = func(target *core.BuildTarget) {
-		if _, present := targets[target]; present {
-			return
-		}
-		targets[target] = struct{}{}
-		// Don't generate watches on any sources in a subrepo; we only watch non-generated source files.
-		if target.Label.Subrepo == "" {
-			for _, source := range target.AllSources() {
-				addSource(watcher, state, source, dirs, files)
-			}
-			for _, datum := range target.AllData() {
-				addSource(watcher, state, datum, dirs, files)
+			changed, affected := w.Changes(paths)
+			if len(affected) == 0 {
+				log.Notice("No watched inputs have changed")
+				continue
 			}
-		}
-		for _, dep := range target.Dependencies() {
-			startWatch(dep)
-		}
-		pkg := state.Graph.PackageOrDie(target.Label)
-		if _, present := files.Load(pkg.Filename); !present {
-			log.Notice("Adding watch on %s", pkg.Filename)
-			files.Store(pkg.Filename, struct{}{})
-		}
-		for _, subinclude := range pkg.Subincludes {
-			startWatch(state.Graph.TargetOrDie(subinclude))
-		}
-	}
-
-	for _, label := range labels {
-		startWatch(state.Graph.TargetOrDie(label))
-	}
-	// Drop a message here so they know when it's actually ready to go.
-	fmt.Println("And now my watch begins...")
-}
+			// Kill any previous process.
+			cancel()
+			ctx, cancel = context.WithCancel(parentCtx)
 
-func addSource(watcher *fsnotify.Watcher, state *core.BuildState, source core.BuildInput, dirs map[string]struct{}, files *sync.Map) {
-	if _, ok := source.Label(); !ok {
-		for _, src := range source.Paths(state.Graph) {
-			if err := fs.Walk(src, func(src string, isDir bool) error {
-				files.Store(src, struct{}{})
-				if !filepath.IsAbs(src) {
-					files.Store("./"+src, struct{}{})
-				}
-				dir := src
-				if !isDir {
-					dir = filepath.Dir(src)
-				}
-				if _, present := dirs[dir]; !present {
-					log.Notice("Adding watch on %s", dir)
-					dirs[dir] = struct{}{}
-					if err := watcher.Add(dir); err != nil {
-						log.Error("Failed to add watch on %s: %s", src, err)
-					}
-				}
-				return nil
-			}); err != nil {
-				log.Error("Failed to add watch on %s: %s", src, err)
-			}
+			start := time.Now()
+			ns := build(ctx, state, affected, labels, testArgs, callback)
+			watching := w.Update(ns, affected, cycle)
+			fmt.Println(newCycleSummary(cycle, changed, ns, watching, time.Since(start)))
+			cycle++
+		case err := <-fsw.Errors:
+			log.Error("Error watching files:", err)
 		}
 	}
 }
@@ -160,8 +111,9 @@ func anyTests(state *core.BuildState, labels []core.BuildLabel) bool {
 	return false
 }
 
-// build invokes a single build while watching.
-func build(ctx context.Context, state *core.BuildState, labels []core.BuildLabel, args []string, callback CallbackFunc) {
+// build invokes a single build of the given labels while watching, and returns the state it used.
+// If we're running targets, all of runLabels are (re)started.
+func build(ctx context.Context, state *core.BuildState, labels, runLabels []core.BuildLabel, args []string, callback CallbackFunc) *core.BuildState {
 	// Set up a new state & copy relevant parts off the existing one.
 	ns := core.NewBuildState(state.Config)
 	ns.Cache = state.Cache
@@ -178,12 +130,13 @@ func build(ctx context.Context, state *core.BuildState, labels []core.BuildLabel
 	callback(ns, labels)
 	if state.NeedRun {
 		// Don't wait for this, its lifetime will be controlled by the context.
-		als := make([]core.AnnotatedOutputLabel, len(labels))
-		for i, l := range labels {
+		als := make([]core.AnnotatedOutputLabel, len(runLabels))
+		for i, l := range runLabels {
 			als[i] = core.AnnotatedOutputLabel{
 				BuildLabel: l,
 			}
 		}
 		go run.Parallel(ctx, state, als, nil, state.Config.Please.NumThreads, process.Default, false, false, false, false, "")
 	}
+	return ns
 }
@@ -0,0 +1,180 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestNewWatchSet(t *testing.T) {
+	state := setUpRepo(t)
+	set := newWatchSet(state, core.ParseBuildLabel("//pkg:lib", ""), 2)
+	assert.Equal(t, map[string]struct{}{
+		"pkg/BUILD":       {},
+		"pkg/lib.go":      {},
+		"pkg/data/x.txt":  {},
+		"dep/BUILD":       {},
+		"dep/dep.go":      {},
+		"defs/BUILD":      {},
+		"defs/rules.defs": {},
+	}, set.files)
+	assert.Equal(t, map[string]struct{}{
+		"pkg":      {},
+		"pkg/data": {},
+		"dep":      {},
+		"defs":     {},
+	}, set.dirs)
+	assert.Equal(t, 2, set.cycle)
+
+	assert.Nil(t, newWatchSet(state, core.ParseBuildLabel("//pkg:missing", ""), 2))
+}
+
+func TestChanges(t *testing.T) {
+	state := setUpRepo(t)
+	lib := core.ParseBuildLabel("//pkg:lib", "")
+	dep := core.ParseBuildLabel("//dep:dep", "")
+	w := newTestWatcher(t, lib, dep)
+	assert.Equal(t, 7, w.Update(state, []core.BuildLabel{lib, dep}, 0))
+	assert.True(t, w.Watching("./pkg/lib.go"))
+	assert.True(t, w.Watching("pkg/new.go"))
+	assert.False(t, w.Watching("other/file.go"))
+
+	// Touching a file without changing it doesn't count.
+	require.NoError(t, os.WriteFile("dep/dep.go", []byte("dep"), 0644))
+	changed, affected := w.Changes([]string{"dep/dep.go"})
+	assert.Empty(t, changed)
+	assert.Empty(t, affected)
+
+	require.NoError(t, os.WriteFile("dep/dep.go", []byte("dep2"), 0644))
+	changed, affected = w.Changes([]string{"dep/dep.go", "./dep/dep.go"})
+	assert.Equal(t, []string{"dep/dep.go"}, changed)
+	assert.Equal(t, []core.BuildLabel{lib, dep}, affected)
+	// It's now up to date.
+	changed, _ = w.Changes([]string{"dep/dep.go"})
+	assert.Empty(t, changed)
+
+	// A new file might be picked up by a glob, but only the targets that depend on that directory are affected.
+	require.NoError(t, os.WriteFile("pkg/new.go", nil, 0644))
+	require.NoError(t, os.WriteFile("pkg/.new.go.swp", nil, 0644))
+	changed, affected = w.Changes([]string{"pkg/new.go", "pkg/.new.go.swp", "pkg/gone.go"})
+	assert.Equal(t, []string{"pkg/new.go"}, changed)
+	assert.Equal(t, []core.BuildLabel{lib}, affected)
+	// Nothing picked it up, so it's ignored from now on.
+	w.Update(state, []core.BuildLabel{lib}, 1)
+	changed, _ = w.Changes([]string{"pkg/new.go"})
+	assert.Empty(t, changed)
+}
+
+func TestAffectedBy(t *testing.T) {
+	set := &watchSet{
+		files: map[string]struct{}{"pkg/a.txt": {}},
+		dirs:  map[string]struct{}{"pkg": {}},
+	}
+	assert.True(t, set.affectedBy([]string{"pkg/a.txt"}, nil))
+	// An existing file in the same directory isn't one of its inputs.
+	assert.False(t, set.affectedBy([]string{"pkg/b.txt"}, nil))
+	// But a new one might be.
+	assert.True(t, set.affectedBy([]string{"pkg/b.txt"}, map[string]bool{"pkg/b.txt": true}))
+	assert.False(t, set.affectedBy([]string{"other/b.txt"}, map[string]bool{"other/b.txt": true}))
+}
+
+func TestUpdate(t *testing.T) {
+	state := setUpRepo(t)
+	lib := core.ParseBuildLabel("//pkg:lib", "")
+	w := newTestWatcher(t, lib)
+	w.Update(state, []core.BuildLabel{lib}, 1)
+	assert.Contains(t, w.dirs, "dep")
+	assert.Contains(t, w.hashes, "dep/dep.go")
+
+	// The dependency is removed.
+	state2 := core.NewDefaultBuildState()
+	state2.Graph.AddPackage(newPackage("pkg"))
+	target := core.NewBuildTarget(lib)
+	target.AddSource(core.FileLabel{File: "lib.go", Package: "pkg"})
+	state2.Graph.AddTarget(target)
+	assert.Equal(t, 2, w.Update(state2, []core.BuildLabel{lib}, 2))
+	assert.NotContains(t, w.dirs, "dep")
+	assert.NotContains(t, w.hashes, "dep/dep.go")
+	assert.Equal(t, []string{"pkg"}, w.watcher.WatchList())
+
+	// An older graph doesn't replace a newer one.
+	w.Update(state, []core.BuildLabel{lib}, 1)
+	assert.NotContains(t, w.dirs, "dep")
+
+	// Nor does a target that's gone missing.
+	assert.Equal(t, 2, w.Update(core.NewDefaultBuildState(), []core.BuildLabel{lib}, 3))
+}
+
+func TestCycleSummary(t *testing.T) {
+	s := &cycleSummary{
+		Cycle:     3,
+		Changed:   []string{"pkg/lib.go"},
+		Packages:  4,
+		Built:     1,
+		Unchanged: 5,
+		Watching:  27,
+		Duration:  1234 * time.Millisecond,
+	}
+	assert.Equal(t, "Cycle 3: pkg/lib.go changed; parsed 4 packages, built 1 target (5 unchanged) in 1.23s. Watching 27 files.", s.String())
+
+	s.Changed = []string{"a", "b", "c", "d", "e"}
+	s.Cached = 2
+	s.Failed = 1
+	s.TestsPassed = 1
+	s.TestsFailed = 2
+	assert.Equal(t, "Cycle 3: a, b, c and 2 other files changed; parsed 4 packages, built 1 target (5 unchanged, 2 from cache), 1 failed; 1 test passed, 2 failed in 1.23s. Watching 27 files.", s.String())
+}
+
+// setUpRepo creates a small repo in a temp directory, changes into it, and returns a state with its graph.
+// //pkg:lib depends on //dep:dep, and pkg's BUILD file subincludes //defs:rules.
+func setUpRepo(t *testing.T) *core.BuildState {
+	dir := t.TempDir()
+	for _, file := range []string{"pkg/BUILD", "pkg/lib.go", "pkg/data/x.txt", "dep/BUILD", "dep/dep.go", "defs/BUILD", "defs/rules.defs"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(filepath.Base(file)[:3]), 0644))
+	}
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	state := core.NewDefaultBuildState()
+	rules := core.NewBuildTarget(core.ParseBuildLabel("//defs:rules", ""))
+	rules.AddSource(core.FileLabel{File: "rules.defs", Package: "defs"})
+	dep := core.NewBuildTarget(core.ParseBuildLabel("//dep:dep", ""))
+	dep.AddSource(core.FileLabel{File: "dep.go", Package: "dep"})
+	lib := core.NewBuildTarget(core.ParseBuildLabel("//pkg:lib", ""))
+	lib.AddSource(core.FileLabel{File: "lib.go", Package: "pkg"})
+	lib.AddDatum(core.FileLabel{File: "data", Package: "pkg"})
+	lib.AddDependency(dep.Label)
+	pkg := newPackage("pkg")
+	pkg.Subincludes = []core.BuildLabel{rules.Label}
+	state.Graph.AddPackage(pkg)
+	state.Graph.AddPackage(newPackage("dep"))
+	state.Graph.AddPackage(newPackage("defs"))
+	for _, target := range []*core.BuildTarget{rules, dep, lib} {
+		state.Graph.AddTarget(target)
+	}
+	require.NoError(t, lib.ResolveDependencies(state.Graph))
+	return state
+}
+
+func newPackage(name string) *core.Package {
+	pkg := core.NewPackage(name)
+	pkg.Filename = name + "/BUILD"
+	return pkg
+}
+
+func newTestWatcher(t *testing.T, labels ...core.BuildLabel) *watcher {
+	fsw, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	t.Cleanup(func() { fsw.Close() })
+	return newWatcher(fsw, labels)
+}
@@ -0,0 +1,249 @@
+package watch
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// A watchSet is the set of files and directories that the build of one of the watched labels depends on.
+type watchSet struct {
+	// The source files (including BUILD files) that it depends on.
+	files map[string]struct{}
+	// Directories in which a new file might affect it (e.g. by matching a glob).
+	dirs map[string]struct{}
+	// The cycle whose graph this set was computed from.
+	cycle int
+}
+
+// A watcher tracks the watch sets of each label and keeps the underlying filesystem watches in line with them.
+type watcher struct {
+	watcher *fsnotify.Watcher
+	labels  []core.BuildLabel
+	mutex   sync.Mutex
+	sets    map[core.BuildLabel]*watchSet
+	// The union of all the watch sets' files and directories.
+	files map[string]struct{}
+	dirs  map[string]struct{}
+	// The last known content hash of each watched file.
+	hashes map[string][]byte
+	hasher *fs.PathHasher
+	// New files that turned out not to be used by anything.
+	ignored map[string]struct{}
+}
+
+func newWatcher(w *fsnotify.Watcher, labels []core.BuildLabel) *watcher {
+	return &watcher{
+		watcher: w,
+		labels:  labels,
+		sets:    map[core.BuildLabel]*watchSet{},
+		files:   map[string]struct{}{},
+		dirs:    map[string]struct{}{},
+		hashes:  map[string][]byte{},
+		ignored: map[string]struct{}{},
+	}
+}
+
+// Update recomputes the watch sets of the given labels from the graph of a build, and adds or removes
+// filesystem watches as needed. Sets from an earlier cycle never replace those from a later one.
+// It returns the number of files now being watched.
+func (w *watcher) Update(state *core.BuildState, labels []core.BuildLabel, cycle int) int {
+	sets := make(map[core.BuildLabel]*watchSet, len(labels))
+	for _, label := range labels {
+		// If the target doesn't exist (most likely its BUILD file failed to parse), we keep watching what it used to need.
+		if set := newWatchSet(state, label, cycle); set != nil {
+			sets[label] = set
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.hasher = state.PathHasher
+	for label, set := range sets {
+		if existing, present := w.sets[label]; !present || existing.cycle <= cycle {
+			w.sets[label] = set
+		}
+	}
+	files := map[string]struct{}{}
+	dirs := map[string]struct{}{}
+	for _, set := range w.sets {
+		for file := range set.files {
+			files[file] = struct{}{}
+		}
+		for dir := range set.dirs {
+			dirs[dir] = struct{}{}
+		}
+	}
+	for dir := range dirs {
+		if _, present := w.dirs[dir]; !present {
+			log.Notice("Adding watch on %s", dir)
+			if err := w.watcher.Add(dir); err != nil {
+				log.Error("Failed to add watch on %s: %s", dir, err)
+			}
+		}
+	}
+	for dir := range w.dirs {
+		if _, present := dirs[dir]; !present {
+			log.Notice("Removing watch on %s", dir)
+			// This fails if the directory has been deleted, in which case the watch is already gone.
+			w.watcher.Remove(dir)
+		}
+	}
+	for file := range files {
+		if _, present := w.hashes[file]; !present {
+			// This is most likely memoised from when the build hashed its sources.
+			w.hashes[file], _ = state.PathHasher.Hash(file, false, false, false)
+		}
+		delete(w.ignored, file)
+	}
+	for file := range w.hashes {
+		if _, present := files[file]; !present {
+			delete(w.hashes, file)
+		}
+	}
+	w.files = files
+	w.dirs = dirs
+	return len(files)
+}
+
+// Watching returns true if an event on the given path could be of interest.
+func (w *watcher) Watching(path string) bool {
+	path = filepath.Clean(path)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, present := w.files[path]; present {
+		return true
+	}
+	_, present := w.dirs[filepath.Dir(path)]
+	return present
+}
+
+// Changes works out which of the given paths have actually changed, and which of the watched labels that affects.
+// Files that already existed are compared by content; new files count if they're in a directory that something
+// depends on, since we can't tell if they'll be picked up by a glob until the package is parsed again.
+func (w *watcher) Changes(paths []string) (changed []string, affected []core.BuildLabel) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	created := map[string]bool{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if slices.Contains(changed, path) {
+			continue
+		} else if _, present := w.files[path]; present {
+			hash, _ := w.hasher.Hash(path, true, false, false)
+			if bytes.Equal(hash, w.hashes[path]) {
+				continue
+			}
+			w.hashes[path] = hash
+		} else if _, present := w.dirs[filepath.Dir(path)]; !present {
+			continue
+		} else if _, present := w.ignored[path]; present {
+			continue
+		} else if strings.HasPrefix(filepath.Base(path), ".") || !fs.PathExists(path) {
+			// Hidden files aren't matched by globs by default, and editors often create temporary files and
+			// immediately delete them again.
+			continue
+		} else {
+			// If nothing picks this up, we won't rebuild for it again until a BUILD file changes.
+			w.ignored[path] = struct{}{}
+			created[path] = true
+		}
+		changed = append(changed, path)
+	}
+	for _, label := range w.labels {
+		if set, present := w.sets[label]; present && set.affectedBy(changed, created) {
+			affected = append(affected, label)
+		}
+	}
+	slices.Sort(changed)
+	return changed, affected
+}
+
+// affectedBy returns true if any of the given paths are in this set, or are newly created files in one of its directories.
+func (set *watchSet) affectedBy(paths []string, created map[string]bool) bool {
+	for _, path := range paths {
+		if _, present := set.files[path]; present {
+			return true
+		} else if _, present := set.dirs[filepath.Dir(path)]; present && created[path] {
+			return true
+		}
+	}
+	return false
+}
+
+// newWatchSet computes the watch set for a label from the given build graph.
+// It returns nil if the label isn't in the graph.
+func newWatchSet(state *core.BuildState, label core.BuildLabel, cycle int) *watchSet {
+	target := state.Graph.Target(label)
+	if target == nil {
+		return nil
+	}
+	set := &watchSet{
+		files: map[string]struct{}{},
+		dirs:  map[string]struct{}{},
+		cycle: cycle,
+	}
+	// Deduplicate seen targets.
+	targets := map[*core.BuildTarget]struct{}{}
+	var add func(*core.BuildTarget)
+	add = func(target *core.BuildTarget) {
+		if _, present := targets[target]; present {
+			return
+		}
+		targets[target] = struct{}{}
+		// Don't generate watches on any sources in a subrepo; we only watch non-generated source files.
+		if target.Label.Subrepo == "" {
+			for _, source := range target.AllSources() {
+				set.addSource(state, source)
+			}
+			for _, datum := range target.AllData() {
+				set.addSource(state, datum)
+			}
+		}
+		for _, dep := range target.Dependencies() {
+			add(dep)
+		}
+		pkg := state.Graph.PackageByLabel(target.Label)
+		if pkg == nil {
+			return
+		}
+		set.files[pkg.Filename] = struct{}{}
+		if target.Label.Subrepo == "" {
+			set.dirs[filepath.Dir(pkg.Filename)] = struct{}{}
+		}
+		for _, subinclude := range pkg.Subincludes {
+			if t := state.Graph.Target(subinclude); t != nil {
+				add(t)
+			}
+		}
+	}
+	add(target)
+	return set
+}
+
+func (set *watchSet) addSource(state *core.BuildState, source core.BuildInput) {
+	if _, ok := source.Label(); ok {
+		return
+	}
+	for _, src := range source.Paths(state.Graph) {
+		if err := fs.Walk(src, func(src string, isDir bool) error {
+			src = filepath.Clean(src)
+			if isDir {
+				set.dirs[src] = struct{}{}
+			} else {
+				set.files[src] = struct{}{}
+				set.dirs[filepath.Dir(src)] = struct{}{}
+			}
+			return nil
+		}); err != nil {
+			log.Error("Failed to add watch on %s: %s", src, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Access is a level of access to the cache.
+type Access int
+
+// The levels of access that can be granted.
+const (
+	NoAccess Access = iota
+	Read
+	Write // Write access implies read access too.
+)
+
+// An Authenticator decides whether requests are allowed to read or write the cache.
+// Clients can authenticate with a bearer token or, if the server is configured for mutual TLS,
+// with a client certificate that's been verified against the server's CA.
+type Authenticator struct {
+	tokens     map[string]Access
+	clientCert Access
+}
+
+// NewAuthenticator creates a new Authenticator.
+// tokens maps bearer tokens to the access they grant; clientCert is the access granted to
+// any request presenting a verified client certificate.
+func NewAuthenticator(tokens map[string]Access, clientCert Access) *Authenticator {
+	return &Authenticator{tokens: tokens, clientCert: clientCert}
+}
+
+// Authorize returns true if the given request is allowed the given level of access.
+// A nil Authenticator allows everything.
+func (a *Authenticator) Authorize(req *http.Request, want Access) bool {
+	if a == nil {
+		return true
+	}
+	return a.access(req) >= want
+}
+
+func (a *Authenticator) access(req *http.Request) Access {
+	access := NoAccess
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		access = a.clientCert
+	}
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); token != "" {
+		for t, a := range a.tokens {
+			// Compare against all of them in constant time so we don't leak anything about valid tokens.
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 && a > access {
+				access = a
+			}
+		}
+	}
+	return access
+}
+
+// ReadTokenFile reads a file of tokens. Each line contains a token followed by either "ro" or
+// "rw" to indicate read-only or read-write access. Blank lines and lines beginning with # are ignored.
+func ReadTokenFile(filename string) (map[string]Access, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := map[string]Access{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a token and an access level", filename, line)
+		}
+		access, err := ParseAccess(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		tokens[fields[0]] = access
+	}
+	return tokens, scanner.Err()
+}
+
+// ParseAccess parses an access level, which is one of "none", "ro" or "rw".
+func ParseAccess(s string) (Access, error) {
+	switch s {
+	case "none":
+		return NoAccess, nil
+	case "ro":
+		return Read, nil
+	case "rw":
+		return Write, nil
+	}
+	return NoAccess, fmt.Errorf("unknown access level %s, must be one of none, ro or rw", s)
+}
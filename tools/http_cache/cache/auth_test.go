@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTokenFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(filename, []byte("# comment\nabc ro\n\ndef rw\n"), 0600))
+	tokens, err := ReadTokenFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Access{"abc": Read, "def": Write}, tokens)
+}
+
+func TestReadTokenFileInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(filename, []byte("abc wibble\n"), 0600))
+	_, err := ReadTokenFile(filename)
+	assert.Error(t, err)
+}
+
+func TestClientCertificateAccess(t *testing.T) {
+	auth := NewAuthenticator(nil, Read)
+	req := httptest.NewRequest("GET", "/abc", nil)
+	assert.False(t, auth.Authorize(req, Read))
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	assert.True(t, auth.Authorize(req, Read))
+	assert.False(t, auth.Authorize(req, Write))
+}
+
+func TestNilAuthenticatorAllowsEverything(t *testing.T) {
+	var auth *Authenticator
+	assert.True(t, auth.Authorize(httptest.NewRequest("PUT", "/abc", nil), Write))
+}
@@ -1,12 +1,20 @@
 package cache
 
 import (
+	"bytes"
+	"container/list"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/djherbis/atime"
 	"gopkg.in/op/go-logging.v1"
 
 	"github.com/thought-machine/please/src/fs"
@@ -14,49 +22,261 @@ import (
 
 var log = logging.MustGetLogger("httpcache")
 
+// tmpSuffix is attached to files while they're being written.
+const tmpSuffix = ".tmp"
+
+// Options configures the behaviour of a Cache.
+type Options struct {
+	// MaxSize is the maximum total size of artifacts to store, in bytes. Zero means unlimited.
+	MaxSize int64
+	// Auth controls who may read & write. If nil, everything is allowed.
+	Auth *Authenticator
+}
+
 // Cache implements a http handler for caching files. Effectively a read/write http.FileSystem
 type Cache struct {
 	Dir string
+
+	maxSize int64
+	auth    *Authenticator
+	metrics *metrics
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List // Most recently used at the front
+	entries map[string]*list.Element
+}
+
+// An entry is a single artifact stored in the cache.
+type entry struct {
+	Path string
+	Size int64
 }
 
-// New create a new http cache
-func New(dir string) *Cache {
-	return &Cache{
-		Dir: dir,
+// New creates a new http cache.
+// Any artifacts already present in the directory are indexed so they count towards the size limit.
+func New(dir string, opts Options) (*Cache, error) {
+	c := &Cache{
+		Dir:     dir,
+		maxSize: opts.MaxSize,
+		auth:    opts.Auth,
+		metrics: newMetrics(),
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
 	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.evict()
+	return c, nil
+}
+
+// load indexes any existing artifacts in the cache directory, ordered by their last access time.
+func (c *Cache) load() error {
+	type existing struct {
+		entry
+		atime time.Time
+	}
+	var files []existing
+	if err := filepath.Walk(c.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == c.Dir {
+				return filepath.SkipDir
+			}
+			return err
+		} else if info.IsDir() {
+			return nil
+		} else if strings.HasSuffix(name, tmpSuffix) {
+			// Left over from an interrupted write.
+			return os.Remove(name)
+		}
+		files = append(files, existing{entry: entry{Path: name, Size: info.Size()}, atime: atime.Get(info)})
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].atime.After(files[j].atime) })
+	for i := range files {
+		c.entries[files[i].Path] = c.lru.PushBack(&files[i].entry)
+		c.size += files[i].Size
+	}
+	c.metrics.update(c.size, len(c.entries))
+	log.Infof("Indexed %d existing artifacts totalling %d bytes", len(c.entries), c.size)
+	return nil
 }
 
 // ServeHTTP implements the http.Handler interface for the cache
 func (c *Cache) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	uri := req.RequestURI
-	if req.Method == http.MethodPut {
-		err := c.store(uri, req.Body)
+	if req.URL.Path == "/metrics" && req.Method == http.MethodGet {
+		c.metrics.ServeHTTP(resp, req)
+		return
+	}
+	w := &statusWriter{ResponseWriter: resp, status: http.StatusOK}
+	defer func() { c.metrics.request(req.Method, w.status) }()
+
+	filename, err := c.path(req.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		if !c.auth.Authorize(req, Write) {
+			c.unauthorized(w, req)
+			return
+		}
+		n, err := c.store(filename, req.Body)
 		if err != nil {
 			log.Errorf("Failed to store in cache: %v", err)
-			resp.WriteHeader(http.StatusInternalServerError)
-			_, _ = resp.Write([]byte(fmt.Sprintf("failed to store in cache: %v", err)))
+			http.Error(w, fmt.Sprintf("failed to store in cache: %v", err), http.StatusInternalServerError)
+			return
 		}
-	} else if req.Method == http.MethodGet {
-		http.ServeFile(resp, req, filepath.Join(c.Dir, uri))
+		c.metrics.stored(n)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		if !c.auth.Authorize(req, Read) {
+			c.unauthorized(w, req)
+			return
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				c.metrics.miss()
+				http.NotFound(w, req)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			c.metrics.miss()
+			http.NotFound(w, req)
+			return
+		}
+		c.touch(filename)
+		c.metrics.hit(info.Size())
+		w.Header().Set("Content-Type", contentType(f))
+		http.ServeContent(w, req, "", info.ModTime(), f)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (c *Cache) store(uri string, data io.Reader) error {
-	path := filepath.Join(c.Dir, uri)
-	if err := os.RemoveAll(uri); err != nil {
-		return err
+// path returns the on-disk path for a request path, making sure it can't escape the cache directory.
+func (c *Cache) path(p string) (string, error) {
+	cleaned := path.Clean("/" + p)
+	if cleaned == "/" || strings.HasSuffix(cleaned, tmpSuffix) {
+		return "", fmt.Errorf("invalid path %s", p)
+	}
+	return filepath.Join(c.Dir, filepath.FromSlash(cleaned)), nil
+}
+
+func (c *Cache) unauthorized(w http.ResponseWriter, req *http.Request) {
+	log.Warningf("Rejected unauthorised %s request for %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="please"`)
+	http.Error(w, "unauthorised", http.StatusUnauthorized)
+}
+
+// store writes an artifact to the cache. It's written to a temporary file first so that
+// concurrent readers never see a partial artifact.
+func (c *Cache) store(filename string, data io.Reader) (int64, error) {
+	if err := fs.EnsureDir(filename); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*"+tmpSuffix)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, data)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	} else if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	} else if err := os.Rename(f.Name(), filename); err != nil {
+		os.Remove(f.Name())
+		return 0, err
 	}
+	c.add(filename, n)
+	return n, nil
+}
 
-	if err := fs.EnsureDir(path); err != nil {
-		return err
+// add records a newly stored artifact and evicts old ones if we're over the size limit.
+func (c *Cache) add(filename string, size int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, present := c.entries[filename]; present {
+		c.size -= elem.Value.(*entry).Size
+		c.lru.Remove(elem)
 	}
+	c.entries[filename] = c.lru.PushFront(&entry{Path: filename, Size: size})
+	c.size += size
+	c.evictLocked()
+}
 
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+// touch marks an artifact as recently used.
+func (c *Cache) touch(filename string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, present := c.entries[filename]; present {
+		c.lru.MoveToFront(elem)
 	}
-	defer file.Close()
+}
+
+// evict removes the least recently used artifacts until we're under the size limit.
+func (c *Cache) evict() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evictLocked()
+}
+
+func (c *Cache) evictLocked() {
+	for c.maxSize > 0 && c.size > c.maxSize {
+		elem := c.lru.Back()
+		if elem == nil {
+			break
+		}
+		e := elem.Value.(*entry)
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to evict %s: %s", e.Path, err)
+		}
+		log.Debugf("Evicted %s (%d bytes)", e.Path, e.Size)
+		c.lru.Remove(elem)
+		delete(c.entries, e.Path)
+		c.size -= e.Size
+		c.metrics.evicted()
+	}
+	c.metrics.update(c.size, len(c.entries))
+}
+
+// zstdMagic is the magic number at the start of every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// contentType returns the content type of an artifact, which tells clients how it was compressed.
+// We don't store the type clients sent since they can always be identified from the content, although
+// http.DetectContentType doesn't know about zstd so we handle that ourselves.
+func contentType(f io.ReadSeeker) string {
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+	f.Seek(0, io.SeekStart)
+	if bytes.HasPrefix(buf[:n], zstdMagic) {
+		return "application/zstd"
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// A statusWriter records the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
 
-	_, err = io.Copy(file, data)
-	return err
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
 }
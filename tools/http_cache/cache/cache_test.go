@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreAndRetrieve(t *testing.T) {
+	c, err := New(t.TempDir(), Options{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, do(c, http.MethodPut, "/abc", "wibble", "").Code)
+	resp := do(c, http.MethodGet, "/abc", "", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "wibble", resp.Body.String())
+	assert.Equal(t, http.StatusNotFound, do(c, http.MethodGet, "/def", "", "").Code)
+}
+
+func TestPathsCannotEscapeDir(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(filepath.Join(dir, "cache"), Options{})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPut, "/abc", strings.NewReader("wibble"))
+	req.URL.Path = "/../../escaped"
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	_, err = os.Stat(filepath.Join(dir, "escaped"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "cache", "escaped"))
+	assert.NoError(t, err)
+}
+
+func TestNoTemporaryFilesLeftBehind(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, Options{})
+	require.NoError(t, err)
+	do(c, http.MethodPut, "/abc", "wibble", "")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "abc", entries[0].Name())
+	assert.Equal(t, http.StatusBadRequest, do(c, http.MethodGet, "/abc"+tmpSuffix, "", "").Code)
+}
+
+func TestEviction(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, Options{MaxSize: 10})
+	require.NoError(t, err)
+	do(c, http.MethodPut, "/a", "1234", "")
+	do(c, http.MethodPut, "/b", "1234", "")
+	// Use a so that b is the least recently used.
+	assert.Equal(t, http.StatusOK, do(c, http.MethodGet, "/a", "", "").Code)
+	do(c, http.MethodPut, "/c", "1234", "")
+	assert.Equal(t, http.StatusOK, do(c, http.MethodGet, "/a", "", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(c, http.MethodGet, "/b", "", "").Code)
+	assert.Equal(t, http.StatusOK, do(c, http.MethodGet, "/c", "", "").Code)
+	assert.EqualValues(t, 8, c.size)
+}
+
+func TestExistingArtifactsCountTowardsLimit(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a"), []byte("12345678"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.123"+tmpSuffix), []byte("12345678"), 0644))
+	c, err := New(dir, Options{MaxSize: 10})
+	require.NoError(t, err)
+	assert.EqualValues(t, 8, c.size)
+	do(c, http.MethodPut, "/b", "1234", "")
+	assert.Equal(t, http.StatusNotFound, do(c, http.MethodGet, "/a", "", "").Code)
+	_, err = os.Stat(filepath.Join(dir, "b.123"+tmpSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAuthentication(t *testing.T) {
+	c, err := New(t.TempDir(), Options{
+		Auth: NewAuthenticator(map[string]Access{"reader": Read, "writer": Write}, NoAccess),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, do(c, http.MethodPut, "/abc", "wibble", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(c, http.MethodPut, "/abc", "wibble", "reader").Code)
+	assert.Equal(t, http.StatusNoContent, do(c, http.MethodPut, "/abc", "wibble", "writer").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(c, http.MethodGet, "/abc", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(c, http.MethodGet, "/abc", "", "wrong").Code)
+	assert.Equal(t, http.StatusOK, do(c, http.MethodGet, "/abc", "", "reader").Code)
+	assert.Equal(t, http.StatusOK, do(c, http.MethodGet, "/abc", "", "writer").Code)
+}
+
+func TestMetrics(t *testing.T) {
+	c, err := New(t.TempDir(), Options{})
+	require.NoError(t, err)
+	do(c, http.MethodPut, "/abc", "wibble", "")
+	do(c, http.MethodGet, "/abc", "", "")
+	do(c, http.MethodGet, "/def", "", "")
+	resp := do(c, http.MethodGet, "/metrics", "", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "http_cache_hits_total 1")
+	assert.Contains(t, string(body), "http_cache_misses_total 1")
+	assert.Contains(t, string(body), "http_cache_size_bytes 6")
+}
+
+func TestContentType(t *testing.T) {
+	c, err := New(t.TempDir(), Options{})
+	require.NoError(t, err)
+	do(c, http.MethodPut, "/gzip", "\x1f\x8b\x08\x00\x00\x00\x00\x00", "")
+	do(c, http.MethodPut, "/zstd", "\x28\xb5\x2f\xfd\x00\x00", "")
+	assert.Equal(t, "application/x-gzip", do(c, http.MethodGet, "/gzip", "", "").Header().Get("Content-Type"))
+	assert.Equal(t, "application/zstd", do(c, http.MethodGet, "/zstd", "", "").Header().Get("Content-Type"))
+}
+
+func do(c *Cache, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, req)
+	return resp
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus metrics exported by the cache.
+// Each cache has its own registry so they don't clash if several are created (e.g. in tests).
+type metrics struct {
+	http.Handler
+	requests      *prometheus.CounterVec
+	hits, misses  prometheus.Counter
+	evictions     prometheus.Counter
+	bytesServed   prometheus.Counter
+	bytesStored   prometheus.Counter
+	size, entries prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	registry := prometheus.NewRegistry()
+	m := &metrics{
+		Handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "http_cache",
+			Name:      "requests_total",
+			Help:      "Number of requests, by method and status code",
+		}, []string{"method", "code"}),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "http_cache",
+			Name:      "hits_total",
+			Help:      "Number of artifacts successfully retrieved",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "http_cache",
+			Name:      "misses_total",
+			Help:      "Number of requests for artifacts that didn't exist",
+		}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "http_cache",
+			Name:      "evictions_total",
+			Help:      "Number of artifacts evicted to stay under the size limit",
+		}),
+		bytesServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "http_cache",
+			Name:      "served_bytes_total",
+			Help:      "Total size of artifacts retrieved",
+		}),
+		bytesStored: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "http_cache",
+			Name:      "stored_bytes_total",
+			Help:      "Total size of artifacts stored",
+		}),
+		size: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "http_cache",
+			Name:      "size_bytes",
+			Help:      "Current total size of stored artifacts",
+		}),
+		entries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "http_cache",
+			Name:      "entries",
+			Help:      "Current number of stored artifacts",
+		}),
+	}
+	registry.MustRegister(m.requests, m.hits, m.misses, m.evictions, m.bytesServed, m.bytesStored, m.size, m.entries)
+	return m
+}
+
+func (m *metrics) request(method string, code int) {
+	m.requests.WithLabelValues(method, strconv.Itoa(code)).Inc()
+}
+
+func (m *metrics) hit(size int64) {
+	m.hits.Inc()
+	m.bytesServed.Add(float64(size))
+}
+
+func (m *metrics) miss() {
+	m.misses.Inc()
+}
+
+func (m *metrics) stored(size int64) {
+	m.bytesStored.Add(float64(size))
+}
+
+func (m *metrics) evicted() {
+	m.evictions.Inc()
+}
+
+func (m *metrics) update(size int64, entries int) {
+	m.size.Set(float64(size))
+	m.entries.Set(float64(entries))
+}
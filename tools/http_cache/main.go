@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"os"
@@ -19,11 +21,25 @@ var opts = struct {
 	Verbosity cli.Verbosity `short:"v" long:"verbosity" default:"warning" description:"Verbosity of output (higher number = more output)"`
 	CacheDir  string        `short:"d" long:"dir" default:"" description:"The directory to store cached artifacts in."`
 	Port      int           `short:"p" long:"port" description:"The port to run the server on" default:"8080"`
+	MaxSize   cli.ByteSize  `short:"s" long:"max_size" description:"Maximum total size of stored artifacts. Least recently used artifacts are evicted beyond this. Unlimited by default."`
+	Auth      struct {
+		TokenFile        string `long:"token_file" description:"File containing bearer tokens that clients can authenticate with. Each line is a token followed by 'ro' or 'rw'."`
+		ClientCertAccess string `long:"client_cert_access" default:"rw" choice:"none" choice:"ro" choice:"rw" description:"Access granted to clients presenting a client certificate verified against --client_ca"`
+	} `group:"Options controlling authentication. If neither tokens nor client CAs are given, all requests are allowed."`
+	TLS struct {
+		CertFile     string `long:"cert_file" description:"Certificate file to serve TLS with"`
+		KeyFile      string `long:"key_file" description:"Private key file to serve TLS with"`
+		ClientCAFile string `long:"client_ca" description:"CA certificate to verify client certificates against (i.e. to enable mutual TLS)"`
+	} `group:"Options controlling TLS"`
 }{
 	Usage: `
 HTTP cache implements a resource based http server that please can use as a cache. The cache supports storing files
 via PUT requests and retrieving them again through GET requests. Really any http server (e.g. nginx) can be used as a
 cache for please however this is a lightweight and easy to configure option.
+
+It can optionally authenticate clients (via bearer tokens or client certificates), limit the total size of
+the cache, and exposes Prometheus metrics on /metrics. Please sends a token from the file given by its
+cache.HTTPTokenFile config option.
 `,
 }
 
@@ -37,10 +53,80 @@ func main() {
 		}
 		opts.CacheDir = filepath.Join(userCacheDir, "please_http_cache")
 	}
+	if (opts.TLS.CertFile == "") != (opts.TLS.KeyFile == "") {
+		log.Fatalf("--cert_file and --key_file must be given together")
+	} else if opts.TLS.ClientCAFile != "" && opts.TLS.CertFile == "" {
+		log.Fatalf("--client_ca requires --cert_file and --key_file to be given")
+	}
 
+	auth, err := authenticator()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	c, err := cache.New(opts.CacheDir, cache.Options{
+		MaxSize: int64(opts.MaxSize),
+		Auth:    auth,
+	})
+	if err != nil {
+		log.Fatalf("failed to initialise cache: %s", err)
+	}
+	server := &http.Server{
+		Addr:    fmt.Sprint(":", opts.Port),
+		Handler: c,
+	}
 	log.Infof("Started please http cache at 127.0.0.1:%v serving out of %v", opts.Port, opts.CacheDir)
-	err := http.ListenAndServe(fmt.Sprint(":", opts.Port), cache.New(opts.CacheDir))
+	if opts.TLS.CertFile != "" {
+		if server.TLSConfig, err = tlsConfig(); err != nil {
+			log.Fatalf("%s", err)
+		}
+		err = server.ListenAndServeTLS(opts.TLS.CertFile, opts.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		log.Panic(err)
 	}
 }
+
+// authenticator returns the authenticator to use, or nil if authentication isn't configured.
+func authenticator() (*cache.Authenticator, error) {
+	if opts.Auth.TokenFile == "" && opts.TLS.ClientCAFile == "" {
+		return nil, nil
+	}
+	tokens := map[string]cache.Access{}
+	if opts.Auth.TokenFile != "" {
+		t, err := cache.ReadTokenFile(opts.Auth.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file: %w", err)
+		}
+		tokens = t
+	}
+	clientCertAccess := cache.NoAccess
+	if opts.TLS.ClientCAFile != "" {
+		access, err := cache.ParseAccess(opts.Auth.ClientCertAccess)
+		if err != nil {
+			return nil, err
+		}
+		clientCertAccess = access
+	}
+	return cache.NewAuthenticator(tokens, clientCertAccess), nil
+}
+
+// tlsConfig returns the TLS config for the server.
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.TLS.ClientCAFile == "" {
+		return config, nil
+	}
+	b, err := os.ReadFile(opts.TLS.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("failed to parse any certificates from %s", opts.TLS.ClientCAFile)
+	}
+	// Clients without certificates are still permitted since they might authenticate with a token instead.
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}